@@ -0,0 +1,73 @@
+package scs
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Session data keys used to record request activity when TrackActivity is
+// enabled.
+const (
+	activityCountKey    = "__activity:count"
+	activityPathKey     = "__activity:path"
+	activityMethodKey   = "__activity:method"
+	activityLastSeenKey = "__activity:lastSeen"
+)
+
+// Activity holds the request activity recorded for a session when
+// TrackActivity is enabled.
+type Activity struct {
+	// Count is the number of requests which have been recorded.
+	Count int64
+
+	// LastPath and LastMethod are the URL path and HTTP method of the most
+	// recently recorded request.
+	LastPath   string
+	LastMethod string
+
+	// LastSeen is the time at which the most recently recorded request was
+	// handled.
+	LastSeen time.Time
+}
+
+// Activity returns the request activity recorded for the session. If
+// TrackActivity is not enabled, or no requests have been recorded, the zero
+// value is returned.
+func (s *SessionManager) Activity(ctx context.Context) Activity {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	a := Activity{}
+	a.Count, _ = sd.values[activityCountKey].(int64)
+	a.LastPath, _ = sd.values[activityPathKey].(string)
+	a.LastMethod, _ = sd.values[activityMethodKey].(string)
+	if ns, ok := sd.values[activityLastSeenKey].(int64); ok {
+		a.LastSeen = time.Unix(0, ns)
+	}
+	return a
+}
+
+// trackActivity records the given request in the session data. Requests are
+// only recorded for sessions which hold some data or have been modified, so
+// that TrackActivity doesn't create or write a session for every client.
+func (s *SessionManager) trackActivity(ctx context.Context, r *http.Request) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.status == Destroyed || (sd.status == Unmodified && (sd.token == "" || len(sd.values) == 0)) {
+		return
+	}
+
+	count, _ := sd.values[activityCountKey].(int64)
+	sd.values[activityCountKey] = count + 1
+	sd.values[activityPathKey] = r.URL.Path
+	sd.values[activityMethodKey] = r.Method
+	sd.values[activityLastSeenKey] = time.Now().UnixNano()
+	sd.status = Modified
+	sd.written = true
+}
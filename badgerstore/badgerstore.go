@@ -73,6 +73,24 @@ func (bs *BadgerStore) Commit(token string, data []byte, expiry time.Time) error
 	return nil
 }
 
+// Expiry returns the expiry time recorded for a given session token in the
+// BadgerStore instance. Badger records expiry times to the nearest second. If
+// the session token is not found or is expired, the returned exists flag will
+// be set to false.
+func (bs *BadgerStore) Expiry(token string) (time.Time, bool, error) {
+	txn := bs.db.NewTransaction(false)
+	defer txn.Discard()
+
+	item, err := txn.Get([]byte(bs.prefix + token))
+	if err == badger.ErrKeyNotFound {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return time.Unix(int64(item.ExpiresAt()), 0), true, nil
+}
+
 // Delete removes a session token and corresponding data from the BadgerStore instance.
 func (bs *BadgerStore) Delete(token string) error {
 	txn := bs.db.NewTransaction(true)
@@ -86,3 +104,9 @@ func (bs *BadgerStore) Delete(token string) error {
 
 	return nil
 }
+
+// Flush removes all session tokens and data with the store's key prefix from
+// the BadgerStore instance.
+func (bs *BadgerStore) Flush() error {
+	return bs.db.DropPrefix([]byte(bs.prefix))
+}
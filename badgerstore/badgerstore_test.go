@@ -215,3 +215,57 @@ func TestDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestFlush(t *testing.T) {
+	store := New(db)
+
+	err := store.Commit("session_token1", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Commit("session_token2", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"session_token1", "session_token2"} {
+		_, found, err := store.Find(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != false {
+			t.Fatalf("got %v: expected %v", found, false)
+		}
+	}
+}
+
+func TestExpiryReporting(t *testing.T) {
+	store := New(db)
+
+	expiry := time.Now().Add(time.Minute)
+	err := store.Commit("session_token", []byte("encoded_data"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, found, err := store.Expiry("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if d := got.Sub(expiry); d < -time.Second || d > time.Second {
+		t.Fatalf("got %v: expected %v", got, expiry)
+	}
+
+	_, found, _ = store.Expiry("missing_session_token")
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
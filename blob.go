@@ -0,0 +1,204 @@
+package scs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// blobsKey is the session data key used to record which values have been
+// offloaded to separate entries in the session store. It holds a []string in
+// which each element has the form "<blob token>:<key>". The blob itself is
+// stored under blobStoreKey(<blob token>) and contains the encoded value for
+// the key, with the same deadline as the session.
+const blobsKey = "__blobs"
+
+// isBlobStoreKey reports whether the session store key holds a blob rather
+// than session data.
+func isBlobStoreKey(key string) bool {
+	return strings.HasPrefix(key, blobStoreKey(""))
+}
+
+// blobRef is held in the session data values in place of an offloaded value
+// which hasn't been fetched from the store yet. It is never encoded.
+type blobRef string
+
+// blobStoreKey returns the session store key for the blob with the given
+// token.
+func blobStoreKey(token string) string {
+	return "__blob:" + token
+}
+
+// decodeBlobRefs replaces the references recorded under blobsKey with blobRef
+// values and records the offloaded keys in sd.blobs. The caller must hold
+// sd.mu, or have exclusive access to sd.
+func (s *SessionManager) decodeBlobRefs(sd *sessionData) {
+	refs, ok := sd.values[blobsKey].([]string)
+	if !ok {
+		return
+	}
+	delete(sd.values, blobsKey)
+
+	sd.blobs = make(map[string]string, len(refs))
+	for _, ref := range refs {
+		i := strings.IndexByte(ref, ':')
+		if i < 0 {
+			continue
+		}
+		token, key := ref[:i], ref[i+1:]
+		sd.values[key] = blobRef(token)
+		sd.blobs[key] = token
+	}
+	sd.blobDeadline = sd.deadline
+}
+
+// resolveBlob returns val, or if val is a blobRef, the offloaded value that it
+// refers to. Fetched values are cached for the rest of the request cycle. If
+// the blob can't be fetched then the error is recorded in sd.err, so that it
+// is returned by the next call to Commit, and nil is returned. The caller must
+// hold sd.mu.
+func (s *SessionManager) resolveBlob(sd *sessionData, key string, val interface{}) interface{} {
+	ref, ok := val.(blobRef)
+	if !ok {
+		return val
+	}
+	if v, ok := sd.blobCache[string(ref)]; ok {
+		return v
+	}
+
+	v, err := s.fetchBlob(key, string(ref))
+	if err != nil {
+		sd.err = err
+		return nil
+	}
+	if sd.blobCache == nil {
+		sd.blobCache = make(map[string]interface{})
+	}
+	sd.blobCache[string(ref)] = v
+	return v
+}
+
+func (s *SessionManager) fetchBlob(key, token string) (interface{}, error) {
+	release, err := s.acquireStore()
+	if err != nil {
+		return nil, err
+	}
+	b, found, err := s.getStore().Find(blobStoreKey(token))
+	release()
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return nil, fmt.Errorf("scs: offloaded value for key %q not found", key)
+	}
+
+	_, values, err := s.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	if values, err = s.decodeKeyValues(values); err != nil {
+		return nil, err
+	}
+	return values[key], nil
+}
+
+// offloadBlobs returns a copy of the session data values in which values over
+// the BlobThreshold have been written to the session store as blobs and
+// replaced by a reference under blobsKey, along with the new set of offloaded
+// keys. Blobs which haven't been fetched are kept as they are, although their
+// expiry is refreshed if the session deadline has changed. The caller must
+// hold sd.mu.
+func (s *SessionManager) offloadBlobs(store Store, sd *sessionData) (map[string]interface{}, map[string]string, error) {
+	if s.BlobThreshold <= 0 && len(sd.blobs) == 0 {
+		return sd.values, nil, nil
+	}
+	if _, ok := store.(StatelessStore); ok {
+		return sd.values, nil, nil
+	}
+
+	expiry := sd.deadline.Add(s.ClockSkew)
+	out := make(map[string]interface{}, len(sd.values)+1)
+	blobs := make(map[string]string)
+	var refs []string
+	for key, val := range sd.values {
+		if ref, ok := val.(blobRef); ok {
+			token := string(ref)
+			if !sd.deadline.Equal(sd.blobDeadline) {
+				if err := refreshBlob(store, token, expiry); err != nil {
+					return nil, nil, err
+				}
+			}
+			blobs[key] = token
+			refs = append(refs, token+":"+key)
+			continue
+		}
+
+		if s.BlobThreshold <= 0 {
+			out[key] = val
+			continue
+		}
+
+		values, err := s.encodeKeyValues(map[string]interface{}{key: val})
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := s.encode(sd.deadline, values)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(b) <= s.BlobThreshold {
+			out[key] = val
+			continue
+		}
+
+		token, ok := sd.blobs[key]
+		if !ok {
+			if token, err = generateToken(); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := store.Commit(blobStoreKey(token), b, expiry); err != nil {
+			return nil, nil, err
+		}
+		delete(sd.blobCache, token)
+		blobs[key] = token
+		refs = append(refs, token+":"+key)
+	}
+	if len(refs) > 0 {
+		out[blobsKey] = refs
+	}
+
+	return out, blobs, nil
+}
+
+// refreshBlob rewrites a blob with a new expiry time.
+func refreshBlob(store Store, token string, expiry time.Time) error {
+	b, found, err := store.Find(blobStoreKey(token))
+	if err != nil || !found {
+		return err
+	}
+	return store.Commit(blobStoreKey(token), b, expiry)
+}
+
+// updateBlobs deletes any blobs which were previously offloaded but are no
+// longer referenced by the session data, and records blobs as the current set
+// of offloaded keys. The caller must hold sd.mu.
+func (s *SessionManager) updateBlobs(store Store, sd *sessionData, blobs map[string]string) error {
+	for key, token := range sd.blobs {
+		if blobs[key] == token {
+			continue
+		}
+		if err := store.Delete(blobStoreKey(token)); err != nil {
+			return err
+		}
+		delete(sd.blobCache, token)
+	}
+	sd.blobs = blobs
+	sd.blobDeadline = sd.deadline
+	return nil
+}
+
+// deleteBlobs deletes all the blobs offloaded from the session data. The
+// caller must hold sd.mu.
+func (s *SessionManager) deleteBlobs(store Store, sd *sessionData) error {
+	return s.updateBlobs(store, sd, nil)
+}
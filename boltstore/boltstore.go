@@ -91,6 +91,39 @@ func (bs *BoltStore) Delete(token string) error {
 	})
 }
 
+// Expiry returns the expiry time recorded for a given session token in the
+// BoltStore instance. If the session token is not found or is expired, the
+// returned exists flag will be set to false.
+func (bs *BoltStore) Expiry(token string) (time.Time, bool, error) {
+	var expiry int64
+	err := bs.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		val := bucket.Get([]byte(token))
+		if val != nil {
+			expiry = int64(binary.BigEndian.Uint64(val[:8]))
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if expiry == 0 || time.Now().UnixNano() > expiry {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(0, expiry), true, nil
+}
+
+// Flush removes all session tokens and data from the BoltStore instance.
+func (bs *BoltStore) Flush() error {
+	return bs.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(bucketName); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		_, err := tx.CreateBucket(bucketName)
+		return err
+	})
+}
+
 func (bs *BoltStore) startCleanup(cleanupInterval time.Duration) {
 	bs.stopCleanup = make(chan bool)
 	ticker := time.NewTicker(cleanupInterval)
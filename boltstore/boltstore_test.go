@@ -164,3 +164,58 @@ func TestStopNilCleanup(t *testing.T) {
 	// A send to a nil channel will block forever
 	m.StopCleanup()
 }
+
+func TestFlush(t *testing.T) {
+	db, err := bbolt.Open("/tmp/testing.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	bs := NewWithCleanupInterval(db, 0)
+	bs.Commit("key1", []byte("value1"), time.Now().Add(time.Minute))
+	bs.Commit("key2", []byte("value2"), time.Now().Add(time.Minute))
+
+	err = bs.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"key1", "key2"} {
+		_, found, err := bs.Find(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != false {
+			t.Fatalf("got %v: expected %v", found, false)
+		}
+	}
+}
+
+func TestExpiryReporting(t *testing.T) {
+	db, err := bbolt.Open("/tmp/testing.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	bs := NewWithCleanupInterval(db, 0)
+	expiry := time.Now().Add(time.Minute)
+	bs.Commit("key1", []byte("value1"), expiry)
+
+	got, found, err := bs.Expiry("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if !got.Equal(expiry) {
+		t.Fatalf("got %v: expected %v", got, expiry)
+	}
+
+	_, found, _ = bs.Expiry("missing_key")
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
@@ -0,0 +1,205 @@
+package cachestore
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+)
+
+// ErrNotIterable is returned by Warm when the primary store doesn't implement
+// the scs.IterableStore interface.
+var ErrNotIterable = errors.New("cachestore: primary store does not support iteration")
+
+// DefaultLifetime is the longest time that session data read from a primary
+// store which can't report its expiry time is kept in the cache.
+const DefaultLifetime = time.Minute
+
+// Broadcaster is the interface for publishing cache invalidations to the other
+// CacheStore instances sharing the same primary store, for example over a
+// pub/sub channel. The receivers should call Invalidate with the token.
+type Broadcaster interface {
+	Publish(token string) error
+}
+
+// CacheStore represents the session store. It wraps a primary store, which
+// holds the authoritative copy of the session data, and a (usually
+// in-memory) cache store, which holds copies of recently used session data so
+// that they can be read without a round trip to the primary store. Writes go
+// to both stores.
+//
+// When several application instances each have their own cache, changing or
+// deleting the session data for a token on one instance doesn't update the
+// caches of the others. Use SetBroadcaster to publish changed and deleted
+// tokens so that the other instances can call Invalidate.
+type CacheStore struct {
+	cache       scs.Store
+	primary     scs.Store
+	lifetime    time.Duration
+	broadcaster Broadcaster
+}
+
+// New returns a new CacheStore instance. If the primary store implements the
+// scs.ExpiryReportingStore interface, cached session data keeps its expiry
+// time; otherwise it is cached for the DefaultLifetime.
+func New(cache, primary scs.Store) *CacheStore {
+	return NewWithLifetime(cache, primary, DefaultLifetime)
+}
+
+// NewWithLifetime returns a new CacheStore instance. The lifetime parameter
+// controls how long session data read from the primary store is cached for
+// when the primary store doesn't implement the scs.ExpiryReportingStore
+// interface.
+func NewWithLifetime(cache, primary scs.Store, lifetime time.Duration) *CacheStore {
+	return &CacheStore{
+		cache:    cache,
+		primary:  primary,
+		lifetime: lifetime,
+	}
+}
+
+// SetBroadcaster sets the Broadcaster which is used to publish the session
+// tokens committed to or deleted from the CacheStore instance. It should be
+// called before the CacheStore is used.
+func (c *CacheStore) SetBroadcaster(b Broadcaster) {
+	c.broadcaster = b
+}
+
+// Find returns the data for a given session token. The cache is checked first,
+// and if the token isn't found there, the data is read from the primary store
+// and added to the cache. If the session token is not found or is expired, the
+// returned exists flag will be set to false.
+func (c *CacheStore) Find(token string) ([]byte, bool, error) {
+	b, found, err := c.cache.Find(token)
+	if err != nil || found {
+		return b, found, err
+	}
+
+	b, found, err = c.primary.Find(token)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	expiry, found, err := c.primaryExpiry(token)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	if err := c.cache.Commit(token, b, expiry); err != nil {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+// primaryExpiry returns the expiry time to cache session data read from the
+// primary store with. If the primary store reports that the session token
+// isn't found, the found return value is false.
+func (c *CacheStore) primaryExpiry(token string) (time.Time, bool, error) {
+	es, ok := c.primary.(scs.ExpiryReportingStore)
+	if !ok {
+		return time.Now().Add(c.lifetime), true, nil
+	}
+	return es.Expiry(token)
+}
+
+// Commit adds a session token and data to the primary store and the cache
+// with the given expiry time. If the session token already exists, then the
+// data and expiry time are updated. The token is published with the
+// Broadcaster, if one has been set, so that other instances don't keep
+// serving their cached copy of the old data.
+func (c *CacheStore) Commit(token string, b []byte, expiry time.Time) error {
+	if err := c.primary.Commit(token, b, expiry); err != nil {
+		return err
+	}
+	if err := c.cache.Commit(token, b, expiry); err != nil {
+		return err
+	}
+
+	if c.broadcaster != nil {
+		return c.broadcaster.Publish(token)
+	}
+	return nil
+}
+
+// Delete removes a session token and corresponding data from the primary
+// store and the cache, and publishes the token with the Broadcaster, if one
+// has been set.
+func (c *CacheStore) Delete(token string) error {
+	if err := c.primary.Delete(token); err != nil {
+		return err
+	}
+	if err := c.cache.Delete(token); err != nil {
+		return err
+	}
+
+	if c.broadcaster != nil {
+		return c.broadcaster.Publish(token)
+	}
+	return nil
+}
+
+// Invalidate removes a session token and corresponding data from the cache
+// only, so that it is read from the primary store next time. It should be
+// called when a token is received from another CacheStore instance.
+func (c *CacheStore) Invalidate(token string) error {
+	return c.cache.Delete(token)
+}
+
+// Warm copies the session data for all of the session tokens in the primary
+// store into the cache, so that the first requests after startup don't all
+// have to read from the primary store. The primary store must implement the
+// scs.IterableStore interface, otherwise ErrNotIterable is returned.
+//
+// If the cache has a MaxEntries() int method (as lrustore does), at most that
+// many sessions are copied. The sessions which expire latest are preferred,
+// because they are usually the ones which have been used most recently.
+func (c *CacheStore) Warm(ctx context.Context) error {
+	is, ok := c.primary.(scs.IterableStore)
+	if !ok {
+		return ErrNotIterable
+	}
+	all, err := is.All()
+	if err != nil {
+		return err
+	}
+
+	type entry struct {
+		token  string
+		b      []byte
+		expiry time.Time
+	}
+	entries := make([]entry, 0, len(all))
+	for token, b := range all {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		expiry, found, err := c.primaryExpiry(token)
+		if err != nil {
+			return err
+		} else if found {
+			entries = append(entries, entry{token, b, expiry})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].expiry.After(entries[j].expiry)
+	})
+	if bc, ok := c.cache.(interface{ MaxEntries() int }); ok && len(entries) > bc.MaxEntries() {
+		entries = entries[:bc.MaxEntries()]
+	}
+
+	// Commit the sessions which expire latest last, so that they're treated
+	// as the most recently used by an LRU cache.
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.cache.Commit(entries[i].token, entries[i].b, entries[i].expiry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package cachestore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+	"github.com/gaconkzk/scs/v2/lrustore"
+	"github.com/gaconkzk/scs/v2/memstore"
+)
+
+func TestFindCaches(t *testing.T) {
+	cache := memstore.NewWithCleanupInterval(0)
+	primary := memstore.NewWithCleanupInterval(0)
+	c := New(cache, primary)
+
+	expiry := time.Now().Add(time.Hour)
+	err := primary.Commit("session_token", []byte("encoded_data"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, found, err := c.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("encoded_data")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+
+	b, found, _ = cache.Find("session_token")
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("encoded_data")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+	got, _, _ := cache.Expiry("session_token")
+	if !got.Equal(expiry) {
+		t.Fatalf("got %v: expected %v", got, expiry)
+	}
+}
+
+func TestCommitAndDelete(t *testing.T) {
+	cache := memstore.NewWithCleanupInterval(0)
+	primary := memstore.NewWithCleanupInterval(0)
+	c := New(cache, primary)
+
+	err := c.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []scs.Store{cache, primary} {
+		if _, found, _ := s.Find("session_token"); found != true {
+			t.Fatalf("got %v: expected %v", found, true)
+		}
+	}
+
+	err = c.Delete("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []scs.Store{cache, primary} {
+		if _, found, _ := s.Find("session_token"); found != false {
+			t.Fatalf("got %v: expected %v", found, false)
+		}
+	}
+}
+
+// localBroadcaster delivers published tokens to the subscribed CacheStore
+// instances in the same process, standing in for a pub/sub channel.
+type localBroadcaster struct {
+	subscribers []*CacheStore
+}
+
+func (l *localBroadcaster) Publish(token string) error {
+	for _, c := range l.subscribers {
+		if err := c.Invalidate(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestBroadcastInvalidation(t *testing.T) {
+	primary := memstore.NewWithCleanupInterval(0)
+	broadcaster := &localBroadcaster{}
+
+	managers := make([]*scs.SessionManager, 2)
+	for i := range managers {
+		c := New(memstore.NewWithCleanupInterval(0), primary)
+		c.SetBroadcaster(broadcaster)
+		broadcaster.subscribers = append(broadcaster.subscribers, c)
+
+		managers[i] = scs.New()
+		managers[i].Store = c
+	}
+
+	ctx, err := managers[0].Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	managers[0].Put(ctx, "foo", "bar")
+	token, _, err := managers[0].Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Load the session on the second instance, so that it's cached there.
+	ctx2, err := managers[1].Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := managers[1].GetString(ctx2, "foo"); got != "bar" {
+		t.Fatalf("got %q: expected %q", got, "bar")
+	}
+
+	// An update on the first instance is seen by the second.
+	managers[0].Put(ctx, "foo", "baz")
+	if _, _, err := managers[0].Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ctx2, err = managers[1].Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := managers[1].GetString(ctx2, "foo"); got != "baz" {
+		t.Fatalf("got %q: expected %q", got, "baz")
+	}
+
+	if err := managers[0].Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx2, err = managers[1].Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := managers[1].GetString(ctx2, "foo"); got != "" {
+		t.Errorf("got %q: expected the session to be invalidated", got)
+	}
+}
+
+type findCountingStore struct {
+	*memstore.MemStore
+	finds int
+}
+
+func (f *findCountingStore) Find(token string) ([]byte, bool, error) {
+	f.finds++
+	return f.MemStore.Find(token)
+}
+
+func TestWarm(t *testing.T) {
+	primary := &findCountingStore{MemStore: memstore.NewWithCleanupInterval(0)}
+	c := New(memstore.NewWithCleanupInterval(0), primary)
+
+	for _, token := range []string{"session_token_1", "session_token_2"} {
+		err := primary.Commit(token, []byte("encoded_data"), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Warm(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"session_token_1", "session_token_2"} {
+		b, found, err := c.Find(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || !bytes.Equal(b, []byte("encoded_data")) {
+			t.Fatalf("got %v, %v: expected %v, %v", b, found, []byte("encoded_data"), true)
+		}
+	}
+	if primary.finds != 0 {
+		t.Errorf("got %d finds in the primary store: expected %d", primary.finds, 0)
+	}
+}
+
+func TestWarmBounded(t *testing.T) {
+	primary := memstore.NewWithCleanupInterval(0)
+	cache := lrustore.New(2)
+	c := New(cache, primary)
+
+	for i, token := range []string{"session_token_1", "session_token_2", "session_token_3"} {
+		err := primary.Commit(token, []byte("encoded_data"), time.Now().Add(time.Duration(i+1)*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Warm(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.Len() != 2 {
+		t.Fatalf("got %d cached sessions: expected %d", cache.Len(), 2)
+	}
+	for token, want := range map[string]bool{"session_token_1": false, "session_token_2": true, "session_token_3": true} {
+		_, found, err := cache.Find(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != want {
+			t.Errorf("%s: got %v: expected %v", token, found, want)
+		}
+	}
+
+	c = New(memstore.NewWithCleanupInterval(0), lrustore.New(2))
+	if err := c.Warm(context.Background()); err != ErrNotIterable {
+		t.Errorf("got %v: expected %v", err, ErrNotIterable)
+	}
+}
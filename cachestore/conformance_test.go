@@ -0,0 +1,14 @@
+package cachestore_test
+
+import (
+	"testing"
+
+	"github.com/gaconkzk/scs/v2/cachestore"
+	"github.com/gaconkzk/scs/v2/lrustore"
+	"github.com/gaconkzk/scs/v2/memstore"
+	"github.com/gaconkzk/scs/v2/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.VerifyStore(t, cachestore.New(lrustore.New(100), memstore.NewWithCleanupInterval(0)))
+}
@@ -0,0 +1,125 @@
+package scs
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownCheckpoint is returned by Restore if the session has no checkpoint
+// with the given ID.
+var ErrUnknownCheckpoint = errors.New("scs: unknown session checkpoint")
+
+// checkpointsKey is the session data key used to hold the snapshots taken by
+// Checkpoint, keyed by checkpoint ID.
+const checkpointsKey = "__checkpoints"
+
+func init() {
+	// The snapshots are held in the session data as an interface{} value, so
+	// GobCodec needs their type to be registered.
+	gob.Register(map[string]interface{}{})
+}
+
+// Checkpoint takes a snapshot of the session data values, apart from reserved
+// keys (those beginning with "__"), and returns an ID which can be passed to
+// Restore to return to them later, for example when the user goes back to an
+// earlier step of a multi-step form. The snapshot is a shallow copy held in the
+// session data itself, so each checkpoint adds to the encoded size of the
+// session; call ClearCheckpoints once they are no longer needed. The session
+// data status will be set to Modified.
+func (s *SessionManager) Checkpoint(ctx context.Context) string {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if !s.hasRoomFor(sd, checkpointsKey) {
+		sd.err = ErrTooManyKeys
+		return ""
+	}
+
+	// Values offloaded with BlobThreshold are fetched, so that the snapshot
+	// holds the values themselves rather than references to blobs.
+	snapshot := make(map[string]interface{})
+	for key, val := range sd.values {
+		if !isReservedKey(key) {
+			snapshot[key] = s.resolveBlob(sd, key, val)
+		}
+	}
+
+	checkpoints := s.checkpoints(sd)
+	if checkpoints == nil {
+		checkpoints = make(map[string]interface{})
+	}
+	id := strconv.Itoa(len(checkpoints) + 1)
+	checkpoints[id] = snapshot
+	sd.values[checkpointsKey] = checkpoints
+	sd.status = Modified
+	sd.written = true
+	return id
+}
+
+// Restore replaces the session data values with the snapshot taken by the call
+// to Checkpoint which returned id. Reserved keys are left as they are, apart
+// from the TTLs of keys which are not in the snapshot, so the checkpoint (and
+// any later ones) can be restored again. ErrUnknownCheckpoint is returned if
+// the session has no such checkpoint, and ErrTooManyKeys if the snapshot holds
+// more keys than the MaxKeys limit; otherwise the session data status will be
+// set to Modified.
+func (s *SessionManager) Restore(ctx context.Context, id string) error {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	snapshot, ok := s.checkpoints(sd)[id].(map[string]interface{})
+	if !ok {
+		return ErrUnknownCheckpoint
+	}
+	if s.MaxKeys > 0 && countKeys(snapshot) > s.MaxKeys {
+		return ErrTooManyKeys
+	}
+
+	for key := range sd.values {
+		if !isReservedKey(key) {
+			delete(sd.values, key)
+		} else if strings.HasPrefix(key, ttlKey("")) {
+			if _, ok := snapshot[strings.TrimPrefix(key, ttlKey(""))]; !ok {
+				delete(sd.values, key)
+			}
+		}
+	}
+	for key, val := range snapshot {
+		sd.values[key] = val
+	}
+	sd.status = Modified
+	sd.written = true
+	return nil
+}
+
+// ClearCheckpoints discards all of the snapshots taken by Checkpoint. If the
+// session has no checkpoints this is a no-op; otherwise the session data
+// status will be set to Modified.
+func (s *SessionManager) ClearCheckpoints(ctx context.Context) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if _, ok := sd.values[checkpointsKey]; !ok {
+		return
+	}
+	delete(sd.values, checkpointsKey)
+	sd.status = Modified
+	sd.written = true
+}
+
+// checkpoints returns the snapshots held under checkpointsKey, fetching them
+// first if they have been offloaded with BlobThreshold. The caller must hold
+// sd.mu.
+func (s *SessionManager) checkpoints(sd *sessionData) map[string]interface{} {
+	checkpoints, _ := s.resolveBlob(sd, checkpointsKey, sd.values[checkpointsKey]).(map[string]interface{})
+	return checkpoints
+}
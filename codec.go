@@ -2,7 +2,13 @@ package scs
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
 	"time"
 )
 
@@ -13,6 +19,17 @@ type Codec interface {
 	Decode([]byte) (deadline time.Time, values map[string]interface{}, err error)
 }
 
+// FieldCodec is the interface for codecs which can decode the value for a
+// single key from encoded session data without decoding the rest of it. It is
+// used by SessionManager.GetField when available.
+type FieldCodec interface {
+	Codec
+
+	// DecodeField should return the session deadline and the value for the
+	// given key. If there is no value for the key, found should be false.
+	DecodeField(b []byte, key string) (deadline time.Time, val interface{}, found bool, err error)
+}
+
 // GobCodec is used for encoding/decoding session data to and from a byte
 // slice using the encoding/gob package.
 type GobCodec struct{}
@@ -35,6 +52,24 @@ func (GobCodec) Encode(deadline time.Time, values map[string]interface{}) ([]byt
 	return b.Bytes(), nil
 }
 
+// RegisterType registers the concrete type of value with the encoding/gob
+// package, by calling gob.Register. Values of a type which isn't a basic Go
+// type, or a slice or map of one, must be registered before they can be
+// stored in the session data, otherwise committing the session data fails.
+// Call it during initialization, for example:
+//
+//	scs.GobCodec{}.RegisterType(User{})
+func (GobCodec) RegisterType(value interface{}) {
+	gob.Register(value)
+}
+
+// gobEncodable returns an error if value can't be encoded by GobCodec as a
+// session data value, for example because its type hasn't been registered.
+func gobEncodable(value interface{}) error {
+	aux := struct{ Value interface{} }{Value: value}
+	return gob.NewEncoder(ioutil.Discard).Encode(&aux)
+}
+
 // Decode converts a byte slice into a session deadline and values.
 func (GobCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
 	aux := &struct {
@@ -49,3 +84,422 @@ func (GobCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
 
 	return aux.Deadline, aux.Values, nil
 }
+
+// JSONTimeFormat controls how JSONCodec encodes time.Time values.
+type JSONTimeFormat int
+
+const (
+	// JSONTimeRFC3339 encodes times as JSON strings in the RFC 3339 format
+	// with nanosecond precision, in UTC and with trailing zeros removed from
+	// the fractional seconds (the time.RFC3339Nano layout), for example
+	// "2006-01-02T15:04:05.999999999Z".
+	JSONTimeRFC3339 JSONTimeFormat = iota
+
+	// JSONTimeUnixMillis encodes times as JSON integers holding the number of
+	// milliseconds since the Unix epoch, for example 1136214245999. Any
+	// sub-millisecond precision is truncated.
+	JSONTimeUnixMillis
+)
+
+// JSONCodecOptions holds the options for a JSONCodec.
+type JSONCodecOptions struct {
+	// TimeFormat is the format used for the session deadline and for
+	// time.Time values in the session data. The default is JSONTimeRFC3339.
+	TimeFormat JSONTimeFormat
+}
+
+// JSONCodec is used for encoding/decoding session data to and from a byte
+// slice using the encoding/json package, so that it can be read by services
+// which aren't written in Go. The session data is encoded as a JSON object
+// with two members:
+//
+//	{"deadline": "2006-01-02T15:04:05.999999999Z", "values": {"foo": "bar"}}
+//
+// The deadline, and any time.Time values in the session data (including
+// those inside []interface{} and map[string]interface{} values), are encoded
+// in the format set by the TimeFormat option. Other values, including time
+// values inside structs, are encoded with json.Marshal.
+//
+// When decoding, the deadline can be in either time format, but values are
+// decoded with json.Unmarshal into the generic JSON types: string, float64,
+// bool, nil, []interface{} and map[string]interface{}. So a time.Time value
+// is returned as a string or a float64, and an int value as a float64. The
+// values held under the reserved keys used by SessionManager features (those
+// beginning with "__") are converted back to the types they were encoded
+// with. The zero value uses the default options.
+type JSONCodec struct {
+	opts JSONCodecOptions
+}
+
+// NewJSONCodec returns a new JSONCodec with the given options.
+func NewJSONCodec(opts JSONCodecOptions) JSONCodec {
+	return JSONCodec{opts: opts}
+}
+
+type jsonSessionData struct {
+	Deadline interface{}            `json:"deadline"`
+	Values   map[string]interface{} `json:"values"`
+}
+
+// Encode converts a session deadline and values into a byte slice.
+func (c JSONCodec) Encode(deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	aux := jsonSessionData{
+		Deadline: c.encodeTime(deadline),
+		Values:   make(map[string]interface{}, len(values)),
+	}
+	for key, val := range values {
+		aux.Values[key] = c.encodeValue(val)
+	}
+	return json.Marshal(aux)
+}
+
+// Decode converts a byte slice into a session deadline and values.
+func (c JSONCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
+	var aux struct {
+		Deadline json.RawMessage        `json:"deadline"`
+		Values   map[string]interface{} `json:"values"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&aux); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	deadline, err := decodeJSONTime(aux.Deadline)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	if aux.Values == nil {
+		aux.Values = make(map[string]interface{})
+	}
+	for key, val := range aux.Values {
+		aux.Values[key] = decodeJSONValue(key, val)
+	}
+	return deadline, aux.Values, nil
+}
+
+// DecodeField returns the session deadline and the value for a single key,
+// without decoding the other values.
+func (c JSONCodec) DecodeField(b []byte, key string) (time.Time, interface{}, bool, error) {
+	var aux struct {
+		Deadline json.RawMessage            `json:"deadline"`
+		Values   map[string]json.RawMessage `json:"values"`
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return time.Time{}, nil, false, err
+	}
+
+	deadline, err := decodeJSONTime(aux.Deadline)
+	if err != nil {
+		return time.Time{}, nil, false, err
+	}
+	raw, ok := aux.Values[key]
+	if !ok {
+		return deadline, nil, false, nil
+	}
+	var val interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&val); err != nil {
+		return time.Time{}, nil, false, err
+	}
+	return deadline, decodeJSONValue(key, val), true, nil
+}
+
+// decodeJSONValue converts a value decoded with json.Decoder.UseNumber into
+// the generic JSON types. Numbers under reserved keys are left as json.Number,
+// so that the int64 values held there are decoded without losing precision;
+// normalizeValue converts them back to int64.
+func decodeJSONValue(key string, val interface{}) interface{} {
+	if n, ok := val.(json.Number); ok && isReservedKey(key) {
+		return n
+	}
+	return jsonNumbersToFloats(val)
+}
+
+// jsonNumbersToFloats replaces any json.Number values in val, including those
+// inside []interface{} and map[string]interface{} values, with float64s.
+func jsonNumbersToFloats(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = jsonNumbersToFloats(elem)
+		}
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = jsonNumbersToFloats(elem)
+		}
+	}
+	return val
+}
+
+func (c JSONCodec) encodeTime(t time.Time) interface{} {
+	if c.opts.TimeFormat == JSONTimeUnixMillis {
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func (c JSONCodec) encodeValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case time.Time:
+		return c.encodeTime(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = c.encodeValue(elem)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			out[key] = c.encodeValue(elem)
+		}
+		return out
+	}
+	return val
+}
+
+// decodeJSONTime decodes a time encoded by JSONCodec in either format.
+func decodeJSONTime(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return time.Time{}, nil
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return time.Time{}, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	}
+
+	var ms int64
+	if err := json.Unmarshal(raw, &ms); err != nil {
+		return time.Time{}, fmt.Errorf("scs: invalid JSON session deadline: %s", raw)
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+}
+
+// codecEnvelopeMagic marks encoded session data which is wrapped in an
+// envelope recording the ID of the codec used. It is followed by a one-byte
+// codec ID and then the payload produced by the codec. No payload produced by
+// GobCodec starts with a zero byte, so unwrapped data can be told apart.
+const codecEnvelopeMagic = "\x00scs"
+
+// encode encodes the session data with the Codec, wrapping it in an envelope
+// if a CodecID is set.
+func (s *SessionManager) encode(deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	b, err := s.Codec.Encode(deadline, values)
+	if err != nil || s.CodecID == 0 {
+		return b, err
+	}
+
+	out := make([]byte, 0, len(codecEnvelopeMagic)+1+len(b))
+	out = append(out, codecEnvelopeMagic...)
+	out = append(out, s.CodecID)
+	return append(out, b...), nil
+}
+
+// decode decodes session data. If the data is wrapped in an envelope it is
+// decoded with the codec registered for the envelope's codec ID, otherwise it
+// is decoded with the Codec.
+func (s *SessionManager) decode(b []byte) (time.Time, map[string]interface{}, error) {
+	codec, payload, err := s.codecFor(b)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	deadline, values, err := codec.Decode(payload)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	for key, val := range values {
+		values[key] = normalizeValue(key, val)
+	}
+	return deadline, values, nil
+}
+
+// stringSliceKeys are the reserved session data keys which hold a []string.
+var stringSliceKeys = map[string]bool{
+	blobsKey:     true,
+	keyCodecsKey: true,
+	labelsKey:    true,
+}
+
+// normalizeValue converts a reserved value decoded by a codec which doesn't
+// preserve Go types, such as JSONCodec, back to the type that was encoded:
+// whole numbers to int64, and lists of strings to []string for the keys in
+// stringSliceKeys. Values under other keys are returned unchanged.
+func normalizeValue(key string, val interface{}) interface{} {
+	if !isReservedKey(key) {
+		return val
+	}
+	switch v := val.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < math.MaxInt64 {
+			return int64(v)
+		}
+	case []interface{}:
+		if !stringSliceKeys[key] {
+			return val
+		}
+		strs := make([]string, 0, len(v))
+		for _, elem := range v {
+			if str, ok := elem.(string); ok {
+				strs = append(strs, str)
+			}
+		}
+		return strs
+	}
+	return val
+}
+
+// codecFor returns the codec to decode session data with, and the payload to
+// pass to it.
+func (s *SessionManager) codecFor(b []byte) (Codec, []byte, error) {
+	if !bytes.HasPrefix(b, []byte(codecEnvelopeMagic)) || len(b) <= len(codecEnvelopeMagic) {
+		return s.Codec, b, nil
+	}
+
+	id, payload := b[len(codecEnvelopeMagic)], b[len(codecEnvelopeMagic)+1:]
+	if id == s.CodecID {
+		return s.Codec, payload, nil
+	}
+	codec, ok := s.Codecs[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("scs: no codec registered for codec ID %d", id)
+	}
+	return codec, payload, nil
+}
+
+// CookieValueCodec is the interface for transforming a session token to and
+// from the value sent in the session cookie. It can be used via
+// SessionManager.CookieValueCodec so that the value on the wire differs from
+// the key used by the session store. Decode must reverse Encode, and should
+// return an error if the cookie value is not one that it produced.
+type CookieValueCodec interface {
+	Encode(token string) (string, error)
+	Decode(value string) (string, error)
+}
+
+// PercentCookieValueCodec is a CookieValueCodec which percent-encodes the
+// session token, as for a URL path segment, so that tokens from a custom
+// TokenGenerator can contain characters which aren't allowed in a cookie
+// value or which are mangled by proxies. URL-safe tokens, such as the default
+// ones, are left unchanged, so it can be enabled without logging anyone out.
+type PercentCookieValueCodec struct{}
+
+// Encode percent-encodes the session token.
+func (PercentCookieValueCodec) Encode(token string) (string, error) {
+	return url.PathEscape(token), nil
+}
+
+// Decode reverses Encode.
+func (PercentCookieValueCodec) Decode(value string) (string, error) {
+	return url.PathUnescape(value)
+}
+
+// Base64CookieValueCodec is a CookieValueCodec which encodes the session
+// token as unpadded base64url, so that the cookie value only ever contains
+// letters, digits, '-' and '_', whatever characters the token contains.
+// Cookie values set before it was enabled can't be decoded, so existing
+// sessions are lost.
+type Base64CookieValueCodec struct{}
+
+// Encode base64url-encodes the session token.
+func (Base64CookieValueCodec) Encode(token string) (string, error) {
+	return base64.RawURLEncoding.EncodeToString([]byte(token)), nil
+}
+
+// Decode reverses Encode.
+func (Base64CookieValueCodec) Decode(value string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// ValueCodec is the interface for encoding/decoding an individual session
+// value. It can be used via SessionManager.KeyCodecs to override the encoding
+// for specific keys.
+type ValueCodec interface {
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(b []byte) (interface{}, error)
+}
+
+// keyCodecsKey is the session data key used to record which keys have been
+// encoded with a per-key ValueCodec.
+const keyCodecsKey = "__keyCodecs"
+
+// encodeKeyValues returns a copy of values in which the values for any keys in
+// s.KeyCodecs have been encoded to a byte slice with the corresponding
+// ValueCodec. The names of the encoded keys are recorded under keyCodecsKey so
+// that they can be decoded by decodeKeyValues. If there are no per-key codecs
+// values is returned unchanged.
+func (s *SessionManager) encodeKeyValues(values map[string]interface{}) (map[string]interface{}, error) {
+	if len(s.KeyCodecs) == 0 {
+		return values, nil
+	}
+
+	out := make(map[string]interface{}, len(values)+1)
+	var encoded []string
+	for key, val := range values {
+		vc, ok := s.KeyCodecs[key]
+		if !ok {
+			out[key] = val
+			continue
+		}
+
+		b, err := vc.Marshal(val)
+		if err != nil {
+			return nil, fmt.Errorf("scs: encoding value for key %q: %v", key, err)
+		}
+		out[key] = b
+		encoded = append(encoded, key)
+	}
+	if len(encoded) > 0 {
+		out[keyCodecsKey] = encoded
+	}
+
+	return out, nil
+}
+
+// decodeKeyValues reverses encodeKeyValues, decoding any values which were
+// encoded with a per-key ValueCodec.
+func (s *SessionManager) decodeKeyValues(values map[string]interface{}) (map[string]interface{}, error) {
+	encoded, ok := values[keyCodecsKey].([]string)
+	if !ok {
+		return values, nil
+	}
+	delete(values, keyCodecsKey)
+
+	for _, key := range encoded {
+		vc, ok := s.KeyCodecs[key]
+		if !ok {
+			return nil, fmt.Errorf("scs: no codec registered for key %q", key)
+		}
+
+		// Codecs such as JSONCodec decode a []byte as a base64 string.
+		b, ok := values[key].([]byte)
+		if str, isString := values[key].(string); !ok && isString {
+			var err error
+			if b, err = base64.StdEncoding.DecodeString(str); err != nil {
+				return nil, fmt.Errorf("scs: decoding value for key %q: %v", key, err)
+			}
+		}
+		val, err := vc.Unmarshal(b)
+		if err != nil {
+			return nil, fmt.Errorf("scs: decoding value for key %q: %v", key, err)
+		}
+		values[key] = val
+	}
+
+	return values, nil
+}
@@ -0,0 +1,87 @@
+// Package codectest provides helpers for checking that session data encoded by
+// an earlier version of an application can still be decoded by a scs.Codec,
+// for example after changing the types stored in the session.
+//
+// Capture the current encoding of some representative session data once with
+// WriteFixture, commit the file, and then check it in a test with
+// VerifyFixtureFile:
+//
+//	var update = flag.Bool("update", false, "update the session fixtures")
+//
+//	func TestSessionFixture(t *testing.T) {
+//		deadline := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+//		values := map[string]interface{}{"user": User{ID: 1, Name: "alice"}}
+//
+//		if *update {
+//			codectest.WriteFixture(t, scs.GobCodec{}, "testdata/session_v1.bin", deadline, values)
+//		}
+//		codectest.VerifyFixtureFile(t, scs.GobCodec{}, "testdata/session_v1.bin", deadline, values)
+//	}
+//
+// When the session data changes shape, capture a new fixture alongside the
+// old ones rather than replacing them, so that every version which may still
+// be held in the session store keeps being checked.
+package codectest
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+)
+
+// WriteFixture encodes the given session deadline and values with the codec
+// and writes the result to the file at path, replacing it if it exists.
+func WriteFixture(t *testing.T, codec scs.Codec, path string, deadline time.Time, values map[string]interface{}) {
+	t.Helper()
+
+	b, err := codec.Encode(deadline, values)
+	if err != nil {
+		t.Fatalf("codectest: encoding fixture: %v", err)
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatalf("codectest: writing fixture: %v", err)
+	}
+}
+
+// VerifyFixture decodes the fixture b with the codec and checks that the
+// result has the given deadline and values. Values are compared with
+// reflect.DeepEqual, so they must have the same types as the decoded values.
+func VerifyFixture(t *testing.T, codec scs.Codec, b []byte, deadline time.Time, values map[string]interface{}) {
+	t.Helper()
+
+	gotDeadline, gotValues, err := codec.Decode(b)
+	if err != nil {
+		t.Fatalf("codectest: decoding fixture: %v", err)
+	}
+	if !gotDeadline.Equal(deadline) {
+		t.Errorf("codectest: got deadline %v: expected %v", gotDeadline, deadline)
+	}
+	for key, want := range values {
+		got, ok := gotValues[key]
+		if !ok {
+			t.Errorf("codectest: key %q is missing", key)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("codectest: key %q: got %#v: expected %#v", key, got, want)
+		}
+	}
+	for key := range gotValues {
+		if _, ok := values[key]; !ok {
+			t.Errorf("codectest: unexpected key %q", key)
+		}
+	}
+}
+
+// VerifyFixtureFile is like VerifyFixture, but reads the fixture from the file
+// at path.
+func VerifyFixtureFile(t *testing.T, codec scs.Codec, path string, deadline time.Time, values map[string]interface{}) {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("codectest: reading fixture: %v", err)
+	}
+	VerifyFixture(t, codec, b, deadline, values)
+}
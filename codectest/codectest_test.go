@@ -0,0 +1,46 @@
+package codectest
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+)
+
+var update = flag.Bool("update", false, "update the fixtures in testdata")
+
+var (
+	fixtureDeadline = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fixtureValues   = map[string]interface{}{
+		"string": "lorem ipsum",
+		"int":    42,
+		"bool":   true,
+		"float":  1.5,
+		"bytes":  []byte("dolor"),
+	}
+)
+
+func TestGobFixture(t *testing.T) {
+	if *update {
+		WriteFixture(t, scs.GobCodec{}, "testdata/gob_v1.bin", fixtureDeadline, fixtureValues)
+	}
+	VerifyFixtureFile(t, scs.GobCodec{}, "testdata/gob_v1.bin", fixtureDeadline, fixtureValues)
+}
+
+func TestJSONFixture(t *testing.T) {
+	codec := scs.NewJSONCodec(scs.JSONCodecOptions{})
+	if *update {
+		WriteFixture(t, codec, "testdata/json_v1.json", fixtureDeadline, map[string]interface{}{
+			"string": "lorem ipsum",
+			"int":    42,
+			"bool":   true,
+		})
+	}
+	// encoding/json decodes all numbers as float64.
+	VerifyFixtureFile(t, codec, "testdata/json_v1.json", fixtureDeadline, map[string]interface{}{
+		"string": "lorem ipsum",
+		"int":    float64(42),
+		"bool":   true,
+	})
+}
@@ -0,0 +1,79 @@
+package scs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// ErrInvalidWatchInterval is returned by WatchConfig if the interval isn't
+// positive.
+var ErrInvalidWatchInterval = errors.New("scs: config watch interval must be positive")
+
+// SessionConfig holds session settings obtained from a ConfigProvider. A zero
+// value for a setting means that there is no override, and the corresponding
+// SessionManager field is used instead.
+type SessionConfig struct {
+	IdleTimeout time.Duration
+	Lifetime    time.Duration
+}
+
+// ConfigProvider is the interface for external sources of session settings,
+// such as a central configuration service shared by a fleet of applications.
+type ConfigProvider interface {
+	// SessionConfig should return the current session settings.
+	SessionConfig() (SessionConfig, error)
+}
+
+// WatchConfig applies the session settings from the given ConfigProvider, and
+// then starts a background goroutine which fetches and applies them again every
+// interval until ctx is canceled. The settings are applied with SetIdleTimeout
+// and SetLifetime, so they take effect for new requests without a restart.
+//
+// An error is returned if the interval isn't positive or the initial settings
+// can't be fetched, in which case no background goroutine is started. Errors from later fetches are logged
+// using Go's standard logger and the previous settings are kept.
+func (s *SessionManager) WatchConfig(ctx context.Context, p ConfigProvider, interval time.Duration) error {
+	if interval <= 0 {
+		return ErrInvalidWatchInterval
+	}
+	if err := s.applyConfig(p); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.applyConfig(p); err != nil {
+					log.Output(2, err.Error())
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *SessionManager) applyConfig(p ConfigProvider) error {
+	c, err := p.SessionConfig()
+	if err != nil {
+		return err
+	}
+
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = s.IdleTimeout
+	}
+	if c.Lifetime == 0 {
+		c.Lifetime = s.Lifetime
+	}
+	s.SetIdleTimeout(c.IdleTimeout)
+	s.SetLifetime(c.Lifetime)
+	return nil
+}
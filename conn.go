@@ -0,0 +1,110 @@
+package scs
+
+import (
+	"context"
+	"time"
+)
+
+// SessionForConn returns a new context.Context containing a copy of the session
+// data in ctx, for use by a long-lived connection which has taken over from the
+// request, such as a WebSocket after the upgrade.
+//
+// The LoadAndSave middleware doesn't commit the session data or write the
+// session cookie once the connection has been hijacked, and the request
+// context is canceled as soon as the handler returns, so the request context
+// shouldn't be used after the upgrade. Call SessionForConn before upgrading the
+// connection and use the returned context in the message loop instead. Reading
+// from it returns the session values as they were when SessionForConn was
+// called. It isn't canceled when the request finishes, and changes made to it
+// aren't visible to the request context (or vice versa). Use CommitConn to save
+// any changes to the session store, including those made in the handler
+// before SessionForConn was called. A pending error, such as ErrTooManyKeys
+// after a Put, is copied too and returned by CommitConn.
+func (s *SessionManager) SessionForConn(ctx context.Context) context.Context {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	values := make(map[string]interface{}, len(sd.values))
+	for key, val := range sd.values {
+		values[key] = val
+	}
+	blobs := make(map[string]string, len(sd.blobs))
+	for key, token := range sd.blobs {
+		blobs[key] = token
+	}
+	var transient map[string]interface{}
+	if sd.transient != nil {
+		transient = make(map[string]interface{}, len(sd.transient))
+		for key, val := range sd.transient {
+			transient[key] = val
+		}
+	}
+
+	csd := &sessionData{
+		deadline:        sd.deadline,
+		status:          sd.status,
+		written:         sd.written,
+		destroyed:       sd.destroyed,
+		revoked:         sd.revoked,
+		token:           sd.token,
+		values:          values,
+		identity:        sd.identity,
+		loaded:          sd.loaded,
+		loadedDeadline:  sd.loadedDeadline,
+		loadedAt:        sd.loadedAt,
+		indexed:         sd.indexed,
+		indexedLabels:   sd.indexedLabels,
+		indexedDeadline: sd.indexedDeadline,
+		loadedToken:     sd.loadedToken,
+		blobs:           blobs,
+		blobDeadline:    sd.blobDeadline,
+		staleStoreKey:   sd.staleStoreKey,
+		transient:       transient,
+		err:             sd.err,
+	}
+	return s.addSessionDataToContext(context.Background(), csd)
+}
+
+// CommitConn saves any changes made to the session data in a context returned
+// by SessionForConn to the session store, and resets its status to Unmodified
+// so that it can be called again after later changes. It returns the session
+// token and expiry time, like Commit, or an empty token if there was nothing to
+// commit.
+//
+// The client can't be sent a new session cookie over a hijacked connection, so
+// if the token returned is different from the one the client sent (because
+// the session was new, or RenewToken was called) it's up to the application
+// to tell the client about it. If the session was destroyed it has already
+// been deleted from the store and nothing is committed.
+func (s *SessionManager) CommitConn(ctx context.Context) (string, time.Time, error) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	status := s.status(sd)
+	sd.written = false
+	if status == Destroyed {
+		sd.status = Unmodified
+	}
+	sd.mu.Unlock()
+
+	if status != Modified {
+		return "", time.Time{}, nil
+	}
+
+	token, expiry, err := s.Commit(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	// Only reset the status if the session data hasn't been changed again
+	// while it was being committed.
+	sd.mu.Lock()
+	if !sd.written {
+		sd.status = Unmodified
+	}
+	sd.mu.Unlock()
+
+	return token, expiry, nil
+}
@@ -1,16 +1,66 @@
 package scs
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// ErrTooManyKeys is returned when adding a key to the session data would take
+// the number of keys over the SessionManager.MaxKeys limit.
+var ErrTooManyKeys = errors.New("scs: too many keys in session")
+
+// ErrFlushNotSupported is returned by SessionManager.Flush when the session
+// store does not implement the FlushableStore interface.
+var ErrFlushNotSupported = errors.New("scs: session store does not support Flush")
+
+// ErrExpiryNotSupported is returned by SessionManager.StoreExpiry when the
+// session store does not implement the ExpiryReportingStore interface.
+var ErrExpiryNotSupported = errors.New("scs: session store does not support reporting expiry")
+
+// StatusDetail gives a more detailed breakdown of the state of the session data
+// during a request cycle than Status. It's intended for metrics, for example to
+// attribute session store load to different kinds of request.
+type StatusDetail int
+
+const (
+	// DetailNotLoaded indicates that no session data has been loaded into the
+	// context (for example, because the request was skipped by SkipFunc).
+	DetailNotLoaded StatusDetail = iota
+
+	// DetailUntouched indicates that the session data has been loaded but not
+	// read or changed in the current request cycle.
+	DetailUntouched
+
+	// DetailReadOnly indicates that the session data has been read but not
+	// changed in the current request cycle.
+	DetailReadOnly
+
+	// DetailReverted indicates that the session data was changed in the
+	// current request cycle, but the changes have since been undone so that it
+	// is the same as when it was loaded.
+	DetailReverted
+
+	// DetailModified indicates that the session data has been changed in the
+	// current request cycle.
+	DetailModified
+
+	// DetailDestroyed indicates that the session data has been destroyed in
+	// the current request cycle.
+	DetailDestroyed
+)
+
 // Status represents the state of the session data during a request cycle.
 type Status int
 
@@ -33,14 +83,94 @@ type sessionData struct {
 	status   Status
 	token    string
 	values   map[string]interface{}
-	mu       sync.Mutex
+	identity interface{}
+
+	// loaded, loadedDeadline and loadedToken hold a shallow copy of the
+	// session values, the deadline and the token as they were when the session
+	// data was loaded, and accessed and written record whether the session data
+	// has been read or changed. They are used by StatusDetail.
+	loaded         map[string]interface{}
+	loadedDeadline time.Time
+	loadedToken    string
+	accessed       bool
+	written        bool
+
+	// destroyed records whether Destroy has been called in the current request
+	// cycle.
+	destroyed bool
+
+	// revoked records whether the session token sent by the client belonged to
+	// a session which has been revoked with Revoke. It is reported by
+	// WasRevoked.
+	revoked bool
+
+	// loadedAt is the time at which the session data was loaded or created,
+	// which is when the session was last active for the purposes of the idle
+	// timeout. It is used by IdleRemaining.
+	loadedAt time.Time
+
+	// refreshed records whether the expiry time of the session data was
+	// extended by a RefreshingStore when it was loaded, in which case it
+	// doesn't need to be committed again unless it has been changed.
+	refreshed bool
+
+	// indexed, indexedLabels and indexedDeadline are the value under IndexKey,
+	// the labels and the deadline which the session token was last added to
+	// the IndexedStore index with. indexed is empty if the token isn't in the
+	// index for IndexKey.
+	indexed         string
+	indexedLabels   map[string]bool
+	indexedDeadline time.Time
+
+	// committedInTx records whether the session data has been committed using
+	// a transaction added with WithTx, and not changed since. Later commits
+	// without the transaction don't write it again, so that it isn't persisted
+	// if the transaction is rolled back.
+	committedInTx bool
+
+	// staleStoreKey is the store key that the session data was found under
+	// when it was loaded, if that was derived from an older StoreKeyPepper key.
+	// It is deleted once the session data has been committed under the
+	// current store key.
+	staleStoreKey string
+
+	// blobs maps the keys of any values which have been offloaded to separate
+	// entries in the session store to their blob tokens, as of the last load or
+	// commit. blobDeadline is the session deadline at that point, and
+	// blobCache holds values fetched from the store, keyed by blob token.
+	blobs        map[string]string
+	blobDeadline time.Time
+	blobCache    map[string]interface{}
+
+	// transient holds the values added with PutTransient, which are never
+	// committed to the session store.
+	transient map[string]interface{}
+
+	// fieldCache holds the values returned by GetField in the current request
+	// cycle, keyed by session token and key. It is cleared whenever session
+	// data is committed to or deleted from the session store.
+	fieldCache map[fieldCacheKey]interface{}
+
+	// loads and commits count the calls to Load and Commit in the current
+	// request cycle. They are reported by RequestCounts.
+	loads   int
+	commits int
+
+	err     error
+	manager *SessionManager
+	mu      sync.Mutex
 }
 
 func newSessionData(lifetime time.Duration) *sessionData {
+	now := time.Now()
+	deadline := now.Add(lifetime).UTC()
 	return &sessionData{
-		deadline: time.Now().Add(lifetime).UTC(),
-		status:   Unmodified,
-		values:   make(map[string]interface{}),
+		loadedAt:       now,
+		deadline:       deadline,
+		status:         Unmodified,
+		values:         make(map[string]interface{}),
+		loaded:         make(map[string]interface{}),
+		loadedDeadline: deadline,
 	}
 }
 
@@ -51,37 +181,385 @@ func newSessionData(lifetime time.Duration) *sessionData {
 // Most applications will use the LoadAndSave() middleware and will not need to
 // use this method.
 func (s *SessionManager) Load(ctx context.Context, token string) (context.Context, error) {
-	if _, ok := ctx.Value(s.contextKey).(*sessionData); ok {
+	if sd, ok := ctx.Value(s.contextKey).(*sessionData); ok {
+		if sd.manager != nil && sd.manager != s {
+			panic(fmt.Sprintf("scs: context key %q is already in use by a different session manager (was the SessionManager copied by value?)", s.contextKey))
+		}
+		sd.mu.Lock()
+		sd.loads++
+		sd.mu.Unlock()
 		return ctx, nil
 	}
 
-	if token == "" {
-		return s.addSessionDataToContext(ctx, newSessionData(s.Lifetime)), nil
+	ctx, err := s.load(ctx, token)
+	if err != nil {
+		return nil, err
 	}
+	s.getSessionDataFromContext(ctx).loads = 1
+	return ctx, nil
+}
 
-	b, found, err := s.Store.Find(token)
+// load reads the session data for the given token from the session store into
+// a new sessionData, and returns a copy of ctx containing it.
+func (s *SessionManager) load(ctx context.Context, token string) (context.Context, error) {
+	if token == "" || (s.TokenValidator != nil && !s.TokenValidator(token)) {
+		return s.addSessionDataToContext(ctx, newSessionData(s.getLifetime())), nil
+	}
+
+	// If the store supports it, extend the expiry time for the idle timeout
+	// while reading the session data. The absolute deadline isn't known yet,
+	// so this may set an expiry time after the deadline, but the session will
+	// still be treated as expired once the deadline has passed. This isn't
+	// done when TombstoneTTL is set, so that tombstones aren't kept for longer.
+	var refreshExpiry time.Time
+	store := s.getStore()
+	if _, ok := store.(RefreshingStore); ok && s.getIdleTimeout() > 0 && s.ExpiryStrategy == nil && s.TombstoneTTL <= 0 {
+		refreshExpiry = time.Now().Add(s.getIdleTimeout()).UTC().Add(s.ClockSkew)
+	}
+	key, b, found, err := s.find(store, token, refreshExpiry)
 	if err != nil {
 		return nil, err
 	} else if !found {
-		return s.addSessionDataToContext(ctx, newSessionData(s.Lifetime)), nil
+		sd := newSessionData(s.getLifetime())
+		if isRevoked(b) {
+			// The session was revoked with Revoke, so the session cookie
+			// should be deleted.
+			sd.revoked = true
+			sd.status = Destroyed
+		}
+		return s.addSessionDataToContext(ctx, sd), nil
 	}
 
-	sd := &sessionData{
-		status: Unmodified,
-		token:  token,
+	sd, err := s.decodeSessionData(token, b)
+	if err != nil {
+		return nil, err
+	} else if sd == nil {
+		s.emitEvent(EventExpired, token)
+		return s.addSessionDataToContext(ctx, newSessionData(s.getLifetime())), nil
+	}
+
+	// The session was created before the user's session generation was last
+	// bumped, so it is no longer valid.
+	if current, err := s.currentGeneration(ctx, sd); err != nil {
+		return nil, err
+	} else if !current {
+		if err := store.Delete(key); err != nil {
+			return nil, err
+		}
+		return s.addSessionDataToContext(ctx, newSessionData(s.getLifetime())), nil
+	}
+	sd.refreshed = !refreshExpiry.IsZero()
+	s.markLoaded(sd, key)
+
+	return s.addSessionDataToContext(ctx, sd), nil
+}
+
+// loadReadOnly reads the session data for the given token from the session
+// store without any side effects: the store's expiry time isn't refreshed,
+// session data invalidated by GenerationFunc isn't deleted, and no events are
+// emitted. It returns nil if the token isn't found, or the session has expired
+// or been invalidated.
+func (s *SessionManager) loadReadOnly(ctx context.Context, token string) (*sessionData, error) {
+	if token == "" || (s.TokenValidator != nil && !s.TokenValidator(token)) {
+		return nil, nil
+	}
+
+	_, b, found, err := s.find(s.getStore(), token, time.Time{})
+	if err != nil || !found {
+		return nil, err
+	}
+	sd, err := s.decodeSessionData(token, b)
+	if err != nil || sd == nil {
+		return nil, err
+	}
+	if current, err := s.currentGeneration(ctx, sd); err != nil || !current {
+		return nil, err
 	}
-	if sd.deadline, sd.values, err = s.Codec.Decode(b); err != nil {
+	return sd, nil
+}
+
+// LoadMany retrieves the session data for a batch of session tokens from the
+// session store, and returns a new context.Context containing the session
+// data for each token that was found, keyed by token. Tokens which aren't
+// found, are invalid or whose sessions have expired are omitted from the
+// returned map. Each context works in the same way as one returned by Load.
+//
+// If the session store implements BatchFindStore, the session data is read
+// with a single call to FindMany. Otherwise Find is called for each token.
+func (s *SessionManager) LoadMany(ctx context.Context, tokens []string) (map[string]context.Context, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
+	store := s.getStore()
+	ctxs := make(map[string]context.Context, len(tokens))
+	keyTokens := make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		if token == "" || (s.TokenValidator != nil && !s.TokenValidator(token)) {
+			continue
+		}
+		keyTokens[s.storeKey(token)] = token
+	}
+	if len(keyTokens) == 0 {
+		return ctxs, nil
+	}
+
+	found := make(map[string][]byte, len(keyTokens))
+	if bs, ok := store.(BatchFindStore); ok {
+		keys := make([]string, 0, len(keyTokens))
+		for key := range keyTokens {
+			keys = append(keys, key)
+		}
+		release, err := s.acquireStore()
+		if err != nil {
+			return nil, err
+		}
+		res, err := bs.FindMany(keys)
+		release()
+		if err != nil {
+			return nil, err
+		}
+		for key, b := range res {
+			if _, ok := keyTokens[key]; ok {
+				found[key] = b
+			}
+		}
+	}
+
+	for key, token := range keyTokens {
+		b, ok := found[key]
+		if !ok {
+			// Look up tokens which weren't found in the batch (or when the store
+			// doesn't support batches) individually, which also checks any older
+			// StoreKeyPepper keys.
+			var err error
+			if key, b, ok, err = s.find(store, token, time.Time{}); err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+		}
+
+		if isTombstone(b) {
+			continue
+		}
+
+		sd, err := s.decodeSessionData(token, b)
+		if err != nil {
+			return nil, err
+		} else if sd == nil {
+			continue
+		}
+
+		// As in load, session data whose generation is no longer current is
+		// deleted.
+		if current, err := s.currentGeneration(ctx, sd); err != nil {
+			return nil, err
+		} else if !current {
+			if err := store.Delete(key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s.markLoaded(sd, key)
+		ctxs[token] = s.addSessionDataToContext(ctx, sd)
+	}
+
+	return ctxs, nil
+}
+
+// markLoaded records the state of session data which has just been read from
+// the store under the given store key, so that changes to it can be detected.
+func (s *SessionManager) markLoaded(sd *sessionData, key string) {
+	if key != s.storeKey(sd.token) {
+		sd.staleStoreKey = key
+	}
+
+	if s.IdentityKey != "" {
+		sd.identity = sd.values[s.IdentityKey]
+	}
+	sd.loaded = make(map[string]interface{}, len(sd.values))
+	for key, val := range sd.values {
+		sd.loaded[key] = val
+	}
+	sd.loadedDeadline = sd.deadline
+	sd.loadedToken = sd.token
+	sd.loadedAt = time.Now()
+	s.markIndexed(sd)
+
 	// Mark the session data as modified if an idle timeout is being used. This
 	// will force the session data to be re-committed to the session store with
-	// a new expiry time.
-	if s.IdleTimeout > 0 {
+	// a new expiry time (unless the store has already refreshed it), and the
+	// session cookie to be sent again. With RefreshCookieEachRequest the status
+	// is left alone and LoadAndSave refreshes the expiry instead. Session data
+	// found under a stale store key is also re-committed, so that it moves to
+	// the current store key. Empty session data is left alone, so that a
+	// request which doesn't touch it causes no store write and no session
+	// cookie.
+	if len(sd.values) > 0 && ((s.getIdleTimeout() > 0 && !s.RefreshCookieEachRequest) || sd.staleStoreKey != "") {
 		sd.status = Modified
 	}
+}
 
-	return s.addSessionDataToContext(ctx, sd), nil
+// decodeSessionData decodes the session data read from the store for the given
+// token. It returns nil if the session has expired.
+func (s *SessionManager) decodeSessionData(token string, b []byte) (*sessionData, error) {
+	sd := &sessionData{
+		status: Unmodified,
+		token:  token,
+	}
+
+	var err error
+	if sd.deadline, sd.values, err = s.decode(b); err != nil {
+		return nil, err
+	}
+	if sd.values, err = s.decodeKeyValues(sd.values); err != nil {
+		return nil, err
+	}
+	s.decodeBlobRefs(sd)
+
+	// Treat the session as expired if its absolute deadline has passed. The
+	// store should already have checked this, but it may be using a different
+	// clock, so allow for the ClockSkew tolerance.
+	if time.Now().After(sd.deadline.Add(s.ClockSkew)) {
+		return nil, nil
+	}
+	return sd, nil
+}
+
+// GetSession returns a copy of the session data values and the absolute
+// deadline for the given session token, without needing a http.Request. It's
+// intended for non-HTTP transports, such as gRPC services or message
+// consumers, which have a session token but don't use the LoadAndSave
+// middleware. Nothing is modified or committed to the store. If the token is
+// not found or the session has expired, GetSession returns nil values, a zero
+// deadline and a nil error.
+func (s *SessionManager) GetSession(ctx context.Context, token string) (map[string]interface{}, time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	sd, err := s.loadReadOnly(ctx, token)
+	if err != nil || sd == nil {
+		return nil, time.Time{}, err
+	}
+
+	// Use a fresh context, so that any session data already in ctx isn't
+	// returned instead.
+	values := s.Snapshot(s.addSessionDataToContext(context.Background(), sd))
+	if err := sd.err; err != nil {
+		return nil, time.Time{}, err
+	}
+	return values, sd.deadline, nil
+}
+
+// GetField returns the value for a single key from the session data for the
+// given session token, without needing a http.Request. It's like GetSession,
+// but if the Codec used to encode the session data implements FieldCodec, only
+// the value for the key is decoded, which can be much cheaper for large
+// sessions. Otherwise the session data is decoded in full. Nothing is modified
+// or committed to the store. If the token or the key is not found, or the
+// session has expired, GetField returns a nil value and a nil error.
+//
+// If ctx holds session data loaded by this session manager (for example in a
+// handler wrapped by LoadAndSave), each value is only fetched and decoded once
+// per request cycle, and later calls for the same token and key return the
+// same value until session data is next committed or destroyed in the request.
+func (s *SessionManager) GetField(ctx context.Context, token, key string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if token == "" || (s.TokenValidator != nil && !s.TokenValidator(token)) {
+		return nil, nil
+	}
+
+	sd, ok := ctx.Value(s.contextKey).(*sessionData)
+	if !ok {
+		return s.getField(ctx, token, key)
+	}
+
+	ck := fieldCacheKey{token: token, key: key}
+	sd.mu.Lock()
+	val, cached := sd.fieldCache[ck]
+	sd.mu.Unlock()
+	if cached {
+		return val, nil
+	}
+
+	val, err := s.getField(ctx, token, key)
+	if err != nil {
+		return nil, err
+	}
+	sd.mu.Lock()
+	if sd.fieldCache == nil {
+		sd.fieldCache = make(map[fieldCacheKey]interface{})
+	}
+	sd.fieldCache[ck] = val
+	sd.mu.Unlock()
+	return val, nil
+}
+
+type fieldCacheKey struct {
+	token string
+	key   string
+}
+
+// getField reads the value for a single key from the session data for the
+// given session token in the session store.
+func (s *SessionManager) getField(ctx context.Context, token, key string) (interface{}, error) {
+	_, b, found, err := s.find(s.getStore(), token, time.Time{})
+	if err != nil || !found {
+		return nil, err
+	}
+
+	// Values encoded with a per-key ValueCodec need the list of encoded keys,
+	// so only use the FieldCodec for other keys. If the key isn't found it may
+	// have been offloaded as a blob, so fall back to a full decode. Checking
+	// the session generation needs the full session data too.
+	if _, ok := s.KeyCodecs[key]; !ok && (s.GenerationFunc == nil || s.IdentityKey == "") {
+		codec, payload, err := s.codecFor(b)
+		if err != nil {
+			return nil, err
+		}
+		if fc, ok := codec.(FieldCodec); ok {
+			deadline, val, found, err := fc.DecodeField(payload, key)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				if time.Now().After(deadline.Add(s.ClockSkew)) {
+					return nil, nil
+				}
+				_, expiry, hasTTL, err := fc.DecodeField(payload, ttlKey(key))
+				if err != nil {
+					return nil, err
+				}
+				if !hasTTL {
+					return val, nil
+				}
+				if expiry, ok := normalizeValue(ttlKey(key), expiry).(int64); ok {
+					if time.Now().UnixNano() >= expiry {
+						return nil, nil
+					}
+					return val, nil
+				}
+			}
+		}
+	}
+
+	sd, err := s.decodeSessionData(token, b)
+	if err != nil || sd == nil {
+		return nil, err
+	}
+	if current, err := s.currentGeneration(ctx, sd); err != nil || !current {
+		return nil, err
+	}
+	sd.expireKey(key)
+	val := s.resolveBlob(sd, key, sd.values[key])
+	if sd.err != nil {
+		return nil, sd.err
+	}
+	return val, nil
 }
 
 // Commit saves the session data to the session store and returns the session
@@ -90,78 +568,847 @@ func (s *SessionManager) Load(ctx context.Context, token string) (context.Contex
 // Most applications will use the LoadAndSave() middleware and will not need to
 // use this method.
 func (s *SessionManager) Commit(ctx context.Context) (string, time.Time, error) {
+	token, expiry, err := s.commit(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	sd := s.getSessionDataFromContext(ctx)
+	sd.mu.Lock()
+	sd.commits++
+	commits := sd.commits
+	sd.mu.Unlock()
+	if commits > 1 && s.OnRedundantCommit != nil {
+		s.OnRedundantCommit(ctx, commits)
+	}
+	s.emitEvent(EventCommitted, token)
+
+	s.notifyIdentityChange(ctx)
+	return token, expiry, nil
+}
+
+// RequestCounts holds the number of times that the session data has been
+// loaded and committed in the current request cycle.
+type RequestCounts struct {
+	// Loads is the number of calls to Load (including those made by the
+	// LoadAndSave middleware) which returned the session data.
+	Loads int
+
+	// Commits is the number of times that the session data was successfully
+	// committed to the session store.
+	Commits int
+}
+
+// RequestCounts returns the number of times that the session data has been
+// loaded and committed in the current request cycle. More than one load or
+// commit usually means that the LoadAndSave middleware has been applied more
+// than once, for example by nested routers, which adds load to the session
+// store. Also see SessionManager.OnRedundantCommit.
+func (s *SessionManager) RequestCounts(ctx context.Context) RequestCounts {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return RequestCounts{Loads: sd.loads, Commits: sd.commits}
+}
+
+// EncodedSize returns the size in bytes of the session data as it would be
+// written to the session store if it were committed now, after applying the
+// BlobThreshold, KeyCodecs, Codec and CodecID settings. Nothing is written to
+// the session store. It's intended for handlers which want to make decisions
+// based on the size of the session, such as warning when it grows too large.
+func (s *SessionManager) EncodedSize(ctx context.Context) (int, error) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	b, err := s.dryEncode(sd)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Validate checks that the session data could be committed now, without
+// writing anything to the session store or sending a cookie. It returns the
+// error that Commit would return for a problem with the session data itself,
+// such as ErrTooManyKeys, or a value which the Codec can't encode (for example
+// a type which hasn't been registered with gob.Register). It's intended for
+// tests and pre-flight checks, so that serialization bugs are found before
+// they cause a failed commit.
+func (s *SessionManager) Validate(ctx context.Context) error {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.err != nil {
+		return sd.err
+	}
+	_, err := s.dryEncode(sd)
+	return err
+}
+
+// dryEncode encodes the session data as it would be written to the session
+// store if it were committed now, without writing anything. The caller must
+// hold sd.mu.
+func (s *SessionManager) dryEncode(sd *sessionData) ([]byte, error) {
+	values := sd.values
+	if _, ok := s.getStore().(StatelessStore); !ok {
+		// Values which would be offloaded are replaced with references, but
+		// the blobs aren't written.
+		var err error
+		if values, _, err = s.offloadBlobs(discardStore{}, sd); err != nil {
+			return nil, err
+		}
+	}
+
+	values, err := s.encodeKeyValues(values)
+	if err != nil {
+		return nil, err
+	}
+	return s.encode(sd.deadline, values)
+}
+
+// discardStore is a Store which holds nothing and discards everything
+// committed to it.
+type discardStore struct{}
+
+func (discardStore) Find(token string) ([]byte, bool, error)               { return nil, false, nil }
+func (discardStore) Commit(token string, b []byte, expiry time.Time) error { return nil }
+func (discardStore) Delete(token string) error                             { return nil }
+
+func (s *SessionManager) commit(ctx context.Context) (string, time.Time, error) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.err != nil {
+		return "", time.Time{}, sd.err
+	}
+
+	created := sd.token == ""
+	if created {
+		var err error
+		if sd.token, err = s.generateToken(); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+
+	// The store extended the expiry time when the session data was loaded, so
+	// if nothing has changed since then there is nothing to write.
+	if sd.refreshed && !sd.written && sd.token == sd.loadedToken && sd.staleStoreKey == "" {
+		return sd.token, s.expiry(sd), nil
+	}
+
+	store, inTx, err := s.storeForContext(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if sd.committedInTx && !sd.written && !inTx {
+		return sd.token, s.expiry(sd), nil
+	}
+
+	if s.MaxLifetime > 0 {
+		s.capDeadline(sd)
+	}
+	if err := s.recordGeneration(ctx, sd); err != nil {
+		return "", time.Time{}, err
+	}
+
+	release, err := s.acquireStore()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer release()
+
+	values, blobs, err := s.offloadBlobs(store, sd)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	values, err = s.encodeKeyValues(values)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	b, err := s.encode(sd.deadline, values)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiry := s.expiry(sd)
+	if s.MaxLifetime > 0 && expiry.After(sd.deadline) {
+		expiry = sd.deadline
+	}
+
+	if ss, ok := store.(StatelessStore); ok {
+		token, err := ss.CommitToken(b, expiry.Add(s.ClockSkew))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		sd.token = token
+		sd.fieldCache = nil
+		if created {
+			s.emitEvent(EventCreated, sd.token)
+		}
+		return sd.token, expiry, nil
+	}
+
+	if err := store.Commit(s.storeKey(sd.token), b, expiry.Add(s.ClockSkew)); err != nil {
+		return "", time.Time{}, err
+	}
+
+	if err := s.deleteStaleStoreKey(store, sd); err != nil {
+		return "", time.Time{}, err
+	}
+
+	if err := s.updateBlobs(store, sd, blobs); err != nil {
+		return "", time.Time{}, err
+	}
+
+	if err := s.updateIndex(sd); err != nil {
+		return "", time.Time{}, err
+	}
+
+	sd.committedInTx = inTx
+	if inTx {
+		sd.written = false
+	}
+	sd.fieldCache = nil
+	if created {
+		s.emitEvent(EventCreated, sd.token)
+	}
+	return sd.token, expiry, nil
+}
+
+// reserveToken makes sure the session data has a token, generating one if
+// necessary, and returns it along with the expiry time that a commit would use.
+// Nothing is written to the session store.
+func (s *SessionManager) reserveToken(ctx context.Context) (string, time.Time, error) {
 	sd := s.getSessionDataFromContext(ctx)
 
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
+	if sd.err != nil {
+		return "", time.Time{}, sd.err
+	}
+
 	if sd.token == "" {
 		var err error
-		if sd.token, err = generateToken(); err != nil {
+		if sd.token, err = s.generateToken(); err != nil {
 			return "", time.Time{}, err
 		}
+		s.emitEvent(EventCreated, sd.token)
+	}
+
+	return sd.token, s.expiry(sd), nil
+}
+
+// touch extends the store expiry time of session data which hasn't been
+// modified during the request to the end of the current idle timeout window,
+// without re-encoding it, and returns the session token and the new expiry
+// time. It returns an empty token if there is nothing to refresh. If the
+// store already refreshed the expiry when the session data was loaded there
+// is nothing to write, and stores which don't implement TouchStore get a full
+// commit instead.
+func (s *SessionManager) touch(ctx context.Context) (string, time.Time, error) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	if sd.err != nil {
+		sd.mu.Unlock()
+		return "", time.Time{}, sd.err
+	}
+	if sd.token == "" || len(sd.values) == 0 {
+		sd.mu.Unlock()
+		return "", time.Time{}, nil
+	}
+	token, expiry, refreshed := sd.token, s.expiry(sd), sd.refreshed
+	sd.mu.Unlock()
+
+	if refreshed {
+		return token, expiry, nil
+	}
+
+	ts, ok := s.getStore().(TouchStore)
+	if !ok {
+		return s.Commit(ctx)
 	}
 
-	b, err := s.Codec.Encode(sd.deadline, sd.values)
+	release, err := s.acquireStore()
 	if err != nil {
 		return "", time.Time{}, err
 	}
+	defer release()
+
+	if err := ts.Touch(s.storeKey(token), expiry.Add(s.ClockSkew)); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiry, nil
+}
+
+// ExpiryStrategy is the interface for custom policies which decide when session
+// data should expire. It can be used via SessionManager.ExpiryStrategy.
+type ExpiryStrategy interface {
+	// Expiry should return the time at which the session data should expire
+	// from the store, and the session cookie with it. It's called each time
+	// the session data is committed, with the current time, the time at which
+	// the session's absolute lifetime began (its deadline minus the Lifetime),
+	// the time the session was last active (which, because a commit is
+	// happening, is also the current time) and the session's absolute
+	// deadline. Sessions are treated as expired once their deadline has
+	// passed, whatever expiry time is returned.
+	Expiry(now, created, lastActive, deadline time.Time) time.Time
+}
 
-	expiry := sd.deadline
-	if s.IdleTimeout > 0 {
-		ie := time.Now().Add(s.IdleTimeout).UTC()
+// expiry returns the time at which the session data should expire from the
+// store, taking into account the idle timeout or the ExpiryStrategy. The
+// caller must hold sd.mu.
+func (s *SessionManager) expiry(sd *sessionData) time.Time {
+	deadline := s.cappedDeadline(sd)
+	if s.ExpiryStrategy != nil {
+		now := time.Now().UTC()
+		return s.ExpiryStrategy.Expiry(now, sd.deadline.Add(-s.getLifetime()), now, deadline)
+	}
+
+	expiry := deadline
+	if idleTimeout := s.getIdleTimeout(); idleTimeout > 0 {
+		ie := time.Now().Add(idleTimeout).UTC()
 		if ie.Before(expiry) {
 			expiry = ie
 		}
 	}
-
-	if err := s.Store.Commit(sd.token, b, expiry); err != nil {
-		return "", time.Time{}, err
+	return expiry
+}
+
+// createdKey is the session data key used to record when the session was
+// created, as a Unix time in nanoseconds, if MaxLifetime is set.
+const createdKey = "__created"
+
+// capDeadline records the creation time of the session under createdKey, if it
+// isn't already, and brings the deadline forward so that it's no later than
+// MaxLifetime after the creation time. Sessions committed before MaxLifetime
+// was set are treated as having been created Lifetime before their deadline.
+// The caller must hold sd.mu.
+func (s *SessionManager) capDeadline(sd *sessionData) {
+	if _, ok := sd.values[createdKey].(int64); !ok {
+		sd.values[createdKey] = sd.deadline.Add(-s.getLifetime()).UnixNano()
+	}
+	sd.deadline = s.cappedDeadline(sd)
+}
+
+// cappedDeadline returns the deadline that capDeadline would set, without
+// changing the session data, so that the deadline and expiry reported before
+// the session data is committed match the ones which are committed. The caller
+// must hold sd.mu.
+func (s *SessionManager) cappedDeadline(sd *sessionData) time.Time {
+	if s.MaxLifetime <= 0 {
+		return sd.deadline
+	}
+	created, ok := sd.values[createdKey].(int64)
+	if !ok {
+		created = sd.deadline.Add(-s.getLifetime()).UnixNano()
+	}
+	if max := time.Unix(0, created).Add(s.MaxLifetime).UTC(); sd.deadline.After(max) {
+		return max
+	}
+	return sd.deadline
+}
+
+// Destroy deletes the session data from the session store and sets the session
+// status to Destroyed. Any further operations in the same request cycle will
+// result in a new session being created, unless FinalDestroy is enabled, in
+// which case the session status stays Destroyed for the rest of the request
+// cycle. Either way, Destroy takes precedence over any changes made to the
+// session data before it was called.
+func (s *SessionManager) Destroy(ctx context.Context) error {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	if err := s.deleteSessionData(ctx, sd); err != nil {
+		sd.mu.Unlock()
+		return err
+	}
+
+	sd.status = Destroyed
+	sd.destroyed = true
+	token := sd.token
+
+	// Reset everything else to defaults.
+	sd.token = ""
+	sd.err = nil
+	sd.deadline = time.Now().Add(s.getLifetime()).UTC()
+	for key := range sd.values {
+		delete(sd.values, key)
+	}
+	sd.transient = nil
+	sd.mu.Unlock()
+
+	s.notifyIdentityChange(ctx)
+	if token != "" {
+		s.emitEvent(EventDestroyed, token)
+		if s.OnDestroy != nil {
+			s.OnDestroy(ctx, token)
+		}
+	}
+	return nil
+}
+
+// deleteSessionData deletes the session data, along with any data under a stale
+// store key and any offloaded blobs, from the session store, using the
+// transaction in ctx if there is one. The caller must hold sd.mu.
+func (s *SessionManager) deleteSessionData(ctx context.Context, sd *sessionData) error {
+	store, _, err := s.storeForContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	release, err := s.acquireStore()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	sd.fieldCache = nil
+	if err := s.removeFromIndex(sd); err != nil {
+		return err
+	}
+	if err := s.deleteStoreKey(store, s.storeKey(sd.token)); err != nil {
+		return err
+	}
+	if err := s.deleteStaleStoreKey(store, sd); err != nil {
+		return err
+	}
+	return s.deleteBlobs(store, sd)
+}
+
+// Flush deletes all session data from the session store, so that every
+// existing session token becomes invalid and all users are logged out. This is
+// intended for incident response, such as after a secret has leaked. The store
+// must implement the FlushableStore interface, otherwise ErrFlushNotSupported
+// is returned.
+func (s *SessionManager) Flush(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fs, ok := s.getStore().(FlushableStore)
+	if !ok {
+		return ErrFlushNotSupported
+	}
+
+	release, err := s.acquireStore()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return fs.Flush()
+}
+
+// StoreExpiry returns the expiry time recorded by the session store for the
+// given session token. Unlike Expiry, this doesn't need the session data to be
+// loaded, which makes it suitable for admin tooling. If the token is not found
+// or is expired, the found return value will be false. The store must
+// implement the ExpiryReportingStore interface, otherwise ErrExpiryNotSupported
+// is returned.
+func (s *SessionManager) StoreExpiry(token string) (time.Time, bool, error) {
+	es, ok := s.getStore().(ExpiryReportingStore)
+	if !ok {
+		return time.Time{}, false, ErrExpiryNotSupported
+	}
+
+	release, err := s.acquireStore()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer release()
+	for _, key := range s.storeKeys(token) {
+		expiry, found, err := es.Expiry(key)
+		if err != nil {
+			return time.Time{}, false, err
+		} else if !found {
+			continue
+		}
+		if s.TombstoneTTL > 0 {
+			b, _, err := es.Find(key)
+			if err != nil {
+				return time.Time{}, false, err
+			} else if isTombstone(b) {
+				return time.Time{}, false, nil
+			}
+		}
+		return expiry, true, nil
+	}
+	return time.Time{}, false, nil
+}
+
+// WasRecentlyValid reports whether the given session token belonged to a
+// session which was destroyed (or whose token was renewed) within the last
+// TombstoneTTL. It always returns false if TombstoneTTL is not set, and for
+// tokens which are still valid.
+func (s *SessionManager) WasRecentlyValid(ctx context.Context, token string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if token == "" || s.TombstoneTTL <= 0 {
+		return false, nil
+	}
+
+	release, err := s.acquireStore()
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	store := s.getStore()
+	for _, key := range s.storeKeys(token) {
+		b, found, err := store.Find(key)
+		if err != nil {
+			return false, err
+		} else if found {
+			return isTombstone(b), nil
+		}
+	}
+	return false, nil
+}
+
+// Put adds a key and corresponding value to the session data. Any existing
+// value for the key will be replaced. The session data status will be set to
+// Modified.
+//
+// If adding the key would exceed the MaxKeys limit then the value is not
+// stored, and ErrTooManyKeys will be returned by the next call to Commit (which
+// the LoadAndSave middleware passes to the ErrorFunc).
+func (s *SessionManager) Put(ctx context.Context, key string, val interface{}) {
+	s.checkEncodable(ctx, key, val)
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if !s.hasRoomFor(sd, key) {
+		sd.err = ErrTooManyKeys
+		return
+	}
+
+	sd.values[key] = val
+	delete(sd.values, ttlKey(key))
+	delete(sd.transient, key)
+	sd.status = Modified
+	sd.written = true
+}
+
+// checkEncodable calls the OnUnencodableValue hook if it is set, the Codec is
+// GobCodec and val can't be encoded by gob. Values for keys with a KeyCodecs
+// entry aren't encoded by gob, so they aren't checked.
+func (s *SessionManager) checkEncodable(ctx context.Context, key string, val interface{}) {
+	if s.OnUnencodableValue == nil {
+		return
+	}
+	if _, ok := s.Codec.(GobCodec); !ok {
+		return
+	}
+	if _, ok := s.KeyCodecs[key]; ok {
+		return
+	}
+	if err := gobEncodable(val); err != nil {
+		s.OnUnencodableValue(ctx, key, err)
+	}
+}
+
+// PutTransient adds a key and corresponding value to the session data for the
+// rest of the current request cycle only. The value can be read with Get (and
+// the other helpers which read a single key) and takes precedence over any
+// value put with Put for the same key, but it isn't committed to the session
+// store and isn't included by Keys or Snapshot. The session data status is
+// not changed. This is useful for values which are derived from the session
+// data and don't need to be stored.
+func (s *SessionManager) PutTransient(ctx context.Context, key string, val interface{}) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.transient == nil {
+		sd.transient = make(map[string]interface{})
+	}
+	sd.transient[key] = val
+}
+
+// PutWithTTL adds a key and corresponding value to the session data, like Put,
+// but the key will only live for the given duration. Once the TTL has passed
+// the key is treated as absent by Get (and the other helpers which read the
+// session data), and it is removed from the session data the next time it is
+// accessed. The rest of the session data is unaffected. This is useful for
+// short-lived values, such as a one-time password challenge.
+func (s *SessionManager) PutWithTTL(ctx context.Context, key string, val interface{}, ttl time.Duration) {
+	s.checkEncodable(ctx, key, val)
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if !s.hasRoomFor(sd, key) {
+		sd.err = ErrTooManyKeys
+		return
+	}
+
+	sd.values[key] = val
+	sd.values[ttlKey(key)] = time.Now().Add(ttl).UnixNano()
+	sd.status = Modified
+	sd.written = true
+}
+
+// PutAll adds all the given keys and corresponding values to the session data.
+// Any existing values for the keys will be replaced. If adding the keys would
+// exceed the MaxKeys limit then ErrTooManyKeys is returned and the session data
+// is left unchanged. Otherwise the session data status will be set to
+// Modified.
+func (s *SessionManager) PutAll(ctx context.Context, values map[string]interface{}) error {
+	for key, val := range values {
+		s.checkEncodable(ctx, key, val)
+	}
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if s.MaxKeys > 0 {
+		n := countKeys(sd.values)
+		for key := range values {
+			if _, exists := sd.values[key]; !exists && !isReservedKey(key) {
+				n++
+			}
+		}
+		if n > s.MaxKeys {
+			return ErrTooManyKeys
+		}
+	}
+
+	for key, val := range values {
+		sd.values[key] = val
+	}
+	sd.status = Modified
+	sd.written = true
+
+	return nil
+}
+
+// Once returns the value for a given key from the session data. If the key is
+// not present, init is called and its result is stored under the key and
+// returned, and the session data status will be set to Modified. Otherwise the
+// session data is left unchanged. This is useful for values which should be
+// set up once when a session is first used, such as a CSRF secret.
+//
+// The check and the call to init happen atomically with respect to other
+// operations on the same session data, so init runs at most once per session
+// even if Once is called concurrently. Because the session data is locked
+// while init runs, init must not call any other methods for the same session.
+func (s *SessionManager) Once(ctx context.Context, key string, init func() interface{}) interface{} {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	sd.accessed = true
+	sd.expireKey(key)
+	if val, exists := sd.values[key]; exists {
+		return s.resolveBlob(sd, key, val)
+	}
+
+	val := init()
+	if !s.hasRoomFor(sd, key) {
+		sd.err = ErrTooManyKeys
+		return val
+	}
+	sd.values[key] = val
+	sd.status = Modified
+	sd.written = true
+
+	return val
+}
+
+// Snapshot returns a copy of all the keys and values in the session data,
+// including reserved keys such as those used by PutWithTTL and RememberMe.
+// The map is copied, and so are any []byte values, so changes to the returned
+// map don't affect the session data. Other reference types (such as maps and
+// pointers) are shared with the session data.
+func (s *SessionManager) Snapshot(ctx context.Context) map[string]interface{} {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	sd.accessed = true
+	values := make(map[string]interface{}, len(sd.values))
+	for key := range sd.values {
+		sd.expireKey(key)
+	}
+	for key, val := range sd.values {
+		val = s.resolveBlob(sd, key, val)
+		if b, ok := val.([]byte); ok {
+			val = append([]byte(nil), b...)
+		}
+		values[key] = val
+	}
+	return values
+}
+
+// CopyInto copies the values for the given keys from the session data in
+// srcCtx into the session data in dstCtx, replacing any existing values, for
+// example to merge a guest session into the session of a user who has just
+// logged in. If no keys are given, all of the keys which don't begin with "__"
+// are copied. Keys which aren't present in the source are skipped, and a TTL
+// set with PutWithTTL is copied along with its key. Values offloaded with
+// BlobThreshold are fetched, and []byte values are copied, so the two sessions
+// don't share any data held in the store. The source session data isn't
+// changed. If any keys are copied, the destination session data status will be
+// set to Modified.
+//
+// As with Put, if copying a key would exceed the MaxKeys limit then it is not
+// copied, and ErrTooManyKeys will be returned by the next call to Commit for
+// the destination.
+func (s *SessionManager) CopyInto(srcCtx, dstCtx context.Context, keys ...string) {
+	src := s.getSessionDataFromContext(srcCtx)
+	dst := s.getSessionDataFromContext(dstCtx)
+	if src == dst {
+		return
+	}
+
+	src.mu.Lock()
+	values := make(map[string]interface{})
+	ttls := make(map[string]int64)
+	now := time.Now().UnixNano()
+	if len(keys) == 0 {
+		for key := range src.values {
+			if !isReservedKey(key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	for _, key := range keys {
+		val, ok := src.values[key]
+		if !ok {
+			continue
+		}
+		if expiry, ok := src.values[ttlKey(key)].(int64); ok {
+			if now >= expiry {
+				continue
+			}
+			ttls[key] = expiry
+		}
+		val = s.resolveBlob(src, key, val)
+		if b, ok := val.([]byte); ok {
+			val = append([]byte(nil), b...)
+		}
+		values[key] = val
+	}
+	err := src.err
+	src.mu.Unlock()
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	if err != nil {
+		dst.err = err
+		return
+	}
+	for key, val := range values {
+		if !s.hasRoomFor(dst, key) {
+			dst.err = ErrTooManyKeys
+			continue
+		}
+		dst.values[key] = val
+		if expiry, ok := ttls[key]; ok {
+			dst.values[ttlKey(key)] = expiry
+		} else {
+			delete(dst.values, ttlKey(key))
+		}
+		delete(dst.transient, key)
+		dst.status = Modified
+		dst.written = true
 	}
-
-	return sd.token, expiry, nil
 }
 
-// Destroy deletes the session data from the session store and sets the session
-// status to Destroyed. Any further operations in the same request cycle will
-// result in a new session being created.
-func (s *SessionManager) Destroy(ctx context.Context) error {
+// Replace swaps the session data values for the given keys and values in a
+// single operation, so that afterwards exactly the given keys are present.
+// Reserved keys (those beginning with "__", such as the ones used by
+// PutWithTTL and RememberMe) are preserved unless they are included in values,
+// although the TTL for a key which is no longer present is dropped. If the
+// result would exceed the MaxKeys limit then ErrTooManyKeys is returned and
+// the session data is left unchanged. Otherwise the session data status will
+// be set to Modified.
+func (s *SessionManager) Replace(ctx context.Context, values map[string]interface{}) error {
 	sd := s.getSessionDataFromContext(ctx)
 
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
-	err := s.Store.Delete(sd.token)
-	if err != nil {
-		return err
+	replaced := make(map[string]interface{}, len(values))
+	for key, val := range values {
+		replaced[key] = val
+	}
+	for key, val := range sd.values {
+		if _, ok := replaced[key]; ok || !isReservedKey(key) {
+			continue
+		}
+		if strings.HasPrefix(key, ttlKey("")) {
+			if _, ok := replaced[strings.TrimPrefix(key, ttlKey(""))]; !ok {
+				continue
+			}
+		}
+		replaced[key] = val
 	}
 
-	sd.status = Destroyed
-
-	// Reset everything else to defaults.
-	sd.token = ""
-	sd.deadline = time.Now().Add(s.Lifetime).UTC()
-	for key := range sd.values {
-		delete(sd.values, key)
+	if s.MaxKeys > 0 && countKeys(replaced) > s.MaxKeys {
+		return ErrTooManyKeys
 	}
 
+	sd.values = replaced
+	sd.status = Modified
+	sd.written = true
+
 	return nil
 }
 
-// Put adds a key and corresponding value to the session data. Any existing
-// value for the key will be replaced. The session data status will be set to
-// Modified.
-func (s *SessionManager) Put(ctx context.Context, key string, val interface{}) {
+// Increment adds delta to the int64 value for a given key in the session data
+// and returns the new value. If the key does not exist, or its value is not an
+// int64, it is treated as zero. The session data status will be set to
+// Modified. The read, update and write happen atomically with respect to other
+// operations on the same session data.
+func (s *SessionManager) Increment(ctx context.Context, key string, delta int64) int64 {
 	sd := s.getSessionDataFromContext(ctx)
 
 	sd.mu.Lock()
-	sd.values[key] = val
+	defer sd.mu.Unlock()
+
+	if !s.hasRoomFor(sd, key) {
+		sd.err = ErrTooManyKeys
+		return 0
+	}
+
+	i, _ := sd.values[key].(int64)
+	i += delta
+	sd.values[key] = i
 	sd.status = Modified
-	sd.mu.Unlock()
+	sd.written = true
+
+	return i
+}
+
+// Decrement subtracts delta from the int64 value for a given key in the session
+// data and returns the new value. It is a convenience wrapper around Increment.
+func (s *SessionManager) Decrement(ctx context.Context, key string, delta int64) int64 {
+	return s.Increment(ctx, key, -delta)
 }
 
-// Get returns the value for a given key from the session data. The return
-// value has the type interface{} so will usually need to be type asserted
+// Get returns the value for a given key from the session data, or the default
+// registered with SetDefault if the key is not present. The return value has
+// the type interface{} so will usually need to be type asserted
 // before you can use it. For example:
 //
 //	foo, ok := session.Get(r, "foo").(string)
@@ -177,27 +1424,90 @@ func (s *SessionManager) Get(ctx context.Context, key string) interface{} {
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
-	return sd.values[key]
+	sd.accessed = true
+	if val, ok := sd.transient[key]; ok {
+		return val
+	}
+	sd.expireKey(key)
+	val, ok := sd.values[key]
+	if !ok {
+		return s.defaultValue(key)
+	}
+	return s.resolveBlob(sd, key, val)
+}
+
+// storedValue returns the value stored under the given key in the session
+// data. Unlike Get it ignores defaults registered with SetDefault and doesn't
+// record the read, so it's used for the checks scs makes itself.
+func (s *SessionManager) storedValue(ctx context.Context, key string) interface{} {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if expiry, ok := sd.values[ttlKey(key)].(int64); ok && time.Now().UnixNano() >= expiry {
+		return nil
+	}
+	return s.resolveBlob(sd, key, sd.values[key])
+}
+
+// Peek returns the value for a given key from the session data, like Get, but
+// without any side effects: the read isn't recorded by StatusDetail, and a key
+// whose TTL has passed is reported as missing but not removed, so the session
+// data status is never changed. It's intended for observability and
+// background checks which shouldn't count as session activity.
+//
+// Note that when an IdleTimeout is set, the LoadAndSave middleware extends the
+// idle expiry for every request which loads the session, whether or not the
+// session data is read. To stop background requests from keeping sessions
+// alive, exclude them from session handling with SkipFunc and load the session
+// data with Load instead.
+func (s *SessionManager) Peek(ctx context.Context, key string) interface{} {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if val, ok := sd.transient[key]; ok {
+		return val
+	}
+	if expiry, ok := sd.values[ttlKey(key)].(int64); ok && time.Now().UnixNano() >= expiry {
+		return s.defaultValue(key)
+	}
+	val, ok := sd.values[key]
+	if !ok {
+		return s.defaultValue(key)
+	}
+	return s.resolveBlob(sd, key, val)
 }
 
 // Pop acts like a one-time Get. It returns the value for a given key from the
 // session data and deletes the key and value from the session data. The
 // session data status will be set to Modified. The return value has the type
 // interface{} so will usually need to be type asserted before you can use it.
+// If the key was added with PutTransient, only the transient value is deleted
+// and the status is unchanged.
 func (s *SessionManager) Pop(ctx context.Context, key string) interface{} {
 	sd := s.getSessionDataFromContext(ctx)
 
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
+	if val, ok := sd.transient[key]; ok {
+		delete(sd.transient, key)
+		return val
+	}
+	sd.expireKey(key)
 	val, exists := sd.values[key]
 	if !exists {
 		return nil
 	}
 	delete(sd.values, key)
+	delete(sd.values, ttlKey(key))
 	sd.status = Modified
+	sd.written = true
 
-	return val
+	return s.resolveBlob(sd, key, val)
 }
 
 // Remove deletes the given key and corresponding value from the session data.
@@ -209,13 +1519,16 @@ func (s *SessionManager) Remove(ctx context.Context, key string) {
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
+	delete(sd.transient, key)
 	_, exists := sd.values[key]
 	if !exists {
 		return
 	}
 
 	delete(sd.values, key)
+	delete(sd.values, ttlKey(key))
 	sd.status = Modified
+	sd.written = true
 }
 
 // Clear removes all data for the current session. The session token and
@@ -227,6 +1540,7 @@ func (s *SessionManager) Clear(ctx context.Context) error {
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
+	sd.transient = nil
 	if len(sd.values) == 0 {
 		return nil
 	}
@@ -235,6 +1549,7 @@ func (s *SessionManager) Clear(ctx context.Context) error {
 		delete(sd.values, key)
 	}
 	sd.status = Modified
+	sd.written = true
 	return nil
 }
 
@@ -243,7 +1558,12 @@ func (s *SessionManager) Exists(ctx context.Context, key string) bool {
 	sd := s.getSessionDataFromContext(ctx)
 
 	sd.mu.Lock()
-	_, exists := sd.values[key]
+	sd.accessed = true
+	_, exists := sd.transient[key]
+	if !exists {
+		sd.expireKey(key)
+		_, exists = sd.values[key]
+	}
 	sd.mu.Unlock()
 
 	return exists
@@ -256,6 +1576,10 @@ func (s *SessionManager) Keys(ctx context.Context) []string {
 	sd := s.getSessionDataFromContext(ctx)
 
 	sd.mu.Lock()
+	sd.accessed = true
+	for key := range sd.values {
+		sd.expireKey(key)
+	}
 	keys := make([]string, len(sd.values))
 	i := 0
 	for key := range sd.values {
@@ -284,23 +1608,284 @@ func (s *SessionManager) RenewToken(ctx context.Context) error {
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
-	err := s.Store.Delete(sd.token)
+	return s.renewToken(ctx, sd)
+}
+
+// renewToken deletes the session data for the current session token from the
+// session store, using the transaction in ctx if there is one, and replaces
+// the token with a new one. The caller must hold sd.mu.
+func (s *SessionManager) renewToken(ctx context.Context, sd *sessionData) error {
+	store, _, err := s.storeForContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	release, err := s.acquireStore()
 	if err != nil {
 		return err
 	}
+	defer release()
+
+	sd.fieldCache = nil
+	if err := s.removeFromIndex(sd); err != nil {
+		return err
+	}
+	if err := s.deleteStoreKey(store, s.storeKey(sd.token)); err != nil {
+		return err
+	}
+	if err := s.deleteStaleStoreKey(store, sd); err != nil {
+		return err
+	}
 
-	newToken, err := generateToken()
+	newToken, err := s.generateToken()
 	if err != nil {
 		return err
 	}
 
 	sd.token = newToken
-	sd.deadline = time.Now().Add(s.Lifetime).UTC()
+	sd.deadline = time.Now().Add(s.getLifetime()).UTC()
+	if expireAt, ok := sd.values[expireAtKey].(int64); ok {
+		sd.deadline = time.Unix(0, expireAt).UTC()
+	}
+	delete(sd.values, reauthenticateKey)
 	sd.status = Modified
+	sd.written = true
+
+	return nil
+}
+
+// Promote turns a guest session into one for a user who has just logged in.
+// The session token is renewed with RenewToken, to prevent session fixation,
+// and then every key except those listed in PromoteKeys (and their TTLs) is
+// removed, so that values seeded into the guest session can't carry over
+// into the logged-in one. Reserved keys, which hold the state scs keeps for
+// itself such as the MaxLifetime creation time and the PublicID, are kept
+// too. Call it before adding the user's identity to the session data. The
+// session data status will be set to Modified.
+func (s *SessionManager) Promote(ctx context.Context) error {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if err := s.renewToken(ctx, sd); err != nil {
+		return err
+	}
 
+	keep := make(map[string]bool, 2*len(s.PromoteKeys))
+	for _, key := range s.PromoteKeys {
+		keep[key] = true
+		keep[ttlKey(key)] = true
+	}
+	for key := range sd.values {
+		if keep[key] || (isReservedKey(key) && !strings.HasPrefix(key, ttlKey(""))) {
+			continue
+		}
+		delete(sd.values, key)
+	}
+	sd.transient = nil
 	return nil
 }
 
+// Deadline returns the absolute expiry time of the session data, capped by
+// MaxLifetime. The session will expire at this time regardless of activity,
+// although it may expire sooner if an idle timeout is being used.
+func (s *SessionManager) Deadline(ctx context.Context) time.Time {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return s.cappedDeadline(sd)
+}
+
+// Expiry returns the time at which the session data will expire from the
+// session store if it is committed now, taking into account both the absolute
+// Lifetime and the IdleTimeout. This is the same expiry time that Commit and
+// the LoadAndSave middleware use, so it can be used to tell the client when
+// the session will expire, and it takes MaxLifetime into account even before
+// the session data has first been committed. Nothing is committed to the
+// store.
+func (s *SessionManager) Expiry(ctx context.Context) time.Time {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return s.expiry(sd)
+}
+
+// IdleRemaining returns how long the session has left before it expires
+// because of inactivity, measured from when the session data was loaded in the
+// current request. It is never negative. If no IdleTimeout is set the idle
+// timeout can't be reached, so the same value as AbsoluteRemaining is returned.
+// Together with AbsoluteRemaining, it can be used to warn users before their
+// session expires.
+func (s *SessionManager) IdleRemaining(ctx context.Context) time.Duration {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	idle, _ := s.remaining(sd, time.Now())
+	return idle
+}
+
+// AbsoluteRemaining returns how long the session has left before it reaches
+// its absolute deadline (see Deadline), regardless of activity. It is never
+// negative.
+func (s *SessionManager) AbsoluteRemaining(ctx context.Context) time.Duration {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	_, absolute := s.remaining(sd, time.Now())
+	return absolute
+}
+
+// Remaining returns the smaller of IdleRemaining and AbsoluteRemaining, which
+// is how long the session has left if the user isn't active again before then.
+func (s *SessionManager) Remaining(ctx context.Context) time.Duration {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	idle, absolute := s.remaining(sd, time.Now())
+	if idle < absolute {
+		return idle
+	}
+	return absolute
+}
+
+// remaining returns the time left at now before the session expires because of
+// inactivity and before it reaches its absolute deadline. The idle value is
+// capped at the absolute value. The caller must hold sd.mu.
+func (s *SessionManager) remaining(sd *sessionData, now time.Time) (idle, absolute time.Duration) {
+	absolute = s.cappedDeadline(sd).Sub(now)
+	if absolute < 0 {
+		absolute = 0
+	}
+
+	idle = absolute
+	if idleTimeout := s.getIdleTimeout(); idleTimeout > 0 {
+		if d := sd.loadedAt.Add(idleTimeout).Sub(now); d < idle {
+			idle = d
+		}
+		if idle < 0 {
+			idle = 0
+		}
+	}
+	return idle, absolute
+}
+
+// reauthenticateKey is the session data key used to record that Reauthenticate
+// has been called for the session.
+const reauthenticateKey = "__reauthenticate"
+
+// Reauthenticate shortens the lifetime of the session so that it expires no
+// later than the given duration from now, and marks the session as requiring
+// reauthentication (see ReauthenticationRequired). This is useful after a user
+// performs a sensitive action and you want to force them to log in again
+// sooner than usual. If the session deadline is already earlier, it is not
+// changed. The session data status will be set to Modified.
+//
+// The flag is cleared when the session token is renewed with RenewToken, which
+// you should do when the user logs in again.
+func (s *SessionManager) Reauthenticate(ctx context.Context, within time.Duration) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	deadline := time.Now().Add(within).UTC()
+	if deadline.Before(sd.deadline) {
+		sd.deadline = deadline
+	}
+	sd.values[reauthenticateKey] = true
+	sd.status = Modified
+	sd.written = true
+}
+
+// expireAtKey is the session data key used to record the time set with
+// ExpireAt, as a Unix time in nanoseconds.
+const expireAtKey = "__expireAt"
+
+// ExpireAt sets the absolute deadline of the session to the given time, so
+// that it expires at that instant regardless of the Lifetime, for example at
+// the end of a timed trial. The deadline can be moved later or earlier, but is
+// still capped by MaxLifetime, and the session may expire sooner if an idle
+// timeout is being used. The store expiry time and the session cookie follow
+// the new deadline when the session data is committed. The time is kept when
+// the session token is renewed with RenewToken. If t has already passed, the
+// session will be treated as expired when it is next loaded. The session data
+// status will be set to Modified.
+func (s *SessionManager) ExpireAt(ctx context.Context, t time.Time) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	// Record the creation time before the deadline changes, because it is
+	// derived from the deadline for sessions which don't have one yet.
+	if s.MaxLifetime > 0 {
+		s.capDeadline(sd)
+	}
+	sd.deadline = t.UTC()
+	sd.values[expireAtKey] = t.UnixNano()
+	if s.MaxLifetime > 0 {
+		s.capDeadline(sd)
+	}
+	sd.status = Modified
+	sd.written = true
+}
+
+// ReauthenticationRequired returns true if Reauthenticate has been called for
+// the session since the session token was last renewed.
+func (s *SessionManager) ReauthenticationRequired(ctx context.Context) bool {
+	required, _ := s.storedValue(ctx, reauthenticateKey).(bool)
+	return required
+}
+
+// publicIDKey is the session data key used to store the public ID of the
+// session.
+const publicIDKey = "__publicID"
+
+// PublicID returns a random identifier for the session which, unlike the
+// session token, isn't a credential and is safe to log or show to the user,
+// for example so that support staff can find the session in logs or admin
+// tools. The public ID stays the same when the session token is renewed with
+// RenewToken, but a new one is generated if the session is destroyed.
+//
+// The public ID is generated the first time PublicID is called for the session,
+// in which case the session data status will be set to Modified so that it is
+// saved. If it can't be generated an empty string is returned, and the error
+// is returned by the next call to Commit.
+func (s *SessionManager) PublicID(ctx context.Context) string {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	sd.accessed = true
+	if id, ok := sd.values[publicIDKey].(string); ok {
+		return id
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		sd.err = err
+		return ""
+	}
+	id := hex.EncodeToString(b)
+
+	sd.values[publicIDKey] = id
+	sd.status = Modified
+	sd.written = true
+	return id
+}
+
 // Status returns the current status of the session data.
 func (s *SessionManager) Status(ctx context.Context) Status {
 	sd := s.getSessionDataFromContext(ctx)
@@ -308,9 +1893,43 @@ func (s *SessionManager) Status(ctx context.Context) Status {
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
+	return s.status(sd)
+}
+
+// status returns the status of the session data, taking FinalDestroy into
+// account. The caller must hold sd.mu.
+func (s *SessionManager) status(sd *sessionData) Status {
+	if s.FinalDestroy && sd.destroyed {
+		return Destroyed
+	}
 	return sd.status
 }
 
+// StatusDetail returns a detailed breakdown of the current status of the
+// session data. Unlike Status, it does not panic if there is no session data in
+// the context; it returns DetailNotLoaded instead.
+func (s *SessionManager) StatusDetail(ctx context.Context) StatusDetail {
+	sd, ok := ctx.Value(s.contextKey).(*sessionData)
+	if !ok {
+		return DetailNotLoaded
+	}
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	switch {
+	case s.status(sd) == Destroyed:
+		return DetailDestroyed
+	case sd.written && (sd.token != sd.loadedToken || !sd.deadline.Equal(sd.loadedDeadline) || !reflect.DeepEqual(sd.values, sd.loaded)):
+		return DetailModified
+	case sd.written:
+		return DetailReverted
+	case sd.accessed:
+		return DetailReadOnly
+	}
+	return DetailUntouched
+}
+
 // GetString returns the string value for a given key from the session data.
 // The zero value for a string ("") is returned if the key does not exist or the
 // value could not be type asserted to a string.
@@ -470,7 +2089,62 @@ func (s *SessionManager) RememberMe(ctx context.Context, val bool) {
 	s.Put(ctx, "__rememberMe", val)
 }
 
+// hasRoomFor reports whether the key can be stored in the session data without
+// exceeding the MaxKeys limit. The caller must hold sd.mu.
+func (s *SessionManager) hasRoomFor(sd *sessionData, key string) bool {
+	if s.MaxKeys <= 0 || isReservedKey(key) {
+		return true
+	}
+	if _, exists := sd.values[key]; exists {
+		return true
+	}
+	return countKeys(sd.values) < s.MaxKeys
+}
+
+// countKeys returns the number of keys in values which count towards the
+// MaxKeys limit, which excludes reserved keys.
+func countKeys(values map[string]interface{}) int {
+	n := 0
+	for key := range values {
+		if !isReservedKey(key) {
+			n++
+		}
+	}
+	return n
+}
+
+// notifyIdentityChange calls the OnIdentityChange hook if the value for the
+// IdentityKey has changed since the session data was loaded or last committed.
+func (s *SessionManager) notifyIdentityChange(ctx context.Context) {
+	if s.IdentityKey == "" || s.OnIdentityChange == nil {
+		return
+	}
+
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	oldID, newID := sd.identity, sd.values[s.IdentityKey]
+	if reflect.DeepEqual(oldID, newID) {
+		sd.mu.Unlock()
+		return
+	}
+	sd.identity = newID
+	sd.mu.Unlock()
+
+	s.OnIdentityChange(ctx, oldID, newID)
+}
+
+// ContextKey returns the key used to store this session manager's session data
+// in a context.Context. The value is opaque but comparable, and is unique to
+// each session manager created with New. Most applications will not need to
+// use this; it's intended for advanced cases like propagating session data
+// between contexts.
+func (s *SessionManager) ContextKey() interface{} {
+	return s.contextKey
+}
+
 func (s *SessionManager) addSessionDataToContext(ctx context.Context, sd *sessionData) context.Context {
+	sd.manager = s
 	return context.WithValue(ctx, s.contextKey, sd)
 }
 
@@ -482,6 +2156,138 @@ func (s *SessionManager) getSessionDataFromContext(ctx context.Context) *session
 	return c
 }
 
+// isReservedKey reports whether the given session data key is reserved for use
+// by this package.
+func isReservedKey(key string) bool {
+	return strings.HasPrefix(key, "__")
+}
+
+// ttlKey returns the session data key used to hold the expiry time (in Unix
+// nanoseconds) for a key added with PutWithTTL.
+func ttlKey(key string) string {
+	return "__ttl:" + key
+}
+
+// expireKey removes the given key and its TTL from the session data if the key
+// has a TTL which has passed. The caller must hold sd.mu.
+func (sd *sessionData) expireKey(key string) {
+	expiry, ok := sd.values[ttlKey(key)].(int64)
+	if !ok || time.Now().UnixNano() < expiry {
+		return
+	}
+	delete(sd.values, key)
+	delete(sd.values, ttlKey(key))
+	sd.status = Modified
+	sd.written = true
+}
+
+// storeKey returns the key used for the given session token in the session
+// store. This is the hex-encoded HMAC-SHA256 of the token using the current
+// StoreKeyPepper key if set, the hex-encoded SHA-256 hash of the token if
+// HashStoreKeys is enabled, or otherwise the token itself.
+func (s *SessionManager) storeKey(token string) string {
+	return s.storeKeys(token)[0]
+}
+
+// storeKeys returns the keys that session data for the given session token may
+// be stored under in the session store, starting with the current store key.
+// There is more than one only if StoreKeyPepper contains older keys.
+func (s *SessionManager) storeKeys(token string) []string {
+	if token == "" || (!s.HashStoreKeys && s.StoreKeyPepper == nil) {
+		return []string{token}
+	}
+	if _, ok := s.getStore().(StatelessStore); ok {
+		return []string{token}
+	}
+
+	if s.StoreKeyPepper != nil && len(s.StoreKeyPepper.All()) > 0 {
+		peppers := s.StoreKeyPepper.All()
+		keys := make([]string, len(peppers))
+		for i, pepper := range peppers {
+			keys[i] = hex.EncodeToString(sign(pepper, []byte(token)))
+		}
+		return keys
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return []string{hex.EncodeToString(sum[:])}
+}
+
+// find looks up the session data for the given session token under each of
+// its store keys in turn, and returns it along with the store key it was found
+// under. If refreshExpiry is not zero, the store must implement
+// RefreshingStore, and the expiry time of the session data is updated. If a
+// tombstone is found instead, it is returned with found set to false.
+func (s *SessionManager) find(store Store, token string, refreshExpiry time.Time) (string, []byte, bool, error) {
+	release, err := s.acquireStore()
+	if err != nil {
+		return "", nil, false, err
+	}
+	defer release()
+
+	for _, key := range s.storeKeys(token) {
+		var (
+			b     []byte
+			found bool
+			err   error
+		)
+		if refreshExpiry.IsZero() {
+			b, found, err = store.Find(key)
+		} else {
+			b, found, err = store.(RefreshingStore).FindAndRefresh(key, refreshExpiry)
+		}
+		if err != nil {
+			return "", nil, false, err
+		} else if isTombstone(b) {
+			return "", b, false, nil
+		} else if found {
+			return key, b, true, nil
+		}
+	}
+	return "", nil, false, nil
+}
+
+// tombstone is committed to the store in place of the session data for a
+// token which has been deleted when TombstoneTTL is set. The leading zero byte
+// means that it can't be mistaken for the output of GobCodec, and it doesn't
+// start with codecEnvelopeMagic.
+var tombstone = []byte("\x00tombstone")
+
+func isTombstone(b []byte) bool {
+	return bytes.Equal(b, tombstone) || isRevoked(b)
+}
+
+// deleteStoreKey deletes the session data stored under the given store key or,
+// if TombstoneTTL is set, replaces it with a tombstone which expires after
+// TombstoneTTL.
+func (s *SessionManager) deleteStoreKey(store Store, key string) error {
+	if _, ok := store.(StatelessStore); s.TombstoneTTL <= 0 || ok || key == "" {
+		return store.Delete(key)
+	}
+	return store.Commit(key, tombstone, time.Now().Add(s.TombstoneTTL).UTC())
+}
+
+// deleteStaleStoreKey deletes the session data stored under a stale store key,
+// if there is one. The caller must hold sd.mu.
+func (s *SessionManager) deleteStaleStoreKey(store Store, sd *sessionData) error {
+	if sd.staleStoreKey == "" {
+		return nil
+	}
+	if err := store.Delete(sd.staleStoreKey); err != nil {
+		return err
+	}
+	sd.staleStoreKey = ""
+	return nil
+}
+
+// generateToken returns a new session token using the TokenGenerator, if set.
+func (s *SessionManager) generateToken() (string, error) {
+	if s.TokenGenerator != nil {
+		return s.TokenGenerator()
+	}
+	return generateToken()
+}
+
 func generateToken() (string, error) {
 	b := make([]byte, 32)
 	_, err := rand.Read(b)
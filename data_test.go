@@ -3,12 +3,18 @@ package scs
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gaconkzk/scs/v2/memstore"
 	"github.com/gaconkzk/scs/v2/mockstore"
 )
 
@@ -25,6 +31,47 @@ func TestSessionDataFromContext(t *testing.T) {
 	s.getSessionDataFromContext(context.Background())
 }
 
+func TestContextKey(t *testing.T) {
+	t.Parallel()
+
+	s1 := New()
+	s2 := New()
+
+	if s1.ContextKey() != s1.ContextKey() {
+		t.Errorf("got %v: expected %v", s1.ContextKey(), s1.ContextKey())
+	}
+	if s1.ContextKey() == s2.ContextKey() {
+		t.Errorf("got %v: expected keys to be different", s1.ContextKey())
+	}
+
+	ctx, err := s1.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctx.Value(s1.ContextKey()).(*sessionData); !ok {
+		t.Error("sessionData not present in context under ContextKey")
+	}
+}
+
+func TestContextKeyCollision(t *testing.T) {
+	t.Parallel()
+
+	s1 := New()
+	ctx, err := s1.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s2 := *s1
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("the code did not panic")
+		}
+	}()
+	s2.Load(ctx, "")
+}
+
 func TestSessionManager_Load(T *testing.T) {
 	T.Parallel()
 
@@ -194,6 +241,66 @@ func TestSessionManager_Load(T *testing.T) {
 	})
 }
 
+func TestClockSkew(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.ClockSkew = time.Minute
+
+	commit := func(deadline time.Time) string {
+		b, err := s.Codec.Encode(deadline, map[string]interface{}{"foo": "bar"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := generateToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Simulate a store whose clock is behind ours.
+		if err := s.Store.Commit(token, b, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	ctx, err := s.Load(context.Background(), commit(time.Now().Add(-30*time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GetString(ctx, "foo") != "bar" {
+		t.Errorf("got %q: expected session inside skew window to be found", s.GetString(ctx, "foo"))
+	}
+
+	ctx, err = s.Load(context.Background(), commit(time.Now().Add(-90*time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists(ctx, "foo") {
+		t.Error("got session outside skew window: expected it to be expired")
+	}
+
+	ctx, err = s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	s.Store = &mockstore.MockStore{}
+	sd := s.getSessionDataFromContext(ctx)
+	sd.token = "example"
+	b, err := s.Codec.Encode(sd.deadline, sd.values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Store.(*mockstore.MockStore).ExpectCommit("example", b, sd.deadline.Add(time.Minute), nil)
+	_, expiry, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiry.Equal(sd.deadline) {
+		t.Errorf("got %v: expected %v", expiry, sd.deadline)
+	}
+}
+
 func TestSessionManager_Commit(T *testing.T) {
 	T.Parallel()
 
@@ -316,81 +423,159 @@ func TestSessionManager_Commit(T *testing.T) {
 	})
 }
 
-func TestPut(t *testing.T) {
+func TestOnIdentityChange(t *testing.T) {
 	t.Parallel()
 
+	type change struct {
+		oldID, newID interface{}
+	}
+
 	s := New()
-	sd := newSessionData(time.Hour)
-	ctx := s.addSessionDataToContext(context.Background(), sd)
+	s.IdentityKey = "userID"
+	var changes []change
+	s.OnIdentityChange = func(ctx context.Context, oldID, newID interface{}) {
+		changes = append(changes, change{oldID, newID})
+	}
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	s.Put(ctx, "foo", "bar")
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("got %v: expected no changes", changes)
+	}
 
-	if sd.values["foo"] != "bar" {
-		t.Errorf("got %q: expected %q", sd.values["foo"], "bar")
+	s.Put(ctx, "userID", 1)
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if sd.status != Modified {
-		t.Errorf("got %v: expected %v", sd.status, "modified")
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "userID", 2)
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Remove(ctx, "userID")
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Put(ctx, "userID", 3)
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []change{{nil, 1}, {1, 2}, {2, nil}, {nil, 3}, {3, nil}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("got %v: expected %v", changes, expected)
 	}
 }
 
-func TestGet(t *testing.T) {
+func TestFlushStore(t *testing.T) {
 	t.Parallel()
 
 	s := New()
-	sd := newSessionData(time.Hour)
-	sd.values["foo"] = "bar"
-	ctx := s.addSessionDataToContext(context.Background(), sd)
 
-	str, ok := s.Get(ctx, "foo").(string)
-	if !ok {
-		t.Errorf("could not convert %T to string", s.Get(ctx, "foo"))
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		ctx, err := s.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put(ctx, "foo", i)
+		token, _, err := s.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
 	}
 
-	if str != "bar" {
-		t.Errorf("got %q: expected %q", str, "bar")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Flush(canceled); err != context.Canceled {
+		t.Errorf("got %v: expected %v", err, context.Canceled)
+	}
+
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range tokens {
+		ctx, err := s.Load(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Exists(ctx, "foo") {
+			t.Errorf("got %v: expected session for token %q to be flushed", true, token)
+		}
+	}
+
+	s.Store = &mockstore.MockStore{}
+	if err := s.Flush(context.Background()); err != ErrFlushNotSupported {
+		t.Errorf("got %v: expected %v", err, ErrFlushNotSupported)
 	}
 }
 
-func TestPop(t *testing.T) {
+func TestStoreExpiry(t *testing.T) {
 	t.Parallel()
 
 	s := New()
-	sd := newSessionData(time.Hour)
-	sd.values["foo"] = "bar"
-	ctx := s.addSessionDataToContext(context.Background(), sd)
+	s.IdleTimeout = time.Hour
 
-	str, ok := s.Pop(ctx, "foo").(string)
-	if !ok {
-		t.Errorf("could not convert %T to string", s.Get(ctx, "foo"))
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	if str != "bar" {
-		t.Errorf("got %q: expected %q", str, "bar")
+	s.Put(ctx, "foo", "bar")
+	token, expiry, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	_, ok = sd.values["foo"]
-	if ok {
-		t.Errorf("got %v: expected %v", ok, false)
+	got, found, err := s.StoreExpiry(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Errorf("got %v: expected %v", found, true)
+	}
+	if !got.Equal(expiry) {
+		t.Errorf("got %v: expected %v", got, expiry)
 	}
 
-	if sd.status != Modified {
-		t.Errorf("got %v: expected %v", sd.status, "modified")
+	s.Store = &mockstore.MockStore{}
+	if _, _, err := s.StoreExpiry(token); err != ErrExpiryNotSupported {
+		t.Errorf("got %v: expected %v", err, ErrExpiryNotSupported)
 	}
 }
 
-func TestRemove(t *testing.T) {
+func TestPut(t *testing.T) {
 	t.Parallel()
 
 	s := New()
 	sd := newSessionData(time.Hour)
-	sd.values["foo"] = "bar"
 	ctx := s.addSessionDataToContext(context.Background(), sd)
 
-	s.Remove(ctx, "foo")
+	s.Put(ctx, "foo", "bar")
 
-	if sd.values["foo"] != nil {
-		t.Errorf("got %v: expected %v", sd.values["foo"], nil)
+	if sd.values["foo"] != "bar" {
+		t.Errorf("got %q: expected %q", sd.values["foo"], "bar")
 	}
 
 	if sd.status != Modified {
@@ -398,145 +583,676 @@ func TestRemove(t *testing.T) {
 	}
 }
 
-func TestClear(t *testing.T) {
+func TestPutMaxKeys(t *testing.T) {
 	t.Parallel()
 
 	s := New()
+	s.MaxKeys = 2
 	sd := newSessionData(time.Hour)
-	sd.values["foo"] = "bar"
-	sd.values["baz"] = "boz"
 	ctx := s.addSessionDataToContext(context.Background(), sd)
 
-	if err := s.Clear(ctx); err != nil {
-		t.Errorf("unexpected error encountered clearing session: %v", err)
-	}
+	s.Put(ctx, "foo", "bar")
+	s.Put(ctx, "baz", "boz")
+	s.Put(ctx, "foo", "qux")
 
-	if sd.values["foo"] != nil {
-		t.Errorf("got %v: expected %v", sd.values["foo"], nil)
+	if sd.err != nil {
+		t.Errorf("got %v: expected %v", sd.err, nil)
+	}
+	if sd.values["foo"] != "qux" {
+		t.Errorf("got %q: expected %q", sd.values["foo"], "qux")
 	}
 
-	if sd.values["baz"] != nil {
-		t.Errorf("got %v: expected %v", sd.values["baz"], nil)
+	s.Put(ctx, "woo", "waa")
+
+	if _, ok := sd.values["woo"]; ok {
+		t.Errorf("got %v: expected %v", ok, false)
+	}
+	if _, _, err := s.Commit(ctx); err != ErrTooManyKeys {
+		t.Errorf("got %v: expected %v", err, ErrTooManyKeys)
 	}
 
-	if sd.status != Modified {
-		t.Errorf("got %v: expected %v", sd.status, "modified")
+	// Reserved keys added by other features don't count towards the limit.
+	sd = newSessionData(time.Hour)
+	ctx = s.addSessionDataToContext(context.Background(), sd)
+	s.PublicID(ctx)
+	s.Reauthenticate(ctx, time.Hour)
+	s.PutWithTTL(ctx, "foo", "bar", time.Hour)
+	s.Put(ctx, "baz", "boz")
+	if sd.err != nil {
+		t.Errorf("got %v: expected %v", sd.err, nil)
+	}
+	if err := s.PutAll(ctx, map[string]interface{}{"foo": "qux", "baz": "woo"}); err != nil {
+		t.Errorf("got %v: expected %v", err, nil)
+	}
+	if err := s.Replace(ctx, map[string]interface{}{"foo": "bar", "baz": "boz"}); err != nil {
+		t.Errorf("got %v: expected %v", err, nil)
 	}
 }
 
-func TestExists(t *testing.T) {
+func TestPutAll(t *testing.T) {
 	t.Parallel()
 
 	s := New()
+	s.MaxKeys = 2
 	sd := newSessionData(time.Hour)
 	sd.values["foo"] = "bar"
 	ctx := s.addSessionDataToContext(context.Background(), sd)
 
-	if !s.Exists(ctx, "foo") {
-		t.Errorf("got %v: expected %v", s.Exists(ctx, "foo"), true)
+	err := s.PutAll(ctx, map[string]interface{}{"foo": "qux", "baz": "boz"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if sd.values["foo"] != "qux" || sd.values["baz"] != "boz" {
+		t.Errorf("got %v: expected %v", sd.values, map[string]interface{}{"foo": "qux", "baz": "boz"})
+	}
+	if sd.status != Modified {
+		t.Errorf("got %v: expected %v", sd.status, "modified")
 	}
 
-	if s.Exists(ctx, "baz") {
-		t.Errorf("got %v: expected %v", s.Exists(ctx, "baz"), false)
+	err = s.PutAll(ctx, map[string]interface{}{"foo": "bar", "woo": "waa"})
+	if err != ErrTooManyKeys {
+		t.Errorf("got %v: expected %v", err, ErrTooManyKeys)
+	}
+	if sd.values["foo"] != "qux" {
+		t.Errorf("got %q: expected %q", sd.values["foo"], "qux")
+	}
+	if _, ok := sd.values["woo"]; ok {
+		t.Errorf("got %v: expected %v", ok, false)
 	}
 }
 
-func TestKeys(t *testing.T) {
+func TestTokenFormatMigration(t *testing.T) {
 	t.Parallel()
 
+	validToken := func(token string) bool {
+		if len(token) > 64 {
+			return false
+		}
+		for _, c := range token {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+		return true
+	}
+
 	s := New()
-	sd := newSessionData(time.Hour)
-	sd.values["foo"] = "bar"
-	sd.values["woo"] = "waa"
-	ctx := s.addSessionDataToContext(context.Background(), sd)
+	s.TokenValidator = validToken
 
-	keys := s.Keys(ctx)
-	if !reflect.DeepEqual(keys, []string{"foo", "woo"}) {
-		t.Errorf("got %v: expected %v", keys, []string{"foo", "woo"})
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "old")
+	oldToken, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.TokenGenerator = func() (string, error) {
+		token, err := generateToken()
+		return "v2_" + token[:16], err
+	}
+
+	ctx, err = s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "new")
+	newToken, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(newToken, "v2_") {
+		t.Errorf("got %q: expected a new-format token", newToken)
+	}
+
+	for token, expected := range map[string]string{oldToken: "old", newToken: "new"} {
+		ctx, err := s.Load(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.GetString(ctx, "foo") != expected {
+			t.Errorf("got %q: expected %q", s.GetString(ctx, "foo"), expected)
+		}
+	}
+
+	ctx, err = s.Load(context.Background(), oldToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RenewToken(ctx); err != nil {
+		t.Fatal(err)
+	}
+	renewedToken, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(renewedToken, "v2_") {
+		t.Errorf("got %q: expected a new-format token", renewedToken)
+	}
+
+	// Rejected tokens must not be passed to the store.
+	s = New()
+	s.Store = &mockstore.MockStore{}
+	s.TokenValidator = validToken
+	ctx, err = s.Load(context.Background(), "../../"+strings.Repeat("x", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Keys(ctx)) != 0 {
+		t.Errorf("got %v: expected a new session", s.Keys(ctx))
 	}
 }
 
-func TestGetString(t *testing.T) {
+func TestPeek(t *testing.T) {
 	t.Parallel()
 
 	s := New()
 	sd := newSessionData(time.Hour)
 	sd.values["foo"] = "bar"
+	sd.values["otp"] = "123456"
+	sd.values[ttlKey("otp")] = time.Now().Add(-time.Second).UnixNano()
 	ctx := s.addSessionDataToContext(context.Background(), sd)
 
-	str := s.GetString(ctx, "foo")
-	if str != "bar" {
-		t.Errorf("got %q: expected %q", str, "bar")
+	if s.Peek(ctx, "foo") != "bar" {
+		t.Errorf("got %v: expected %q", s.Peek(ctx, "foo"), "bar")
+	}
+	if s.Peek(ctx, "otp") != nil {
+		t.Errorf("got %v: expected %v", s.Peek(ctx, "otp"), nil)
+	}
+	if _, ok := sd.values["otp"]; !ok {
+		t.Errorf("got %v: expected expired key to be kept", ok)
+	}
+	if s.StatusDetail(ctx) != DetailUntouched {
+		t.Errorf("got %d: expected %d", s.StatusDetail(ctx), DetailUntouched)
 	}
 
-	str = s.GetString(ctx, "baz")
-	if str != "" {
-		t.Errorf("got %q: expected %q", str, "")
+	s.Get(ctx, "foo")
+	if s.StatusDetail(ctx) != DetailReadOnly {
+		t.Errorf("got %d: expected %d", s.StatusDetail(ctx), DetailReadOnly)
+	}
+
+	s.Get(ctx, "otp")
+	if s.Status(ctx) != Modified {
+		t.Errorf("got %d: expected %d", s.Status(ctx), Modified)
 	}
 }
 
-func TestGetBool(t *testing.T) {
+func TestGetSession(t *testing.T) {
 	t.Parallel()
 
 	s := New()
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, deadline, err := s.GetSession(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, map[string]interface{}{"foo": "bar"}) {
+		t.Errorf("got %v: expected %v", values, map[string]interface{}{"foo": "bar"})
+	}
+	if !deadline.Equal(s.Deadline(ctx)) {
+		t.Errorf("got %v: expected %v", deadline, s.Deadline(ctx))
+	}
+
+	// Session data already in the context is ignored.
+	values, _, err = s.GetSession(ctx, "missing_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values != nil {
+		t.Errorf("got %v: expected %v", values, nil)
+	}
+
 	sd := newSessionData(time.Hour)
-	sd.values["foo"] = true
-	ctx := s.addSessionDataToContext(context.Background(), sd)
+	sd.deadline = time.Now().Add(-time.Minute)
+	sd.values["foo"] = "bar"
+	expiredToken, _, err := s.commit(s.addSessionDataToContext(context.Background(), sd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, deadline, err = s.GetSession(context.Background(), expiredToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values != nil || !deadline.IsZero() {
+		t.Errorf("got %v, %v: expected an empty result", values, deadline)
+	}
 
-	b := s.GetBool(ctx, "foo")
-	if b != true {
-		t.Errorf("got %v: expected %v", b, true)
+	// Nothing is changed in the store, even when the session would be
+	// refreshed or has been invalidated by a generation bump.
+	var gen int64 = 1
+	s = New()
+	s.IdleTimeout = time.Minute
+	s.IdentityKey = "userID"
+	s.GenerationFunc = func(ctx context.Context, identity interface{}) (int64, error) {
+		return atomic.LoadInt64(&gen), nil
+	}
+	events := s.Events()
+	ctx, err = s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "userID", 1)
+	token, _, err = s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(events) > 0 {
+		<-events
+	}
+	expiry, _, err := s.StoreExpiry(token)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	b = s.GetBool(ctx, "baz")
-	if b != false {
-		t.Errorf("got %v: expected %v", b, false)
+	time.Sleep(10 * time.Millisecond)
+	if values, _, err = s.GetSession(context.Background(), token); err != nil || values["userID"] != 1 {
+		t.Fatalf("got %v, %v: expected the session values", values, err)
+	}
+	if got, _, _ := s.StoreExpiry(token); !got.Equal(expiry) {
+		t.Errorf("got %v: expected the store expiry to be unchanged at %v", got, expiry)
+	}
+
+	atomic.AddInt64(&gen, 1)
+	if values, _, err = s.GetSession(context.Background(), token); err != nil || values != nil {
+		t.Errorf("got %v, %v: expected an empty result", values, err)
+	}
+	if _, found, _ := s.Store.Find(token); !found {
+		t.Errorf("got %v: expected the session data to be left in the store", found)
+	}
+	if len(events) != 0 {
+		t.Errorf("got %d: expected no events", len(events))
 	}
 }
 
-func TestGetInt(t *testing.T) {
+func TestSnapshot(t *testing.T) {
 	t.Parallel()
 
 	s := New()
 	sd := newSessionData(time.Hour)
-	sd.values["foo"] = 123
+	sd.values["foo"] = "bar"
+	sd.values["baz"] = []byte("boz")
 	ctx := s.addSessionDataToContext(context.Background(), sd)
 
-	i := s.GetInt(ctx, "foo")
-	if i != 123 {
-		t.Errorf("got %v: expected %d", i, 123)
+	values := s.Snapshot(ctx)
+	if !reflect.DeepEqual(values, sd.values) {
+		t.Errorf("got %v: expected %v", values, sd.values)
 	}
 
-	i = s.GetInt(ctx, "baz")
-	if i != 0 {
-		t.Errorf("got %v: expected %d", i, 0)
+	values["foo"] = "qux"
+	values["baz"].([]byte)[0] = 'x'
+	if sd.values["foo"] != "bar" || string(sd.values["baz"].([]byte)) != "boz" {
+		t.Errorf("got %v: expected session data to be unchanged", sd.values)
+	}
+	if sd.status != Unmodified {
+		t.Errorf("got %v: expected %v", sd.status, Unmodified)
 	}
 }
 
-func TestGetFloat(t *testing.T) {
+func TestReplace(t *testing.T) {
 	t.Parallel()
 
 	s := New()
 	sd := newSessionData(time.Hour)
-	sd.values["foo"] = 123.456
+	sd.values["foo"] = "bar"
+	sd.values["baz"] = "boz"
+	sd.values["__rememberMe"] = true
+	sd.values[ttlKey("baz")] = time.Now().Add(time.Hour).UnixNano()
 	ctx := s.addSessionDataToContext(context.Background(), sd)
 
-	f := s.GetFloat(ctx, "foo")
-	if f != 123.456 {
-		t.Errorf("got %v: expected %f", f, 123.456)
+	err := s.Replace(ctx, map[string]interface{}{"foo": "qux", "woo": "waa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"foo": "qux", "woo": "waa", "__rememberMe": true}
+	if !reflect.DeepEqual(sd.values, expected) {
+		t.Errorf("got %v: expected %v", sd.values, expected)
+	}
+	if sd.status != Modified {
+		t.Errorf("got %v: expected %v", sd.status, Modified)
 	}
 
-	f = s.GetFloat(ctx, "baz")
-	if f != 0 {
-		t.Errorf("got %v: expected %f", f, 0.00)
+	err = s.Replace(ctx, map[string]interface{}{"__rememberMe": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]interface{}{"__rememberMe": false}
+	if !reflect.DeepEqual(sd.values, expected) {
+		t.Errorf("got %v: expected %v", sd.values, expected)
+	}
+
+	// The reserved key doesn't count towards MaxKeys.
+	s.MaxKeys = 2
+	err = s.Replace(ctx, map[string]interface{}{"a": 1, "b": 2, "c": 3})
+	if err != ErrTooManyKeys {
+		t.Errorf("got %v: expected %v", err, ErrTooManyKeys)
+	}
+	if !reflect.DeepEqual(sd.values, expected) {
+		t.Errorf("got %v: expected %v", sd.values, expected)
 	}
 }
 
-func TestGetBytes(t *testing.T) {
+func TestPutWithTTL(t *testing.T) {
 	t.Parallel()
 
 	s := New()
-	sd := newSessionData(time.Hour)
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Put(ctx, "foo", "bar")
+	s.PutWithTTL(ctx, "otp", "123456", 100*time.Millisecond)
+
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.GetString(ctx, "otp") != "123456" {
+		t.Errorf("got %q: expected %q", s.GetString(ctx, "otp"), "123456")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if s.Exists(ctx, "otp") {
+		t.Errorf("got %v: expected %v", true, false)
+	}
+	if s.Get(ctx, "otp") != nil {
+		t.Errorf("got %v: expected %v", s.Get(ctx, "otp"), nil)
+	}
+	if s.GetString(ctx, "foo") != "bar" {
+		t.Errorf("got %q: expected %q", s.GetString(ctx, "foo"), "bar")
+	}
+	if !reflect.DeepEqual(s.Keys(ctx), []string{"foo"}) {
+		t.Errorf("got %v: expected %v", s.Keys(ctx), []string{"foo"})
+	}
+	if s.Status(ctx) != Modified {
+		t.Errorf("got %v: expected %v", s.Status(ctx), "modified")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["existing"] = int64(5)
+	sd.values["mismatch"] = "five"
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	if i := s.Increment(ctx, "absent", 2); i != 2 {
+		t.Errorf("got %d: expected %d", i, 2)
+	}
+	if i := s.Increment(ctx, "existing", 3); i != 8 {
+		t.Errorf("got %d: expected %d", i, 8)
+	}
+	if i := s.Increment(ctx, "mismatch", 1); i != 1 {
+		t.Errorf("got %d: expected %d", i, 1)
+	}
+	if i := s.Decrement(ctx, "existing", 10); i != -2 {
+		t.Errorf("got %d: expected %d", i, -2)
+	}
+	if sd.values["existing"] != int64(-2) {
+		t.Errorf("got %v: expected %v", sd.values["existing"], int64(-2))
+	}
+	if sd.status != Modified {
+		t.Errorf("got %v: expected %v", sd.status, "modified")
+	}
+}
+
+func TestGet(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = "bar"
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	str, ok := s.Get(ctx, "foo").(string)
+	if !ok {
+		t.Errorf("could not convert %T to string", s.Get(ctx, "foo"))
+	}
+
+	if str != "bar" {
+		t.Errorf("got %q: expected %q", str, "bar")
+	}
+}
+
+func TestPop(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = "bar"
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	str, ok := s.Pop(ctx, "foo").(string)
+	if !ok {
+		t.Errorf("could not convert %T to string", s.Get(ctx, "foo"))
+	}
+
+	if str != "bar" {
+		t.Errorf("got %q: expected %q", str, "bar")
+	}
+
+	_, ok = sd.values["foo"]
+	if ok {
+		t.Errorf("got %v: expected %v", ok, false)
+	}
+
+	if sd.status != Modified {
+		t.Errorf("got %v: expected %v", sd.status, "modified")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = "bar"
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	s.Remove(ctx, "foo")
+
+	if sd.values["foo"] != nil {
+		t.Errorf("got %v: expected %v", sd.values["foo"], nil)
+	}
+
+	if sd.status != Modified {
+		t.Errorf("got %v: expected %v", sd.status, "modified")
+	}
+}
+
+func TestClear(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = "bar"
+	sd.values["baz"] = "boz"
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	if err := s.Clear(ctx); err != nil {
+		t.Errorf("unexpected error encountered clearing session: %v", err)
+	}
+
+	if sd.values["foo"] != nil {
+		t.Errorf("got %v: expected %v", sd.values["foo"], nil)
+	}
+
+	if sd.values["baz"] != nil {
+		t.Errorf("got %v: expected %v", sd.values["baz"], nil)
+	}
+
+	if sd.status != Modified {
+		t.Errorf("got %v: expected %v", sd.status, "modified")
+	}
+}
+
+func TestExists(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = "bar"
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	if !s.Exists(ctx, "foo") {
+		t.Errorf("got %v: expected %v", s.Exists(ctx, "foo"), true)
+	}
+
+	if s.Exists(ctx, "baz") {
+		t.Errorf("got %v: expected %v", s.Exists(ctx, "baz"), false)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = "bar"
+	sd.values["woo"] = "waa"
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	keys := s.Keys(ctx)
+	if !reflect.DeepEqual(keys, []string{"foo", "woo"}) {
+		t.Errorf("got %v: expected %v", keys, []string{"foo", "woo"})
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	s.Reauthenticate(ctx, 10*time.Minute)
+
+	deadline := s.Deadline(ctx)
+	if deadline.After(time.Now().Add(10 * time.Minute)) {
+		t.Errorf("got %v: expected deadline within 10 minutes", deadline)
+	}
+	if !s.ReauthenticationRequired(ctx) {
+		t.Errorf("got %v: expected %v", false, true)
+	}
+	if sd.status != Modified {
+		t.Errorf("got %v: expected %v", sd.status, "modified")
+	}
+
+	s.Reauthenticate(ctx, time.Hour)
+	if !s.Deadline(ctx).Equal(deadline) {
+		t.Errorf("got %v: expected %v", s.Deadline(ctx), deadline)
+	}
+
+	s.Store = &mockstore.MockStore{}
+	s.Store.(*mockstore.MockStore).ExpectDelete("", nil)
+	if err := s.RenewToken(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s.ReauthenticationRequired(ctx) {
+		t.Errorf("got %v: expected %v", true, false)
+	}
+}
+
+func TestGetString(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = "bar"
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	str := s.GetString(ctx, "foo")
+	if str != "bar" {
+		t.Errorf("got %q: expected %q", str, "bar")
+	}
+
+	str = s.GetString(ctx, "baz")
+	if str != "" {
+		t.Errorf("got %q: expected %q", str, "")
+	}
+}
+
+func TestGetBool(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = true
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	b := s.GetBool(ctx, "foo")
+	if b != true {
+		t.Errorf("got %v: expected %v", b, true)
+	}
+
+	b = s.GetBool(ctx, "baz")
+	if b != false {
+		t.Errorf("got %v: expected %v", b, false)
+	}
+}
+
+func TestGetInt(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = 123
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	i := s.GetInt(ctx, "foo")
+	if i != 123 {
+		t.Errorf("got %v: expected %d", i, 123)
+	}
+
+	i = s.GetInt(ctx, "baz")
+	if i != 0 {
+		t.Errorf("got %v: expected %d", i, 0)
+	}
+}
+
+func TestGetFloat(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = 123.456
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	f := s.GetFloat(ctx, "foo")
+	if f != 123.456 {
+		t.Errorf("got %v: expected %f", f, 123.456)
+	}
+
+	f = s.GetFloat(ctx, "baz")
+	if f != 0 {
+		t.Errorf("got %v: expected %f", f, 0.00)
+	}
+}
+
+func TestGetBytes(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
 	sd.values["foo"] = []byte("bar")
 	ctx := s.addSessionDataToContext(context.Background(), sd)
 
@@ -768,3 +1484,2390 @@ func TestStatus(t *testing.T) {
 		t.Errorf("got %d: expected %d", status, Destroyed)
 	}
 }
+
+func TestStatusDetail(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+
+	if detail := s.StatusDetail(context.Background()); detail != DetailNotLoaded {
+		t.Errorf("got %d: expected %d", detail, DetailNotLoaded)
+	}
+
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = "bar"
+	token, _, err := s.commit(s.addSessionDataToContext(context.Background(), sd))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail := s.StatusDetail(ctx); detail != DetailUntouched {
+		t.Errorf("got %d: expected %d", detail, DetailUntouched)
+	}
+
+	s.GetString(ctx, "foo")
+	if detail := s.StatusDetail(ctx); detail != DetailReadOnly {
+		t.Errorf("got %d: expected %d", detail, DetailReadOnly)
+	}
+
+	s.Put(ctx, "foo", "baz")
+	if detail := s.StatusDetail(ctx); detail != DetailModified {
+		t.Errorf("got %d: expected %d", detail, DetailModified)
+	}
+
+	s.Put(ctx, "foo", "bar")
+	if detail := s.StatusDetail(ctx); detail != DetailReverted {
+		t.Errorf("got %d: expected %d", detail, DetailReverted)
+	}
+	if status := s.Status(ctx); status != Modified {
+		t.Errorf("got %d: expected %d", status, Modified)
+	}
+
+	if err := s.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if detail := s.StatusDetail(ctx); detail != DetailDestroyed {
+		t.Errorf("got %d: expected %d", detail, DetailDestroyed)
+	}
+}
+
+type jsonProfileCodec struct{}
+
+type testProfile struct {
+	Name  string
+	Likes []string
+}
+
+func (jsonProfileCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonProfileCodec) Unmarshal(b []byte) (interface{}, error) {
+	var p testProfile
+	err := json.Unmarshal(b, &p)
+	return p, err
+}
+
+func TestKeyCodecs(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.KeyCodecs = map[string]ValueCodec{"profile": jsonProfileCodec{}}
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := testProfile{Name: "alice", Likes: []string{"go", "tea"}}
+	s.Put(ctx, "profile", profile)
+	s.Put(ctx, "foo", "bar")
+
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _, _ := s.Store.Find(token)
+	_, values, err := s.Codec.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := values["profile"].([]byte); !ok {
+		t.Errorf("got %T: expected profile to be stored as []byte", values["profile"])
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Get(ctx, "profile"), profile) {
+		t.Errorf("got %v: expected %v", s.Get(ctx, "profile"), profile)
+	}
+	if s.GetString(ctx, "foo") != "bar" {
+		t.Errorf("got %q: expected %q", s.GetString(ctx, "foo"), "bar")
+	}
+	if s.Exists(ctx, keyCodecsKey) {
+		t.Errorf("got %v: expected %q to be removed", true, keyCodecsKey)
+	}
+}
+
+func TestBlobOffload(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.BlobThreshold = 256
+	big := strings.Repeat("x", 1024)
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "big", big)
+	s.Put(ctx, "small", "y")
+
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _, _ := s.Store.Find(token)
+	_, values, err := s.Codec.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := values["big"]; ok {
+		t.Errorf("got %v: expected %q to be offloaded", true, "big")
+	}
+	if values["small"] != "y" {
+		t.Errorf("got %v: expected %q", values["small"], "y")
+	}
+	refs, _ := values[blobsKey].([]string)
+	if len(refs) != 1 || !strings.HasSuffix(refs[0], ":big") {
+		t.Fatalf("got %v: expected a single reference to %q", refs, "big")
+	}
+	blobToken := strings.TrimSuffix(refs[0], ":big")
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GetString(ctx, "big") != big {
+		t.Errorf("got %q: expected %q", s.GetString(ctx, "big"), big)
+	}
+	if !s.Exists(ctx, "big") {
+		t.Errorf("got %v: expected %v", false, true)
+	}
+
+	s.Remove(ctx, "big")
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := s.Store.Find(blobStoreKey(blobToken)); found {
+		t.Errorf("got %v: expected %v", found, false)
+	}
+}
+
+func TestBlobOffloadDestroy(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.BlobThreshold = 256
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "big", strings.Repeat("x", 1024))
+
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobToken := string(s.getSessionDataFromContext(ctx).values["big"].(blobRef))
+
+	if err := s.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := s.Store.Find(blobStoreKey(blobToken)); found {
+		t.Errorf("got %v: expected %v", found, false)
+	}
+}
+
+type jsonSessionCodec struct{}
+
+func (jsonSessionCodec) Encode(deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{"deadline": deadline, "values": values})
+}
+
+func (jsonSessionCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
+	var aux struct {
+		Deadline time.Time
+		Values   map[string]interface{}
+	}
+	err := json.Unmarshal(b, &aux)
+	return aux.Deadline, aux.Values, err
+}
+
+type jsonFieldCodec struct {
+	jsonSessionCodec
+	mu           sync.Mutex
+	decodes      int
+	fieldDecodes int
+}
+
+func (c *jsonFieldCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
+	c.mu.Lock()
+	c.decodes++
+	c.mu.Unlock()
+	return c.jsonSessionCodec.Decode(b)
+}
+
+func (c *jsonFieldCodec) DecodeField(b []byte, key string) (time.Time, interface{}, bool, error) {
+	c.mu.Lock()
+	c.fieldDecodes++
+	c.mu.Unlock()
+
+	var aux struct {
+		Deadline time.Time
+		Values   map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return time.Time{}, nil, false, err
+	}
+	raw, ok := aux.Values[key]
+	if !ok {
+		return aux.Deadline, nil, false, nil
+	}
+	var val interface{}
+	err := json.Unmarshal(raw, &val)
+	return aux.Deadline, val, true, err
+}
+
+func TestGetField(t *testing.T) {
+	t.Parallel()
+
+	fieldCodec := &jsonFieldCodec{}
+	for _, codec := range []Codec{GobCodec{}, fieldCodec} {
+		s := New()
+		s.Codec = codec
+
+		ctx, err := s.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put(ctx, "foo", "bar")
+		if codec == (GobCodec{}) {
+			s.PutWithTTL(ctx, "baz", "qux", time.Nanosecond)
+		}
+		token, _, err := s.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		val, err := s.GetField(context.Background(), token, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != "bar" {
+			t.Errorf("%T: got %v: expected %v", codec, val, "bar")
+		}
+
+		for _, tc := range []struct{ token, key string }{
+			{token, "missing"},
+			{token, "baz"},
+			{"missing_token", "foo"},
+		} {
+			val, err := s.GetField(context.Background(), tc.token, tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if val != nil {
+				t.Errorf("%T: got %v: expected %v", codec, val, nil)
+			}
+		}
+	}
+
+	// The field-aware codec only needed a full decode for the two keys which
+	// weren't found, in case they had been offloaded as blobs.
+	fieldCodec.mu.Lock()
+	decodes := fieldCodec.decodes
+	fieldCodec.mu.Unlock()
+	if decodes != 2 {
+		t.Errorf("got %d full decodes: expected %d", decodes, 2)
+	}
+}
+
+func TestCodecEnvelope(t *testing.T) {
+	t.Parallel()
+
+	gobManager := New()
+	gobManager.CodecID = 1
+	gobManager.Codecs = map[byte]Codec{2: jsonSessionCodec{}}
+
+	jsonManager := New()
+	jsonManager.Store = gobManager.Store
+	jsonManager.Codec = jsonSessionCodec{}
+	jsonManager.CodecID = 2
+	jsonManager.Codecs = map[byte]Codec{1: GobCodec{}}
+
+	legacyManager := New()
+	legacyManager.Store = gobManager.Store
+
+	tokens := make(map[*SessionManager]string)
+	for _, s := range []*SessionManager{gobManager, jsonManager, legacyManager} {
+		ctx, err := s.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put(ctx, "foo", "bar")
+		if tokens[s], _, err = s.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, s := range []*SessionManager{gobManager, jsonManager} {
+		for _, token := range []string{tokens[gobManager], tokens[jsonManager]} {
+			ctx, err := s.Load(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.GetString(ctx, "foo") != "bar" {
+				t.Errorf("got %q: expected %q", s.GetString(ctx, "foo"), "bar")
+			}
+		}
+	}
+
+	// Data without an envelope is decoded with the configured codec.
+	ctx, err := gobManager.Load(context.Background(), tokens[legacyManager])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gobManager.GetString(ctx, "foo") != "bar" {
+		t.Errorf("got %q: expected %q", gobManager.GetString(ctx, "foo"), "bar")
+	}
+
+	_, err = legacyManager.Load(context.Background(), tokens[jsonManager])
+	if err == nil {
+		t.Errorf("got %v: expected an error for an unregistered codec ID", err)
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+	t.Parallel()
+
+	deadline := time.Date(2026, 1, 2, 15, 4, 5, 123000000, time.FixedZone("", 3600))
+	values := map[string]interface{}{
+		"foo":  "bar",
+		"time": deadline,
+		"list": []interface{}{deadline},
+	}
+
+	testCases := []struct {
+		opts JSONCodecOptions
+		want string
+	}{
+		{
+			JSONCodecOptions{},
+			`{"deadline":"2026-01-02T14:04:05.123Z","values":{"foo":"bar","list":["2026-01-02T14:04:05.123Z"],"time":"2026-01-02T14:04:05.123Z"}}`,
+		},
+		{
+			JSONCodecOptions{TimeFormat: JSONTimeUnixMillis},
+			`{"deadline":1767362645123,"values":{"foo":"bar","list":[1767362645123],"time":1767362645123}}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		codec := NewJSONCodec(tc.opts)
+		b, err := codec.Encode(deadline, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.want {
+			t.Errorf("got %s: expected %s", b, tc.want)
+		}
+
+		got, vals, err := codec.Decode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(deadline) {
+			t.Errorf("got %v: expected %v", got, deadline)
+		}
+		if vals["foo"] != "bar" {
+			t.Errorf("got %v: expected %v", vals["foo"], "bar")
+		}
+
+		_, val, found, err := codec.DecodeField(b, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || val != "bar" {
+			t.Errorf("got %v, %v: expected %v, %v", val, found, "bar", true)
+		}
+	}
+
+	s := New()
+	s.Codec = JSONCodec{}
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GetString(ctx, "foo") != "bar" {
+		t.Errorf("got %q: expected %q", s.GetString(ctx, "foo"), "bar")
+	}
+}
+
+func TestJSONCodecReservedValues(t *testing.T) {
+	t.Parallel()
+
+	newSession := func(t *testing.T, s *SessionManager) context.Context {
+		ctx, err := s.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx
+	}
+	roundTrip := func(t *testing.T, s *SessionManager, ctx context.Context) context.Context {
+		token, _, err := s.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, err = s.Load(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx
+	}
+
+	t.Run("Throttle", func(t *testing.T) {
+		t.Parallel()
+
+		s := New()
+		s.Codec = JSONCodec{}
+		s.LockoutThreshold = 1
+		ctx := newSession(t, s)
+		s.RecordFailure(ctx)
+		ctx = roundTrip(t, s, ctx)
+		if !s.IsLockedOut(ctx) {
+			t.Errorf("got %v: expected %v", false, true)
+		}
+	})
+
+	t.Run("Generation", func(t *testing.T) {
+		t.Parallel()
+
+		// The generation can't be represented exactly as a float64.
+		var mu sync.Mutex
+		gen := int64(1<<60 + 1)
+		s := New()
+		s.Codec = JSONCodec{}
+		s.IdentityKey = "userID"
+		s.GenerationFunc = func(ctx context.Context, identity interface{}) (int64, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return gen, nil
+		}
+		ctx := newSession(t, s)
+		s.Put(ctx, "userID", 1)
+		ctx = roundTrip(t, s, ctx)
+		if !s.Exists(ctx, "userID") {
+			t.Fatalf("got %v: expected %v", false, true)
+		}
+
+		mu.Lock()
+		gen++
+		mu.Unlock()
+		ctx = roundTrip(t, s, ctx)
+		if s.Exists(ctx, "userID") {
+			t.Errorf("got %v: expected the session to be invalidated", true)
+		}
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		t.Parallel()
+
+		s := New()
+		s.Codec = JSONCodec{}
+		ctx := newSession(t, s)
+		s.PutWithTTL(ctx, "code", "1234", 20*time.Millisecond)
+		ctx = roundTrip(t, s, ctx)
+		if s.GetString(ctx, "code") != "1234" {
+			t.Fatalf("got %q: expected %q", s.GetString(ctx, "code"), "1234")
+		}
+		time.Sleep(40 * time.Millisecond)
+		if s.Exists(ctx, "code") {
+			t.Errorf("got %v: expected %v", true, false)
+		}
+	})
+
+	t.Run("Blob", func(t *testing.T) {
+		t.Parallel()
+
+		s := New()
+		s.Codec = JSONCodec{}
+		s.BlobThreshold = 256
+		big := strings.Repeat("x", 1024)
+		ctx := newSession(t, s)
+		s.Put(ctx, "big", big)
+		ctx = roundTrip(t, s, ctx)
+		if s.GetString(ctx, "big") != big {
+			t.Errorf("got %q: expected %q", s.GetString(ctx, "big"), big)
+		}
+	})
+
+	t.Run("KeyCodecs", func(t *testing.T) {
+		t.Parallel()
+
+		s := New()
+		s.Codec = JSONCodec{}
+		s.KeyCodecs = map[string]ValueCodec{"profile": jsonProfileCodec{}}
+		profile := testProfile{Name: "alice", Likes: []string{"go", "tea"}}
+		ctx := newSession(t, s)
+		s.Put(ctx, "profile", profile)
+		ctx = roundTrip(t, s, ctx)
+		if !reflect.DeepEqual(s.Get(ctx, "profile"), profile) {
+			t.Errorf("got %v: expected %v", s.Get(ctx, "profile"), profile)
+		}
+	})
+}
+
+func TestPublicID(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := s.PublicID(ctx)
+	if len(id) != 32 {
+		t.Fatalf("got %q: expected a 32 character ID", id)
+	}
+	if s.Status(ctx) != Modified {
+		t.Errorf("got %v: expected %v", s.Status(ctx), Modified)
+	}
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == token {
+		t.Error("expected the public ID to differ from the token")
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RenewToken(ctx); err != nil {
+		t.Fatal(err)
+	}
+	newToken, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newToken == token {
+		t.Fatal("expected the token to change")
+	}
+
+	ctx, err = s.Load(context.Background(), newToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.PublicID(ctx); got != id {
+		t.Errorf("got %q: expected %q", got, id)
+	}
+	if s.Status(ctx) != Unmodified {
+		t.Errorf("got %v: expected %v", s.Status(ctx), Unmodified)
+	}
+
+	if err := s.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.PublicID(ctx); got == id {
+		t.Errorf("got %q: expected a new ID after Destroy", got)
+	}
+}
+
+type dumpStore struct {
+	mu    sync.Mutex
+	items map[string][]byte
+}
+
+func (d *dumpStore) Find(token string) ([]byte, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, ok := d.items[token]
+	return b, ok, nil
+}
+
+func (d *dumpStore) Commit(token string, b []byte, expiry time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.items[token] = b
+	return nil
+}
+
+func (d *dumpStore) Delete(token string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.items, token)
+	return nil
+}
+
+func (d *dumpStore) keys() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var keys []string
+	for key := range d.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestHashStoreKeys(t *testing.T) {
+	t.Parallel()
+
+	store := &dumpStore{items: make(map[string][]byte)}
+	s := New()
+	s.Store = store
+	s.HashStoreKeys = true
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	want := []string{hex.EncodeToString(sum[:])}
+	if keys := store.keys(); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got %v: expected %v", keys, want)
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "foo"); got != "bar" {
+		t.Errorf("got %q: expected %q", got, "bar")
+	}
+	if val, err := s.GetField(context.Background(), token, "foo"); err != nil || val != "bar" {
+		t.Errorf("got %v, %v: expected %q", val, err, "bar")
+	}
+
+	if err := s.RenewToken(ctx); err != nil {
+		t.Fatal(err)
+	}
+	newToken, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum = sha256.Sum256([]byte(newToken))
+	want = []string{hex.EncodeToString(sum[:])}
+	if keys := store.keys(); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got %v: expected %v", keys, want)
+	}
+
+	if err := s.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys := store.keys(); len(keys) != 0 {
+		t.Errorf("got %v: expected no keys", keys)
+	}
+}
+
+func TestStoreKeyPepper(t *testing.T) {
+	t.Parallel()
+
+	store := &dumpStore{items: make(map[string][]byte)}
+	keys := NewKeyRing([]byte("old_secret"))
+	s := New()
+	s.Store = store
+	s.StoreKeyPepper = keys
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldKey := hex.EncodeToString(sign([]byte("old_secret"), []byte(token)))
+	if got := store.keys(); !reflect.DeepEqual(got, []string{oldKey}) {
+		t.Fatalf("got %v: expected %v", got, []string{oldKey})
+	}
+
+	// After rotating the pepper the session data is still found, and it's
+	// moved to the new store key when it is next committed.
+	keys.Add([]byte("new_secret"))
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "foo"); got != "bar" {
+		t.Errorf("got %q: expected %q", got, "bar")
+	}
+	if s.Status(ctx) != Modified {
+		t.Errorf("got %v: expected %v", s.Status(ctx), Modified)
+	}
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := hex.EncodeToString(sign([]byte("new_secret"), []byte(token)))
+	if newKey == oldKey {
+		t.Fatal("expected the store key to change with the pepper")
+	}
+	if got := store.keys(); !reflect.DeepEqual(got, []string{newKey}) {
+		t.Fatalf("got %v: expected %v", got, []string{newKey})
+	}
+
+	keys.Retire([]byte("old_secret"))
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "foo"); got != "bar" {
+		t.Errorf("got %q: expected %q", got, "bar")
+	}
+	if s.Status(ctx) != Unmodified {
+		t.Errorf("got %v: expected %v", s.Status(ctx), Unmodified)
+	}
+}
+
+func TestOnDestroy(t *testing.T) {
+	t.Parallel()
+
+	var destroyed []string
+	s := New()
+	s.OnDestroy = func(ctx context.Context, token string) {
+		destroyed = append(destroyed, token)
+	}
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(destroyed) != 0 {
+		t.Fatalf("got %v: expected no calls for an uncommitted session", destroyed)
+	}
+
+	s.Put(ctx, "foo", "bar")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(destroyed, []string{token}) {
+		t.Errorf("got %v: expected %v", destroyed, []string{token})
+	}
+}
+
+type findCountingStore struct {
+	*memstore.MemStore
+	mu    sync.Mutex
+	finds int
+}
+
+func (s *findCountingStore) Find(token string) ([]byte, bool, error) {
+	s.mu.Lock()
+	s.finds++
+	s.mu.Unlock()
+	return s.MemStore.Find(token)
+}
+
+func TestLoadMany(t *testing.T) {
+	t.Parallel()
+
+	batchStore := &findCountingStore{MemStore: memstore.NewWithCleanupInterval(0)}
+	for _, store := range []Store{batchStore, &dumpStore{items: make(map[string][]byte)}} {
+		s := New()
+		s.Store = store
+		s.HashStoreKeys = true
+
+		var tokens []string
+		for _, val := range []string{"bar", "baz"} {
+			ctx, err := s.Load(context.Background(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Put(ctx, "foo", val)
+			token, _, err := s.Commit(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens = append(tokens, token)
+		}
+
+		ctxs, err := s.LoadMany(context.Background(), []string{tokens[0], "missing_token", tokens[1], ""})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ctxs) != 2 {
+			t.Fatalf("%T: got %d sessions: expected %d", store, len(ctxs), 2)
+		}
+		if got := s.GetString(ctxs[tokens[0]], "foo"); got != "bar" {
+			t.Errorf("%T: got %q: expected %q", store, got, "bar")
+		}
+		if got := s.GetString(ctxs[tokens[1]], "foo"); got != "baz" {
+			t.Errorf("%T: got %q: expected %q", store, got, "baz")
+		}
+	}
+
+	// Only the missing token should be looked up individually.
+	if batchStore.finds != 1 {
+		t.Errorf("got %d finds: expected %d", batchStore.finds, 1)
+	}
+}
+
+func TestTombstoneTTL(t *testing.T) {
+	t.Parallel()
+
+	store := memstore.NewWithCleanupInterval(0)
+	s := New()
+	s.Store = store
+	s.TombstoneTTL = 100 * time.Millisecond
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid, err := s.WasRecentlyValid(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Errorf("got %v: expected %v for a live session", valid, false)
+	}
+
+	if err := s.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	values, _, err := s.GetSession(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values != nil {
+		t.Errorf("got %v: expected %v", values, nil)
+	}
+	ctxs, err := s.LoadMany(context.Background(), []string{token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ctxs) != 0 {
+		t.Errorf("got %d sessions: expected %d", len(ctxs), 0)
+	}
+
+	for _, tc := range []struct {
+		token string
+		want  bool
+	}{
+		{token, true},
+		{"missing_token", false},
+	} {
+		valid, err := s.WasRecentlyValid(context.Background(), tc.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid != tc.want {
+			t.Errorf("%s: got %v: expected %v", tc.token, valid, tc.want)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	valid, err = s.WasRecentlyValid(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Errorf("got %v: expected %v after the tombstone expired", valid, false)
+	}
+	if _, found, _ := store.Find(token); found {
+		t.Errorf("got %v: expected %v", found, false)
+	}
+}
+
+func TestPutTransient(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PutTransient(ctx, "derived", "value")
+	if s.Status(ctx) != Unmodified {
+		t.Errorf("got %v: expected %v", s.Status(ctx), Unmodified)
+	}
+	if got := s.GetString(ctx, "derived"); got != "value" {
+		t.Errorf("got %q: expected %q", got, "value")
+	}
+	if !s.Exists(ctx, "derived") {
+		t.Errorf("got %v: expected %v", false, true)
+	}
+
+	s.Put(ctx, "baz", "qux")
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists(ctx, "derived") {
+		t.Errorf("got %v: expected transient key to be absent after reloading", true)
+	}
+	if got := s.GetString(ctx, "baz"); got != "qux" {
+		t.Errorf("got %q: expected %q", got, "qux")
+	}
+}
+
+type blockingStore struct {
+	*memstore.MemStore
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingStore) Find(token string) ([]byte, bool, error) {
+	b.started <- struct{}{}
+	<-b.unblock
+	return b.MemStore.Find(token)
+}
+
+func TestMaxConcurrentStoreOps(t *testing.T) {
+	t.Parallel()
+
+	store := &blockingStore{
+		MemStore: memstore.NewWithCleanupInterval(0),
+		started:  make(chan struct{}, 2),
+		unblock:  make(chan struct{}),
+	}
+	s := New()
+	s.Store = store
+	s.MaxConcurrentStoreOps = 1
+
+	errs := make(chan error, 2)
+	load := func() {
+		_, err := s.Load(context.Background(), "token")
+		errs <- err
+	}
+
+	go load()
+	<-store.started
+	go load()
+
+	// The second load must wait for the first to finish before it can call
+	// Find.
+	select {
+	case <-store.started:
+		t.Fatal("second store operation started while the first was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(store.unblock)
+	<-store.started
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStoreQueueTimeout(t *testing.T) {
+	t.Parallel()
+
+	store := &blockingStore{
+		MemStore: memstore.NewWithCleanupInterval(0),
+		started:  make(chan struct{}, 1),
+		unblock:  make(chan struct{}),
+	}
+	defer close(store.unblock)
+	s := New()
+	s.Store = store
+	s.MaxConcurrentStoreOps = 1
+	s.StoreQueueTimeout = 20 * time.Millisecond
+
+	go s.Load(context.Background(), "token")
+	<-store.started
+
+	_, err := s.Load(context.Background(), "token")
+	if err != ErrStoreBusy {
+		t.Errorf("got %v: expected %v", err, ErrStoreBusy)
+	}
+}
+
+func TestLoginThrottling(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.LockoutThreshold = 3
+	s.LockoutWindow = 50 * time.Millisecond
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if s.IsLockedOut(ctx) {
+			t.Fatalf("attempt %d: got %v: expected %v", i, true, false)
+		}
+		if locked := s.RecordFailure(ctx); locked != (i == 3) {
+			t.Fatalf("attempt %d: got %v: expected %v", i, locked, i == 3)
+		}
+	}
+	if !s.IsLockedOut(ctx) {
+		t.Fatalf("got %v: expected %v", false, true)
+	}
+
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.RecordFailure(ctx) || !s.IsLockedOut(ctx) {
+		t.Fatalf("got %v: expected the lockout to persist across requests", false)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if s.IsLockedOut(ctx) {
+		t.Fatalf("got %v: expected the lockout to end after LockoutWindow", true)
+	}
+	if s.RecordFailure(ctx) {
+		t.Fatalf("got %v: expected the counter to restart after the lockout ends", true)
+	}
+
+	s.RecordFailure(ctx)
+	s.ClearFailures(ctx)
+	if s.RecordFailure(ctx) {
+		t.Fatalf("got %v: expected ClearFailures to reset the counter", true)
+	}
+	s.ClearFailures(ctx)
+	if s.Exists(ctx, failureCountKey) || s.Exists(ctx, lockedUntilKey) {
+		t.Errorf("expected ClearFailures to remove the failed attempt data")
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.IdentityKey = "userID"
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Impersonate(ctx, 2); err != ErrNoIdentity {
+		t.Fatalf("got %v: expected %v", err, ErrNoIdentity)
+	}
+	if err := s.StopImpersonation(ctx); err != ErrNotImpersonating {
+		t.Fatalf("got %v: expected %v", err, ErrNotImpersonating)
+	}
+
+	s.Put(ctx, "userID", 1)
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Impersonate(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Impersonate(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if !s.IsImpersonating(ctx) {
+		t.Fatalf("got %v: expected %v", false, true)
+	}
+	newToken, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newToken == token {
+		t.Fatalf("expected the session token to be renewed")
+	}
+
+	ctx, err = s.Load(context.Background(), newToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetInt(ctx, "userID"); got != 3 {
+		t.Fatalf("got %d: expected %d", got, 3)
+	}
+	if got := s.Impersonators(ctx); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("got %v: expected %v", got, []interface{}{1, 2})
+	}
+
+	if err := s.StopImpersonation(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetInt(ctx, "userID"); got != 2 {
+		t.Fatalf("got %d: expected %d", got, 2)
+	}
+	if !s.IsImpersonating(ctx) {
+		t.Fatalf("got %v: expected %v", false, true)
+	}
+
+	if err := s.StopImpersonation(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetInt(ctx, "userID"); got != 1 {
+		t.Fatalf("got %d: expected %d", got, 1)
+	}
+	if s.IsImpersonating(ctx) || s.Impersonators(ctx) != nil {
+		t.Fatalf("got %v: expected %v", true, false)
+	}
+	if err := s.StopImpersonation(ctx); err != ErrNotImpersonating {
+		t.Fatalf("got %v: expected %v", err, ErrNotImpersonating)
+	}
+}
+
+// testTx is a transaction for txTestStore, which holds the changes made with
+// it until it is committed.
+type testTx struct {
+	commits map[string][]byte
+	deletes []string
+}
+
+type txTestStore struct {
+	*memstore.MemStore
+}
+
+func (s txTestStore) CommitTx(tx interface{}, token string, b []byte, expiry time.Time) error {
+	tx.(*testTx).commits[token] = b
+	return nil
+}
+
+func (s txTestStore) DeleteTx(tx interface{}, token string) error {
+	tx.(*testTx).deletes = append(tx.(*testTx).deletes, token)
+	return nil
+}
+
+func (s txTestStore) commitTx(tx *testTx) {
+	for _, token := range tx.deletes {
+		s.Delete(token)
+	}
+	for token, b := range tx.commits {
+		s.Commit(token, b, time.Now().Add(time.Hour))
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	t.Parallel()
+
+	store := txTestStore{memstore.NewWithCleanupInterval(0)}
+	s := New()
+	s.Store = store
+
+	// Rolled back: the transaction is discarded, and the commit made without
+	// it afterwards (as by the LoadAndSave middleware) doesn't write the
+	// session data.
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := &testTx{commits: make(map[string][]byte)}
+	txCtx := WithTx(ctx, tx)
+	s.Put(txCtx, "userID", 1)
+	token, _, err := s.Commit(txCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.commits) != 1 {
+		t.Fatalf("got %d commits in the transaction: expected %d", len(tx.commits), 1)
+	}
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := store.Find(token); found {
+		t.Fatalf("got %v: expected no session data to be persisted", found)
+	}
+
+	// Committed: the session data is persisted when the transaction is.
+	ctx, err = s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx = &testTx{commits: make(map[string][]byte)}
+	s.Put(WithTx(ctx, tx), "userID", 2)
+	token, _, err = s.Commit(WithTx(ctx, tx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.commitTx(tx)
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetInt(ctx, "userID"); got != 2 {
+		t.Fatalf("got %d: expected %d", got, 2)
+	}
+
+	// Deletes use the transaction too.
+	tx = &testTx{commits: make(map[string][]byte)}
+	if err := s.Destroy(WithTx(ctx, tx)); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := store.Find(token); !found {
+		t.Fatalf("got %v: expected the session data to be kept until the transaction is committed", found)
+	}
+	store.commitTx(tx)
+	if _, found, _ := store.Find(token); found {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+
+	// A store which doesn't support transactions.
+	s = New()
+	ctx, err = s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	if _, _, err := s.Commit(WithTx(ctx, tx)); err != ErrTxNotSupported {
+		t.Fatalf("got %v: expected %v", err, ErrTxNotSupported)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.EventBufferSize = 3
+	events := s.Events()
+	if s.Events() != events {
+		t.Fatalf("expected Events to return the same channel each time")
+	}
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []EventType{EventCreated, EventCommitted, EventDestroyed} {
+		ev := <-events
+		if ev.Type != want {
+			t.Errorf("got %v: expected %v", ev.Type, want)
+		}
+		if ev.TokenPrefix != token[:6] {
+			t.Errorf("got %q: expected %q", ev.TokenPrefix, token[:6])
+		}
+		if ev.Time.IsZero() {
+			t.Errorf("expected the event time to be set")
+		}
+	}
+
+	b, err := s.Codec.Encode(time.Now().Add(-time.Minute), map[string]interface{}{"foo": "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store.Commit("expired_token", b, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(context.Background(), "expired_token"); err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-events; ev.Type != EventExpired || ev.TokenPrefix != "expire" {
+		t.Errorf("got %+v: expected an %v event for %q", ev, EventExpired, "expire")
+	}
+
+	// With nobody consuming, the oldest events are dropped once the buffer is
+	// full, and sending doesn't block.
+	var tokens []string
+	for i := 0; i < 5; i++ {
+		ctx, err := s.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Destroy(ctx); err != nil {
+			t.Fatal(err)
+		}
+		s.Put(ctx, "foo", "bar")
+		token, _, err := s.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+	if len(events) != 3 {
+		t.Fatalf("got %d buffered events: expected %d", len(events), 3)
+	}
+	want := []SessionEvent{
+		{Type: EventCommitted, TokenPrefix: tokens[3][:6]},
+		{Type: EventCreated, TokenPrefix: tokens[4][:6]},
+		{Type: EventCommitted, TokenPrefix: tokens[4][:6]},
+	}
+	for _, w := range want {
+		ev := <-events
+		if ev.Type != w.Type || ev.TokenPrefix != w.TokenPrefix {
+			t.Errorf("got %v %q: expected %v %q", ev.Type, ev.TokenPrefix, w.Type, w.TokenPrefix)
+		}
+	}
+}
+
+// sizeRecordingStore records the size of the data committed under each key.
+type sizeRecordingStore struct {
+	*memstore.MemStore
+	sizes map[string]int
+}
+
+func (s *sizeRecordingStore) Commit(token string, b []byte, expiry time.Time) error {
+	s.sizes[token] = len(b)
+	return s.MemStore.Commit(token, b, expiry)
+}
+
+func TestEncodedSize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		configure func(s *SessionManager)
+	}{
+		{"Default", func(s *SessionManager) {}},
+		{"JSONCodec", func(s *SessionManager) { s.Codec = NewJSONCodec(JSONCodecOptions{}) }},
+		{"CodecID", func(s *SessionManager) { s.CodecID = 1 }},
+		{"BlobThreshold", func(s *SessionManager) { s.BlobThreshold = 256 }},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			store := &sizeRecordingStore{MemStore: memstore.NewWithCleanupInterval(0), sizes: make(map[string]int)}
+			s := New()
+			s.Store = store
+			tt.configure(s)
+
+			ctx, err := s.Load(context.Background(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Put(ctx, "foo", "bar")
+			s.Put(ctx, "large", strings.Repeat("x", 1024))
+
+			size, err := s.EncodedSize(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(store.sizes) != 0 {
+				t.Fatalf("got %d commits: expected EncodedSize not to write to the store", len(store.sizes))
+			}
+
+			token, _, err := s.Commit(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := store.sizes[token]; got != size {
+				t.Errorf("got %d: expected %d", size, got)
+			}
+			if s.BlobThreshold > 0 && len(store.sizes) != 2 {
+				t.Errorf("got %d commits: expected the large value to be offloaded", len(store.sizes))
+			}
+		})
+	}
+}
+
+func TestGetFieldCache(t *testing.T) {
+	t.Parallel()
+
+	fieldCodec := &jsonFieldCodec{}
+	s := New()
+	s.Codec = fieldCodec
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := func() (int, int) {
+		fieldCodec.mu.Lock()
+		defer fieldCodec.mu.Unlock()
+		return fieldCodec.fieldDecodes, fieldCodec.decodes
+	}
+
+	// Within a request, each key is only decoded once, whether or not it is
+	// found.
+	reqCtx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		for key, want := range map[string]interface{}{"foo": "bar", "missing": nil} {
+			val, err := s.GetField(reqCtx, token, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if val != want {
+				t.Errorf("got %v: expected %v", val, want)
+			}
+		}
+	}
+	// The first lookup of "foo" also checks for a TTL, and the lookup of
+	// "missing" falls back to a full decode.
+	if fieldDecodes, decodes := counts(); fieldDecodes != 3 || decodes != 1 {
+		t.Errorf("got %d field decodes and %d full decodes: expected 3 and 1", fieldDecodes, decodes)
+	}
+
+	// Without session data in the context, nothing is cached.
+	if _, err := s.GetField(context.Background(), token, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if fieldDecodes, _ := counts(); fieldDecodes != 5 {
+		t.Errorf("got %d field decodes: expected %d", fieldDecodes, 5)
+	}
+
+	// Committing the session data clears the cache.
+	if val, _ := s.GetField(ctx, token, "foo"); val != "bar" {
+		t.Fatalf("got %v: expected %v", val, "bar")
+	}
+	s.Put(ctx, "foo", "qux")
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := s.GetField(ctx, token, "foo"); val != "qux" {
+		t.Errorf("got %v: expected %v", val, "qux")
+	}
+}
+
+func TestCopyInto(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+
+	guestCtx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(guestCtx, "cart", []byte("apples"))
+	s.Put(guestCtx, "theme", "dark")
+	s.PutWithTTL(guestCtx, "promo", "SPRING", time.Hour)
+	s.RememberMe(guestCtx, true)
+	token, _, err := s.Commit(guestCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srcCtx, err := s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstCtx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(dstCtx, "theme", "light")
+	dstToken, _, err := s.Commit(dstCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstCtx, err = s.Load(context.Background(), dstToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.CopyInto(srcCtx, dstCtx, "cart", "missing")
+	if got := s.GetBytes(dstCtx, "cart"); string(got) != "apples" {
+		t.Errorf("got %q: expected %q", got, "apples")
+	}
+	if got := s.GetString(dstCtx, "theme"); got != "light" {
+		t.Errorf("got %q: expected %q", got, "light")
+	}
+	if s.Exists(dstCtx, "missing") {
+		t.Errorf("expected keys missing from the source not to be copied")
+	}
+	if s.Status(dstCtx) != Modified {
+		t.Errorf("got %v: expected %v", s.Status(dstCtx), Modified)
+	}
+
+	// The []byte value isn't shared.
+	s.GetBytes(dstCtx, "cart")[0] = 'A'
+	if got := s.GetBytes(srcCtx, "cart"); string(got) != "apples" {
+		t.Errorf("got %q: expected %q", got, "apples")
+	}
+
+	s.CopyInto(srcCtx, dstCtx)
+	if got := s.GetString(dstCtx, "theme"); got != "dark" {
+		t.Errorf("got %q: expected %q", got, "dark")
+	}
+	if got := s.GetString(dstCtx, "promo"); got != "SPRING" {
+		t.Errorf("got %q: expected %q", got, "SPRING")
+	}
+	if _, ok := s.Snapshot(dstCtx)[ttlKey("promo")]; !ok {
+		t.Errorf("expected the TTL to be copied with its key")
+	}
+	if s.GetBool(dstCtx, "__rememberMe") {
+		t.Errorf("expected reserved keys not to be copied")
+	}
+
+	if s.Status(srcCtx) != Unmodified {
+		t.Errorf("got %v: expected %v", s.Status(srcCtx), Unmodified)
+	}
+	if got := s.Keys(srcCtx); len(got) != 5 {
+		t.Errorf("got %v: expected the source keys to be unchanged", got)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.PromoteKeys = []string{"cart", "coupon"}
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "cart", "apples")
+	s.PutWithTTL(ctx, "coupon", "SPRING", time.Hour)
+	s.Put(ctx, "userID", 99)
+	s.Reauthenticate(ctx, time.Hour)
+	guestToken, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err = s.Load(context.Background(), guestToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Promote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s.Status(ctx) != Modified {
+		t.Errorf("got %v: expected %v", s.Status(ctx), Modified)
+	}
+	s.Put(ctx, "userID", 1)
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == guestToken {
+		t.Fatalf("expected the session token to be renewed")
+	}
+	if _, found, _ := s.Store.Find(guestToken); found {
+		t.Errorf("expected the guest session to be deleted from the store")
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"__ttl:coupon", "cart", "coupon", "userID"}
+	got := s.Keys(ctx)
+	if len(got) != len(want) {
+		t.Fatalf("got %v: expected %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v: expected %v", got, want)
+		}
+	}
+	if s.GetString(ctx, "cart") != "apples" || s.GetString(ctx, "coupon") != "SPRING" || s.GetInt(ctx, "userID") != 1 {
+		t.Errorf("got %v: expected the whitelisted values to be kept", s.Snapshot(ctx))
+	}
+	if s.ReauthenticationRequired(ctx) {
+		t.Errorf("expected the guest session flags to be cleared")
+	}
+
+	// Reserved keys are kept, so the MaxLifetime deadline and the PublicID
+	// carry over into the logged-in session.
+	s = New()
+	s.MaxLifetime = time.Hour
+
+	ctx, err = s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "theme", "dark")
+	publicID := s.PublicID(ctx)
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deadline := s.Deadline(ctx)
+
+	time.Sleep(10 * time.Millisecond)
+	if err := s.Promote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "userID", 1)
+	token, _, err = s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Deadline(ctx); !got.Equal(deadline) {
+		t.Errorf("got %v: expected %v", got, deadline)
+	}
+	if got := s.PublicID(ctx); got != publicID {
+		t.Errorf("got %q: expected %q", got, publicID)
+	}
+	if s.Exists(ctx, "theme") {
+		t.Errorf("expected %q to be removed", "theme")
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.Lifetime = time.Hour
+	s.IdleTimeout = 20 * time.Minute
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := s.Remaining(ctx); d <= 19*time.Minute || d > 20*time.Minute {
+		t.Errorf("got %v: expected about 20m", d)
+	}
+
+	sd := s.getSessionDataFromContext(ctx)
+	start := sd.loadedAt
+	sd.deadline = start.Add(30 * time.Minute)
+
+	testTable := []struct {
+		elapsed  time.Duration
+		idle     time.Duration
+		absolute time.Duration
+	}{
+		{0, 20 * time.Minute, 30 * time.Minute},
+		{5 * time.Minute, 15 * time.Minute, 25 * time.Minute},
+		{15 * time.Minute, 5 * time.Minute, 15 * time.Minute},
+		{20 * time.Minute, 0, 10 * time.Minute},
+		{45 * time.Minute, 0, 0},
+	}
+	for _, test := range testTable {
+		idle, absolute := s.remaining(sd, start.Add(test.elapsed))
+		if idle != test.idle || absolute != test.absolute {
+			t.Errorf("after %v: got %v and %v: expected %v and %v", test.elapsed, idle, absolute, test.idle, test.absolute)
+		}
+	}
+
+	// The idle countdown can't outlast the absolute one, and without an idle
+	// timeout it follows the absolute one.
+	sd.deadline = start.Add(10 * time.Minute)
+	if idle, _ := s.remaining(sd, start); idle != 10*time.Minute {
+		t.Errorf("got %v: expected %v", idle, 10*time.Minute)
+	}
+	s.IdleTimeout = 0
+	if idle, absolute := s.remaining(sd, start.Add(4*time.Minute)); idle != 6*time.Minute || absolute != 6*time.Minute {
+		t.Errorf("got %v and %v: expected %v", idle, absolute, 6*time.Minute)
+	}
+}
+
+func TestStepUp(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if needs, purpose := s.NeedsStepUp(ctx); needs || purpose != "" {
+		t.Fatalf("got %v %q: expected %v %q", needs, purpose, false, "")
+	}
+
+	s.RequireStepUp(ctx, "change-email")
+	if s.Status(ctx) != Modified {
+		t.Errorf("got %v: expected %v", s.Status(ctx), Modified)
+	}
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if needs, purpose := s.NeedsStepUp(ctx); !needs || purpose != "change-email" {
+		t.Fatalf("got %v %q: expected %v %q", needs, purpose, true, "change-email")
+	}
+
+	s.CompleteStepUp(ctx)
+	if needs, _ := s.NeedsStepUp(ctx); needs {
+		t.Fatalf("got %v: expected CompleteStepUp to clear the requirement", needs)
+	}
+	if s.Exists(ctx, stepUpPurposeKey) || s.Exists(ctx, stepUpExpiresKey) {
+		t.Errorf("expected CompleteStepUp to remove the step-up data")
+	}
+
+	s.StepUpTTL = 50 * time.Millisecond
+	s.RequireStepUp(ctx, "delete-account")
+	if needs, purpose := s.NeedsStepUp(ctx); !needs || purpose != "delete-account" {
+		t.Fatalf("got %v %q: expected %v %q", needs, purpose, true, "delete-account")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if needs, _ := s.NeedsStepUp(ctx); needs {
+		t.Fatalf("got %v: expected the requirement to lapse after StepUpTTL", needs)
+	}
+	if s.Exists(ctx, stepUpPurposeKey) {
+		t.Errorf("expected the lapsed requirement to be removed")
+	}
+}
+
+func TestDestroyAllForUser(t *testing.T) {
+	t.Parallel()
+
+	newSession := func(t *testing.T, s *SessionManager, userID interface{}) string {
+		ctx, err := s.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put(ctx, "foo", "bar")
+		if userID != nil {
+			s.Put(ctx, "userID", userID)
+		}
+		token, _, err := s.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	exists := func(t *testing.T, s *SessionManager, token string) bool {
+		_, found, err := s.Store.Find(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+
+	t.Run("Indexed", func(t *testing.T) {
+		store := memstore.NewWithCleanupInterval(0)
+		s := New()
+		s.Store = store
+		s.IndexKey = "userID"
+
+		a := newSession(t, s, 1)
+		b := newSession(t, s, 1)
+		c := newSession(t, s, 2)
+		anon := newSession(t, s, nil)
+
+		// Renewing the token moves the index entry to the new token.
+		ctx, err := s.Load(context.Background(), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RenewToken(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if b, _, err = s.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// Switching user moves the session to the new user's index.
+		d := newSession(t, s, 1)
+		ctx, err = s.Load(context.Background(), d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put(ctx, "userID", 3)
+		if _, _, err := s.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// Destroying a session removes it from the index.
+		e := newSession(t, s, 1)
+		ctx, err = s.Load(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Destroy(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		for userID, want := range map[string][]string{"1": {a, b}, "2": {c}, "3": {d}} {
+			got, err := store.TokensForIndex("userID", userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("user %s: got %v: expected %v", userID, got, want)
+			}
+			for _, token := range want {
+				found := false
+				for _, g := range got {
+					found = found || g == token
+				}
+				if !found {
+					t.Fatalf("user %s: got %v: expected %v", userID, got, want)
+				}
+			}
+		}
+
+		if err := s.DestroyAllForUser(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+		if exists(t, s, a) || exists(t, s, b) {
+			t.Errorf("expected the sessions for user 1 to be destroyed")
+		}
+		if !exists(t, s, c) || !exists(t, s, d) || !exists(t, s, anon) {
+			t.Errorf("expected the other sessions to be kept")
+		}
+		if got, _ := store.TokensForIndex("userID", "1"); len(got) != 0 {
+			t.Errorf("got %v: expected the index for user 1 to be empty", got)
+		}
+	})
+
+	t.Run("Iterable", func(t *testing.T) {
+		s := New()
+		s.Store = struct{ IterableStore }{memstore.NewWithCleanupInterval(0)}
+		s.IndexKey = "userID"
+
+		a := newSession(t, s, 1)
+		b := newSession(t, s, 2)
+		anon := newSession(t, s, nil)
+
+		if err := s.DestroyAllForUser(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+		if exists(t, s, a) {
+			t.Errorf("expected the session for user 1 to be destroyed")
+		}
+		if !exists(t, s, b) || !exists(t, s, anon) {
+			t.Errorf("expected the other sessions to be kept")
+		}
+	})
+
+	t.Run("Blobs", func(t *testing.T) {
+		for name, store := range map[string]Store{
+			"Indexed":  memstore.NewWithCleanupInterval(0),
+			"Iterable": struct{ IterableStore }{memstore.NewWithCleanupInterval(0)},
+		} {
+			s := New()
+			s.Store = store
+			s.IndexKey = "userID"
+			s.BlobThreshold = 256
+
+			ctx, err := s.Load(context.Background(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Put(ctx, "userID", 1)
+			s.Put(ctx, "avatar", strings.Repeat("x", 1024))
+			token, _, err := s.Commit(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.DestroyAllForUser(context.Background(), 1); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if exists(t, s, token) {
+				t.Errorf("%s: expected the session to be destroyed", name)
+			}
+			all, err := store.(IterableStore).All()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key := range all {
+				t.Errorf("%s: got %q: expected the offloaded values to be deleted", name, key)
+			}
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		s := New()
+		if err := s.DestroyAllForUser(context.Background(), 1); err != ErrNoIndexKey {
+			t.Errorf("got %v: expected %v", err, ErrNoIndexKey)
+		}
+
+		s.IndexKey = "userID"
+		s.Store = struct{ Store }{memstore.NewWithCleanupInterval(0)}
+		if err := s.DestroyAllForUser(context.Background(), 1); err != ErrIndexNotSupported {
+			t.Errorf("got %v: expected %v", err, ErrIndexNotSupported)
+		}
+	})
+}
+
+type unregisteredValue struct {
+	N int
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	store := &sizeRecordingStore{MemStore: memstore.NewWithCleanupInterval(0), sizes: make(map[string]int)}
+	s := New()
+	s.Store = store
+	s.MaxKeys = 2
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	if err := s.Validate(ctx); err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+
+	s.Put(ctx, "bad", unregisteredValue{N: 1})
+	err = s.Validate(ctx)
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("got %v: expected an error for the unregistered type", err)
+	}
+	if _, _, commitErr := s.Commit(ctx); commitErr == nil || commitErr.Error() != err.Error() {
+		t.Errorf("got %v: expected Commit to fail with %v", commitErr, err)
+	}
+
+	s.Remove(ctx, "bad")
+	s.Put(ctx, "baz", 1)
+	s.Put(ctx, "qux", 2)
+	if err := s.Validate(ctx); err != ErrTooManyKeys {
+		t.Errorf("got %v: expected %v", err, ErrTooManyKeys)
+	}
+
+	if len(store.sizes) != 0 {
+		t.Errorf("got %d commits: expected Validate not to write to the store", len(store.sizes))
+	}
+	if s.Status(ctx) != Modified {
+		t.Errorf("got %v: expected %v", s.Status(ctx), Modified)
+	}
+}
+
+type registeredValue struct {
+	Name string
+}
+
+func TestRegisterType(t *testing.T) {
+	t.Parallel()
+
+	GobCodec{}.RegisterType(registeredValue{})
+
+	var warnings []string
+	s := New()
+	s.OnUnencodableValue = func(ctx context.Context, key string, err error) {
+		warnings = append(warnings, key)
+	}
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "string", "bar")
+	s.Put(ctx, "registered", registeredValue{Name: "alice"})
+	s.PutWithTTL(ctx, "ttl", []int{1, 2}, time.Hour)
+	if len(warnings) != 0 {
+		t.Fatalf("got warnings for %v: expected none", warnings)
+	}
+
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := s.Get(ctx, "registered").(registeredValue); !ok || got.Name != "alice" {
+		t.Fatalf("got %#v: expected the registered type to round-trip", s.Get(ctx, "registered"))
+	}
+
+	s.Put(ctx, "unregistered", unregisteredValue{N: 1})
+	if err := s.PutAll(ctx, map[string]interface{}{"also": unregisteredValue{N: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"unregistered", "also"}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("got warnings for %v: expected %v", warnings, want)
+	}
+
+	// Values aren't checked when they won't be encoded by gob.
+	warnings = nil
+	s.Codec = NewJSONCodec(JSONCodecOptions{})
+	s.Put(ctx, "json", unregisteredValue{N: 3})
+	if len(warnings) != 0 {
+		t.Errorf("got warnings for %v: expected none", warnings)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	t.Parallel()
+
+	newSession := func(t *testing.T, s *SessionManager, labels ...string) string {
+		ctx, err := s.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put(ctx, "foo", "bar")
+		for _, label := range labels {
+			s.AddLabel(ctx, label)
+		}
+		token, _, err := s.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	stores := map[string]func() Store{
+		"Indexed":  func() Store { return memstore.NewWithCleanupInterval(0) },
+		"Iterable": func() Store { return struct{ IterableStore }{memstore.NewWithCleanupInterval(0)} },
+	}
+	for name, newStore := range stores {
+		newStore := newStore
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s := New()
+			s.Store = newStore()
+
+			a := newSession(t, s, "incident")
+			b := newSession(t, s, "incident", "beta")
+			c := newSession(t, s, "beta")
+			d := newSession(t, s)
+
+			ctx, err := s.Load(context.Background(), b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Labels(ctx); !reflect.DeepEqual(got, []string{"beta", "incident"}) {
+				t.Fatalf("got %v: expected %v", got, []string{"beta", "incident"})
+			}
+			s.RemoveLabel(ctx, "incident")
+			s.AddLabel(ctx, "beta")
+			if got := s.Labels(ctx); !reflect.DeepEqual(got, []string{"beta"}) {
+				t.Fatalf("got %v: expected %v", got, []string{"beta"})
+			}
+			if _, _, err := s.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			// A destroyed session isn't counted.
+			e := newSession(t, s, "incident")
+			ctx, err = s.Load(context.Background(), e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Destroy(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := s.DestroyByLabel(context.Background(), "incident")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("got %d: expected %d", n, 1)
+			}
+			for token, want := range map[string]bool{a: false, b: true, c: true, d: true} {
+				if _, found, _ := s.Store.Find(token); found != want {
+					t.Errorf("got %v: expected %v", found, want)
+				}
+			}
+
+			n, err = s.DestroyByLabel(context.Background(), "beta")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Errorf("got %d: expected %d", n, 2)
+			}
+			if _, found, _ := s.Store.Find(d); !found {
+				t.Errorf("expected the unlabeled session to be kept")
+			}
+		})
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.SetDefault("locale", "en-GB")
+	s.SetDefault("pageSize", 20)
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Defaults are returned for missing keys without being written.
+	if locale := s.GetString(ctx, "locale"); locale != "en-GB" {
+		t.Errorf("got %q: expected %q", locale, "en-GB")
+	}
+	if pageSize := s.GetInt(ctx, "pageSize"); pageSize != 20 {
+		t.Errorf("got %d: expected %d", pageSize, 20)
+	}
+	if s.Exists(ctx, "locale") {
+		t.Errorf("got %v: expected %v", true, false)
+	}
+	if s.Status(ctx) != Unmodified {
+		t.Errorf("got %v: expected %v", s.Status(ctx), Unmodified)
+	}
+
+	// Stored values take precedence, including after a round trip through the
+	// store.
+	s.Put(ctx, "locale", "fr-FR")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locale := s.GetString(ctx, "locale"); locale != "fr-FR" {
+		t.Errorf("got %q: expected %q", locale, "fr-FR")
+	}
+	if locale := s.Peek(ctx, "locale"); locale != "fr-FR" {
+		t.Errorf("got %v: expected %q", locale, "fr-FR")
+	}
+
+	s.Remove(ctx, "locale")
+	if locale := s.GetString(ctx, "locale"); locale != "en-GB" {
+		t.Errorf("got %q: expected %q", locale, "en-GB")
+	}
+
+	s.SetDefault("locale", nil)
+	if locale := s.Get(ctx, "locale"); locale != nil {
+		t.Errorf("got %v: expected %v", locale, nil)
+	}
+
+	// Reserved keys can't be given a default.
+	s.SetDefault(reauthenticateKey, true)
+	if required := s.ReauthenticationRequired(ctx); required {
+		t.Errorf("got %v: expected %v", required, false)
+	}
+	if val := s.Get(ctx, reauthenticateKey); val != nil {
+		t.Errorf("got %v: expected %v", val, nil)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	codecs := map[string]Codec{
+		"Gob":  GobCodec{},
+		"JSON": JSONCodec{},
+	}
+	for name, codec := range codecs {
+		codec := codec
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s := New()
+			s.Codec = codec
+
+			ctx, err := s.Load(context.Background(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Put(ctx, "step", "1")
+			s.Put(ctx, "name", "alice")
+			id := s.Checkpoint(ctx)
+
+			s.Put(ctx, "step", "2")
+			s.Put(ctx, "email", "alice@example.com")
+			s.PutWithTTL(ctx, "code", "1234", time.Minute)
+
+			// The checkpoint survives being committed and loaded again.
+			token, _, err := s.Commit(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, err = s.Load(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.Restore(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+			if s.Status(ctx) != Modified {
+				t.Errorf("got %v: expected %v", s.Status(ctx), Modified)
+			}
+			expected := []string{checkpointsKey, "name", "step"}
+			if keys := s.Keys(ctx); !reflect.DeepEqual(keys, expected) {
+				t.Errorf("got %v: expected %v", keys, expected)
+			}
+			if step := s.GetString(ctx, "step"); step != "1" {
+				t.Errorf("got %q: expected %q", step, "1")
+			}
+			if s.Exists(ctx, "code") {
+				t.Errorf("got %v: expected %v", true, false)
+			}
+
+			// A checkpoint can be restored more than once.
+			s.Put(ctx, "step", "3")
+			if err := s.Restore(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+			if step := s.GetString(ctx, "step"); step != "1" {
+				t.Errorf("got %q: expected %q", step, "1")
+			}
+
+			if err := s.Restore(ctx, "missing"); err != ErrUnknownCheckpoint {
+				t.Errorf("got %v: expected %v", err, ErrUnknownCheckpoint)
+			}
+			s.ClearCheckpoints(ctx)
+			if err := s.Restore(ctx, id); err != ErrUnknownCheckpoint {
+				t.Errorf("got %v: expected %v", err, ErrUnknownCheckpoint)
+			}
+		})
+	}
+
+	t.Run("Blobs", func(t *testing.T) {
+		t.Parallel()
+
+		s := New()
+		s.BlobThreshold = 256
+		big := strings.Repeat("x", 1024)
+		roundTrip := func(ctx context.Context) context.Context {
+			token, _, err := s.Commit(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, err = s.Load(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ctx
+		}
+
+		ctx, err := s.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put(ctx, "big", big)
+
+		// The value has been offloaded when the checkpoint is taken, and the
+		// checkpoints themselves are large enough to be offloaded.
+		ctx = roundTrip(ctx)
+		id := s.Checkpoint(ctx)
+		ctx = roundTrip(ctx)
+
+		s.Put(ctx, "big", "small")
+		ctx = roundTrip(ctx)
+		if err := s.Restore(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		ctx = roundTrip(ctx)
+		if got := s.GetString(ctx, "big"); got != big {
+			t.Errorf("got %q: expected %q", got, big)
+		}
+
+		// A snapshot with more keys than MaxKeys allows isn't restored.
+		s.Put(ctx, "other", "value")
+		id = s.Checkpoint(ctx)
+		s.Remove(ctx, "other")
+		s.MaxKeys = 1
+		if err := s.Restore(ctx, id); err != ErrTooManyKeys {
+			t.Errorf("got %v: expected %v", err, ErrTooManyKeys)
+		}
+		if s.Exists(ctx, "other") {
+			t.Errorf("got %v: expected %v", true, false)
+		}
+	})
+}
+
+func TestExpireAt(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.IdleTimeout = time.Hour
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	at := time.Now().Add(200 * time.Millisecond)
+	s.ExpireAt(ctx, at)
+	if !s.Deadline(ctx).Equal(at) {
+		t.Errorf("got %v: expected %v", s.Deadline(ctx), at)
+	}
+	if err := s.RenewToken(ctx); err != nil {
+		t.Fatal(err)
+	}
+	token, expiry, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiry.Equal(at) {
+		t.Errorf("got %v: expected the store expiry to be %v", expiry, at)
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GetString(ctx, "foo") != "bar" {
+		t.Fatalf("got %q: expected the session to be valid before the deadline", s.GetString(ctx, "foo"))
+	}
+
+	time.Sleep(time.Until(at) + 50*time.Millisecond)
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists(ctx, "foo") {
+		t.Errorf("expected the session to have expired after the deadline")
+	}
+
+	// The deadline is still capped by MaxLifetime.
+	s = New()
+	s.MaxLifetime = time.Hour
+	ctx, err = s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ExpireAt(ctx, time.Now().Add(48*time.Hour))
+	if d := time.Until(s.Deadline(ctx)); d > time.Hour {
+		t.Errorf("got %v: expected the deadline to be capped by MaxLifetime", d)
+	}
+}
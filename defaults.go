@@ -0,0 +1,45 @@
+package scs
+
+import "sync"
+
+var defaultsMutex = &sync.Mutex{}
+
+// SetDefault registers a default value for the given key, such as a default
+// locale or theme. Get, Peek and the GetString, GetInt and other helper methods
+// return the default when the key isn't present in the session data. Defaults
+// are never written to the session data, so they don't change the session data
+// status, and a value stored under the key always takes precedence. Passing a
+// nil value removes the default for the key. It is safe to call SetDefault
+// while requests are being served.
+//
+// Defaults only apply to the application's own reads. Keys beginning with "__",
+// which are reserved for scs, can't be given a default and are ignored, and the
+// checks scs makes itself, such as RequireSession and the IdentityKey tracking,
+// only look at the values actually stored in the session data.
+func (s *SessionManager) SetDefault(key string, value interface{}) {
+	if isReservedKey(key) {
+		return
+	}
+
+	defaultsMutex.Lock()
+	defer defaultsMutex.Unlock()
+
+	old, _ := s.defaults.Load().(map[string]interface{})
+	defaults := make(map[string]interface{}, len(old)+1)
+	for k, v := range old {
+		defaults[k] = v
+	}
+	if value == nil {
+		delete(defaults, key)
+	} else {
+		defaults[key] = value
+	}
+	s.defaults.Store(defaults)
+}
+
+// defaultValue returns the default value registered with SetDefault for the
+// given key, or nil if there isn't one.
+func (s *SessionManager) defaultValue(key string) interface{} {
+	defaults, _ := s.defaults.Load().(map[string]interface{})
+	return defaults[key]
+}
@@ -0,0 +1,47 @@
+// Package echosession provides Echo middleware which loads and saves session
+// data using a scs.SessionManager.
+//
+// The middleware wraps the scs LoadAndSave middleware, so that it behaves in
+// exactly the same way: the response is buffered until the handler chain has
+// finished, at which point the session data is committed and the session
+// cookie is written before the response is sent. Handlers access the session
+// data through the request context, for example:
+//
+//	sessionManager.Put(c.Request().Context(), "message", "Hello from a session!")
+package echosession
+
+import (
+	"net/http"
+
+	"github.com/gaconkzk/scs/v2"
+	"github.com/labstack/echo/v4"
+)
+
+// Middleware returns an echo.MiddlewareFunc which loads and saves session data
+// for the current request using the given session manager.
+//
+// Errors returned by the handler chain are passed to the Echo HTTPErrorHandler
+// before the session is saved, so that the error response is written along
+// with the session cookie.
+func Middleware(s *scs.SessionManager) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response()
+			orig := res.Writer
+
+			s.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c.SetRequest(r)
+				res.Writer = w
+				defer func() {
+					res.Writer = orig
+				}()
+
+				if err := next(c); err != nil {
+					c.Error(err)
+				}
+			})).ServeHTTP(orig, c.Request())
+
+			return nil
+		}
+	}
+}
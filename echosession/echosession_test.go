@@ -0,0 +1,70 @@
+package echosession
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gaconkzk/scs/v2"
+	"github.com/labstack/echo/v4"
+)
+
+func TestMiddleware(t *testing.T) {
+	sessionManager := scs.New()
+
+	e := echo.New()
+	e.Use(Middleware(sessionManager))
+	e.GET("/put", func(c echo.Context) error {
+		sessionManager.Put(c.Request().Context(), "foo", "bar")
+		return c.String(http.StatusCreated, "ok")
+	})
+	e.GET("/get", func(c echo.Context) error {
+		return c.String(http.StatusOK, sessionManager.GetString(c.Request().Context(), "foo"))
+	})
+
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, httptest.NewRequest("GET", "/put", nil))
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("got %d: expected %d", rr.Code, http.StatusCreated)
+	}
+	cookie := rr.Header().Get("Set-Cookie")
+	if !strings.HasPrefix(cookie, "session=") || !strings.Contains(cookie, "HttpOnly") {
+		t.Fatalf("got %q: expected session cookie", cookie)
+	}
+
+	req := httptest.NewRequest("GET", "/get", nil)
+	req.Header.Set("Cookie", strings.SplitN(cookie, ";", 2)[0])
+	rr = httptest.NewRecorder()
+	e.ServeHTTP(rr, req)
+
+	if body := rr.Body.String(); body != "bar" {
+		t.Errorf("got %q: expected %q", body, "bar")
+	}
+	if rr.Header().Get("Set-Cookie") != "" {
+		t.Errorf("got %q: expected no cookie", rr.Header().Get("Set-Cookie"))
+	}
+}
+
+func TestMiddlewareHandlerError(t *testing.T) {
+	sessionManager := scs.New()
+
+	e := echo.New()
+	e.Use(Middleware(sessionManager))
+	e.GET("/", func(c echo.Context) error {
+		sessionManager.Put(c.Request().Context(), "foo", "bar")
+		return echo.NewHTTPError(http.StatusTeapot, errors.New("short and stout"))
+	})
+
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	if rr.Code != http.StatusTeapot {
+		t.Errorf("got %d: expected %d", rr.Code, http.StatusTeapot)
+	}
+	if cookie := rr.Header().Get("Set-Cookie"); !strings.HasPrefix(cookie, "session=") {
+		t.Errorf("got %q: expected session cookie", cookie)
+	}
+}
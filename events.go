@@ -0,0 +1,104 @@
+package scs
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies the kind of a SessionEvent.
+type EventType int
+
+const (
+	// EventCreated indicates that a new session token has been assigned to
+	// session data which is being committed for the first time.
+	EventCreated EventType = iota
+
+	// EventCommitted indicates that the session data has been committed.
+	EventCommitted
+
+	// EventDestroyed indicates that the session data has been destroyed with
+	// Destroy.
+	EventDestroyed
+
+	// EventExpired indicates that session data was found in the session store
+	// when it was loaded, but had passed its deadline, so a new session was
+	// started instead.
+	EventExpired
+)
+
+// tokenPrefixLength is the number of characters of the session token included
+// in a SessionEvent.
+const tokenPrefixLength = 6
+
+// defaultEventBufferSize is the size of the events channel buffer used when
+// EventBufferSize isn't set.
+const defaultEventBufferSize = 100
+
+// SessionEvent describes a change in the lifecycle of a session. Session
+// events are sent on the channel returned by Events.
+type SessionEvent struct {
+	// Type is the kind of event.
+	Type EventType
+
+	// TokenPrefix holds the first few characters of the session token, which
+	// is enough to tell sessions apart on a dashboard without exposing the
+	// token itself. With HashStoreKeys or StoreKeyPepper the token is still
+	// used, not the store key.
+	TokenPrefix string
+
+	// Time is when the event happened.
+	Time time.Time
+}
+
+var eventsMutex = &sync.Mutex{}
+
+// Events returns a channel on which session lifecycle events are sent, for
+// uses such as dashboards. Events are only generated once Events has been
+// called, and every call returns the same channel, so there should be a single
+// consumer. The channel has a buffer of EventBufferSize events, and if it is
+// full when an event is sent the oldest buffered event is dropped, so a slow
+// consumer never delays requests. Events for different sessions may be
+// delivered slightly out of order when they happen at the same time.
+func (s *SessionManager) Events() <-chan SessionEvent {
+	if ch, ok := s.events.Load().(chan SessionEvent); ok {
+		return ch
+	}
+
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	if ch, ok := s.events.Load().(chan SessionEvent); ok {
+		return ch
+	}
+	size := s.EventBufferSize
+	if size <= 0 {
+		size = defaultEventBufferSize
+	}
+	ch := make(chan SessionEvent, size)
+	s.events.Store(ch)
+	return ch
+}
+
+// emitEvent sends an event for the given session token if Events has been
+// called, dropping the oldest buffered event if the channel is full.
+func (s *SessionManager) emitEvent(typ EventType, token string) {
+	ch, ok := s.events.Load().(chan SessionEvent)
+	if !ok {
+		return
+	}
+
+	if len(token) > tokenPrefixLength {
+		token = token[:tokenPrefixLength]
+	}
+	ev := SessionEvent{Type: typ, TokenPrefix: token, Time: time.Now()}
+	for {
+		select {
+		case ch <- ev:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
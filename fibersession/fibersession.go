@@ -0,0 +1,83 @@
+// Package fibersession provides Fiber middleware which loads and saves session
+// data using a scs.SessionManager.
+//
+// Fiber isn't built on net/http, so the middleware converts the incoming
+// request and runs the scs LoadAndSave middleware around the rest of the Fiber
+// handler chain. The handlers write their response to the Fiber context as
+// usual, and once they have returned the session data is committed and the
+// session cookie is added to the Fiber response. Handlers access the session
+// data through the user context, for example:
+//
+//	sessionManager.Put(c.UserContext(), "message", "Hello from a session!")
+package fibersession
+
+import (
+	"net/http"
+
+	"github.com/gaconkzk/scs/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// Middleware returns a fiber.Handler which loads and saves session data for
+// the current request using the given session manager.
+func Middleware(s *scs.SessionManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		r, err := adaptor.ConvertRequest(c, true)
+		if err != nil {
+			return err
+		}
+		r = r.WithContext(c.UserContext())
+
+		var nextErr error
+		w := &responseWriter{c: c, header: make(http.Header)}
+		s.LoadAndSave(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			c.SetUserContext(r.Context())
+			nextErr = c.Next()
+		})).ServeHTTP(w, r)
+		w.writeHeader()
+
+		return nextErr
+	}
+}
+
+// responseWriter is the http.ResponseWriter passed to LoadAndSave. The Fiber
+// handlers write their response directly to the Fiber context, so the only
+// things written here are the session cookie and cache headers, and any error
+// response from the session manager's ErrorFunc.
+type responseWriter struct {
+	c           *fiber.Ctx
+	header      http.Header
+	wroteHeader bool
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	w.writeHeader()
+	if code > 0 {
+		w.c.Status(code)
+	}
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.writeHeader()
+	return w.c.Write(b)
+}
+
+// writeHeader copies the headers to the Fiber response, the first time it is
+// called.
+func (w *responseWriter) writeHeader() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	for key, values := range w.header {
+		for _, value := range values {
+			w.c.Response().Header.Add(key, value)
+		}
+	}
+}
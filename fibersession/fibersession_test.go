@@ -0,0 +1,83 @@
+package fibersession
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gaconkzk/scs/v2"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestMiddleware(t *testing.T) {
+	sessionManager := scs.New()
+
+	app := fiber.New()
+	app.Use(Middleware(sessionManager))
+	app.Get("/put", func(c *fiber.Ctx) error {
+		sessionManager.Put(c.UserContext(), "foo", "bar")
+		return c.Status(http.StatusCreated).SendString("ok")
+	})
+	app.Get("/get", func(c *fiber.Ctx) error {
+		return c.SendString(sessionManager.GetString(c.UserContext(), "foo"))
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/put", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("got %d: expected %d", resp.StatusCode, http.StatusCreated)
+	}
+	cookie := resp.Header.Get("Set-Cookie")
+	if !strings.HasPrefix(cookie, "session=") || !strings.Contains(cookie, "HttpOnly") {
+		t.Fatalf("got %q: expected session cookie", cookie)
+	}
+	if vary := resp.Header.Get("Vary"); vary != "Cookie" {
+		t.Errorf("got %q: expected %q", vary, "Cookie")
+	}
+
+	req := httptest.NewRequest("GET", "/get", nil)
+	req.Header.Set("Cookie", strings.SplitN(cookie, ";", 2)[0])
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "bar" {
+		t.Errorf("got %q: expected %q", body, "bar")
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		t.Errorf("got %q: expected no cookie", resp.Header.Get("Set-Cookie"))
+	}
+}
+
+func TestMiddlewareHandlerError(t *testing.T) {
+	sessionManager := scs.New()
+
+	app := fiber.New()
+	app.Use(Middleware(sessionManager))
+	app.Get("/", func(c *fiber.Ctx) error {
+		sessionManager.Put(c.UserContext(), "foo", "bar")
+		return fiber.NewError(http.StatusTeapot, "short and stout")
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusTeapot {
+		t.Errorf("got %d: expected %d", resp.StatusCode, http.StatusTeapot)
+	}
+	if cookie := resp.Header.Get("Set-Cookie"); !strings.HasPrefix(cookie, "session=") {
+		t.Errorf("got %q: expected session cookie", cookie)
+	}
+}
@@ -0,0 +1,61 @@
+package scs
+
+import (
+	"context"
+)
+
+// Session data keys used to record the session generation of the identity
+// under IdentityKey when GenerationFunc is set.
+const (
+	generationKey    = "__generation"
+	generationForKey = "__generation:for"
+)
+
+// recordGeneration records the current session generation for the identity
+// under IdentityKey in the session data, if it hasn't already been recorded
+// for that identity. It is called when the session data is committed, so the
+// generation is recorded when the user logs in. The caller must hold sd.mu.
+func (s *SessionManager) recordGeneration(ctx context.Context, sd *sessionData) error {
+	if s.GenerationFunc == nil || s.IdentityKey == "" {
+		return nil
+	}
+
+	identity := sd.values[s.IdentityKey]
+	if identity == nil {
+		delete(sd.values, generationKey)
+		delete(sd.values, generationForKey)
+		return nil
+	}
+	if _, ok := sd.values[generationKey].(int64); ok && sd.values[generationForKey] == indexValue(identity) {
+		return nil
+	}
+
+	gen, err := s.GenerationFunc(ctx, identity)
+	if err != nil {
+		return err
+	}
+	sd.values[generationKey] = gen
+	sd.values[generationForKey] = indexValue(identity)
+	return nil
+}
+
+// currentGeneration reports whether the session generation recorded in
+// session data which has just been loaded is still the current one for its
+// identity. Session data without a recorded generation is always current.
+func (s *SessionManager) currentGeneration(ctx context.Context, sd *sessionData) (bool, error) {
+	if s.GenerationFunc == nil || s.IdentityKey == "" {
+		return true, nil
+	}
+
+	recorded, ok := sd.values[generationKey].(int64)
+	identity := sd.values[s.IdentityKey]
+	if !ok || identity == nil || sd.values[generationForKey] != indexValue(identity) {
+		return true, nil
+	}
+
+	gen, err := s.GenerationFunc(ctx, identity)
+	if err != nil {
+		return false, err
+	}
+	return gen == recorded, nil
+}
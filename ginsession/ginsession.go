@@ -0,0 +1,119 @@
+// Package ginsession provides Gin middleware which loads and saves session
+// data using a scs.SessionManager.
+//
+// The middleware wraps the scs LoadAndSave middleware, so that it behaves in
+// exactly the same way: the response is buffered until the handler chain has
+// finished, at which point the session data is committed and the session
+// cookie is written before the response is sent. Handlers access the session
+// data through the request context, for example:
+//
+//	sessionManager.Put(c.Request.Context(), "message", "Hello from a session!")
+package ginsession
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+
+	"github.com/gaconkzk/scs/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware returns a gin.HandlerFunc which loads and saves session data for
+// the current request using the given session manager.
+func Middleware(s *scs.SessionManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var called bool
+		s.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+
+			orig := c.Writer
+			rw := &responseWriter{ResponseWriter: orig, w: w, status: http.StatusOK, size: -1}
+			c.Request = r
+			c.Writer = rw
+			defer func() {
+				c.Writer = orig
+			}()
+
+			c.Next()
+			rw.WriteHeaderNow()
+		})).ServeHTTP(c.Writer, c.Request)
+
+		// The session couldn't be loaded and the error response has already
+		// been written, so don't run the rest of the handler chain.
+		if !called {
+			c.Abort()
+		}
+	}
+}
+
+// responseWriter implements gin.ResponseWriter on top of the http.ResponseWriter
+// passed to the handler by LoadAndSave, so that writes made through the Gin
+// context are buffered until the session has been saved.
+type responseWriter struct {
+	gin.ResponseWriter
+	w      http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if code > 0 && !rw.Written() {
+		rw.status = code
+	}
+}
+
+func (rw *responseWriter) WriteHeaderNow() {
+	if !rw.Written() {
+		rw.size = 0
+		rw.w.WriteHeader(rw.status)
+	}
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.WriteHeaderNow()
+	n, err := rw.w.Write(b)
+	rw.size += n
+	return n, err
+}
+
+func (rw *responseWriter) WriteString(s string) (int, error) {
+	return rw.Write([]byte(s))
+}
+
+func (rw *responseWriter) Status() int {
+	return rw.status
+}
+
+func (rw *responseWriter) Size() int {
+	return rw.size
+}
+
+func (rw *responseWriter) Written() bool {
+	return rw.size != -1
+}
+
+func (rw *responseWriter) Flush() {
+	rw.WriteHeaderNow()
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rw.size < 0 {
+		rw.size = 0
+	}
+	return rw.w.(http.Hijacker).Hijack()
+}
+
+func (rw *responseWriter) Pusher() http.Pusher {
+	if p, ok := rw.w.(http.Pusher); ok {
+		return p
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package ginsession
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestMiddleware(t *testing.T) {
+	sessionManager := scs.New()
+
+	router := gin.New()
+	router.Use(Middleware(sessionManager))
+	router.GET("/put", func(c *gin.Context) {
+		sessionManager.Put(c.Request.Context(), "foo", "bar")
+		c.String(http.StatusCreated, "ok")
+	})
+	router.GET("/get", func(c *gin.Context) {
+		c.String(http.StatusOK, sessionManager.GetString(c.Request.Context(), "foo"))
+	})
+	router.GET("/status", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/put", nil))
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("got %d: expected %d", rr.Code, http.StatusCreated)
+	}
+	cookie := rr.Header().Get("Set-Cookie")
+	if !strings.HasPrefix(cookie, "session=") || !strings.Contains(cookie, "HttpOnly") {
+		t.Fatalf("got %q: expected session cookie", cookie)
+	}
+
+	req := httptest.NewRequest("GET", "/get", nil)
+	req.Header.Set("Cookie", strings.SplitN(cookie, ";", 2)[0])
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if body := rr.Body.String(); body != "bar" {
+		t.Errorf("got %q: expected %q", body, "bar")
+	}
+	if rr.Header().Get("Set-Cookie") != "" {
+		t.Errorf("got %q: expected no cookie", rr.Header().Get("Set-Cookie"))
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/status", nil))
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("got %d: expected %d", rr.Code, http.StatusNoContent)
+	}
+}
+
+func TestMiddlewareLoadError(t *testing.T) {
+	sessionManager := scs.New()
+	sessionManager.Store = errorStore{}
+
+	var called bool
+	router := gin.New()
+	router.Use(Middleware(sessionManager))
+	router.GET("/", func(c *gin.Context) {
+		called = true
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", "session=foo")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if called {
+		t.Error("expected handler not to be called")
+	}
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("got %d: expected %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+type errorStore struct{}
+
+func (errorStore) Find(token string) ([]byte, bool, error) {
+	return nil, false, errors.New("find failed")
+}
+
+func (errorStore) Commit(token string, b []byte, expiry time.Time) error {
+	return nil
+}
+
+func (errorStore) Delete(token string) error {
+	return nil
+}
@@ -0,0 +1,124 @@
+// Package grpcsession provides gRPC server interceptors which load and commit
+// session data using a scs.SessionManager, so that gRPC services can share
+// sessions with a HTTP application.
+//
+// The session token is read from the incoming request metadata under a
+// configurable key. If the session data is modified by the handler it is
+// committed, and the session token is sent back to the client in the trailing
+// metadata under the same key. If the session is destroyed, the trailer is
+// sent with an empty value, which the client should treat as a signal to
+// discard its stored token.
+package grpcsession
+
+import (
+	"context"
+
+	"github.com/gaconkzk/scs/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultMetadataKey is the metadata key used for the session token by
+// UnaryServerInterceptor and StreamServerInterceptor.
+const DefaultMetadataKey = "session"
+
+// UnaryServerInterceptor returns a unary server interceptor which loads and
+// commits session data using the given session manager, with the session
+// token sent in the DefaultMetadataKey metadata key.
+func UnaryServerInterceptor(s *scs.SessionManager) grpc.UnaryServerInterceptor {
+	return UnaryServerInterceptorWithKey(s, DefaultMetadataKey)
+}
+
+// UnaryServerInterceptorWithKey returns a unary server interceptor which loads
+// and commits session data using the given session manager. The key parameter
+// controls the metadata key used for the session token.
+func UnaryServerInterceptorWithKey(s *scs.SessionManager, key string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := s.Load(ctx, readToken(ctx, key))
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := handler(ctx, req)
+
+		trailer, commitErr := commit(ctx, s, key)
+		if commitErr != nil {
+			return nil, commitErr
+		}
+		if trailer != nil {
+			grpc.SetTrailer(ctx, trailer)
+		}
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns a stream server interceptor which loads and
+// commits session data using the given session manager, with the session
+// token sent in the DefaultMetadataKey metadata key. The session data is
+// committed when the handler returns.
+func StreamServerInterceptor(s *scs.SessionManager) grpc.StreamServerInterceptor {
+	return StreamServerInterceptorWithKey(s, DefaultMetadataKey)
+}
+
+// StreamServerInterceptorWithKey returns a stream server interceptor which
+// loads and commits session data using the given session manager. The key
+// parameter controls the metadata key used for the session token.
+func StreamServerInterceptorWithKey(s *scs.SessionManager, key string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := s.Load(ss.Context(), readToken(ss.Context(), key))
+		if err != nil {
+			return err
+		}
+
+		err = handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+
+		trailer, commitErr := commit(ctx, s, key)
+		if commitErr != nil {
+			return commitErr
+		}
+		if trailer != nil {
+			ss.SetTrailer(trailer)
+		}
+		return err
+	}
+}
+
+// serverStream wraps a grpc.ServerStream so that handlers see the context
+// containing the session data.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *serverStream) Context() context.Context {
+	return ss.ctx
+}
+
+// readToken returns the session token from the incoming metadata in ctx, or
+// the empty string if there isn't one.
+func readToken(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// commit commits the session data in ctx if it has been modified, and returns
+// the trailing metadata which should be sent to the client, if any.
+func commit(ctx context.Context, s *scs.SessionManager, key string) (metadata.MD, error) {
+	switch s.Status(ctx) {
+	case scs.Modified:
+		token, _, err := s.Commit(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return metadata.Pairs(key, token), nil
+	case scs.Destroyed:
+		return metadata.Pairs(key, ""), nil
+	}
+	return nil, nil
+}
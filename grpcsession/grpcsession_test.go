@@ -0,0 +1,171 @@
+package grpcsession
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/gaconkzk/scs/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// newTestServer starts an in-process gRPC server with a "test.Session" service
+// which has a unary Put method that stores the request value in the session, a
+// unary Get method which returns it, a unary Destroy method and a Watch
+// server stream which sends the stored value and then stores a new one.
+func newTestServer(t *testing.T, s *scs.SessionManager) *grpc.ClientConn {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(s)),
+		grpc.StreamInterceptor(StreamServerInterceptor(s)),
+	)
+
+	unary := func(name string, fn func(ctx context.Context, in *wrapperspb.StringValue) (*wrapperspb.StringValue, error)) grpc.MethodDesc {
+		return grpc.MethodDesc{
+			MethodName: name,
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(wrapperspb.StringValue)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Session/" + name}
+				return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return fn(ctx, req.(*wrapperspb.StringValue))
+				})
+			},
+		}
+	}
+
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Session",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			unary("Put", func(ctx context.Context, in *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+				s.Put(ctx, "value", in.Value)
+				return &wrapperspb.StringValue{}, nil
+			}),
+			unary("Get", func(ctx context.Context, in *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+				return wrapperspb.String(s.GetString(ctx, "value")), nil
+			}),
+			unary("Destroy", func(ctx context.Context, in *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+				return &wrapperspb.StringValue{}, s.Destroy(ctx)
+			}),
+		},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Watch",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				if err := stream.SendMsg(wrapperspb.String(s.GetString(stream.Context(), "value"))); err != nil {
+					return err
+				}
+				s.Put(stream.Context(), "value", "streamed")
+				return nil
+			},
+		}},
+	}, struct{}{})
+
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func invoke(t *testing.T, conn *grpc.ClientConn, method, token, value string) (string, metadata.MD) {
+	t.Helper()
+
+	ctx := context.Background()
+	if token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, DefaultMetadataKey, token)
+	}
+	out := new(wrapperspb.StringValue)
+	var trailer metadata.MD
+	err := conn.Invoke(ctx, "/test.Session/"+method, wrapperspb.String(value), out, grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Value, trailer
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	s := scs.New()
+	conn := newTestServer(t, s)
+
+	_, trailer := invoke(t, conn, "Put", "", "bar")
+	tokens := trailer.Get(DefaultMetadataKey)
+	if len(tokens) != 1 || tokens[0] == "" {
+		t.Fatalf("got %v: expected a session token in the trailer", tokens)
+	}
+	token := tokens[0]
+
+	value, trailer := invoke(t, conn, "Get", token, "")
+	if value != "bar" {
+		t.Errorf("got %q: expected %q", value, "bar")
+	}
+	if len(trailer.Get(DefaultMetadataKey)) != 0 {
+		t.Errorf("got %v: expected no session token for an unmodified session", trailer.Get(DefaultMetadataKey))
+	}
+
+	_, trailer = invoke(t, conn, "Destroy", token, "")
+	if tokens := trailer.Get(DefaultMetadataKey); len(tokens) != 1 || tokens[0] != "" {
+		t.Errorf("got %v: expected an empty session token", tokens)
+	}
+
+	value, _ = invoke(t, conn, "Get", token, "")
+	if value != "" {
+		t.Errorf("got %q: expected %q", value, "")
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	s := scs.New()
+	conn := newTestServer(t, s)
+
+	_, trailer := invoke(t, conn, "Put", "", "bar")
+	token := trailer.Get(DefaultMetadataKey)[0]
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), DefaultMetadataKey, token)
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{StreamName: "Watch", ServerStreams: true}, "/test.Session/Watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&wrapperspb.StringValue{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(wrapperspb.StringValue)
+	if err := stream.RecvMsg(out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Value != "bar" {
+		t.Errorf("got %q: expected %q", out.Value, "bar")
+	}
+	if err := stream.RecvMsg(out); err != io.EOF {
+		t.Fatalf("got %v: expected %v", err, io.EOF)
+	}
+
+	if tokens := stream.Trailer().Get(DefaultMetadataKey); len(tokens) != 1 || tokens[0] != token {
+		t.Errorf("got %v: expected %v", tokens, []string{token})
+	}
+	value, _ := invoke(t, conn, "Get", token, "")
+	if value != "streamed" {
+		t.Errorf("got %q: expected %q", value, "streamed")
+	}
+}
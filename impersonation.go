@@ -0,0 +1,112 @@
+package scs
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+)
+
+// ErrNoIdentity is returned by Impersonate if IdentityKey is not set or the
+// session has no identity under it.
+var ErrNoIdentity = errors.New("scs: session has no identity to impersonate from")
+
+// ErrNotImpersonating is returned by StopImpersonation if the session is not
+// impersonating another identity.
+var ErrNotImpersonating = errors.New("scs: session is not impersonating another identity")
+
+// impersonatorsKey is the session data key used to hold the stack of
+// identities which have been replaced by Impersonate, oldest first.
+const impersonatorsKey = "__impersonators"
+
+func init() {
+	// The stack of identities is held in the session data as an interface{}
+	// value, so GobCodec needs its type to be registered.
+	gob.Register([]interface{}{})
+}
+
+// Impersonate replaces the identity under IdentityKey with targetID, for
+// example so that an administrator can act as another user, and pushes the
+// current identity onto a stack held in the session data so that it can be
+// restored with StopImpersonation. Impersonation can be nested. The session
+// token is renewed, as for any other privilege level change, and the session
+// data status will be set to Modified. If OnIdentityChange is set it is called
+// as usual when the session data is committed.
+//
+// ErrNoIdentity is returned if IdentityKey is not set or the session has no
+// identity to impersonate from.
+func (s *SessionManager) Impersonate(ctx context.Context, targetID interface{}) error {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if s.IdentityKey == "" || sd.values[s.IdentityKey] == nil {
+		return ErrNoIdentity
+	}
+	if err := s.renewToken(ctx, sd); err != nil {
+		return err
+	}
+
+	stack, _ := sd.values[impersonatorsKey].([]interface{})
+	stack = append(stack[:len(stack):len(stack)], sd.values[s.IdentityKey])
+	sd.values[impersonatorsKey] = stack
+	sd.values[s.IdentityKey] = targetID
+	return nil
+}
+
+// StopImpersonation ends the most recent call to Impersonate, restoring the
+// identity that it replaced. The session token is renewed and the session
+// data status will be set to Modified. ErrNotImpersonating is returned if the
+// session is not impersonating another identity.
+func (s *SessionManager) StopImpersonation(ctx context.Context) error {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	stack, _ := sd.values[impersonatorsKey].([]interface{})
+	if s.IdentityKey == "" || len(stack) == 0 {
+		return ErrNotImpersonating
+	}
+	if err := s.renewToken(ctx, sd); err != nil {
+		return err
+	}
+
+	sd.values[s.IdentityKey] = stack[len(stack)-1]
+	if len(stack) == 1 {
+		delete(sd.values, impersonatorsKey)
+	} else {
+		sd.values[impersonatorsKey] = stack[:len(stack)-1]
+	}
+	return nil
+}
+
+// IsImpersonating returns true if the session is impersonating another
+// identity, that is if Impersonate has been called more times than
+// StopImpersonation.
+func (s *SessionManager) IsImpersonating(ctx context.Context) bool {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	stack, _ := sd.values[impersonatorsKey].([]interface{})
+	return len(stack) > 0
+}
+
+// Impersonators returns the identities which have been replaced by
+// Impersonate, oldest first, so the first is the real identity of the user
+// who started impersonating. It returns nil if the session is not
+// impersonating another identity. This is useful for audit logging.
+func (s *SessionManager) Impersonators(ctx context.Context) []interface{} {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	stack, _ := sd.values[impersonatorsKey].([]interface{})
+	if len(stack) == 0 {
+		return nil
+	}
+	return append([]interface{}(nil), stack...)
+}
@@ -0,0 +1,240 @@
+package scs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNoIndexKey is returned by DestroyAllForUser if IndexKey is not set.
+var ErrNoIndexKey = errors.New("scs: IndexKey is not set")
+
+// ErrIndexNotSupported is returned by DestroyAllForUser and DestroyByLabel
+// when the session store implements neither the IndexedStore nor the
+// IterableStore interface.
+var ErrIndexNotSupported = errors.New("scs: session store does not support indexes or iteration")
+
+// indexValue returns the string form of a value held under IndexKey, which is
+// what the session store indexes. It returns an empty string for nil.
+func indexValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// DestroyAllForUser deletes the data for every session whose value under
+// IndexKey is userID from the session store, for example to log a user out
+// everywhere after a password change. If the session store implements
+// IndexedStore the sessions are looked up in the index; otherwise, if it
+// implements IterableStore, every session in the store is read and checked.
+// ErrNoIndexKey is returned if IndexKey is not set, and ErrIndexNotSupported if
+// the store supports neither. Values are compared using their fmt.Sprint
+// form.
+//
+// Session data already loaded into a request context is not affected, and
+// will be written back to the store if it is committed, so call Destroy for
+// the current request's session as well if it belongs to the user. Sessions
+// committed before IndexKey was set are only found by iteration.
+func (s *SessionManager) DestroyAllForUser(ctx context.Context, userID interface{}) error {
+	if s.IndexKey == "" {
+		return ErrNoIndexKey
+	}
+	value := indexValue(userID)
+	_, err := s.destroyIndexed(ctx, s.IndexKey, value, func(sd *sessionData) bool {
+		return indexValue(sd.values[s.IndexKey]) == value
+	})
+	return err
+}
+
+// destroyIndexed deletes the data for every session held in the index for the
+// given index key and value from the session store, and returns the number of
+// sessions deleted. If the store doesn't implement IndexedStore, every session
+// in the store is read instead and those for which match returns true are
+// deleted.
+func (s *SessionManager) destroyIndexed(ctx context.Context, key, value string, match func(sd *sessionData) bool) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	store := s.getStore()
+
+	release, err := s.acquireStore()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	n := 0
+	if is, ok := store.(IndexedStore); ok {
+		tokens, err := is.TokensForIndex(key, value)
+		if err != nil {
+			return n, err
+		}
+		for _, token := range tokens {
+			if err := ctx.Err(); err != nil {
+				return n, err
+			}
+			// The index may still hold tokens whose session data has already
+			// been deleted, so they aren't counted.
+			b, found, err := store.Find(token)
+			if err != nil {
+				return n, err
+			}
+			if found && !isTombstone(b) {
+				if err := s.deleteIndexedSession(store, token, b); err != nil {
+					return n, err
+				}
+				n++
+			}
+			if err := is.RemoveFromIndex(key, value, token); err != nil {
+				return n, err
+			}
+		}
+		return n, nil
+	}
+
+	its, ok := store.(IterableStore)
+	if !ok {
+		return n, ErrIndexNotSupported
+	}
+	all, err := its.All()
+	if err != nil {
+		return n, err
+	}
+	for token, b := range all {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if isTombstone(b) || isBlobStoreKey(token) {
+			continue
+		}
+		sd, err := s.decodeSessionData(token, b)
+		if err != nil {
+			return n, err
+		} else if sd == nil || !match(sd) {
+			continue
+		}
+		if err := s.deleteStoreKey(store, token); err != nil {
+			return n, err
+		}
+		if err := s.deleteBlobs(store, sd); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// deleteIndexedSession deletes the session data b held under the given store
+// key, along with any blobs offloaded from it. The session data is deleted
+// first, so it's gone even if b can't be decoded to find the blobs.
+func (s *SessionManager) deleteIndexedSession(store Store, key string, b []byte) error {
+	if err := s.deleteStoreKey(store, key); err != nil {
+		return err
+	}
+	sd, err := s.decodeSessionData(key, b)
+	if err != nil || sd == nil {
+		return err
+	}
+	return s.deleteBlobs(store, sd)
+}
+
+// markIndexed records the value under IndexKey, the labels and the deadline
+// of session data which has just been loaded, which is what it was indexed
+// with when it was committed. The caller must hold sd.mu.
+func (s *SessionManager) markIndexed(sd *sessionData) {
+	if s.IndexKey != "" {
+		sd.indexed = indexValue(sd.values[s.IndexKey])
+	}
+	sd.indexedLabels = nil
+	for _, label := range sd.labels() {
+		if sd.indexedLabels == nil {
+			sd.indexedLabels = make(map[string]bool)
+		}
+		sd.indexedLabels[label] = true
+	}
+	sd.indexedDeadline = sd.deadline
+}
+
+// updateIndex updates the IndexedStore index after the session data has been
+// committed. The session token is added to the index for the current value
+// under IndexKey and for each of its labels, and removed from the index for
+// any previous value and for labels which have been removed. Index entries
+// last until the session's absolute deadline, so existing entries are only
+// rewritten when the deadline changes. The index is kept in the underlying
+// session store, even when a transaction added with WithTx is being used;
+// stale entries are harmless. The caller must hold sd.mu.
+func (s *SessionManager) updateIndex(sd *sessionData) error {
+	is, ok := s.getStore().(IndexedStore)
+	if !ok {
+		return nil
+	}
+
+	key := s.storeKey(sd.token)
+	expiry := sd.deadline.Add(s.ClockSkew)
+	extended := sd.deadline.After(sd.indexedDeadline)
+
+	if s.IndexKey != "" {
+		value := indexValue(sd.values[s.IndexKey])
+		if sd.indexed != "" && sd.indexed != value {
+			if err := is.RemoveFromIndex(s.IndexKey, sd.indexed, key); err != nil {
+				return err
+			}
+		}
+		if value != "" && (value != sd.indexed || extended) {
+			if err := is.AddToIndex(s.IndexKey, value, key, expiry); err != nil {
+				return err
+			}
+		}
+		sd.indexed = value
+	}
+
+	labels := make(map[string]bool)
+	for _, label := range sd.labels() {
+		labels[label] = true
+		if sd.indexedLabels[label] && !extended {
+			continue
+		}
+		if err := is.AddToIndex(labelsKey, label, key, expiry); err != nil {
+			return err
+		}
+	}
+	for label := range sd.indexedLabels {
+		if labels[label] {
+			continue
+		}
+		if err := is.RemoveFromIndex(labelsKey, label, key); err != nil {
+			return err
+		}
+	}
+	sd.indexedLabels = labels
+	sd.indexedDeadline = sd.deadline
+	return nil
+}
+
+// removeFromIndex removes the session token from the index, before its
+// session data is deleted or its token is replaced. The caller must hold
+// sd.mu.
+func (s *SessionManager) removeFromIndex(sd *sessionData) error {
+	is, ok := s.getStore().(IndexedStore)
+	if !ok {
+		return nil
+	}
+
+	key := s.storeKey(sd.token)
+	if s.IndexKey != "" && sd.indexed != "" {
+		if err := is.RemoveFromIndex(s.IndexKey, sd.indexed, key); err != nil {
+			return err
+		}
+	}
+	for label := range sd.indexedLabels {
+		if err := is.RemoveFromIndex(labelsKey, label, key); err != nil {
+			return err
+		}
+	}
+	sd.indexed = ""
+	sd.indexedLabels = nil
+	sd.indexedDeadline = time.Time{}
+	return nil
+}
@@ -0,0 +1,13 @@
+package instrumentedstore_test
+
+import (
+	"testing"
+
+	"github.com/gaconkzk/scs/v2/instrumentedstore"
+	"github.com/gaconkzk/scs/v2/memstore"
+	"github.com/gaconkzk/scs/v2/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.VerifyStore(t, instrumentedstore.New(memstore.NewWithCleanupInterval(0)))
+}
@@ -0,0 +1,191 @@
+package instrumentedstore
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+)
+
+// sizeBuckets holds the upper bounds, in bytes, of the buckets in the session
+// data size histogram. Sizes larger than the last bound are counted in an
+// extra overflow bucket.
+var sizeBuckets = [...]int{256, 1024, 4096, 16384, 65536, 262144}
+
+// InstrumentedStore represents the session store. It wraps another store and
+// records aggregate statistics about how it is used, such as the number of
+// lookups, the hit ratio, the time spent in the wrapped store and the sizes of
+// the session data committed, for use in capacity planning. Statistics are
+// kept with atomic counters, so the overhead for each operation is small.
+//
+// Only the methods of the scs.Store interface are passed through to the
+// wrapped store; optional interfaces such as scs.FlushableStore are not.
+type InstrumentedStore struct {
+	// The counters are accessed atomically, so they are kept at the start of
+	// the struct to guarantee 64-bit alignment on 32-bit platforms.
+	finds        uint64
+	hits         uint64
+	commits      uint64
+	deletes      uint64
+	errors       uint64
+	bytesRead    uint64
+	bytesWritten uint64
+	findTime     uint64
+	commitTime   uint64
+	sizes        [len(sizeBuckets) + 1]uint64
+
+	store scs.Store
+}
+
+// New returns a new InstrumentedStore instance which wraps the given store.
+func New(store scs.Store) *InstrumentedStore {
+	return &InstrumentedStore{store: store}
+}
+
+// Find returns the data for a given session token from the wrapped store,
+// recording the lookup, whether it was a hit and how long it took.
+func (i *InstrumentedStore) Find(token string) ([]byte, bool, error) {
+	start := time.Now()
+	b, found, err := i.store.Find(token)
+	atomic.AddUint64(&i.findTime, uint64(time.Since(start)))
+	atomic.AddUint64(&i.finds, 1)
+
+	if err != nil {
+		atomic.AddUint64(&i.errors, 1)
+	} else if found {
+		atomic.AddUint64(&i.hits, 1)
+		atomic.AddUint64(&i.bytesRead, uint64(len(b)))
+	}
+	return b, found, err
+}
+
+// Commit adds a session token and data to the wrapped store with the given
+// expiry time, recording the size of the data and how long it took.
+func (i *InstrumentedStore) Commit(token string, b []byte, expiry time.Time) error {
+	start := time.Now()
+	err := i.store.Commit(token, b, expiry)
+	atomic.AddUint64(&i.commitTime, uint64(time.Since(start)))
+	atomic.AddUint64(&i.commits, 1)
+
+	if err != nil {
+		atomic.AddUint64(&i.errors, 1)
+		return err
+	}
+	atomic.AddUint64(&i.bytesWritten, uint64(len(b)))
+	atomic.AddUint64(&i.sizes[sizeBucket(len(b))], 1)
+	return nil
+}
+
+// Delete removes a session token and corresponding data from the wrapped
+// store.
+func (i *InstrumentedStore) Delete(token string) error {
+	err := i.store.Delete(token)
+	atomic.AddUint64(&i.deletes, 1)
+	if err != nil {
+		atomic.AddUint64(&i.errors, 1)
+	}
+	return err
+}
+
+// Stats returns a snapshot of the statistics recorded since the
+// InstrumentedStore was created or last reset. The counters are read one at
+// a time, so a snapshot taken while operations are in progress may be
+// slightly inconsistent.
+func (i *InstrumentedStore) Stats() Stats {
+	st := Stats{
+		Finds:        atomic.LoadUint64(&i.finds),
+		Hits:         atomic.LoadUint64(&i.hits),
+		Commits:      atomic.LoadUint64(&i.commits),
+		Deletes:      atomic.LoadUint64(&i.deletes),
+		Errors:       atomic.LoadUint64(&i.errors),
+		BytesRead:    atomic.LoadUint64(&i.bytesRead),
+		BytesWritten: atomic.LoadUint64(&i.bytesWritten),
+		FindTime:     time.Duration(atomic.LoadUint64(&i.findTime)),
+		CommitTime:   time.Duration(atomic.LoadUint64(&i.commitTime)),
+		Sizes:        make([]Bucket, len(i.sizes)),
+	}
+	for n := range i.sizes {
+		max := -1
+		if n < len(sizeBuckets) {
+			max = sizeBuckets[n]
+		}
+		st.Sizes[n] = Bucket{Max: max, Count: atomic.LoadUint64(&i.sizes[n])}
+	}
+	return st
+}
+
+// Reset sets all of the recorded statistics back to zero. Calling Stats and
+// then Reset at a regular interval gives the statistics for each interval.
+func (i *InstrumentedStore) Reset() {
+	for _, c := range []*uint64{&i.finds, &i.hits, &i.commits, &i.deletes, &i.errors, &i.bytesRead, &i.bytesWritten, &i.findTime, &i.commitTime} {
+		atomic.StoreUint64(c, 0)
+	}
+	for n := range i.sizes {
+		atomic.StoreUint64(&i.sizes[n], 0)
+	}
+}
+
+func sizeBucket(size int) int {
+	for n, max := range sizeBuckets {
+		if size <= max {
+			return n
+		}
+	}
+	return len(sizeBuckets)
+}
+
+// Stats holds the statistics recorded by an InstrumentedStore.
+type Stats struct {
+	// Finds is the number of calls to Find, and Hits is the number of those
+	// which found session data.
+	Finds uint64
+	Hits  uint64
+
+	// Commits and Deletes are the number of calls to Commit and Delete.
+	Commits uint64
+	Deletes uint64
+
+	// Errors is the number of calls to any method which returned an error.
+	Errors uint64
+
+	// BytesRead is the total size of the session data returned by Find, and
+	// BytesWritten is the total size of the session data successfully
+	// committed.
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// FindTime and CommitTime are the total time spent in the wrapped store's
+	// Find and Commit methods.
+	FindTime   time.Duration
+	CommitTime time.Duration
+
+	// Sizes is a histogram of the sizes of the session data successfully
+	// committed, in order of increasing size.
+	Sizes []Bucket
+}
+
+// Bucket is a bucket in a histogram of session data sizes.
+type Bucket struct {
+	// Max is the largest size, in bytes, counted in the bucket. Each bucket
+	// counts the sizes larger than the Max of the bucket before it. The last
+	// bucket has a Max of -1 and counts all sizes larger than the others.
+	Max int
+
+	// Count is the number of committed session data payloads in the bucket.
+	Count uint64
+}
+
+// HitRatio returns the proportion of calls to Find which found session data,
+// between 0 and 1. It returns 0 if Find hasn't been called.
+func (s Stats) HitRatio() float64 {
+	if s.Finds == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Finds)
+}
+
+// Misses returns the number of calls to Find which didn't find session data,
+// including those which returned an error.
+func (s Stats) Misses() uint64 {
+	return s.Finds - s.Hits
+}
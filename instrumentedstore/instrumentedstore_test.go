@@ -0,0 +1,113 @@
+package instrumentedstore
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gaconkzk/scs/v2/memstore"
+	"github.com/gaconkzk/scs/v2/mockstore"
+)
+
+func TestStats(t *testing.T) {
+	i := New(memstore.NewWithCleanupInterval(0))
+	expiry := time.Now().Add(time.Minute)
+
+	for _, size := range []int{10, 256, 257, 5000, 300000} {
+		if err := i.Commit("session_token", make([]byte, size), expiry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, token := range []string{"session_token", "session_token", "missing_session_token"} {
+		if _, _, err := i.Find(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := i.Delete("session_token"); err != nil {
+		t.Fatal(err)
+	}
+
+	st := i.Stats()
+	if st.Commits != 5 {
+		t.Errorf("got %d commits: expected %d", st.Commits, 5)
+	}
+	if st.Finds != 3 || st.Hits != 2 || st.Misses() != 1 {
+		t.Errorf("got %d finds, %d hits and %d misses: expected 3, 2 and 1", st.Finds, st.Hits, st.Misses())
+	}
+	if st.Deletes != 1 {
+		t.Errorf("got %d deletes: expected %d", st.Deletes, 1)
+	}
+	if got, want := st.HitRatio(), 2.0/3.0; got != want {
+		t.Errorf("got %v: expected %v", got, want)
+	}
+	if st.BytesWritten != 10+256+257+5000+300000 {
+		t.Errorf("got %d: expected %d", st.BytesWritten, 10+256+257+5000+300000)
+	}
+	if st.BytesRead != 2*300000 {
+		t.Errorf("got %d: expected %d", st.BytesRead, 2*300000)
+	}
+
+	want := []Bucket{
+		{Max: 256, Count: 2},
+		{Max: 1024, Count: 1},
+		{Max: 4096, Count: 0},
+		{Max: 16384, Count: 1},
+		{Max: 65536, Count: 0},
+		{Max: 262144, Count: 0},
+		{Max: -1, Count: 1},
+	}
+	if len(st.Sizes) != len(want) {
+		t.Fatalf("got %d buckets: expected %d", len(st.Sizes), len(want))
+	}
+	for n := range want {
+		if st.Sizes[n] != want[n] {
+			t.Errorf("bucket %d: got %+v: expected %+v", n, st.Sizes[n], want[n])
+		}
+	}
+
+	i.Reset()
+	st = i.Stats()
+	if st.Finds != 0 || st.Commits != 0 || st.BytesWritten != 0 || st.Sizes[0].Count != 0 {
+		t.Errorf("got %+v: expected zero statistics after Reset", st)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	errStore := errors.New("store error")
+	m := &mockstore.MockStore{}
+	m.ExpectFind("session_token", nil, false, errStore)
+	m.ExpectCommit("session_token", []byte("encoded_data"), time.Time{}, errStore)
+
+	i := New(m)
+	if _, _, err := i.Find("session_token"); err != errStore {
+		t.Fatalf("got %v: expected %v", err, errStore)
+	}
+	if err := i.Commit("session_token", []byte("encoded_data"), time.Time{}); err != errStore {
+		t.Fatalf("got %v: expected %v", err, errStore)
+	}
+
+	st := i.Stats()
+	if st.Errors != 2 {
+		t.Errorf("got %d errors: expected %d", st.Errors, 2)
+	}
+	if st.Hits != 0 || st.BytesWritten != 0 || st.Sizes[0].Count != 0 {
+		t.Errorf("got %+v: expected failed operations not to be counted as hits or writes", st)
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	i := New(memstore.NewWithCleanupInterval(0))
+
+	err := i.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, found, err := i.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !bytes.Equal(b, []byte("encoded_data")) {
+		t.Fatalf("got %v, %v: expected %v, %v", b, found, []byte("encoded_data"), true)
+	}
+}
@@ -0,0 +1,93 @@
+package scs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"sync"
+)
+
+// KeyRing holds a set of secret keys to support key rotation. The current key
+// (the one most recently added) is used for signing and encrypting, and all
+// keys in the ring are tried when verifying and decrypting. This means values
+// produced with an older key remain valid until that key is retired. It is
+// safe for concurrent use.
+type KeyRing struct {
+	keys [][]byte
+	mu   sync.RWMutex
+}
+
+// NewKeyRing returns a new KeyRing containing the given keys. The first key is
+// the current key, and any others are older keys which are still accepted for
+// verification and decryption.
+func NewKeyRing(current []byte, older ...[]byte) *KeyRing {
+	kr := &KeyRing{}
+	kr.keys = append(kr.keys, current)
+	kr.keys = append(kr.keys, older...)
+	return kr
+}
+
+// Current returns the key which should be used for signing and encrypting.
+func (kr *KeyRing) Current() []byte {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	if len(kr.keys) == 0 {
+		return nil
+	}
+	return kr.keys[0]
+}
+
+// All returns all keys in the ring, starting with the current key and followed
+// by older keys in the order they were added (newest first).
+func (kr *KeyRing) All() [][]byte {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	keys := make([][]byte, len(kr.keys))
+	copy(keys, kr.keys)
+	return keys
+}
+
+// Add adds a new key to the ring and makes it the current key. The previous
+// current key is retained for verification and decryption.
+func (kr *KeyRing) Add(key []byte) {
+	kr.mu.Lock()
+	kr.keys = append([][]byte{key}, kr.keys...)
+	kr.mu.Unlock()
+}
+
+// Retire removes a key from the ring, so that values signed or encrypted with
+// it will no longer be accepted. If the key is not in the ring this is a no-op.
+func (kr *KeyRing) Retire(key []byte) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	for i, k := range kr.keys {
+		if hmac.Equal(k, key) {
+			kr.keys = append(kr.keys[:i], kr.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// Sign returns a HMAC-SHA256 signature for b using the current key.
+func (kr *KeyRing) Sign(b []byte) []byte {
+	return sign(kr.Current(), b)
+}
+
+// Verify reports whether sig is a valid HMAC-SHA256 signature for b using any
+// of the keys in the ring.
+func (kr *KeyRing) Verify(b []byte, sig []byte) bool {
+	for _, key := range kr.All() {
+		if hmac.Equal(sign(key, b), sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func sign(key []byte, b []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,44 @@
+package scs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyRing(t *testing.T) {
+	t.Parallel()
+
+	oldKey := []byte("old-secret")
+	newKey := []byte("new-secret")
+
+	kr := NewKeyRing(oldKey)
+	msg := []byte("hello, world!")
+	sig := kr.Sign(msg)
+
+	kr.Add(newKey)
+
+	if !bytes.Equal(kr.Current(), newKey) {
+		t.Errorf("got %q: expected %q", kr.Current(), newKey)
+	}
+	if len(kr.All()) != 2 {
+		t.Errorf("got %d: expected %d", len(kr.All()), 2)
+	}
+	if !kr.Verify(msg, sig) {
+		t.Error("signature from older key did not verify")
+	}
+	if bytes.Equal(kr.Sign(msg), sig) {
+		t.Error("expected new signature to use current key")
+	}
+	if kr.Verify([]byte("tampered"), sig) {
+		t.Error("tampered message verified")
+	}
+
+	kr.Retire(oldKey)
+
+	if kr.Verify(msg, sig) {
+		t.Error("signature from retired key verified")
+	}
+	if !kr.Verify(msg, kr.Sign(msg)) {
+		t.Error("signature from current key did not verify")
+	}
+}
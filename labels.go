@@ -0,0 +1,111 @@
+package scs
+
+import (
+	"context"
+	"sort"
+)
+
+// labelsKey is the session data key which holds the labels added with
+// AddLabel. It is also the index key used for labels in an IndexedStore.
+const labelsKey = "__labels"
+
+// AddLabel attaches a label to the session, such as the name of a rollout
+// stage or an incident, so that all of the sessions with the label can later
+// be destroyed together with DestroyByLabel. If the session already has the
+// label this is a no-op; otherwise the session data status will be set to
+// Modified.
+func (s *SessionManager) AddLabel(ctx context.Context, label string) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	labels := sd.labels()
+	for _, l := range labels {
+		if l == label {
+			return
+		}
+	}
+	labels = append(labels, label)
+	sort.Strings(labels)
+	sd.values[labelsKey] = labels
+	sd.status = Modified
+	sd.written = true
+}
+
+// RemoveLabel removes a label added with AddLabel from the session. If the
+// session doesn't have the label this is a no-op; otherwise the session data
+// status will be set to Modified.
+func (s *SessionManager) RemoveLabel(ctx context.Context, label string) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	labels := sd.labels()
+	for i, l := range labels {
+		if l != label {
+			continue
+		}
+		labels = append(labels[:i:i], labels[i+1:]...)
+		if len(labels) == 0 {
+			delete(sd.values, labelsKey)
+		} else {
+			sd.values[labelsKey] = labels
+		}
+		sd.status = Modified
+		sd.written = true
+		return
+	}
+}
+
+// Labels returns the labels added to the session with AddLabel, in sorted
+// order.
+func (s *SessionManager) Labels(ctx context.Context) []string {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return sd.labels()
+}
+
+// DestroyByLabel deletes the data for every session with the given label from
+// the session store, and returns the number of sessions deleted. If the
+// session store implements IndexedStore the sessions are looked up in the
+// index; otherwise, if it implements IterableStore, every session in the store
+// is read and checked. ErrIndexNotSupported is returned if the store supports
+// neither.
+//
+// As with DestroyAllForUser, session data already loaded into a request
+// context is not affected, and will be written back to the store if it is
+// committed.
+func (s *SessionManager) DestroyByLabel(ctx context.Context, label string) (int, error) {
+	return s.destroyIndexed(ctx, labelsKey, label, func(sd *sessionData) bool {
+		for _, l := range sd.labels() {
+			if l == label {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// labels returns a copy of the session's labels. They are stored as a
+// []string, but codecs such as JSONCodec decode them as a []interface{}. The
+// caller must hold sd.mu.
+func (sd *sessionData) labels() []string {
+	switch v := sd.values[labelsKey].(type) {
+	case []string:
+		return append([]string(nil), v...)
+	case []interface{}:
+		labels := make([]string, 0, len(v))
+		for _, l := range v {
+			if l, ok := l.(string); ok {
+				labels = append(labels, l)
+			}
+		}
+		return labels
+	}
+	return nil
+}
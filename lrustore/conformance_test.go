@@ -0,0 +1,12 @@
+package lrustore_test
+
+import (
+	"testing"
+
+	"github.com/gaconkzk/scs/v2/lrustore"
+	"github.com/gaconkzk/scs/v2/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.VerifyStore(t, lrustore.New(100))
+}
@@ -0,0 +1,172 @@
+package lrustore
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type item struct {
+	token      string
+	object     []byte
+	expiration int64
+}
+
+// LRUStore represents the session store. It is an in-memory store which holds
+// at most a fixed number of sessions. When it is full, committing a new
+// session evicts the least recently used one, so memory use stays bounded
+// even if a large number of sessions are created (for example, by a crawler
+// which accepts cookies).
+type LRUStore struct {
+	maxEntries int
+	onEvict    func(token string, b []byte)
+
+	items map[string]*list.Element
+	order *list.List // Most recently used at the front.
+	mu    sync.Mutex
+}
+
+// New returns a new LRUStore instance which holds at most maxEntries sessions.
+func New(maxEntries int) *LRUStore {
+	return NewWithEvictFunc(maxEntries, nil)
+}
+
+// NewWithEvictFunc returns a new LRUStore instance which holds at most
+// maxEntries sessions. The onEvict function, if not nil, is called with the
+// session token and data of each session which is evicted to make room for
+// another. It is not called for sessions which expire or are deleted.
+func NewWithEvictFunc(maxEntries int, onEvict func(token string, b []byte)) *LRUStore {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &LRUStore{
+		maxEntries: maxEntries,
+		onEvict:    onEvict,
+		items:      make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Find returns the data for a given session token from the LRUStore instance
+// and marks the session as recently used. If the session token is not found or
+// is expired, the returned exists flag will be set to false.
+func (l *LRUStore) Find(token string) ([]byte, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, found := l.items[token]
+	if !found {
+		return nil, false, nil
+	}
+
+	it := e.Value.(*item)
+	if time.Now().UnixNano() > it.expiration {
+		l.remove(e)
+		return nil, false, nil
+	}
+
+	l.order.MoveToFront(e)
+	return it.object, true, nil
+}
+
+// Commit adds a session token and data to the LRUStore instance with the given
+// expiry time, and marks the session as recently used. If the session token
+// already exists, then the data and expiry time are updated. If the store is
+// full, the least recently used session is evicted; the session being
+// committed is never evicted by its own commit.
+func (l *LRUStore) Commit(token string, b []byte, expiry time.Time) error {
+	l.mu.Lock()
+
+	if e, found := l.items[token]; found {
+		it := e.Value.(*item)
+		it.object = b
+		it.expiration = expiry.UnixNano()
+		l.order.MoveToFront(e)
+		l.mu.Unlock()
+		return nil
+	}
+
+	l.items[token] = l.order.PushFront(&item{
+		token:      token,
+		object:     b,
+		expiration: expiry.UnixNano(),
+	})
+
+	var evicted []*item
+	for l.order.Len() > l.maxEntries {
+		e := l.order.Back()
+		l.remove(e)
+		evicted = append(evicted, e.Value.(*item))
+	}
+	l.mu.Unlock()
+
+	if l.onEvict != nil {
+		for _, it := range evicted {
+			l.onEvict(it.token, it.object)
+		}
+	}
+	return nil
+}
+
+// Delete removes a session token and corresponding data from the LRUStore
+// instance.
+func (l *LRUStore) Delete(token string) error {
+	l.mu.Lock()
+	if e, found := l.items[token]; found {
+		l.remove(e)
+	}
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Expiry returns the expiry time recorded for a given session token in the
+// LRUStore instance. If the session token is not found or is expired, the
+// returned exists flag will be set to false. It does not mark the session as
+// recently used.
+func (l *LRUStore) Expiry(token string) (time.Time, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, found := l.items[token]
+	if !found {
+		return time.Time{}, false, nil
+	}
+	it := e.Value.(*item)
+	if time.Now().UnixNano() > it.expiration {
+		return time.Time{}, false, nil
+	}
+
+	return time.Unix(0, it.expiration), true, nil
+}
+
+// Flush removes all session tokens and data from the LRUStore instance.
+func (l *LRUStore) Flush() error {
+	l.mu.Lock()
+	l.items = make(map[string]*list.Element)
+	l.order.Init()
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Len returns the number of sessions held in the LRUStore instance, including
+// any which have expired but not yet been removed.
+func (l *LRUStore) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.order.Len()
+}
+
+// MaxEntries returns the largest number of sessions that the LRUStore instance
+// can hold.
+func (l *LRUStore) MaxEntries() int {
+	return l.maxEntries
+}
+
+// remove deletes an element from the store. The caller must hold l.mu.
+func (l *LRUStore) remove(e *list.Element) {
+	l.order.Remove(e)
+	delete(l.items, e.Value.(*item).token)
+}
@@ -0,0 +1,133 @@
+package lrustore
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFind(t *testing.T) {
+	l := New(10)
+	l.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+
+	b, found, err := l.Find("session_token")
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("encoded_data")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+}
+
+func TestFindMissing(t *testing.T) {
+	l := New(10)
+
+	_, found, err := l.Find("missing_session_token")
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	l := New(10)
+	l.Commit("session_token", []byte("encoded_data"), time.Now().Add(100*time.Millisecond))
+
+	_, found, _ := l.Find("session_token")
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	_, found, _ = l.Find("session_token")
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+	if l.Len() != 0 {
+		t.Fatalf("got %d: expected %d", l.Len(), 0)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	l := New(10)
+	l.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+
+	err := l.Delete("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found, _ := l.Find("session_token")
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	var evicted []string
+	l := NewWithEvictFunc(3, func(token string, b []byte) {
+		evicted = append(evicted, token)
+	})
+
+	expiry := time.Now().Add(time.Minute)
+	l.Commit("a", []byte("a"), expiry)
+	l.Commit("b", []byte("b"), expiry)
+	l.Commit("c", []byte("c"), expiry)
+
+	// Using "a" makes "b" the least recently used.
+	l.Find("a")
+	l.Commit("d", []byte("d"), expiry)
+
+	// Updating "c" makes "a" the least recently used.
+	l.Commit("c", []byte("c2"), expiry)
+	l.Commit("e", []byte("e"), expiry)
+
+	if !reflect.DeepEqual(evicted, []string{"b", "a"}) {
+		t.Fatalf("got %v: expected %v", evicted, []string{"b", "a"})
+	}
+	if l.Len() != 3 {
+		t.Fatalf("got %d: expected %d", l.Len(), 3)
+	}
+	for _, token := range []string{"c", "d", "e"} {
+		if _, found, _ := l.Find(token); found != true {
+			t.Errorf("%s: got %v: expected %v", token, found, true)
+		}
+	}
+}
+
+func TestEvictionKeepsNewEntry(t *testing.T) {
+	var evicted []string
+	l := NewWithEvictFunc(1, func(token string, b []byte) {
+		evicted = append(evicted, token)
+	})
+
+	l.Commit("a", []byte("a"), time.Now().Add(time.Minute))
+	l.Commit("b", []byte("b"), time.Now().Add(time.Minute))
+
+	if _, found, _ := l.Find("b"); found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if !reflect.DeepEqual(evicted, []string{"a"}) {
+		t.Fatalf("got %v: expected %v", evicted, []string{"a"})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	l := New(10)
+	l.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+
+	err := l.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Len() != 0 {
+		t.Fatalf("got %d: expected %d", l.Len(), 0)
+	}
+}
@@ -0,0 +1,15 @@
+package memstore_test
+
+import (
+	"testing"
+
+	"github.com/gaconkzk/scs/v2"
+	"github.com/gaconkzk/scs/v2/memstore"
+	"github.com/gaconkzk/scs/v2/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.RunStoreTests(t, func() scs.Store {
+		return memstore.NewWithCleanupInterval(0)
+	})
+}
@@ -15,6 +15,23 @@ type MemStore struct {
 	items       map[string]item
 	mu          sync.RWMutex
 	stopCleanup chan bool
+
+	// locks holds a channel for each locked session token, which is closed
+	// when the token is unlocked.
+	locks  map[string]chan struct{}
+	lockMu sync.Mutex
+
+	// onExpire is the callback set by SetOnExpire. It is protected by mu.
+	onExpire func(token string, data []byte)
+
+	// indexes maps an index key and value to the expiration time of each
+	// session token in the index. It is protected by mu.
+	indexes map[indexName]map[string]int64
+}
+
+type indexName struct {
+	key   string
+	value string
 }
 
 // New returns a new MemStore instance, with a background cleanup goroutine that
@@ -29,7 +46,9 @@ func New() *MemStore {
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(cleanupInterval time.Duration) *MemStore {
 	m := &MemStore{
-		items: make(map[string]item),
+		items:   make(map[string]item),
+		locks:   make(map[string]chan struct{}),
+		indexes: make(map[indexName]map[string]int64),
 	}
 
 	if cleanupInterval > 0 {
@@ -44,20 +63,99 @@ func NewWithCleanupInterval(cleanupInterval time.Duration) *MemStore {
 // be set to false.
 func (m *MemStore) Find(token string) ([]byte, bool, error) {
 	m.mu.RLock()
-	defer m.mu.RUnlock()
-
 	item, found := m.items[token]
+	m.mu.RUnlock()
+
 	if !found {
 		return nil, false, nil
 	}
 
 	if time.Now().UnixNano() > item.expiration {
+		m.expire(token)
 		return nil, false, nil
 	}
 
 	return item.object, true, nil
 }
 
+// FindAndRefresh returns the data for a given session token from the MemStore
+// instance, and if it is found, updates its expiry time to newExpiry. If the
+// session token is not found or is expired, the returned exists flag will be
+// set to false.
+func (m *MemStore) FindAndRefresh(token string, newExpiry time.Time) ([]byte, bool, error) {
+	m.mu.Lock()
+	item, found := m.items[token]
+	if !found {
+		m.mu.Unlock()
+		return nil, false, nil
+	}
+	if time.Now().UnixNano() > item.expiration {
+		m.mu.Unlock()
+		m.expire(token)
+		return nil, false, nil
+	}
+
+	item.expiration = newExpiry.UnixNano()
+	m.items[token] = item
+	m.mu.Unlock()
+
+	return item.object, true, nil
+}
+
+// Touch sets the expiry time of the session token to newExpiry, without
+// changing its data. If the session token is not found or is expired, Touch
+// does nothing.
+func (m *MemStore) Touch(token string, newExpiry time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, found := m.items[token]
+	if !found || time.Now().UnixNano() > item.expiration {
+		return nil
+	}
+	item.expiration = newExpiry.UnixNano()
+	m.items[token] = item
+	return nil
+}
+
+// FindMany returns the data for each of the given session tokens which is
+// found in the MemStore instance, keyed by session token. Tokens which are not
+// found or are expired are omitted.
+func (m *MemStore) FindMany(tokens []string) (map[string][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	res := make(map[string][]byte, len(tokens))
+	for _, token := range tokens {
+		item, found := m.items[token]
+		if !found || now > item.expiration {
+			continue
+		}
+		res[token] = item.object
+	}
+
+	return res, nil
+}
+
+// All returns the data for all of the unexpired session tokens in the
+// MemStore instance, keyed by session token.
+func (m *MemStore) All() (map[string][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	res := make(map[string][]byte, len(m.items))
+	for token, item := range m.items {
+		if now > item.expiration {
+			continue
+		}
+		res[token] = item.object
+	}
+
+	return res, nil
+}
+
 // Commit adds a session token and data to the MemStore instance with the given
 // expiry time. If the session token already exists, then the data and expiry
 // time are updated.
@@ -82,6 +180,123 @@ func (m *MemStore) Delete(token string) error {
 	return nil
 }
 
+// Expiry returns the expiry time recorded for a given session token in the
+// MemStore instance. If the session token is not found or is expired, the
+// returned exists flag will be set to false.
+func (m *MemStore) Expiry(token string) (time.Time, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	item, found := m.items[token]
+	if !found || time.Now().UnixNano() > item.expiration {
+		return time.Time{}, false, nil
+	}
+
+	return time.Unix(0, item.expiration), true, nil
+}
+
+// SetOnExpire sets a callback which is called with the session token and data
+// whenever session data is removed from the MemStore instance because it has
+// expired, either by the background cleanup goroutine or when an expired
+// session token is looked up with Find or FindAndRefresh. It can be used to
+// clean up resources associated with the session, such as temporary files. It
+// isn't called for session data removed with Delete or Flush. The callback is
+// called from the goroutine which removed the data, after it has been removed,
+// so it must not block for long.
+func (m *MemStore) SetOnExpire(fn func(token string, data []byte)) {
+	m.mu.Lock()
+	m.onExpire = fn
+	m.mu.Unlock()
+}
+
+// AddToIndex adds a session token to the set of tokens held for the given
+// index key and value in the MemStore instance, until the expiry time.
+func (m *MemStore) AddToIndex(key, value, token string, expiry time.Time) error {
+	name := indexName{key: key, value: value}
+	m.mu.Lock()
+	tokens, ok := m.indexes[name]
+	if !ok {
+		tokens = make(map[string]int64)
+		m.indexes[name] = tokens
+	}
+	tokens[token] = expiry.UnixNano()
+	m.mu.Unlock()
+
+	return nil
+}
+
+// RemoveFromIndex removes a session token from the set of tokens held for the
+// given index key and value in the MemStore instance.
+func (m *MemStore) RemoveFromIndex(key, value, token string) error {
+	name := indexName{key: key, value: value}
+	m.mu.Lock()
+	delete(m.indexes[name], token)
+	if len(m.indexes[name]) == 0 {
+		delete(m.indexes, name)
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+// TokensForIndex returns the unexpired session tokens in the set held for the
+// given index key and value in the MemStore instance.
+func (m *MemStore) TokensForIndex(key, value string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	tokens := m.indexes[indexName{key: key, value: value}]
+	res := make([]string, 0, len(tokens))
+	for token, expiration := range tokens {
+		if now > expiration {
+			continue
+		}
+		res = append(res, token)
+	}
+
+	return res, nil
+}
+
+// Lock acquires the lock for a given session token, blocking until any other
+// holder has unlocked it.
+func (m *MemStore) Lock(token string) error {
+	for {
+		m.lockMu.Lock()
+		ch, locked := m.locks[token]
+		if !locked {
+			m.locks[token] = make(chan struct{})
+			m.lockMu.Unlock()
+			return nil
+		}
+		m.lockMu.Unlock()
+		<-ch
+	}
+}
+
+// Unlock releases the lock for a given session token. If the token isn't
+// locked then this is a no-op.
+func (m *MemStore) Unlock(token string) error {
+	m.lockMu.Lock()
+	if ch, locked := m.locks[token]; locked {
+		delete(m.locks, token)
+		close(ch)
+	}
+	m.lockMu.Unlock()
+
+	return nil
+}
+
+// Flush removes all session tokens and data from the MemStore instance.
+func (m *MemStore) Flush() error {
+	m.mu.Lock()
+	m.items = make(map[string]item)
+	m.indexes = make(map[indexName]map[string]int64)
+	m.mu.Unlock()
+
+	return nil
+}
+
 func (m *MemStore) startCleanup(interval time.Duration) {
 	m.stopCleanup = make(chan bool)
 	ticker := time.NewTicker(interval)
@@ -115,10 +330,51 @@ func (m *MemStore) StopCleanup() {
 func (m *MemStore) deleteExpired() {
 	now := time.Now().UnixNano()
 	m.mu.Lock()
+	onExpire := m.onExpire
+	var expired map[string][]byte
 	for token, item := range m.items {
 		if now > item.expiration {
 			delete(m.items, token)
+			if onExpire != nil {
+				if expired == nil {
+					expired = make(map[string][]byte)
+				}
+				expired[token] = item.object
+			}
+		}
+	}
+	for name, tokens := range m.indexes {
+		for token, expiration := range tokens {
+			if now > expiration {
+				delete(tokens, token)
+			}
+		}
+		if len(tokens) == 0 {
+			delete(m.indexes, name)
 		}
 	}
 	m.mu.Unlock()
+
+	for token, b := range expired {
+		onExpire(token, b)
+	}
+}
+
+// expire removes the session data for the given token if it has expired, and
+// calls the callback set by SetOnExpire for it.
+func (m *MemStore) expire(token string) {
+	now := time.Now().UnixNano()
+	m.mu.Lock()
+	item, found := m.items[token]
+	if !found || now <= item.expiration {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.items, token)
+	onExpire := m.onExpire
+	m.mu.Unlock()
+
+	if onExpire != nil {
+		onExpire(token, item.object)
+	}
 }
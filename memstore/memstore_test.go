@@ -3,6 +3,8 @@ package memstore
 import (
 	"bytes"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 )
@@ -124,3 +126,306 @@ func TestCleanupInterval(t *testing.T) {
 		t.Fatalf("got %v: expected %v", ok, false)
 	}
 }
+
+func TestFlush(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+	m.items["session_token1"] = item{object: []byte("encoded_data"), expiration: time.Now().Add(time.Minute).UnixNano()}
+	m.items["session_token2"] = item{object: []byte("encoded_data"), expiration: time.Now().Add(time.Minute).UnixNano()}
+
+	err := m.Flush()
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+
+	for _, token := range []string{"session_token1", "session_token2"} {
+		_, found, _ := m.Find(token)
+		if found != false {
+			t.Fatalf("got %v: expected %v", found, false)
+		}
+	}
+}
+
+func TestExpiryReporting(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+
+	expiry := time.Now().Add(time.Minute)
+	err := m.Commit("session_token", []byte("encoded_data"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, found, err := m.Expiry("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if !got.Equal(expiry) {
+		t.Fatalf("got %v: expected %v", got, expiry)
+	}
+
+	_, found, _ = m.Expiry("missing_session_token")
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestFindAndRefresh(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+
+	err := m.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newExpiry := time.Now().Add(time.Hour)
+	b, found, err := m.FindAndRefresh("session_token", newExpiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if !bytes.Equal(b, []byte("encoded_data")) {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+
+	got, _, err := m.Expiry("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(newExpiry) {
+		t.Fatalf("got %v: expected %v", got, newExpiry)
+	}
+
+	_, found, _ = m.FindAndRefresh("missing_session_token", newExpiry)
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+	if _, found, _ = m.Find("missing_session_token"); found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+
+	err := m.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newExpiry := time.Now().Add(time.Hour)
+	if err := m.Touch("session_token", newExpiry); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, err := m.Expiry("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(newExpiry) {
+		t.Fatalf("got %v: expected %v", got, newExpiry)
+	}
+	b, _, err := m.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("encoded_data")) {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+
+	if err := m.Touch("missing_session_token", newExpiry); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := m.Find("missing_session_token"); found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestFindMany(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+
+	err := m.Commit("session_token_1", []byte("encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Commit("session_token_2", []byte("encoded_data_2"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Commit("expired_session_token", []byte("encoded_data_3"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.FindMany([]string{"session_token_1", "session_token_2", "expired_session_token", "missing_session_token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d results: expected %d", len(got), 2)
+	}
+	if !bytes.Equal(got["session_token_1"], []byte("encoded_data_1")) {
+		t.Fatalf("got %v: expected %v", got["session_token_1"], []byte("encoded_data_1"))
+	}
+	if !bytes.Equal(got["session_token_2"], []byte("encoded_data_2")) {
+		t.Fatalf("got %v: expected %v", got["session_token_2"], []byte("encoded_data_2"))
+	}
+}
+
+func TestAll(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+
+	err := m.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Commit("expired_session_token", []byte("encoded_data"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"session_token": []byte("encoded_data")}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v: expected %v", got, want)
+	}
+}
+
+func TestLock(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+
+	err := m.Lock("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		m.Lock("session_token")
+		close(locked)
+	}()
+
+	// A different token can be locked while the first is held.
+	if err := m.Lock("other_session_token"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-locked:
+		t.Fatal("expected Lock to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := m.Unlock("session_token"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("expected Lock to be acquired")
+	}
+
+	if err := m.Unlock("missing_session_token"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnExpire(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+
+	var mu sync.Mutex
+	expired := make(map[string][]byte)
+	m.SetOnExpire(func(token string, data []byte) {
+		mu.Lock()
+		expired[token] = data
+		mu.Unlock()
+	})
+
+	m.items["expired_token"] = item{object: []byte("expired_data"), expiration: time.Now().Add(-time.Second).UnixNano()}
+	m.items["active_token"] = item{object: []byte("active_data"), expiration: time.Now().Add(time.Minute).UnixNano()}
+	m.items["lazy_token"] = item{object: []byte("lazy_data"), expiration: time.Now().Add(time.Minute).UnixNano()}
+	m.items["deleted_token"] = item{object: []byte("deleted_data"), expiration: time.Now().Add(-time.Second).UnixNano()}
+
+	if err := m.Delete("deleted_token"); err != nil {
+		t.Fatal(err)
+	}
+	m.deleteExpired()
+
+	if len(expired) != 1 || !bytes.Equal(expired["expired_token"], []byte("expired_data")) {
+		t.Fatalf("got %v: expected only %q to expire", expired, "expired_token")
+	}
+	if _, ok := m.items["active_token"]; !ok {
+		t.Fatalf("got %v: expected %v", ok, true)
+	}
+
+	m.items["lazy_token"] = item{object: []byte("lazy_data"), expiration: time.Now().Add(-time.Second).UnixNano()}
+	_, found, err := m.Find("lazy_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+	if !bytes.Equal(expired["lazy_token"], []byte("lazy_data")) {
+		t.Fatalf("got %q: expected %q", expired["lazy_token"], []byte("lazy_data"))
+	}
+	if _, ok := m.items["lazy_token"]; ok {
+		t.Fatalf("got %v: expected %v", ok, false)
+	}
+	if len(expired) != 2 {
+		t.Fatalf("got %d expired tokens: expected %d", len(expired), 2)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+
+	for _, token := range []string{"token_1", "token_2"} {
+		if err := m.AddToIndex("userID", "42", token, time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.AddToIndex("userID", "42", "expired_token", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddToIndex("userID", "7", "token_3", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.TokensForIndex("userID", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{"token_1", "token_2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v: expected %v", got, want)
+	}
+
+	if err := m.RemoveFromIndex("userID", "42", "token_1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RemoveFromIndex("userID", "42", "missing_token"); err != nil {
+		t.Fatal(err)
+	}
+	got, err = m.TokensForIndex("userID", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"token_2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v: expected %v", got, want)
+	}
+
+	m.deleteExpired()
+	if _, ok := m.indexes[indexName{key: "userID", value: "42"}]["expired_token"]; ok {
+		t.Errorf("expected the expired index entry to be removed by the cleanup")
+	}
+}
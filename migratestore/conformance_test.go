@@ -0,0 +1,13 @@
+package migratestore_test
+
+import (
+	"testing"
+
+	"github.com/gaconkzk/scs/v2/memstore"
+	"github.com/gaconkzk/scs/v2/migratestore"
+	"github.com/gaconkzk/scs/v2/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.VerifyStore(t, migratestore.New(memstore.NewWithCleanupInterval(0), memstore.NewWithCleanupInterval(0)))
+}
@@ -0,0 +1,97 @@
+package migratestore
+
+import (
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+)
+
+// DefaultLifetime is the lifetime given to session data copied from a source
+// store which can't report its expiry time. It matches the default
+// SessionManager.Lifetime.
+const DefaultLifetime = 24 * time.Hour
+
+// MigrateStore represents the session store. It wraps a source store which is
+// being migrated away from and a destination store which is being migrated
+// to. New session data is only ever written to the destination store, and
+// session data which is found in the source store is copied to the destination
+// store and deleted from the source store, so active sessions move over to the
+// destination store on their next request. Sessions which are never accessed
+// again simply expire in the source store.
+type MigrateStore struct {
+	source      scs.Store
+	destination scs.Store
+	lifetime    time.Duration
+}
+
+// New returns a new MigrateStore instance. If the source store implements the
+// scs.ExpiryReportingStore interface, migrated session data keeps its expiry
+// time; otherwise it is given the DefaultLifetime.
+func New(source, destination scs.Store) *MigrateStore {
+	return NewWithLifetime(source, destination, DefaultLifetime)
+}
+
+// NewWithLifetime returns a new MigrateStore instance. The lifetime parameter
+// controls the expiry time given to migrated session data when the source
+// store doesn't implement the scs.ExpiryReportingStore interface. It should
+// usually be the same as the session manager's Lifetime.
+func NewWithLifetime(source, destination scs.Store, lifetime time.Duration) *MigrateStore {
+	return &MigrateStore{
+		source:      source,
+		destination: destination,
+		lifetime:    lifetime,
+	}
+}
+
+// Find returns the data for a given session token. The destination store is
+// checked first. If the token is only found in the source store, the data is
+// copied to the destination store and deleted from the source store before it
+// is returned. If the session token is not found in either store or is
+// expired, the returned exists flag will be set to false.
+func (m *MigrateStore) Find(token string) ([]byte, bool, error) {
+	b, found, err := m.destination.Find(token)
+	if err != nil || found {
+		return b, found, err
+	}
+
+	b, found, err = m.source.Find(token)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	expiry := time.Now().Add(m.lifetime)
+	if es, ok := m.source.(scs.ExpiryReportingStore); ok {
+		e, found, err := es.Expiry(token)
+		if err != nil {
+			return nil, false, err
+		} else if !found {
+			return nil, false, nil
+		}
+		expiry = e
+	}
+
+	if err := m.destination.Commit(token, b, expiry); err != nil {
+		return nil, false, err
+	}
+	if err := m.source.Delete(token); err != nil {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+// Commit adds a session token and data to the destination store with the
+// given expiry time. If the session token already exists, then the data and
+// expiry time are updated.
+func (m *MigrateStore) Commit(token string, b []byte, expiry time.Time) error {
+	return m.destination.Commit(token, b, expiry)
+}
+
+// Delete removes a session token and corresponding data from both the source
+// and destination stores.
+func (m *MigrateStore) Delete(token string) error {
+	if err := m.source.Delete(token); err != nil {
+		return err
+	}
+	return m.destination.Delete(token)
+}
@@ -0,0 +1,150 @@
+package migratestore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+	"github.com/gaconkzk/scs/v2/memstore"
+)
+
+func TestFindMigrates(t *testing.T) {
+	source := memstore.NewWithCleanupInterval(0)
+	destination := memstore.NewWithCleanupInterval(0)
+	m := New(source, destination)
+
+	expiry := time.Now().Add(time.Hour)
+	err := source.Commit("session_token", []byte("encoded_data"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, found, err := m.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("encoded_data")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+
+	_, found, _ = source.Find("session_token")
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+	b, found, _ = destination.Find("session_token")
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("encoded_data")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+	got, _, _ := destination.Expiry("session_token")
+	if !got.Equal(expiry) {
+		t.Fatalf("got %v: expected %v", got, expiry)
+	}
+}
+
+func TestFindPrefersDestination(t *testing.T) {
+	source := memstore.NewWithCleanupInterval(0)
+	destination := memstore.NewWithCleanupInterval(0)
+	m := New(source, destination)
+
+	source.Commit("session_token", []byte("old_data"), time.Now().Add(time.Hour))
+	destination.Commit("session_token", []byte("new_data"), time.Now().Add(time.Hour))
+
+	b, found, err := m.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("new_data")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("new_data"))
+	}
+}
+
+func TestFindMissing(t *testing.T) {
+	m := New(memstore.NewWithCleanupInterval(0), memstore.NewWithCleanupInterval(0))
+
+	_, found, err := m.Find("missing_session_token")
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+// plainStore hides any optional interfaces implemented by the wrapped store.
+type plainStore struct {
+	scs.Store
+}
+
+func TestFindWithLifetime(t *testing.T) {
+	source := memstore.NewWithCleanupInterval(0)
+	destination := memstore.NewWithCleanupInterval(0)
+	m := NewWithLifetime(plainStore{source}, destination, time.Minute)
+
+	source.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Hour))
+
+	_, found, err := m.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+
+	got, _, _ := destination.Expiry("session_token")
+	if d := time.Until(got); d <= 0 || d > time.Minute {
+		t.Fatalf("got %v: expected an expiry within %v", d, time.Minute)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	source := memstore.NewWithCleanupInterval(0)
+	destination := memstore.NewWithCleanupInterval(0)
+	m := New(source, destination)
+
+	err := m.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found, _ := source.Find("session_token")
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+	_, found, _ = destination.Find("session_token")
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	source := memstore.NewWithCleanupInterval(0)
+	destination := memstore.NewWithCleanupInterval(0)
+	m := New(source, destination)
+
+	source.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	destination.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+
+	err := m.Delete("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found, _ := source.Find("session_token")
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+	_, found, _ = destination.Find("session_token")
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
@@ -2,12 +2,22 @@ package mysqlstore
 
 import (
 	"database/sql"
+	"errors"
 	"log"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// ErrUnsupportedTx is returned by CommitTx and DeleteTx if the transaction
+// isn't a *sql.Tx.
+var ErrUnsupportedTx = errors.New("mysqlstore: transaction must be a *sql.Tx")
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 // MySQLStore represents the session store.
 type MySQLStore struct {
 	*sql.DB
@@ -61,21 +71,157 @@ func (m *MySQLStore) Find(token string) ([]byte, bool, error) {
 	return b, true, nil
 }
 
+// FindMany returns the data for each of the given session tokens which is
+// found in the MySQLStore instance, keyed by session token, using a single
+// query. Tokens which are not found or are expired are omitted.
+func (m *MySQLStore) FindMany(tokens []string) (map[string][]byte, error) {
+	res := make(map[string][]byte, len(tokens))
+	if len(tokens) == 0 {
+		return res, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(tokens)), ", ")
+	args := make([]interface{}, len(tokens))
+	for i, token := range tokens {
+		args[i] = token
+	}
+
+	var stmt string
+	if compareVersion("5.6.4", m.version) >= 0 {
+		stmt = "SELECT token, data FROM sessions WHERE token IN (" + placeholders + ") AND UTC_TIMESTAMP(6) < expiry"
+	} else {
+		stmt = "SELECT token, data FROM sessions WHERE token IN (" + placeholders + ") AND UTC_TIMESTAMP < expiry"
+	}
+
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			token string
+			b     []byte
+		)
+		if err := rows.Scan(&token, &b); err != nil {
+			return nil, err
+		}
+		res[token] = b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// All returns the data for all of the unexpired session tokens in the
+// MySQLStore instance, keyed by session token.
+func (m *MySQLStore) All() (map[string][]byte, error) {
+	var stmt string
+	if compareVersion("5.6.4", m.version) >= 0 {
+		stmt = "SELECT token, data FROM sessions WHERE UTC_TIMESTAMP(6) < expiry"
+	} else {
+		stmt = "SELECT token, data FROM sessions WHERE UTC_TIMESTAMP < expiry"
+	}
+
+	rows, err := m.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string][]byte)
+	for rows.Next() {
+		var (
+			token string
+			b     []byte
+		)
+		if err := rows.Scan(&token, &b); err != nil {
+			return nil, err
+		}
+		res[token] = b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // Commit adds a session token and data to the MySQLStore instance with the given
 // expiry time. If the session token already exists, then the data and expiry
 // time are updated.
 func (m *MySQLStore) Commit(token string, b []byte, expiry time.Time) error {
-	_, err := m.DB.Exec("INSERT INTO sessions (token, data, expiry) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry)", token, b, expiry.UTC())
-	if err != nil {
-		return err
+	return commit(m.DB, token, b, expiry)
+}
+
+// CommitTx adds a session token and data to the MySQLStore instance in the same
+// way as Commit, but using the given transaction, which must be a *sql.Tx
+// opened on the same database. Otherwise ErrUnsupportedTx is returned.
+func (m *MySQLStore) CommitTx(tx interface{}, token string, b []byte, expiry time.Time) error {
+	sqlTx, ok := tx.(*sql.Tx)
+	if !ok {
+		return ErrUnsupportedTx
 	}
-	return nil
+	return commit(sqlTx, token, b, expiry)
+}
+
+func commit(e execer, token string, b []byte, expiry time.Time) error {
+	_, err := e.Exec("INSERT INTO sessions (token, data, expiry) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry)", token, b, expiry.UTC())
+	return err
 }
 
 // Delete removes a session token and corresponding data from the MySQLStore
 // instance.
 func (m *MySQLStore) Delete(token string) error {
-	_, err := m.DB.Exec("DELETE FROM sessions WHERE token = ?", token)
+	return remove(m.DB, token)
+}
+
+// DeleteTx removes a session token and corresponding data from the MySQLStore
+// instance in the same way as Delete, but using the given transaction, which
+// must be a *sql.Tx opened on the same database. Otherwise ErrUnsupportedTx is
+// returned.
+func (m *MySQLStore) DeleteTx(tx interface{}, token string) error {
+	sqlTx, ok := tx.(*sql.Tx)
+	if !ok {
+		return ErrUnsupportedTx
+	}
+	return remove(sqlTx, token)
+}
+
+func remove(e execer, token string) error {
+	_, err := e.Exec("DELETE FROM sessions WHERE token = ?", token)
+	return err
+}
+
+// Expiry returns the expiry time recorded for a given session token in the
+// MySQLStore instance. If the session token is not found or is expired, the
+// returned exists flag will be set to false.
+func (m *MySQLStore) Expiry(token string) (time.Time, bool, error) {
+	var remaining int64
+	var stmt string
+
+	// The remaining lifetime is calculated by the database so that the result
+	// doesn't depend on the connection time zone or the parseTime DSN setting.
+	if compareVersion("5.6.4", m.version) >= 0 {
+		stmt = "SELECT TIMESTAMPDIFF(MICROSECOND, UTC_TIMESTAMP(6), expiry) FROM sessions WHERE token = ? AND UTC_TIMESTAMP(6) < expiry"
+	} else {
+		stmt = "SELECT TIMESTAMPDIFF(MICROSECOND, UTC_TIMESTAMP, expiry) FROM sessions WHERE token = ? AND UTC_TIMESTAMP < expiry"
+	}
+
+	row := m.DB.QueryRow(stmt, token)
+	err := row.Scan(&remaining)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Now().Add(time.Duration(remaining) * time.Microsecond), true, nil
+}
+
+// Flush removes all session tokens and data from the MySQLStore instance.
+func (m *MySQLStore) Flush() error {
+	_, err := m.DB.Exec("TRUNCATE TABLE sessions")
 	return err
 }
 
@@ -2,10 +2,22 @@ package postgresstore
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// ErrUnsupportedTx is returned by CommitTx and DeleteTx if the transaction
+// isn't a *sql.Tx.
+var ErrUnsupportedTx = errors.New("postgresstore: transaction must be a *sql.Tx")
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 // PostgresStore represents the session store.
 type PostgresStore struct {
 	db          *sql.DB
@@ -44,21 +56,133 @@ func (p *PostgresStore) Find(token string) (b []byte, exists bool, err error) {
 	return b, true, nil
 }
 
+// FindMany returns the data for each of the given session tokens which is
+// found in the PostgresStore instance, keyed by session token, using a single
+// query. Tokens which are not found or are expired are omitted.
+func (p *PostgresStore) FindMany(tokens []string) (map[string][]byte, error) {
+	res := make(map[string][]byte, len(tokens))
+	if len(tokens) == 0 {
+		return res, nil
+	}
+
+	placeholders := make([]string, len(tokens))
+	args := make([]interface{}, len(tokens))
+	for i, token := range tokens {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+		args[i] = token
+	}
+
+	rows, err := p.db.Query("SELECT token, data FROM sessions WHERE token IN ("+strings.Join(placeholders, ", ")+") AND current_timestamp < expiry", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			token string
+			b     []byte
+		)
+		if err := rows.Scan(&token, &b); err != nil {
+			return nil, err
+		}
+		res[token] = b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// All returns the data for all of the unexpired session tokens in the
+// PostgresStore instance, keyed by session token.
+func (p *PostgresStore) All() (map[string][]byte, error) {
+	rows, err := p.db.Query("SELECT token, data FROM sessions WHERE current_timestamp < expiry")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string][]byte)
+	for rows.Next() {
+		var (
+			token string
+			b     []byte
+		)
+		if err := rows.Scan(&token, &b); err != nil {
+			return nil, err
+		}
+		res[token] = b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // Commit adds a session token and data to the PostgresStore instance with the
 // given expiry time. If the session token already exists, then the data and expiry
 // time are updated.
 func (p *PostgresStore) Commit(token string, b []byte, expiry time.Time) error {
-	_, err := p.db.Exec("INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry", token, b, expiry)
-	if err != nil {
-		return err
+	return commit(p.db, token, b, expiry)
+}
+
+// CommitTx adds a session token and data to the PostgresStore instance in the same
+// way as Commit, but using the given transaction, which must be a *sql.Tx
+// opened on the same database. Otherwise ErrUnsupportedTx is returned.
+func (p *PostgresStore) CommitTx(tx interface{}, token string, b []byte, expiry time.Time) error {
+	sqlTx, ok := tx.(*sql.Tx)
+	if !ok {
+		return ErrUnsupportedTx
 	}
-	return nil
+	return commit(sqlTx, token, b, expiry)
+}
+
+func commit(e execer, token string, b []byte, expiry time.Time) error {
+	_, err := e.Exec("INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry", token, b, expiry)
+	return err
 }
 
 // Delete removes a session token and corresponding data from the PostgresStore
 // instance.
 func (p *PostgresStore) Delete(token string) error {
-	_, err := p.db.Exec("DELETE FROM sessions WHERE token = $1", token)
+	return remove(p.db, token)
+}
+
+// DeleteTx removes a session token and corresponding data from the PostgresStore
+// instance in the same way as Delete, but using the given transaction, which
+// must be a *sql.Tx opened on the same database. Otherwise ErrUnsupportedTx is
+// returned.
+func (p *PostgresStore) DeleteTx(tx interface{}, token string) error {
+	sqlTx, ok := tx.(*sql.Tx)
+	if !ok {
+		return ErrUnsupportedTx
+	}
+	return remove(sqlTx, token)
+}
+
+func remove(e execer, token string) error {
+	_, err := e.Exec("DELETE FROM sessions WHERE token = $1", token)
+	return err
+}
+
+// Expiry returns the expiry time recorded for a given session token in the
+// PostgresStore instance. If the session token is not found or is expired, the
+// returned exists flag will be set to false.
+func (p *PostgresStore) Expiry(token string) (expiry time.Time, exists bool, err error) {
+	row := p.db.QueryRow("SELECT expiry FROM sessions WHERE token = $1 AND current_timestamp < expiry", token)
+	err = row.Scan(&expiry)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+	return expiry, true, nil
+}
+
+// Flush removes all session tokens and data from the PostgresStore instance.
+func (p *PostgresStore) Flush() error {
+	_, err := p.db.Exec("TRUNCATE TABLE sessions")
 	return err
 }
 
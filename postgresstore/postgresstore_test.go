@@ -271,3 +271,254 @@ func TestStopNilCleanup(t *testing.T) {
 	// A send to a nil channel will block forever
 	p.StopCleanup()
 }
+
+func TestFlush(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO sessions VALUES('session_token', 'encoded_data', current_timestamp + interval '1 minute')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+
+	err = p.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row := db.QueryRow("SELECT COUNT(*) FROM sessions")
+	var count int
+	err = row.Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("got %d: expected %d", count, 0)
+	}
+}
+
+func TestExpiryReporting(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+
+	expiry := time.Now().Add(time.Minute)
+	err = p.Commit("session_token", []byte("encoded_data"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, found, err := p.Expiry("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if d := got.Sub(expiry); d < -time.Second || d > time.Second {
+		t.Fatalf("got %v: expected %v", got, expiry)
+	}
+
+	_, found, _ = p.Expiry("missing_session_token")
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestFindMany(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+
+	err = p.Commit("session_token_1", []byte("encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Commit("session_token_2", []byte("encoded_data_2"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := p.FindMany([]string{"session_token_1", "missing_session_token", "session_token_2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d results: expected %d", len(got), 2)
+	}
+	if !bytes.Equal(got["session_token_1"], []byte("encoded_data_1")) {
+		t.Fatalf("got %v: expected %v", got["session_token_1"], []byte("encoded_data_1"))
+	}
+	if !bytes.Equal(got["session_token_2"], []byte("encoded_data_2")) {
+		t.Fatalf("got %v: expected %v", got["session_token_2"], []byte("encoded_data_2"))
+	}
+}
+
+func TestAll(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+
+	err = p.Commit("session_token_1", []byte("encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Commit("session_token_2", []byte("encoded_data_2"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := p.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{
+		"session_token_1": []byte("encoded_data_1"),
+		"session_token_2": []byte("encoded_data_2"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v: expected %v", got, want)
+	}
+}
+
+func TestTx(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+
+	if err := p.CommitTx(db, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute)); err != ErrUnsupportedTx {
+		t.Fatalf("got %v: expected %v", err, ErrUnsupportedTx)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CommitTx(tx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	_, found, err := p.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CommitTx(tx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	b, found, err := p.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true || !bytes.Equal(b, []byte("encoded_data")) {
+		t.Fatalf("got %v, %v: expected %v, %v", b, found, []byte("encoded_data"), true)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeleteTx(tx, "session_token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	_, found, err = p.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeleteTx(tx, "session_token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	_, found, err = p.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
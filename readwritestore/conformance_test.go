@@ -0,0 +1,14 @@
+package readwritestore_test
+
+import (
+	"testing"
+
+	"github.com/gaconkzk/scs/v2/memstore"
+	"github.com/gaconkzk/scs/v2/readwritestore"
+	"github.com/gaconkzk/scs/v2/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	m := memstore.NewWithCleanupInterval(0)
+	storetest.VerifyStore(t, readwritestore.New(m, m))
+}
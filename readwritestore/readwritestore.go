@@ -0,0 +1,119 @@
+package readwritestore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+)
+
+// ReadWriteStore represents the session store. It wraps a read store, such as
+// a connection to a read replica, and a write store, such as a connection to
+// the primary it replicates from. Find reads from the read store, and Commit
+// and Delete write to the write store.
+//
+// Because replication isn't instant, a session which has just been committed
+// or deleted may not yet have changed in the read store. If a read-your-writes
+// window is set, Find reads session tokens which have been committed or
+// deleted by this ReadWriteStore instance within the window from the write
+// store instead.
+type ReadWriteStore struct {
+	read   scs.Store
+	write  scs.Store
+	window time.Duration
+
+	// written maps session tokens committed or deleted within the window to
+	// the time at which the window ends for them. pruned is when expired
+	// entries were last removed.
+	mu      sync.Mutex
+	written map[string]time.Time
+	pruned  time.Time
+}
+
+// New returns a new ReadWriteStore instance, without a read-your-writes
+// window.
+func New(read, write scs.Store) *ReadWriteStore {
+	return NewWithReadYourWrites(read, write, 0)
+}
+
+// NewWithReadYourWrites returns a new ReadWriteStore instance. The window
+// parameter controls how long after a session token is committed or deleted
+// Find reads it from the write store rather than the read store. It should be
+// longer than the usual replication lag. Setting it to 0 means that Find
+// always uses the read store.
+func NewWithReadYourWrites(read, write scs.Store, window time.Duration) *ReadWriteStore {
+	return &ReadWriteStore{
+		read:    read,
+		write:   write,
+		window:  window,
+		written: make(map[string]time.Time),
+	}
+}
+
+// Find returns the data for a given session token from the read store, or from
+// the write store if the token was committed or deleted within the
+// read-your-writes window. If the session token is not found or is expired,
+// the returned exists flag will be set to false.
+func (r *ReadWriteStore) Find(token string) ([]byte, bool, error) {
+	if r.recentlyWritten(token) {
+		return r.write.Find(token)
+	}
+	return r.read.Find(token)
+}
+
+// Commit adds a session token and data to the write store with the given
+// expiry time. If the session token already exists, then the data and expiry
+// time are updated.
+func (r *ReadWriteStore) Commit(token string, b []byte, expiry time.Time) error {
+	if err := r.write.Commit(token, b, expiry); err != nil {
+		return err
+	}
+	r.markWritten(token)
+	return nil
+}
+
+// Delete removes a session token and corresponding data from the write store.
+func (r *ReadWriteStore) Delete(token string) error {
+	if err := r.write.Delete(token); err != nil {
+		return err
+	}
+	r.markWritten(token)
+	return nil
+}
+
+// recentlyWritten reports whether the session token was committed or deleted
+// within the read-your-writes window.
+func (r *ReadWriteStore) recentlyWritten(token string) bool {
+	if r.window <= 0 {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	until, ok := r.written[token]
+	return ok && time.Now().Before(until)
+}
+
+// markWritten starts the read-your-writes window for the session token. Expired
+// entries are removed at most once per window, so that the map doesn't grow
+// without bound.
+func (r *ReadWriteStore) markWritten(token string) {
+	if r.window <= 0 {
+		return
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.pruned) > r.window {
+		for t, until := range r.written {
+			if !now.Before(until) {
+				delete(r.written, t)
+			}
+		}
+		r.pruned = now
+	}
+	r.written[token] = now.Add(r.window)
+}
@@ -0,0 +1,100 @@
+package readwritestore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gaconkzk/scs/v2/memstore"
+)
+
+func TestRouting(t *testing.T) {
+	read := memstore.NewWithCleanupInterval(0)
+	write := memstore.NewWithCleanupInterval(0)
+	r := New(read, write)
+
+	err := r.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := write.Find("session_token"); found != true {
+		t.Fatalf("got %v: expected the commit to go to the write store", found)
+	}
+	if _, found, _ := read.Find("session_token"); found != false {
+		t.Fatalf("got %v: expected the commit not to go to the read store", found)
+	}
+
+	// Nothing has replicated to the read store yet.
+	_, found, err := r.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+
+	read.Commit("session_token", []byte("replicated_data"), time.Now().Add(time.Minute))
+	b, found, err := r.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true || !bytes.Equal(b, []byte("replicated_data")) {
+		t.Fatalf("got %v %q: expected %v %q", found, b, true, "replicated_data")
+	}
+
+	if err := r.Delete("session_token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := write.Find("session_token"); found != false {
+		t.Fatalf("got %v: expected the delete to go to the write store", found)
+	}
+	if _, found, _ := read.Find("session_token"); found != true {
+		t.Fatalf("got %v: expected the delete not to go to the read store", found)
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	read := memstore.NewWithCleanupInterval(0)
+	write := memstore.NewWithCleanupInterval(0)
+	r := NewWithReadYourWrites(read, write, 100*time.Millisecond)
+
+	read.Commit("session_token", []byte("stale_data"), time.Now().Add(time.Minute))
+	err := r.Commit("session_token", []byte("new_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, found, err := r.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true || !bytes.Equal(b, []byte("new_data")) {
+		t.Fatalf("got %v %q: expected %v %q", found, b, true, "new_data")
+	}
+
+	// Deleted sessions are also read from the write store within the window.
+	read.Commit("deleted_token", []byte("stale_data"), time.Now().Add(time.Minute))
+	if err := r.Delete("deleted_token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := r.Find("deleted_token"); found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	b, found, err = r.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true || !bytes.Equal(b, []byte("stale_data")) {
+		t.Fatalf("got %v %q: expected the read store to be used after the window", found, b)
+	}
+
+	r.Commit("other_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	r.mu.Lock()
+	_, ok := r.written["session_token"]
+	r.mu.Unlock()
+	if ok {
+		t.Errorf("expected the expired window entry to be removed")
+	}
+}
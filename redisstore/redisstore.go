@@ -1,15 +1,53 @@
 package redisstore
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
+// ErrLockTimeout is returned by Lock if the lock for a session token isn't
+// released within the lock timeout.
+var ErrLockTimeout = errors.New("redisstore: timed out waiting for session lock")
+
+const (
+	// lockTimeout is how long a session lock is held before it expires
+	// automatically, in case the holder fails to unlock it, and also how long
+	// Lock waits to acquire it.
+	lockTimeout = 30 * time.Second
+
+	// lockRetryInterval is how often Lock retries while the lock is held.
+	lockRetryInterval = 10 * time.Millisecond
+)
+
+// unlockScript deletes a lock key only if it still holds the value set by the
+// caller, so that a lock which has expired and been acquired by someone else
+// isn't released.
+var unlockScript = redis.NewScript(1, `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`)
+
+// addToIndexScript adds a session token to an index sorted set, scored by its
+// expiry time, after removing expired members, and sets the expiry time of the
+// sorted set to that of its last member.
+var addToIndexScript = redis.NewScript(1, `
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[3])
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+return redis.call("PEXPIREAT", KEYS[1], last[2])`)
+
 // RedisStore represents the session store.
 type RedisStore struct {
 	pool   *redis.Pool
 	prefix string
+
+	// locks maps each session token locked by this RedisStore instance to the
+	// random value stored in its lock key.
+	locks sync.Map
 }
 
 // New returns a new RedisStore instance. The pool parameter should be a pointer
@@ -44,6 +82,99 @@ func (r *RedisStore) Find(token string) (b []byte, exists bool, err error) {
 	return b, true, nil
 }
 
+// FindAndRefresh returns the data for a given session token from the RedisStore
+// instance, and if it is found, updates its expiry time to newExpiry in the same
+// round trip. It uses the GETEX command, which requires Redis 6.2 or newer. If
+// the session token is not found or is expired, the returned exists flag will
+// be set to false.
+func (r *RedisStore) FindAndRefresh(token string, newExpiry time.Time) (b []byte, exists bool, err error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	b, err = redis.Bytes(conn.Do("GETEX", r.prefix+token, "PXAT", makeMillisecondTimestamp(newExpiry)))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// FindMany returns the data for each of the given session tokens which is
+// found in the RedisStore instance, keyed by session token, using a single
+// MGET command. Tokens which are not found or are expired are omitted.
+func (r *RedisStore) FindMany(tokens []string) (map[string][]byte, error) {
+	res := make(map[string][]byte, len(tokens))
+	if len(tokens) == 0 {
+		return res, nil
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	args := make([]interface{}, len(tokens))
+	for i, token := range tokens {
+		args[i] = r.prefix + token
+	}
+	bs, err := redis.ByteSlices(conn.Do("MGET", args...))
+	if err != nil {
+		return nil, err
+	}
+	for i, b := range bs {
+		if b != nil {
+			res[tokens[i]] = b
+		}
+	}
+	return res, nil
+}
+
+// All returns the data for all of the session tokens in the RedisStore
+// instance, keyed by session token. The keys are found with the SCAN command,
+// so the RedisStore prefix should be unique to the session data. Lock and
+// index keys are skipped.
+func (r *RedisStore) All() (map[string][]byte, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	res := make(map[string][]byte)
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", r.prefix+"*", "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		var scanned, keys []string
+		if _, err := redis.Scan(values, &cursor, &scanned); err != nil {
+			return nil, err
+		}
+		for _, key := range scanned {
+			if !strings.HasSuffix(key, ":lock") && !strings.HasSuffix(key, ":index") {
+				keys = append(keys, key)
+			}
+		}
+
+		if len(keys) > 0 {
+			args := make([]interface{}, len(keys))
+			for i, key := range keys {
+				args[i] = key
+			}
+			bs, err := redis.ByteSlices(conn.Do("MGET", args...))
+			if err != nil {
+				return nil, err
+			}
+			for i, b := range bs {
+				if b != nil {
+					res[strings.TrimPrefix(keys[i], r.prefix)] = b
+				}
+			}
+		}
+
+		if cursor == 0 {
+			return res, nil
+		}
+	}
+}
+
 // Commit adds a session token and data to the RedisStore instance with the
 // given expiry time. If the session token already exists then the data and
 // expiry time are updated.
@@ -77,6 +208,142 @@ func (r *RedisStore) Delete(token string) error {
 	return err
 }
 
+// Expiry returns the expiry time recorded for a given session token in the
+// RedisStore instance. If the session token is not found or is expired, the
+// returned exists flag will be set to false.
+func (r *RedisStore) Expiry(token string) (time.Time, bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	ms, err := redis.Int64(conn.Do("PTTL", r.prefix+token))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	// PTTL returns -2 if the key does not exist and -1 if it has no expiry.
+	if ms < 0 {
+		return time.Time{}, false, nil
+	}
+	return time.Now().Add(time.Duration(ms) * time.Millisecond), true, nil
+}
+
+// Flush removes all session tokens and data with the store's key prefix from
+// the RedisStore instance. The keys are found using SCAN, so this is safe to
+// use on a Redis database which is shared with other data.
+func (r *RedisStore) Flush() error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", r.prefix+"*", "COUNT", 100))
+		if err != nil {
+			return err
+		}
+
+		var keys []interface{}
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if _, err := conn.Do("DEL", keys...); err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// AddToIndex adds a session token to the set of tokens held for the given
+// index key and value in the RedisStore instance, until the expiry time. The
+// set is held in a sorted set scored by expiry time, which itself expires
+// along with its last member.
+func (r *RedisStore) AddToIndex(key, value, token string, expiry time.Time) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err := addToIndexScript.Do(conn, r.indexKey(key, value), makeMillisecondTimestamp(expiry), token, makeMillisecondTimestamp(time.Now()))
+	return err
+}
+
+// RemoveFromIndex removes a session token from the set of tokens held for the
+// given index key and value in the RedisStore instance.
+func (r *RedisStore) RemoveFromIndex(key, value, token string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("ZREM", r.indexKey(key, value), token)
+	return err
+}
+
+// TokensForIndex returns the unexpired session tokens in the set held for the
+// given index key and value in the RedisStore instance.
+func (r *RedisStore) TokensForIndex(key, value string) ([]string, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", r.indexKey(key, value), "("+strconv.FormatInt(makeMillisecondTimestamp(time.Now()), 10), "+inf"))
+}
+
+// Lock acquires the lock for a given session token, blocking until any other
+// holder has unlocked it. The lock is held in Redis using SET NX, so it is
+// shared by every RedisStore instance using the same Redis server and key
+// prefix. It expires automatically after 30 seconds, in case the holder fails
+// to unlock it, and if it can't be acquired within that time ErrLockTimeout is
+// returned.
+func (r *RedisStore) Lock(token string) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	value := hex.EncodeToString(b)
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		_, err := redis.String(conn.Do("SET", r.lockKey(token), value, "NX", "PX", int64(lockTimeout/time.Millisecond)))
+		if err == nil {
+			r.locks.Store(token, value)
+			return nil
+		} else if err != redis.ErrNil {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// Unlock releases the lock for a given session token. If the token isn't
+// locked by this RedisStore instance then this is a no-op.
+func (r *RedisStore) Unlock(token string) error {
+	value, ok := r.locks.Load(token)
+	if !ok {
+		return nil
+	}
+	r.locks.Delete(token)
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err := unlockScript.Do(conn, r.lockKey(token), value)
+	return err
+}
+
+func (r *RedisStore) lockKey(token string) string {
+	return r.prefix + token + ":lock"
+}
+
+func (r *RedisStore) indexKey(key, value string) string {
+	return r.prefix + key + ":" + value + ":index"
+}
+
 func makeMillisecondTimestamp(t time.Time) int64 {
 	return t.UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"os"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -223,3 +224,358 @@ func TestDelete(t *testing.T) {
 		t.Fatalf("got %v: expected %v", data, nil)
 	}
 }
+
+func TestFlush(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SCS_REDIS_TEST_DSN")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 1)
+	defer redisPool.Close()
+
+	r := New(redisPool)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Do("SET", r.prefix+"session_token", "encoded_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Do("SET", "other_key", "other_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found, err := r.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+
+	exists, err := redis.Bool(conn.Do("EXISTS", "other_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists != true {
+		t.Fatalf("got %v: expected %v", exists, true)
+	}
+}
+
+func TestExpiryReporting(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SCS_REDIS_TEST_DSN")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 1)
+	defer redisPool.Close()
+
+	r := New(redisPool)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := time.Now().Add(time.Minute)
+	err = r.Commit("session_token", []byte("encoded_data"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, found, err := r.Expiry("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if d := got.Sub(expiry); d < -time.Second || d > time.Second {
+		t.Fatalf("got %v: expected %v", got, expiry)
+	}
+
+	_, found, _ = r.Expiry("missing_session_token")
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestFindAndRefresh(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SCS_REDIS_TEST_DSN")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 1)
+	defer redisPool.Close()
+
+	r := New(redisPool)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newExpiry := time.Now().Add(time.Hour)
+	b, found, err := r.FindAndRefresh("session_token", newExpiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if !bytes.Equal(b, []byte("encoded_data")) {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+
+	got, _, err := r.Expiry("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := got.Sub(newExpiry); d < -time.Second || d > time.Second {
+		t.Fatalf("got %v: expected %v", got, newExpiry)
+	}
+
+	_, found, _ = r.FindAndRefresh("missing_session_token", newExpiry)
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestFindMany(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SCS_REDIS_TEST_DSN")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 1)
+	defer redisPool.Close()
+
+	r := New(redisPool)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Commit("session_token_1", []byte("encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Commit("session_token_2", []byte("encoded_data_2"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.FindMany([]string{"session_token_1", "missing_session_token", "session_token_2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d results: expected %d", len(got), 2)
+	}
+	if !bytes.Equal(got["session_token_1"], []byte("encoded_data_1")) {
+		t.Fatalf("got %v: expected %v", got["session_token_1"], []byte("encoded_data_1"))
+	}
+	if !bytes.Equal(got["session_token_2"], []byte("encoded_data_2")) {
+		t.Fatalf("got %v: expected %v", got["session_token_2"], []byte("encoded_data_2"))
+	}
+}
+
+func TestLock(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SCS_REDIS_TEST_DSN")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 3)
+	defer redisPool.Close()
+
+	r := New(redisPool)
+
+	conn := redisPool.Get()
+	_, err := conn.Do("FLUSHDB")
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Lock("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := New(redisPool)
+	locked := make(chan error)
+	go func() {
+		locked <- other.Lock("session_token")
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("expected Lock to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err = r.Unlock("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Lock to be acquired")
+	}
+
+	err = other.Unlock("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAll(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SCS_REDIS_TEST_DSN")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 1)
+	defer redisPool.Close()
+
+	r := New(redisPool)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Lock("session_token_1"); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Unlock("session_token_1")
+
+	err = r.Commit("session_token_1", []byte("encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Commit("session_token_2", []byte("encoded_data_2"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{
+		"session_token_1": []byte("encoded_data_1"),
+		"session_token_2": []byte("encoded_data_2"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v: expected %v", got, want)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SCS_REDIS_TEST_DSN")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 1)
+	defer redisPool.Close()
+
+	r := New(redisPool)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"session_token_1", "session_token_2"} {
+		if err := r.AddToIndex("userID", "42", token, time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.AddToIndex("userID", "42", "expired_session_token", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	err = r.Commit("session_token_1", []byte("encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.TokensForIndex("userID", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{"session_token_1", "session_token_2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v: expected %v", got, want)
+	}
+
+	all, err := r.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Fatalf("got %v: expected the index key to be skipped", all)
+	}
+
+	if err := r.RemoveFromIndex("userID", "42", "session_token_1"); err != nil {
+		t.Fatal(err)
+	}
+	got, err = r.TokensForIndex("userID", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"session_token_2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v: expected %v", got, want)
+	}
+}
@@ -0,0 +1,67 @@
+package scs
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// revokedTombstone is committed to the store in place of the session data for
+// a token which has been revoked with Revoke. It is treated as a tombstone
+// everywhere, but lets Load tell a revoked token apart from an unknown one.
+var revokedTombstone = []byte("\x00revoked")
+
+func isRevoked(b []byte) bool {
+	return bytes.Equal(b, revokedTombstone)
+}
+
+// Revoke force-revokes the session with the given token, for example from
+// admin tooling, by replacing its session data in the store with a marker. The
+// marker expires after TombstoneTTL or, if that isn't set, after Lifetime.
+// Until then, a request which presents the token gets a new, empty session
+// with the status Destroyed, so that the session cookie is deleted, and
+// WasRevoked reports that it was revoked; the LoadAndSave middleware passes
+// such requests to OnRevoked if it is set. Revoking a token which isn't found
+// is a no-op. It has no effect when using a StatelessStore.
+//
+// As with DestroyAllForUser, session data already loaded into a request
+// context is not affected, and will be written back to the store if it is
+// committed.
+func (s *SessionManager) Revoke(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	store := s.getStore()
+	if _, ok := store.(StatelessStore); ok || token == "" {
+		return nil
+	}
+
+	key, _, found, err := s.find(store, token, time.Time{})
+	if err != nil || !found {
+		return err
+	}
+
+	release, err := s.acquireStore()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ttl := s.TombstoneTTL
+	if ttl <= 0 {
+		ttl = s.getLifetime()
+	}
+	return store.Commit(key, revokedTombstone, time.Now().Add(ttl).UTC())
+}
+
+// WasRevoked returns true if the session token sent by the client belonged to
+// a session which has been revoked with Revoke, in which case the session data
+// in the context is a new, empty session.
+func (s *SessionManager) WasRevoked(ctx context.Context) bool {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return sd.revoked
+}
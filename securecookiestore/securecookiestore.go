@@ -0,0 +1,134 @@
+package securecookiestore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+)
+
+// DefaultMaxLength is the default maximum length of an encoded session token.
+// Browsers typically limit each cookie (including its name and attributes) to
+// 4096 bytes, so this leaves some room for those.
+const DefaultMaxLength = 3800
+
+// ErrTokenTooLarge is returned when the encrypted session data is too large to
+// fit in the session cookie.
+var ErrTokenTooLarge = errors.New("securecookiestore: encoded session data exceeds maximum cookie length")
+
+// SecureCookieStore represents the session store. Rather than persisting the
+// session data on the server, it encrypts and authenticates the session data
+// using AES-GCM and uses the result as the session token, so that the session
+// data is held by the client in the session cookie.
+type SecureCookieStore struct {
+	keys      *scs.KeyRing
+	maxLength int
+}
+
+// New returns a new SecureCookieStore instance. The keys parameter holds the
+// secret keys used to encrypt and decrypt the session data. The current key is
+// used for encrypting, and all keys in the ring are tried when decrypting, so
+// keys can be rotated without invalidating existing sessions.
+func New(keys *scs.KeyRing) *SecureCookieStore {
+	return NewWithMaxLength(keys, DefaultMaxLength)
+}
+
+// NewWithMaxLength returns a new SecureCookieStore instance. The maxLength
+// parameter controls the maximum length of an encoded session token; trying to
+// commit session data which would exceed this results in ErrTokenTooLarge.
+func NewWithMaxLength(keys *scs.KeyRing, maxLength int) *SecureCookieStore {
+	return &SecureCookieStore{
+		keys:      keys,
+		maxLength: maxLength,
+	}
+}
+
+// Find decrypts and returns the session data held in the given session token.
+// If the token cannot be decrypted with any of the keys (because it has been
+// tampered with, or was encrypted with a key which has since been retired) or
+// the session data has expired, the returned exists flag will be set to false.
+func (s *SecureCookieStore) Find(token string) ([]byte, bool, error) {
+	ciphertext, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	for _, key := range s.keys.All() {
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(ciphertext) < gcm.NonceSize() {
+			return nil, false, nil
+		}
+
+		nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+		plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+		if err != nil || len(plaintext) < 8 {
+			continue
+		}
+
+		expiry := int64(binary.BigEndian.Uint64(plaintext[:8]))
+		if time.Now().UnixNano() > expiry {
+			return nil, false, nil
+		}
+		return plaintext[8:], true, nil
+	}
+
+	return nil, false, nil
+}
+
+// CommitToken encrypts the session data and expiry time using the current key
+// and returns the result as a new session token. If the token would be longer
+// than the maximum length, ErrTokenTooLarge is returned.
+func (s *SecureCookieStore) CommitToken(b []byte, expiry time.Time) (string, error) {
+	gcm, err := newGCM(s.keys.Current())
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	plaintext := make([]byte, 8, 8+len(b))
+	binary.BigEndian.PutUint64(plaintext, uint64(expiry.UnixNano()))
+	plaintext = append(plaintext, b...)
+
+	token := base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil))
+	if s.maxLength > 0 && len(token) > s.maxLength {
+		return "", ErrTokenTooLarge
+	}
+	return token, nil
+}
+
+// Commit is a no-op. The session data is held in the session token returned by
+// CommitToken, so there is nothing to persist on the server.
+func (s *SecureCookieStore) Commit(token string, b []byte, expiry time.Time) error {
+	return nil
+}
+
+// Delete is a no-op. The session data is held by the client, so it can't be
+// removed by the server; the session manager instructs the client to delete
+// the session cookie instead.
+func (s *SecureCookieStore) Delete(token string) error {
+	return nil
+}
+
+// newGCM returns an AES-256-GCM cipher using a key derived from the given
+// secret, so that secrets of any length can be used.
+func newGCM(secret []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,198 @@
+package securecookiestore
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+)
+
+func TestFind(t *testing.T) {
+	s := New(scs.NewKeyRing([]byte("secret")))
+
+	token, err := s.CommitToken([]byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, found, err := s.Find(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("encoded_data")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+}
+
+func TestFindMissing(t *testing.T) {
+	s := New(scs.NewKeyRing([]byte("secret")))
+
+	_, found, err := s.Find("missing_session_token")
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := New(scs.NewKeyRing([]byte("secret")))
+
+	token, err := s.CommitToken([]byte("encoded_data"), time.Now().Add(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found, _ := s.Find(token)
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	_, found, _ = s.Find(token)
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	keys := scs.NewKeyRing([]byte("old_secret"))
+	s := New(keys)
+
+	token, err := s.CommitToken([]byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.Add([]byte("new_secret"))
+
+	b, found, err := s.Find(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("encoded_data")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+
+	newToken, err := s.CommitToken([]byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.Retire([]byte("old_secret"))
+
+	_, found, _ = s.Find(token)
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+	_, found, _ = s.Find(newToken)
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	s := New(scs.NewKeyRing([]byte("secret")))
+
+	token, err := s.CommitToken([]byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := []byte(token)
+	if tampered[20] == 'A' {
+		tampered[20] = 'B'
+	} else {
+		tampered[20] = 'A'
+	}
+
+	_, found, err := s.Find(string(tampered))
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+
+	other := New(scs.NewKeyRing([]byte("other_secret")))
+	_, found, _ = other.Find(token)
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestTokenTooLarge(t *testing.T) {
+	s := NewWithMaxLength(scs.NewKeyRing([]byte("secret")), 100)
+
+	_, err := s.CommitToken(bytes.Repeat([]byte("a"), 100), time.Now().Add(time.Minute))
+	if err != ErrTokenTooLarge {
+		t.Fatalf("got %v: expected %v", err, ErrTokenTooLarge)
+	}
+
+	_, err = s.CommitToken([]byte("a"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+}
+
+func TestSessionManager(t *testing.T) {
+	sessionManager := scs.New()
+	sessionManager.Store = New(scs.NewKeyRing([]byte("secret")))
+
+	var commitErr error
+	sessionManager.ErrorFunc = func(w http.ResponseWriter, r *http.Request, err error) {
+		commitErr = err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/put":
+			sessionManager.Put(r.Context(), "foo", "bar")
+		case "/put-large":
+			sessionManager.Put(r.Context(), "foo", string(bytes.Repeat([]byte("a"), 4096)))
+		case "/get":
+			w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+		}
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/put", nil))
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies: expected %d", len(cookies), 1)
+	}
+
+	r := httptest.NewRequest("GET", "/get", nil)
+	r.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if rr.Body.String() != "bar" {
+		t.Fatalf("got %q: expected %q", rr.Body.String(), "bar")
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/put-large", nil))
+	if commitErr != ErrTokenTooLarge {
+		t.Fatalf("got %v: expected %v", commitErr, ErrTokenTooLarge)
+	}
+
+	ctx, err := sessionManager.Load(context.Background(), "tampered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionManager.Exists(ctx, "foo") {
+		t.Fatalf("got %v: expected %v", true, false)
+	}
+}
@@ -3,50 +3,522 @@ package scs
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gaconkzk/scs/v2/memstore"
 )
 
+var errStreamAborted = errors.New("scs: response aborted after session error")
+
+// ErrCookieDomainMismatch is passed to the ErrorFunc by the LoadAndSave
+// middleware when the request host is not within the configured cookie Domain,
+// so the session cookie would be rejected by the client.
+var ErrCookieDomainMismatch = errors.New("scs: request host is not within the session cookie domain")
+
+// ErrUntrustedTokenHeader is passed to the ErrorFunc by the LoadAndSave
+// middleware when TrustedTokenHeader is set without TrustTokenHeader.
+var ErrUntrustedTokenHeader = errors.New("scs: TrustedTokenHeader is set but TrustTokenHeader is false")
+
+// ErrCookiePrefixConflict is returned by UseHostPrefix and UseSecurePrefix when
+// the existing session cookie settings can't be used with the cookie name
+// prefix.
+var ErrCookiePrefixConflict = errors.New("scs: session cookie settings conflict with the cookie name prefix")
+
+const (
+	hostCookiePrefix   = "__Host-"
+	secureCookiePrefix = "__Secure-"
+)
+
 // Session Deprecated: Session is a backwards-compatible alias for SessionManager.
 type Session = SessionManager
 
 // SessionManager holds the configuration settings for your sessions.
+//
+// The public fields should be set before the session manager is used. To
+// change the IdleTimeout, Lifetime, Cookie or Store settings while requests are
+// being handled, use the SetIdleTimeout, SetLifetime, SetCookie and SetStore
+// methods instead; assigning to the fields directly at that point is a data
+// race.
 type SessionManager struct {
 	// IdleTimeout controls the maximum length of time a session can be inactive
 	// before it expires. For example, some applications may wish to set this so
-	// there is a timeout after 20 minutes of inactivity. By default IdleTimeout
-	// is not set and there is no inactivity timeout.
+	// there is a timeout after 20 minutes of inactivity. When an IdleTimeout is
+	// set, the session data is re-committed to the store and the session cookie
+	// is re-sent with an extended expiry on every request, even if the session
+	// data hasn't been changed, so that both stay in sync with the sliding
+	// window. This means that every request for a session holding data
+	// results in a store write; requests which don't use the session, or whose
+	// session is empty, still cause no write and no cookie. By default
+	// IdleTimeout is not set and there is no inactivity timeout.
 	IdleTimeout time.Duration
 
+	// RefreshCookieEachRequest changes how the LoadAndSave middleware keeps an
+	// IdleTimeout window up to date for requests which read the session data
+	// without changing it. Instead of marking the session Modified and
+	// re-committing all of its data, the session is left Unmodified and only
+	// its expiry time in the store is extended, using Touch if the store
+	// implements TouchStore, before the session cookie is re-sent with the new
+	// expiry. A RefreshingStore has already extended the expiry when the
+	// session was loaded, so costs no extra write; other stores still get a
+	// full commit. Either way every request for a session holding data costs a
+	// store write and a Set-Cookie header. It has no effect unless IdleTimeout
+	// is set.
+	RefreshCookieEachRequest bool
+
 	// Lifetime controls the maximum length of time that a session is valid for
 	// before it expires. The lifetime is an 'absolute expiry' which is set when
 	// the session is first created and does not change. The default value is 24
 	// hours.
 	Lifetime time.Duration
 
+	// MaxLifetime, if set, is a hard limit on how long a session can last
+	// from when it was first created, which applies to every session
+	// regardless of the Lifetime, RememberMe, RenewToken or ExpiryStrategy.
+	// When the session data is committed, its deadline is brought forward if
+	// necessary so that it is no later than the creation time plus
+	// MaxLifetime. The creation time is recorded in the session data. The
+	// default value of 0 means there is no limit.
+	MaxLifetime time.Duration
+
+	// ExpiryStrategy, if set, decides when session data expires from the store
+	// instead of the built-in policy, which expires it after the IdleTimeout
+	// or at the absolute deadline set by Lifetime, whichever comes first. This
+	// allows custom policies, such as only extending sessions during business
+	// hours. By default ExpiryStrategy is nil and the built-in policy is used.
+	ExpiryStrategy ExpiryStrategy
+
+	// ClockSkew sets a tolerance for differences between the application clock
+	// and the clock used by the session store (for example, a database server).
+	// Session data is committed to the store with an expiry time extended by
+	// this amount, and when session data is loaded it is not treated as expired
+	// until its deadline has passed by more than this amount. This means that
+	// sessions may live slightly longer than Lifetime and IdleTimeout would
+	// otherwise allow. The session cookie expiry is not affected. The default
+	// value of 0 means there is no tolerance.
+	ClockSkew time.Duration
+
 	// Store controls the session store where the session data is persisted.
+	// To replace the session store while the session manager is in use, call
+	// SetStore instead of assigning to this field.
 	Store Store
 
+	// HashStoreKeys controls whether session tokens are hashed with SHA-256
+	// before being used as keys in the session store. The plaintext token is
+	// only ever sent to the client, so someone who can read the contents of
+	// the store can't use the keys to hijack sessions. Stores which list their
+	// keys will list the hashes. It has no effect with a StatelessStore.
+	// Changing this setting invalidates all existing sessions. The default
+	// value is false.
+	HashStoreKeys bool
+
+	// StoreKeyPepper, if set, is used in place of HashStoreKeys to derive the
+	// session store keys from the session tokens using HMAC-SHA256 with the
+	// current key in the ring, so that the store keys can't be computed, or
+	// matched up with session tokens, without the secret. When the session
+	// data is loaded, the older keys in the ring are also tried, and session
+	// data found under an older key is moved to the current key the next time
+	// it's committed. It has no effect with a StatelessStore. The default
+	// value is nil.
+	StoreKeyPepper *KeyRing
+
 	// Cookie contains the configuration settings for session cookies.
 	Cookie SessionCookie
 
+	// UnauthenticatedHandler handles the requests rejected by the
+	// RequireSession middleware, for example by redirecting to a login page.
+	// By default it is nil, and rejected requests get a 401 Unauthorized
+	// response.
+	UnauthenticatedHandler http.Handler
+
+	// OnRevoked, if set, handles the requests passed to the LoadAndSave
+	// middleware whose session has been revoked with Revoke, instead of the
+	// next handler, for example to respond with 401 Unauthorized or a "you
+	// have been logged out" page. The request context holds a new, empty
+	// session, which can be used to store a flash message. By default it is
+	// nil, and such requests carry on with the new session.
+	OnRevoked func(w http.ResponseWriter, r *http.Request)
+
+	// LegacyCookieNames lists previous names of the session cookie, so that
+	// the cookie can be renamed without logging users out. If the session
+	// cookie doesn't hold a live session, the LoadAndSave middleware tries
+	// the legacy cookies in order and uses the first which does. The session
+	// cookie is then sent under the current Cookie.Name, and any legacy
+	// cookies sent by the client are deleted. By default it is nil.
+	LegacyCookieNames []string
+
+	// CookiePathFunc, if set, is called by the LoadAndSave middleware to get
+	// the 'Path' attribute for the session cookie from the request, for
+	// applications which are mounted at a different path externally than the
+	// one they see, such as behind a reverse proxy which strips a path prefix.
+	// If it returns the empty string, Cookie.Path is used. ForwardedPrefixPath
+	// can be used to honor the X-Forwarded-Prefix request header. It isn't
+	// used by CommitAndCookie. By default it is nil, and Cookie.Path is always
+	// used.
+	CookiePathFunc func(r *http.Request) string
+
+	// TokenHeader, if set, switches the LoadAndSave middleware into a cookie-less
+	// mode where the session token is communicated using the named HTTP header
+	// instead of a cookie. The token is read from the request header, and when
+	// the session is modified the token is returned in the response header. The
+	// client is responsible for storing the token and sending it with each
+	// request. When the session is destroyed the response header is sent with
+	// an empty value, which the client should treat as a signal to discard its
+	// stored token. Cookies are never read or written in this mode, and the
+	// Cookie settings have no effect. By default TokenHeader is not set and a
+	// cookie is used.
+	TokenHeader string
+
+	// TrustedTokenHeader, if set, makes the LoadAndSave middleware read the
+	// session token from the named request header, which should be set by a
+	// trusted gateway in front of the application that has already resolved
+	// the session (for example "X-Internal-Session-Token"). The session data is
+	// loaded and committed as normal, but cookies are never read or written
+	// and the token isn't sent in the response, so a new session token (from
+	// a new session or RenewToken) isn't communicated to the client. It takes
+	// precedence over TokenHeader.
+	//
+	// Because any client which can reach the application directly could set
+	// the header to another user's session token, TrustTokenHeader must also
+	// be set to true to confirm that the header can only come from the
+	// gateway. Otherwise the LoadAndSave middleware passes
+	// ErrUntrustedTokenHeader to the ErrorFunc. By default TrustedTokenHeader
+	// is not set.
+	TrustedTokenHeader string
+
+	// TrustTokenHeader confirms that the TrustedTokenHeader request header is
+	// set by a trusted gateway and can't be set by clients. The default value
+	// is false.
+	TrustTokenHeader bool
+
+	// TokenGenerator controls how new session tokens are generated. Tokens
+	// already held by clients are looked up in the store whatever their format,
+	// so changing the generator doesn't invalidate existing sessions; they
+	// keep their old-format tokens until they expire or RenewToken is called.
+	// It is not used with a StatelessStore, which generates its own tokens. By
+	// default tokens are 32 random bytes encoded as unpadded base64url.
+	TokenGenerator func() (string, error)
+
+	// TokenValidator, if set, is called with the session token sent by the
+	// client before it is looked up in the store. If it returns false the token
+	// is ignored and a new session is created. It's intended as a cheap check
+	// to reject malformed or hostile values (for example, by length or
+	// character set) and should accept every format that TokenGenerator has
+	// produced for sessions which are still live. By default all tokens are
+	// looked up.
+	TokenValidator func(token string) bool
+
+	// MaxTokenLength is the maximum length, in bytes, of the session token
+	// value accepted by the LoadAndSave middleware from the session cookie or
+	// token header. Longer values are ignored without being looked up in the
+	// store, and a new session is created, which protects the store from
+	// oversized keys. Values containing characters which aren't allowed in a
+	// cookie value are always ignored in the same way. If you use a
+	// StatelessStore, remember that its tokens hold the encoded session data
+	// and may be long. The default value of 0 means that there is no limit.
+	MaxTokenLength int
+
+	// OmitCacheHeaders controls whether the LoadAndSave middleware adds the
+	// 'Vary: Cookie' and 'Cache-Control: no-cache="Set-Cookie"' headers to
+	// responses which set the session cookie (or the equivalent headers for
+	// the TokenHeader). These headers prevent shared caches from storing and
+	// replaying a response containing a session token, so you should only omit
+	// them if you are controlling caching yourself, for example at a CDN. The
+	// default value is false.
+	OmitCacheHeaders bool
+
 	// Codec controls the encoder/decoder used to transform session data to a
 	// byte slice for use by the session store. By default session data is
 	// encoded/decoded using encoding/gob.
 	Codec Codec
 
+	// CodecID, if set, causes committed session data to be wrapped in a small
+	// envelope which records this ID, so that services sharing a session store
+	// but using different codecs can tell how the data was encoded. It should
+	// uniquely identify the Codec among the services sharing the store. The
+	// default value of 0 means that no envelope is written.
+	CodecID byte
+
+	// Codecs maps codec IDs to the codecs used to decode session data which
+	// has been wrapped in an envelope by a service with a different Codec.
+	// Session data without an envelope, or with an envelope matching CodecID,
+	// is always decoded using the Codec. Loading session data with an
+	// unrecognized codec ID results in an error. By default Codecs is nil.
+	Codecs map[byte]Codec
+
+	// KeyCodecs allows you to override the encoding of the values for specific
+	// session data keys. This can be useful when a key holds a large value
+	// which can be encoded more efficiently than with the Codec. The values for
+	// these keys are encoded to a byte slice with the given ValueCodec before
+	// the session data is passed to the Codec, and the session data records
+	// which keys were encoded this way. By default KeyCodecs is nil and all
+	// values are encoded using the Codec.
+	KeyCodecs map[string]ValueCodec
+
+	// CookieValueCodec allows you to transform the session token into a
+	// different value for the session cookie, for example so that the cookie
+	// doesn't contain a recognizable session token. The LoadAndSave middleware
+	// encodes the token when setting the cookie and decodes the cookie value
+	// when reading it; a cookie value which can't be decoded is treated as if
+	// there were no session cookie. It has no effect when TokenHeader is set.
+	// PercentCookieValueCodec and Base64CookieValueCodec make tokens from any
+	// TokenGenerator safe to send in a cookie. By default CookieValueCodec is
+	// nil and the token is used as-is.
+	CookieValueCodec CookieValueCodec
+
 	// ErrorFunc allows you to control behavior when an error is encountered by
 	// the LoadAndSave middleware. The default behavior is for a HTTP 500
 	// "Internal Server Error" message to be sent to the client and the error
 	// logged using Go's standard logger. If a custom ErrorFunc is set, then
 	// control will be passed to this instead. A typical use would be to provide
 	// a function which logs the error and returns a customized HTML error page.
+	//
+	// If the error occurs after the session data has been loaded (for example,
+	// when committing the session data to the store fails), the request passed
+	// to ErrorFunc carries the loaded session in its context. This means you
+	// can call methods like GetString(r.Context(), "userID") to find out which
+	// session was affected.
 	ErrorFunc func(http.ResponseWriter, *http.Request, error)
 
+	// AsyncCommit controls whether modified session data is committed to the
+	// store in a background goroutine after the response has been written,
+	// rather than before. The session token is still generated up front and
+	// the session cookie set as normal, so a slow store does not delay the
+	// response. The trade-off is durability: if the commit fails (or the
+	// process exits before it completes) the client will hold a cookie for
+	// session data which was never saved, and a following request may race
+	// ahead of the commit and not see the changes. Errors from the background
+	// commit are passed to AsyncCommitErrorFunc. The background commit uses a
+	// context which holds the values of the request context, but isn't
+	// canceled when the request finishes. AsyncCommit has no effect
+	// when using a StatelessStore, because the session token depends on the
+	// session data. The default value is false.
+	AsyncCommit bool
+
+	// AsyncCommitErrorFunc is called with any error returned by a background
+	// commit when AsyncCommit is enabled. Because the response has already
+	// been sent, it does not receive a http.ResponseWriter. As with ErrorFunc,
+	// the request context carries the session data. By default the
+	// error is logged using Go's standard logger.
+	AsyncCommitErrorFunc func(*http.Request, error)
+
+	// IdentityKey is the session data key which holds the identity of the
+	// authenticated user (for example "userID"). When it is set along with
+	// OnIdentityChange, changes to the value under this key are detected so
+	// that logins, logouts and account switches can be audited.
+	IdentityKey string
+
+	// GenerationFunc, if set, returns the current session generation for the
+	// identity held under IdentityKey, from your source of truth such as the
+	// users table. The generation is recorded in the session data when it is
+	// committed with a new identity (typically at login), and checked each
+	// time the session is loaded; if the user's generation has changed since,
+	// the session data is deleted and a new, empty session is started. This
+	// makes logging a user out of every session, for example after a password
+	// change, a matter of incrementing their generation. It is only used if
+	// IdentityKey is set. Errors are returned from Load and Commit (and so
+	// passed to the ErrorFunc by LoadAndSave). By default it is nil.
+	GenerationFunc func(ctx context.Context, identity interface{}) (int64, error)
+
+	// IndexKey is the session data key whose value (for example "userID")
+	// is used to find a user's sessions with DestroyAllForUser. If the session
+	// store implements IndexedStore, the store keeps an index from the value
+	// to the session tokens holding it, which is updated whenever the session
+	// data is committed, destroyed or given a new token. By default it is not
+	// set.
+	IndexKey string
+
+	// OnIdentityChange is called after the session data has been committed or
+	// destroyed if the value under IdentityKey has changed since the session was
+	// loaded. A nil oldID indicates a login, a nil newID indicates a logout,
+	// and two non-nil values indicate a switch between accounts. It is not
+	// called if IdentityKey is not set.
+	OnIdentityChange func(ctx context.Context, oldID, newID interface{})
+
+	// OnDestroy is called after the session data has been destroyed with
+	// Destroy, with the session token that it had. It isn't called if the
+	// session was never committed. It can be used, for example, to publish a
+	// logout event to other services. By default it is nil.
+	OnDestroy func(ctx context.Context, token string)
+
+	// OnUnencodableValue is called by Put, PutWithTTL and PutAll when the
+	// Codec is GobCodec and a value can't be encoded by gob, usually because
+	// its type hasn't been registered with GobCodec.RegisterType or
+	// gob.Register. Without it the problem only shows up as an error when the
+	// session data is committed. Checking means encoding every value as it is
+	// put, so this is intended for development; it can log the problem, or
+	// panic to catch it in tests. By default it is nil and no check is made.
+	OnUnencodableValue func(ctx context.Context, key string, err error)
+
+	// OnRedundantCommit is called when the session data is committed more than
+	// once in the same request cycle, with the number of commits so far. This
+	// usually means that the LoadAndSave middleware has been applied more than
+	// once, so that each request writes to the session store several times.
+	// It can log the problem, or panic to catch it in tests. Also see
+	// RequestCounts. By default it is nil.
+	OnRedundantCommit func(ctx context.Context, commits int)
+
+	// TombstoneTTL enables soft deletion. When it is greater than zero, the
+	// session data for a token which is destroyed with Destroy, or replaced
+	// with RenewToken, is overwritten in the store with a tombstone which
+	// expires after TombstoneTTL, instead of being deleted immediately. The
+	// tombstoned token can't be used to load a session, but WasRecentlyValid
+	// reports it, which can help when investigating an incident. It has no
+	// effect when using a StatelessStore. The default value is 0, which
+	// deletes the session data immediately.
+	TombstoneTTL time.Duration
+
+	// FinalDestroy controls what happens when the session data is changed after
+	// Destroy has been called in the same request cycle. By default a new
+	// session is created to hold the changes, which is useful for things like
+	// showing a flash message after logout. If FinalDestroy is true the
+	// session stays destroyed for the rest of the request cycle: the changes
+	// are discarded, nothing is written to the store and the session cookie is
+	// expired. The default value is false.
+	FinalDestroy bool
+
+	// TrackActivity controls whether the LoadAndSave middleware records the
+	// number of requests, the path and method of the last request, and the
+	// time it was handled in the session data, for use in things like "last
+	// seen" displays. The recorded activity can be read with the Activity
+	// method. Enabling this means that every request for an existing session
+	// holding data modifies the session data, so it results in a store write.
+	// Anonymous requests and empty sessions are not recorded. The default
+	// value is false.
+	TrackActivity bool
+
+	// PromoteKeys lists the session data keys which are kept by Promote, such
+	// as the contents of a shopping cart added before the user logged in.
+	// Every other key is removed. By default no keys are kept.
+	PromoteKeys []string
+
+	// LockoutThreshold is the number of failed attempts, recorded for the
+	// session with RecordFailure, after which the session is locked out. A
+	// value of 0 means that sessions are never locked out. The default value
+	// is 5.
+	LockoutThreshold int
+
+	// LockoutWindow is how long a session stays locked out once it reaches
+	// LockoutThreshold failed attempts. When it has passed the lockout ends
+	// and the failed attempt counter starts again from zero. The default value
+	// is 15 minutes.
+	LockoutWindow time.Duration
+
+	// StepUpTTL is how long a step-up authentication requirement set with
+	// RequireStepUp lasts before it lapses. The default value of 0 means that
+	// it lasts until it is cleared with CompleteStepUp.
+	StepUpTTL time.Duration
+
+	// MaxKeys sets the maximum number of distinct keys that a session may hold.
+	// Attempting to add a new key beyond this limit will fail with
+	// ErrTooManyKeys; updating the value of an existing key is always allowed.
+	// Reserved keys beginning with "__", such as those used by PutWithTTL and
+	// PublicID, aren't counted. The default value of 0 means that there is no
+	// limit.
+	MaxKeys int
+
+	// BlobThreshold sets the encoded size in bytes above which an individual
+	// session value is offloaded to a separate entry in the session store,
+	// leaving only a reference in the main session data. Offloaded values are
+	// fetched from the store the first time they are read in a request, so
+	// this keeps the main session payload small for requests which don't need
+	// them. Offloading is not used with a StatelessStore. The default value of
+	// 0 means that values are never offloaded.
+	BlobThreshold int
+
+	// SkipFunc allows you to bypass session handling for some requests, such
+	// as those for static assets or health checks. If it returns true, the
+	// LoadAndSave middleware passes the request straight through to the next
+	// handler without loading or committing session data and without reading
+	// or setting the session cookie. Any attempt to use the session in the
+	// handler for a skipped request will panic. By default no requests are
+	// skipped.
+	SkipFunc func(*http.Request) bool
+
+	// PassThroughUnmodified enables a fast path for requests which don't
+	// change the session data. When the handler first writes to the response,
+	// the LoadAndSave middleware checks whether the session data has been
+	// modified; if not, the response is not buffered and writes are passed
+	// straight through to the client. This reduces memory use and allocations
+	// for read-only requests. As with StreamThreshold, any changes made to the
+	// session data after this point will not be saved, so only enable this if
+	// your handlers make all changes to the session before writing the
+	// response. The default value is false.
+	PassThroughUnmodified bool
+
+	// StreamThreshold sets the maximum number of bytes of response body that
+	// the LoadAndSave middleware will buffer. Once a handler has written more
+	// than this, the session is committed, the session cookie is set and the
+	// response is switched to pass-through mode, so memory use stays bounded
+	// for large responses. Handlers can also switch to pass-through mode
+	// immediately by calling Flush. Any changes to the session data after this
+	// point will not be saved. The default value of 0 means that the whole
+	// response body is buffered.
+	StreamThreshold int
+
+	// LockTokens controls whether the LoadAndSave middleware locks the session
+	// token for the duration of each request, so that concurrent requests
+	// with the same session token are handled one at a time. Without it, if
+	// two requests change the session data at the same time, the changes made
+	// by the one which commits first are lost. It only has an effect if the
+	// session store implements LockingStore. Note that requests with the same
+	// session token can't overlap while it's enabled, so long-running requests
+	// will delay others from the same client. The default value is false.
+	LockTokens bool
+
+	// MaxConcurrentStoreOps limits how many operations on the session store,
+	// such as reading, committing or deleting session data, the session
+	// manager runs at once. Further operations wait until one finishes, so a
+	// burst of requests doesn't open more connections to the store than it can
+	// handle. Locks taken for LockTokens aren't counted, because they're held
+	// for the whole request. It must be set before the session manager is
+	// used. The default value of 0 means that there is no limit.
+	MaxConcurrentStoreOps int
+
+	// StoreQueueTimeout is the longest time that an operation waits to start
+	// when MaxConcurrentStoreOps operations are already running. If it
+	// passes, the operation fails with ErrStoreBusy. The default value of 0
+	// means that operations wait indefinitely.
+	StoreQueueTimeout time.Duration
+
+	// EventBufferSize sets the number of events buffered by the channel
+	// returned by Events. It must be set before Events is first called. The
+	// default value of 0 means that 100 events are buffered.
+	EventBufferSize int
+
+	// store holds the session store set by SetStore, if any, wrapped in a
+	// storeValue. It takes precedence over the Store field.
+	store atomic.Value
+
+	// idleTimeout, lifetime and cookie hold the settings from SetIdleTimeout,
+	// SetLifetime and SetCookie, if called. They take precedence over the
+	// corresponding public fields.
+	idleTimeout atomic.Value
+	lifetime    atomic.Value
+	cookie      atomic.Value
+
+	// storeSlots holds a channel which is used as a semaphore, with a value
+	// for each store operation in progress, when MaxConcurrentStoreOps is set.
+	// It is created on first use.
+	storeSlots atomic.Value
+
+	// events holds the channel returned by Events, once it has been called.
+	events atomic.Value
+
+	// defaults holds the default values registered with SetDefault, keyed by
+	// session data key. The map is replaced, never modified, when a default is
+	// added.
+	defaults atomic.Value
+
 	// contextKey is the key used to set and retrieve the session data from a
 	// context.Context. It's automatically generated to ensure uniqueness.
 	contextKey contextKey
@@ -62,9 +534,20 @@ type SessionCookie struct {
 	Name string
 
 	// Domain sets the 'Domain' attribute on the session cookie. By default
-	// it will be set to the domain name that the cookie was issued from.
+	// it will be set to the domain name that the cookie was issued from. It
+	// can be set to a parent domain (for example "example.com") to share the
+	// session cookie between subdomains. To guard against mistakes, the
+	// LoadAndSave middleware checks that the request host is the Domain or a
+	// subdomain of it before setting the cookie, and passes
+	// ErrCookieDomainMismatch to the ErrorFunc if not.
 	Domain string
 
+	// SkipDomainCheck disables the check that the request host is within the
+	// cookie Domain. This is only needed if the host seen by the application
+	// differs from the one used by the client, for example behind a proxy
+	// which rewrites the Host header. The default value is false.
+	SkipDomainCheck bool
+
 	// HTTPOnly sets the 'HTTPOnly' attribute on the session cookie. The
 	// default value is true.
 	HTTPOnly bool
@@ -89,6 +572,14 @@ type SessionCookie struct {
 	// attribute or value in the session cookie then you should set this to 0.
 	SameSite http.SameSite
 
+	// PersistentSameSite, if set, overrides the SameSite attribute for
+	// persistent session cookies (i.e. when Persist is true or the session has
+	// opted in with RememberMe). This allows, for example, remembered sessions
+	// to use 'SameSite=Lax' while transient sessions use the stricter
+	// 'SameSite=Strict'. By default it is not set and the SameSite value is
+	// used for all session cookies.
+	PersistentSameSite http.SameSite
+
 	// Secure sets the 'Secure' attribute on the session cookie. The default
 	// value is false. It's recommended that you set this to true and serve all
 	// requests over HTTPS in production environments.
@@ -100,12 +591,15 @@ type SessionCookie struct {
 // concurrent use.
 func New() *SessionManager {
 	s := &SessionManager{
-		IdleTimeout: 0,
-		Lifetime:    24 * time.Hour,
-		Store:       memstore.New(),
-		Codec:       GobCodec{},
-		ErrorFunc:   defaultErrorFunc,
-		contextKey:  generateContextKey(),
+		IdleTimeout:          0,
+		Lifetime:             24 * time.Hour,
+		Store:                memstore.New(),
+		Codec:                GobCodec{},
+		ErrorFunc:            defaultErrorFunc,
+		AsyncCommitErrorFunc: defaultAsyncCommitErrorFunc,
+		LockoutThreshold:     5,
+		LockoutWindow:        15 * time.Minute,
+		contextKey:           generateContextKey(),
 		Cookie: SessionCookie{
 			Name:     "session",
 			Domain:   "",
@@ -125,72 +619,625 @@ func NewSession() *SessionManager {
 	return New()
 }
 
+type storeValue struct {
+	Store
+}
+
+// SetStore replaces the session store used by the session manager. It is safe
+// to call while requests are being handled: each operation uses either the old
+// or the new store, never a partially-updated value. Once SetStore has been
+// called, the Store field is no longer used.
+func (s *SessionManager) SetStore(store Store) {
+	s.store.Store(storeValue{store})
+}
+
+// getStore returns the session store set by SetStore, or the Store field if
+// SetStore has not been called.
+func (s *SessionManager) getStore() Store {
+	if v, ok := s.store.Load().(storeValue); ok {
+		return v.Store
+	}
+	return s.Store
+}
+
+// SetIdleTimeout changes the IdleTimeout setting. It is safe to call while
+// requests are being handled. Once it has been called, the IdleTimeout field is
+// no longer used.
+func (s *SessionManager) SetIdleTimeout(d time.Duration) {
+	s.idleTimeout.Store(d)
+}
+
+// SetLifetime changes the Lifetime setting. It is safe to call while requests
+// are being handled. Once it has been called, the Lifetime field is no longer
+// used.
+func (s *SessionManager) SetLifetime(d time.Duration) {
+	s.lifetime.Store(d)
+}
+
+// SetCookie changes the session cookie settings. It is safe to call while
+// requests are being handled. Once it has been called, the Cookie field is no
+// longer used.
+func (s *SessionManager) SetCookie(c SessionCookie) {
+	s.cookie.Store(c)
+}
+
+// UseHostPrefix adds the "__Host-" prefix to the session cookie name, and sets
+// the attributes which browsers require for cookies with that prefix: Secure
+// is set to true and Path to "/", and there must be no Domain. This stops the
+// session cookie from being set or overwritten by a subdomain or over an
+// insecure connection. If the Domain, a Path other than "/" or a
+// CookiePathFunc has been set, or the name already has the "__Secure-" prefix,
+// ErrCookiePrefixConflict is returned and the settings are not changed. The new
+// settings are applied with SetCookie, so the Cookie field is no longer used
+// afterwards.
+func (s *SessionManager) UseHostPrefix() error {
+	c := s.getCookie()
+	if c.Domain != "" || (c.Path != "" && c.Path != "/") || s.CookiePathFunc != nil || strings.HasPrefix(c.Name, secureCookiePrefix) {
+		return ErrCookiePrefixConflict
+	}
+
+	if !strings.HasPrefix(c.Name, hostCookiePrefix) {
+		c.Name = hostCookiePrefix + c.Name
+	}
+	c.Secure = true
+	c.Path = "/"
+	s.SetCookie(c)
+	return nil
+}
+
+// UseSecurePrefix adds the "__Secure-" prefix to the session cookie name, and
+// sets Secure to true, as browsers require for cookies with that prefix. If
+// the name already has the "__Host-" prefix, ErrCookiePrefixConflict is
+// returned and the settings are not changed. The new settings are applied
+// with SetCookie, so the Cookie field is no longer used afterwards.
+func (s *SessionManager) UseSecurePrefix() error {
+	c := s.getCookie()
+	if strings.HasPrefix(c.Name, hostCookiePrefix) {
+		return ErrCookiePrefixConflict
+	}
+
+	if !strings.HasPrefix(c.Name, secureCookiePrefix) {
+		c.Name = secureCookiePrefix + c.Name
+	}
+	c.Secure = true
+	s.SetCookie(c)
+	return nil
+}
+
+func (s *SessionManager) getIdleTimeout() time.Duration {
+	if d, ok := s.idleTimeout.Load().(time.Duration); ok {
+		return d
+	}
+	return s.IdleTimeout
+}
+
+func (s *SessionManager) getLifetime() time.Duration {
+	if d, ok := s.lifetime.Load().(time.Duration); ok {
+		return d
+	}
+	return s.Lifetime
+}
+
+func (s *SessionManager) getCookie() SessionCookie {
+	if c, ok := s.cookie.Load().(SessionCookie); ok {
+		return c
+	}
+	return s.Cookie
+}
+
 // LoadAndSave provides middleware which automatically loads and saves session
 // data for the current request, and communicates the session token to and from
 // the client in a cookie.
 func (s *SessionManager) LoadAndSave(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var token string
-		cookie, err := r.Cookie(s.Cookie.Name)
-		if err == nil {
-			token = cookie.Value
+		if s.SkipFunc != nil && s.SkipFunc(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if s.TrustedTokenHeader != "" && !s.TrustTokenHeader {
+			s.ErrorFunc(w, r, ErrUntrustedTokenHeader)
+			return
 		}
 
+		token := s.readSessionToken(r)
+		unlock := func() {}
+		if s.LockTokens {
+			var err error
+			if unlock, err = s.lockToken(token); err != nil {
+				s.ErrorFunc(w, r, err)
+				return
+			}
+		}
+
+		var commitLater bool
+		defer func() {
+			// If the session data is being committed in the background, the
+			// token is unlocked once that has finished.
+			if !commitLater {
+				unlock()
+			}
+		}()
+
 		ctx, err := s.Load(r.Context(), token)
 		if err != nil {
 			s.ErrorFunc(w, r, err)
 			return
 		}
 
+		legacyNames, legacyTokens := s.legacyCookies(r)
+		if ctx, unlock, err = s.loadLegacySession(ctx, r, unlock, legacyTokens); err != nil {
+			s.ErrorFunc(w, r, err)
+			return
+		}
+
 		sr := r.WithContext(ctx)
-		bw := &bufferedResponseWriter{ResponseWriter: w}
-		next.ServeHTTP(bw, sr)
+
+		saveSession := func() bool {
+			// Don't commit the session data or set the session cookie if the
+			// request has been canceled, for example because the client has
+			// disconnected.
+			if r.Context().Err() != nil {
+				return false
+			}
+
+			if s.TrackActivity {
+				s.trackActivity(ctx, r)
+			}
+
+			if s.TokenHeader == "" && s.TrustedTokenHeader == "" && s.Status(ctx) != Unmodified && !s.hostWithinCookieDomain(r.Host) {
+				s.ErrorFunc(w, sr, ErrCookieDomainMismatch)
+				return false
+			}
+
+			var err error
+			commitLater, err = s.writeSessionToken(ctx, w, r)
+			if err != nil {
+				s.ErrorFunc(w, sr, err)
+				return false
+			}
+			s.expireLegacyCookies(ctx, w, r, legacyNames)
+			return true
+		}
+
+		bw := &bufferedResponseWriter{
+			ResponseWriter: w,
+			ctx:            r.Context(),
+			threshold:      s.StreamThreshold,
+			saveSession:    saveSession,
+		}
+		if s.PassThroughUnmodified {
+			bw.passThrough = func() bool {
+				return s.Status(ctx) == Unmodified
+			}
+		}
+		defer bw.release()
+		if s.OnRevoked != nil && s.WasRevoked(ctx) {
+			s.OnRevoked(bw, sr)
+		} else {
+			next.ServeHTTP(bw, sr)
+		}
 
 		if sr.MultipartForm != nil {
 			sr.MultipartForm.RemoveAll()
 		}
 
-		if s.Status(ctx) != Unmodified {
-			responseCookie := &http.Cookie{
-				Name:     s.Cookie.Name,
-				Path:     s.Cookie.Path,
-				Secure:   s.Cookie.Secure,
-				HttpOnly: s.Cookie.HTTPOnly,
-				SameSite: s.Cookie.SameSite,
+		// The connection has been taken over by the handler, so the session
+		// cookie can't be sent. Use SessionForConn and CommitConn to save
+		// changes to the session data made by a hijacked connection.
+		if bw.hijacked {
+			return
+		}
+
+		if !bw.streaming {
+			if !saveSession() {
+				return
 			}
-			if s.Cookie.Domain != "" {
-				responseCookie.Domain = s.Cookie.Domain
+
+			if !bodyAllowedForStatus(bw.code) {
+				w.WriteHeader(bw.code)
+			} else {
+				if r.Method != http.MethodHead && w.Header().Get("Content-Length") != "" {
+					w.Header().Set("Content-Length", strconv.Itoa(len(bw.bytes())))
+				}
+				if bw.code != 0 {
+					w.WriteHeader(bw.code)
+				}
+				w.Write(bw.bytes())
 			}
+		}
 
-			switch s.Status(ctx) {
-			case Modified:
-				token, expiry, err := s.Commit(ctx)
-				if err != nil {
-					s.ErrorFunc(w, r, err)
-					return
+		if commitLater {
+			go func() {
+				defer unlock()
+				if _, _, err := s.Commit(detachedContext{ctx}); err != nil {
+					s.AsyncCommitErrorFunc(sr, err)
 				}
+			}()
+		}
+	})
+}
 
-				responseCookie.Value = token
+// detachedContext carries the values of its parent context, but not its
+// deadline or cancellation, so that the background commit made when
+// AsyncCommit is enabled isn't affected by the request context being canceled
+// once the handler has returned. It doesn't carry a transaction added with
+// WithTx either, because that will have been finished by then.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	if _, ok := key.(txContextKey); ok {
+		return nil
+	}
+	return c.parent.Value(key)
+}
+
+// LoadAndSaveFunc is an adapter for the LoadAndSave middleware with the
+// signature used by negroni and similar middleware stacks. It behaves exactly
+// like LoadAndSave(next).
+func (s *SessionManager) LoadAndSaveFunc(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	s.LoadAndSave(next).ServeHTTP(w, r)
+}
 
-				if s.Cookie.Persist || s.GetBool(ctx, "__rememberMe") {
-					responseCookie.Expires = time.Unix(expiry.Unix()+1, 0)        // Round up to the nearest second.
-					responseCookie.MaxAge = int(time.Until(expiry).Seconds() + 1) // Round up to the nearest second.
+// RequireSession returns middleware which only passes requests on to the next
+// handler if the session holds a non-nil value under identityKey (or under
+// IdentityKey, if identityKey is empty), such as the ID of the logged-in user.
+// Other requests are passed to the UnauthenticatedHandler instead, which by
+// default responds with 401 Unauthorized. It must be used inside the
+// LoadAndSave middleware; requests without session data are also rejected.
+// Defaults registered with SetDefault are ignored, so a default for
+// identityKey doesn't let requests through.
+func (s *SessionManager) RequireSession(identityKey string) func(http.Handler) http.Handler {
+	if identityKey == "" {
+		identityKey = s.IdentityKey
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, loaded := r.Context().Value(s.contextKey).(*sessionData)
+			if !loaded || identityKey == "" || s.storedValue(r.Context(), identityKey) == nil {
+				if s.UnauthenticatedHandler != nil {
+					s.UnauthenticatedHandler.ServeHTTP(w, r)
+				} else {
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				}
-			case Destroyed:
-				responseCookie.Expires = time.Unix(1, 0)
-				responseCookie.MaxAge = -1
+				return
 			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-			w.Header().Add("Set-Cookie", responseCookie.String())
-			addHeaderIfMissing(w, "Cache-Control", `no-cache="Set-Cookie"`)
-			addHeaderIfMissing(w, "Vary", "Cookie")
+// lockToken locks the session token, if the session store implements
+// LockingStore, and returns a function which unlocks it again. Errors from
+// unlocking the token are logged, because the response has already been sent.
+func (s *SessionManager) lockToken(token string) (func(), error) {
+	ls, ok := s.getStore().(LockingStore)
+	if !ok || token == "" || (s.TokenValidator != nil && !s.TokenValidator(token)) {
+		return func() {}, nil
+	}
+
+	key := s.storeKey(token)
+	if err := ls.Lock(key); err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := ls.Unlock(key); err != nil {
+			log.Output(2, err.Error())
 		}
+	}, nil
+}
 
-		if bw.code != 0 {
-			w.WriteHeader(bw.code)
+// readSessionToken returns the session token sent by the client, either in the
+// TrustedTokenHeader or TokenHeader request header, or the session cookie. If
+// there is no session token it returns the empty string.
+func (s *SessionManager) readSessionToken(r *http.Request) string {
+	if s.TrustedTokenHeader != "" {
+		return s.checkTokenValue(r.Header.Get(s.TrustedTokenHeader))
+	}
+	if s.TokenHeader != "" {
+		return s.checkTokenValue(r.Header.Get(s.TokenHeader))
+	}
+
+	return s.cookieToken(r, s.getCookie().Name)
+}
+
+// cookieToken returns the session token sent by the client in the cookie with
+// the given name, or the empty string if there isn't a valid one.
+func (s *SessionManager) cookieToken(r *http.Request, name string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil || s.checkTokenValue(cookie.Value) == "" {
+		return ""
+	}
+	if s.CookieValueCodec != nil {
+		token, err := s.CookieValueCodec.Decode(cookie.Value)
+		if err != nil {
+			return ""
 		}
-		w.Write(bw.buf.Bytes())
-	})
+		return token
+	}
+	return cookie.Value
+}
+
+// legacyCookies returns the names of the LegacyCookieNames cookies sent by the
+// client, and the session tokens that they hold, in order. Nothing is
+// returned if the session token is sent in a header.
+func (s *SessionManager) legacyCookies(r *http.Request) (names, tokens []string) {
+	if s.TrustedTokenHeader != "" || s.TokenHeader != "" {
+		return nil, nil
+	}
+	for _, name := range s.LegacyCookieNames {
+		if _, err := r.Cookie(name); err != nil {
+			continue
+		}
+		names = append(names, name)
+		tokens = append(tokens, s.cookieToken(r, name))
+	}
+	return names, tokens
+}
+
+// loadLegacySession loads the session for the first of the legacy cookie
+// tokens which resolves to a live session, if the session in ctx isn't live,
+// and locks its token if LockTokens is set. The session data is marked as
+// Modified so that the session cookie is sent under the current name. It
+// returns the original ctx and unlock function if no legacy session is found.
+func (s *SessionManager) loadLegacySession(ctx context.Context, r *http.Request, unlock func(), tokens []string) (context.Context, func(), error) {
+	if len(tokens) == 0 || s.getSessionDataFromContext(ctx).token != "" {
+		return ctx, unlock, nil
+	}
+
+	for _, token := range tokens {
+		if token == "" {
+			continue
+		}
+		legacyUnlock := func() {}
+		if s.LockTokens {
+			var err error
+			if legacyUnlock, err = s.lockToken(token); err != nil {
+				return nil, nil, err
+			}
+		}
+		legacyCtx, err := s.Load(r.Context(), token)
+		if err != nil {
+			legacyUnlock()
+			return nil, nil, err
+		}
+		sd := s.getSessionDataFromContext(legacyCtx)
+		sd.mu.Lock()
+		live := sd.token != ""
+		if live {
+			sd.status = Modified
+		}
+		sd.mu.Unlock()
+		if live {
+			unlock()
+			return legacyCtx, legacyUnlock, nil
+		}
+		legacyUnlock()
+	}
+	return ctx, unlock, nil
+}
+
+// expireLegacyCookies adds a Set-Cookie header to the response deleting each
+// of the named legacy cookies.
+func (s *SessionManager) expireLegacyCookies(ctx context.Context, w http.ResponseWriter, r *http.Request, names []string) {
+	for _, name := range names {
+		cookie := s.sessionCookie(ctx, r, Destroyed, "", time.Time{})
+		cookie.Name = name
+		w.Header().Add("Set-Cookie", cookie.String())
+	}
+	if len(names) > 0 && !s.OmitCacheHeaders {
+		addHeaderIfMissing(w, "Cache-Control", `no-cache="Set-Cookie"`)
+		addHeaderIfMissing(w, "Vary", "Cookie")
+	}
+}
+
+// checkTokenValue returns the session token value sent by the client, or the
+// empty string if it is longer than MaxTokenLength or contains characters
+// which aren't allowed in a cookie value.
+func (s *SessionManager) checkTokenValue(v string) string {
+	if s.MaxTokenLength > 0 && len(v) > s.MaxTokenLength {
+		return ""
+	}
+	for i := 0; i < len(v); i++ {
+		// These are the cookie-octet characters from RFC 6265, section 4.1.1.
+		c := v[i]
+		if c < 0x21 || c > 0x7e || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return ""
+		}
+	}
+	return v
+}
+
+// writeSessionToken commits the session data (if it has been modified) and
+// communicates the session token to the client in either the TokenHeader
+// response header or the session cookie. If AsyncCommit is enabled then the
+// commit is not carried out, and the returned commitLater value will be true
+// when the caller needs to do so.
+func (s *SessionManager) writeSessionToken(ctx context.Context, w http.ResponseWriter, r *http.Request) (commitLater bool, err error) {
+	var (
+		token  string
+		expiry time.Time
+	)
+
+	status := s.Status(ctx)
+	if status == Unmodified {
+		if !s.RefreshCookieEachRequest || s.getIdleTimeout() <= 0 {
+			return false, nil
+		}
+		if token, expiry, err = s.touch(ctx); err != nil || token == "" {
+			return false, err
+		}
+		status = Modified
+	} else if status == Modified {
+		if _, stateless := s.getStore().(StatelessStore); s.AsyncCommit && !stateless {
+			token, expiry, err = s.reserveToken(ctx)
+			commitLater = true
+		} else {
+			token, expiry, err = s.Commit(ctx)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// The token is managed by the gateway which sets the TrustedTokenHeader, so
+	// nothing is sent to the client.
+	if s.TrustedTokenHeader != "" {
+		return commitLater, nil
+	}
+
+	if s.TokenHeader != "" {
+		// A destroyed session is signalled by an empty token value.
+		w.Header().Set(s.TokenHeader, token)
+		if !s.OmitCacheHeaders {
+			addHeaderIfMissing(w, "Cache-Control", fmt.Sprintf("no-cache=%q", s.TokenHeader))
+			addHeaderIfMissing(w, "Vary", s.TokenHeader)
+		}
+		return commitLater, nil
+	}
+
+	if s.CookieValueCodec != nil && token != "" {
+		if token, err = s.CookieValueCodec.Encode(token); err != nil {
+			return false, err
+		}
+	}
+	s.writeSessionCookie(ctx, w, r, status, token, expiry)
+	return commitLater, nil
+}
+
+func (s *SessionManager) writeSessionCookie(ctx context.Context, w http.ResponseWriter, r *http.Request, status Status, token string, expiry time.Time) {
+	w.Header().Add("Set-Cookie", s.sessionCookie(ctx, r, status, token, expiry).String())
+	if !s.OmitCacheHeaders {
+		addHeaderIfMissing(w, "Cache-Control", `no-cache="Set-Cookie"`)
+		addHeaderIfMissing(w, "Vary", "Cookie")
+	}
+}
+
+// sessionCookie returns the session cookie to send to the client for the given
+// session status, token and expiry time. If r is not nil, it is passed to the
+// CookiePathFunc.
+func (s *SessionManager) sessionCookie(ctx context.Context, r *http.Request, status Status, token string, expiry time.Time) *http.Cookie {
+	cookie := s.getCookie()
+	responseCookie := &http.Cookie{
+		Name:     cookie.Name,
+		Path:     cookie.Path,
+		Secure:   cookie.Secure,
+		HttpOnly: cookie.HTTPOnly,
+		SameSite: cookie.SameSite,
+	}
+	if cookie.Domain != "" {
+		responseCookie.Domain = cookie.Domain
+	}
+	if s.CookiePathFunc != nil && r != nil {
+		if path := s.CookiePathFunc(r); path != "" {
+			responseCookie.Path = path
+		}
+	}
+
+	switch status {
+	case Modified:
+		responseCookie.Value = token
+
+		if rememberMe, _ := s.storedValue(ctx, "__rememberMe").(bool); cookie.Persist || rememberMe {
+			if cookie.PersistentSameSite != 0 {
+				responseCookie.SameSite = cookie.PersistentSameSite
+			}
+			responseCookie.Expires = time.Unix(expiry.Unix()+1, 0)        // Round up to the nearest second.
+			responseCookie.MaxAge = int(time.Until(expiry).Seconds() + 1) // Round up to the nearest second.
+		}
+	case Destroyed:
+		responseCookie.Expires = time.Unix(1, 0)
+		responseCookie.MaxAge = -1
+	}
+
+	return responseCookie
+}
+
+// CommitAndCookie commits the session data (if it has been modified), and
+// returns the session cookie that the LoadAndSave middleware would send to the
+// client, without writing it to a http.ResponseWriter. It's intended for
+// frameworks which write the response themselves. If the session has been
+// destroyed, the returned cookie deletes the session cookie on the client. If
+// the session data is unmodified there is nothing to send, and a nil cookie is
+// returned. The CookieValueCodec is applied to the session token, but the
+// TokenHeader, AsyncCommit and the cookie Domain check are not used.
+func (s *SessionManager) CommitAndCookie(ctx context.Context) (*http.Cookie, error) {
+	status := s.Status(ctx)
+	if status == Unmodified {
+		return nil, nil
+	}
+
+	var (
+		token  string
+		expiry time.Time
+		err    error
+	)
+	if status == Modified {
+		token, expiry, err = s.Commit(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if s.CookieValueCodec != nil {
+			if token, err = s.CookieValueCodec.Encode(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return s.sessionCookie(ctx, nil, status, token, expiry), nil
+}
+
+// ForwardedPrefixPath returns the path prefix in the X-Forwarded-Prefix request
+// header, which is set by some reverse proxies when they strip a path prefix
+// before forwarding the request, without any trailing slash. It returns the
+// empty string if the header isn't set or doesn't hold an absolute path. It is
+// intended for use as the CookiePathFunc:
+//
+//	sessionManager.CookiePathFunc = scs.ForwardedPrefixPath
+//
+// The header is set by the client unless the proxy replaces it, so only use
+// this behind a proxy which does.
+func ForwardedPrefixPath(r *http.Request) string {
+	prefix := r.Header.Get("X-Forwarded-Prefix")
+	if !strings.HasPrefix(prefix, "/") {
+		return ""
+	}
+	for i := 0; i < len(prefix); i++ {
+		if c := prefix[i]; c < 0x20 || c == 0x7f || c == ';' {
+			return ""
+		}
+	}
+	if prefix = strings.TrimRight(prefix, "/"); prefix == "" {
+		return "/"
+	}
+	return prefix
+}
+
+// hostWithinCookieDomain reports whether the given request host is the cookie
+// Domain or a subdomain of it. It always returns true if no Domain is set or
+// the check is disabled with SkipDomainCheck.
+func (s *SessionManager) hostWithinCookieDomain(host string) bool {
+	cookie := s.getCookie()
+	if cookie.Domain == "" || cookie.SkipDomainCheck || host == "" {
+		return true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domain := strings.ToLower(strings.TrimPrefix(cookie.Domain, "."))
+
+	return host == domain || strings.HasSuffix(host, "."+domain)
 }
 
 func addHeaderIfMissing(w http.ResponseWriter, key, value string) {
@@ -202,32 +1249,163 @@ func addHeaderIfMissing(w http.ResponseWriter, key, value string) {
 	w.Header().Add(key, value)
 }
 
+// bodyAllowedForStatus reports whether a given response status code permits a
+// body. See RFC 7230, section 3.3.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent:
+		return false
+	case status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
 func defaultErrorFunc(w http.ResponseWriter, r *http.Request, err error) {
 	log.Output(2, err.Error())
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
+func defaultAsyncCommitErrorFunc(r *http.Request, err error) {
+	log.Output(2, err.Error())
+}
+
+// maxPooledBufferSize is the maximum capacity of a response buffer which will
+// be returned to bufferPool for reuse.
+const maxPooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
 type bufferedResponseWriter struct {
 	http.ResponseWriter
-	buf         bytes.Buffer
+	buf         *bytes.Buffer
 	code        int
 	wroteHeader bool
+
+	// ctx is the context of the original request. Once it is canceled, writes
+	// to the buffer fail with the context error.
+	ctx context.Context
+
+	// threshold is the buffer size (in bytes) above which the response is
+	// switched to pass-through streaming. Zero means no limit.
+	threshold int
+
+	// saveSession commits the session data and sets the session cookie on the
+	// underlying response. It returns false if an error was encountered and
+	// has already been handled.
+	saveSession func() bool
+	streaming   bool
+	failed      bool
+
+	// hijacked records whether the handler has taken over the connection,
+	// after which nothing more can be written to the response.
+	hijacked bool
+
+	// passThrough, if set, is called when the handler first writes to the
+	// response. If it returns true the response is switched to pass-through
+	// mode straight away.
+	passThrough func() bool
 }
 
 func (bw *bufferedResponseWriter) Write(b []byte) (int, error) {
-	return bw.buf.Write(b)
+	bw.checkPassThrough()
+	if bw.streaming {
+		if bw.failed {
+			return 0, errStreamAborted
+		}
+		return bw.ResponseWriter.Write(b)
+	}
+
+	if err := bw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if bw.buf == nil {
+		bw.buf = bufferPool.Get().(*bytes.Buffer)
+	}
+	n, err := bw.buf.Write(b)
+	if bw.threshold > 0 && bw.buf.Len() > bw.threshold {
+		bw.startStreaming()
+	}
+	return n, err
 }
 
 func (bw *bufferedResponseWriter) WriteHeader(code int) {
+	if bw.streaming {
+		return
+	}
 	if !bw.wroteHeader {
 		bw.code = code
 		bw.wroteHeader = true
 	}
+	bw.checkPassThrough()
+}
+
+// checkPassThrough switches to pass-through mode the first time the handler
+// writes to the response, if the passThrough function reports that it should.
+func (bw *bufferedResponseWriter) checkPassThrough() {
+	if bw.passThrough == nil || bw.streaming {
+		return
+	}
+	pt := bw.passThrough
+	bw.passThrough = nil
+	if pt() {
+		bw.startStreaming()
+	}
+}
+
+// startStreaming saves the session, writes the status code and any buffered
+// data to the underlying response, and switches to pass-through mode so that
+// subsequent writes are not buffered.
+func (bw *bufferedResponseWriter) startStreaming() {
+	bw.streaming = true
+	if !bw.saveSession() {
+		bw.failed = true
+		return
+	}
+	if bw.code != 0 {
+		bw.ResponseWriter.WriteHeader(bw.code)
+	}
+	bw.ResponseWriter.Write(bw.bytes())
+	bw.release()
+}
+
+// bytes returns the buffered response body.
+func (bw *bufferedResponseWriter) bytes() []byte {
+	if bw.buf == nil {
+		return nil
+	}
+	return bw.buf.Bytes()
+}
+
+// release returns the buffer to the pool. It must only be called once the
+// buffered bytes have been written to the underlying response (or are no longer
+// needed). Buffers which have grown larger than maxPooledBufferSize are left for
+// the garbage collector, so that one large response doesn't permanently
+// increase the memory held by the pool.
+func (bw *bufferedResponseWriter) release() {
+	if bw.buf == nil {
+		return
+	}
+	if bw.buf.Cap() <= maxPooledBufferSize {
+		bw.buf.Reset()
+		bufferPool.Put(bw.buf)
+	}
+	bw.buf = nil
 }
 
 func (bw *bufferedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	hj := bw.ResponseWriter.(http.Hijacker)
-	return hj.Hijack()
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		bw.hijacked = true
+	}
+	return conn, rw, err
 }
 
 func (bw *bufferedResponseWriter) Push(target string, opts *http.PushOptions) error {
@@ -237,12 +1415,16 @@ func (bw *bufferedResponseWriter) Push(target string, opts *http.PushOptions) er
 	return http.ErrNotSupported
 }
 
+// Flush saves the session and switches the response to pass-through mode
+// (see SessionManager.StreamThreshold) before flushing the underlying
+// response.
 func (bw *bufferedResponseWriter) Flush() {
-	// Take all from buf and flush
-	bw.ResponseWriter.Write(bw.buf.Bytes())
-	// Clear?? is this work, I need test more
-	bw.buf.Reset()
-	bw.ResponseWriter.(http.Flusher).Flush()
+	if !bw.streaming {
+		bw.startStreaming()
+	}
+	if !bw.failed {
+		bw.ResponseWriter.(http.Flusher).Flush()
+	}
 }
 
 func (bw *bufferedResponseWriter) CloseNotify() <-chan bool {
@@ -1,14 +1,22 @@
 package scs
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/gaconkzk/scs/v2/memstore"
+	"github.com/gaconkzk/scs/v2/mockstore"
 )
 
 type testServer struct {
@@ -163,6 +171,323 @@ func TestIdleTimeout(t *testing.T) {
 	}
 }
 
+func TestIdleTimeoutRefreshesCookie(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.IdleTimeout = 10 * time.Second
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	ts.execute(t, "/put")
+
+	// Wait long enough for the MaxAge of a cookie which hadn't been refreshed
+	// to have dropped by a second.
+	time.Sleep(1100 * time.Millisecond)
+
+	header, _ := ts.execute(t, "/get")
+	cookies := (&http.Response{Header: header}).Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies: expected %d", len(cookies), 1)
+	}
+	if cookies[0].MaxAge < 10 {
+		t.Errorf("got %d: expected at least %d", cookies[0].MaxAge, 10)
+	}
+}
+
+// touchCountingStore only embeds the Store interface, so that FindAndRefresh
+// isn't used when a session is loaded.
+type touchCountingStore struct {
+	Store
+	mu      sync.Mutex
+	touches int
+	commits int
+}
+
+func (s *touchCountingStore) Commit(token string, b []byte, expiry time.Time) error {
+	s.mu.Lock()
+	s.commits++
+	s.mu.Unlock()
+	return s.Store.Commit(token, b, expiry)
+}
+
+func (s *touchCountingStore) Touch(token string, newExpiry time.Time) error {
+	s.mu.Lock()
+	s.touches++
+	s.mu.Unlock()
+	return s.Store.(TouchStore).Touch(token, newExpiry)
+}
+
+func TestRefreshCookieEachRequest(t *testing.T) {
+	t.Parallel()
+
+	mem := memstore.NewWithCleanupInterval(0)
+	touchStore := &touchCountingStore{Store: mem}
+	commitStore := &countingStore{Store: memstore.NewWithCleanupInterval(0)}
+
+	tests := []struct {
+		name     string
+		store    Store
+		counts   func() (touches, commits int)
+		expected [2]int
+	}{
+		{
+			name:  "Touch",
+			store: touchStore,
+			counts: func() (int, int) {
+				touchStore.mu.Lock()
+				defer touchStore.mu.Unlock()
+				return touchStore.touches, touchStore.commits
+			},
+			expected: [2]int{1, 0},
+		},
+		{
+			name:  "Commit",
+			store: commitStore,
+			counts: func() (int, int) {
+				commitStore.mu.Lock()
+				defer commitStore.mu.Unlock()
+				return 0, commitStore.commits
+			},
+			expected: [2]int{0, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			sessionManager := New()
+			sessionManager.Store = tt.store
+			sessionManager.IdleTimeout = 10 * time.Second
+			sessionManager.RefreshCookieEachRequest = true
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sessionManager.Put(r.Context(), "foo", "bar")
+			}))
+			mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(fmt.Sprintf("%s:%d", sessionManager.GetString(r.Context(), "foo"), sessionManager.Status(r.Context()))))
+			}))
+
+			ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+			defer ts.Close()
+
+			header, _ := ts.execute(t, "/put")
+			token := extractTokenFromCookie(header.Get("Set-Cookie"))
+			touches1, commits1 := tt.counts()
+
+			// Wait long enough for the MaxAge of a cookie which hadn't been
+			// refreshed to have dropped by a second.
+			time.Sleep(1100 * time.Millisecond)
+
+			header, body := ts.execute(t, "/get")
+			if expected := fmt.Sprintf("bar:%d", Unmodified); body != expected {
+				t.Errorf("got %q: expected %q", body, expected)
+			}
+			cookies := (&http.Response{Header: header}).Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("got %d cookies: expected %d", len(cookies), 1)
+			}
+			if cookies[0].Value != token {
+				t.Errorf("got %q: expected %q", cookies[0].Value, token)
+			}
+			if cookies[0].MaxAge < 10 {
+				t.Errorf("got %d: expected at least %d", cookies[0].MaxAge, 10)
+			}
+
+			touches2, commits2 := tt.counts()
+			if got := [2]int{touches2 - touches1, commits2 - commits1}; got != tt.expected {
+				t.Errorf("got %v touches and commits: expected %v", got, tt.expected)
+			}
+		})
+	}
+
+	// The store expiry is extended by Touch.
+	sessionManager := New()
+	sessionManager.Store = touchStore
+	sessionManager.IdleTimeout = 10 * time.Second
+	sessionManager.RefreshCookieEachRequest = true
+
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionManager.Put(ctx, "foo", "bar")
+	token, _, err := sessionManager.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry1, _, err := mem.Expiry(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, err = sessionManager.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sessionManager.touch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expiry2, _, err := mem.Expiry(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiry2.After(expiry1) {
+		t.Errorf("got %v: expected expiry after %v", expiry2, expiry1)
+	}
+}
+
+type refreshCountingStore struct {
+	*memstore.MemStore
+	mu        sync.Mutex
+	finds     int
+	refreshes int
+	commits   int
+}
+
+func (s *refreshCountingStore) Find(token string) ([]byte, bool, error) {
+	s.mu.Lock()
+	s.finds++
+	s.mu.Unlock()
+	return s.MemStore.Find(token)
+}
+
+func (s *refreshCountingStore) FindAndRefresh(token string, newExpiry time.Time) ([]byte, bool, error) {
+	s.mu.Lock()
+	s.refreshes++
+	s.mu.Unlock()
+	return s.MemStore.FindAndRefresh(token, newExpiry)
+}
+
+func (s *refreshCountingStore) Commit(token string, b []byte, expiry time.Time) error {
+	s.mu.Lock()
+	s.commits++
+	s.mu.Unlock()
+	return s.MemStore.Commit(token, b, expiry)
+}
+
+func TestIdleTimeoutRefreshingStore(t *testing.T) {
+	t.Parallel()
+
+	store := &refreshCountingStore{MemStore: memstore.NewWithCleanupInterval(0)}
+	sessionManager := New()
+	sessionManager.Store = store
+	sessionManager.IdleTimeout = 10 * time.Second
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, _ := ts.execute(t, "/put")
+	token := extractTokenFromCookie(header.Get("Set-Cookie"))
+
+	expiry1, _, err := store.Expiry(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	store.mu.Lock()
+	store.finds, store.refreshes, store.commits = 0, 0, 0
+	store.mu.Unlock()
+
+	header, body := ts.execute(t, "/get")
+	if body != "bar" {
+		t.Errorf("want %q; got %q", "bar", body)
+	}
+	if header.Get("Set-Cookie") == "" {
+		t.Error("expected session cookie to be refreshed")
+	}
+
+	store.mu.Lock()
+	finds, refreshes, commits := store.finds, store.refreshes, store.commits
+	store.mu.Unlock()
+	if finds != 0 || refreshes != 1 || commits != 0 {
+		t.Errorf("got %d finds, %d refreshes and %d commits: expected 0, 1 and 0", finds, refreshes, commits)
+	}
+
+	expiry2, _, err := store.Expiry(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiry2.After(expiry1) {
+		t.Errorf("got %v: expected expiry after %v", expiry2, expiry1)
+	}
+
+	ts.execute(t, "/put")
+
+	store.mu.Lock()
+	commits = store.commits
+	store.mu.Unlock()
+	if commits != 1 {
+		t.Errorf("got %d commits: expected 1", commits)
+	}
+}
+
+func TestLockTokens(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.LockTokens = true
+
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		sessionManager.Put(r.Context(), "slow", "done")
+	}))
+	mux.HandleFunc("/fast", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "fast", "done")
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s,%s", sessionManager.GetString(r.Context(), "slow"), sessionManager.GetString(r.Context(), "fast"))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	ts.execute(t, "/put")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ts.execute(t, "/slow")
+	}()
+	<-started
+	ts.execute(t, "/fast")
+	wg.Wait()
+
+	_, body := ts.execute(t, "/get")
+	if body != "done,done" {
+		t.Errorf("want %q; got %q", "done,done", body)
+	}
+}
+
 func TestDestroy(t *testing.T) {
 	t.Parallel()
 
@@ -211,6 +536,218 @@ func TestDestroy(t *testing.T) {
 	}
 }
 
+type countingStore struct {
+	Store
+	mu      sync.Mutex
+	commits int
+}
+
+func (s *countingStore) Commit(token string, b []byte, expiry time.Time) error {
+	s.mu.Lock()
+	s.commits++
+	s.mu.Unlock()
+	return s.Store.Commit(token, b, expiry)
+}
+
+func TestDestroyPrecedence(t *testing.T) {
+	t.Parallel()
+
+	for _, finalDestroy := range []bool{false, true} {
+		sessionManager := New()
+		sessionManager.FinalDestroy = finalDestroy
+		store := &countingStore{Store: sessionManager.Store}
+		sessionManager.Store = store
+
+		put := func(r *http.Request) {
+			sessionManager.Put(r.Context(), "foo", "bar")
+		}
+		destroy := func(r *http.Request) {
+			if err := sessionManager.Destroy(r.Context()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for name, steps := range map[string][]func(*http.Request){
+			"put-then-destroy": {put, destroy},
+			"destroy-then-put": {destroy, put},
+		} {
+			ctx, err := sessionManager.Load(context.Background(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessionManager.Put(ctx, "foo", "bar")
+			token, _, err := sessionManager.Commit(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			commits := store.commits
+
+			h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for _, step := range steps {
+					step(r)
+				}
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(&http.Cookie{Name: sessionManager.Cookie.Name, Value: token})
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if _, found, _ := store.Find(token); found {
+				t.Errorf("%s (FinalDestroy=%v): got %v: expected store entry to be deleted", name, finalDestroy, found)
+			}
+
+			cookie := rr.Header().Get("Set-Cookie")
+			destroyed := strings.HasPrefix(cookie, fmt.Sprintf("%s=;", sessionManager.Cookie.Name))
+			wantDestroyed := finalDestroy || name == "put-then-destroy"
+			if destroyed != wantDestroyed {
+				t.Errorf("%s (FinalDestroy=%v): got cookie %q: expected destroyed %v", name, finalDestroy, cookie, wantDestroyed)
+			}
+			if wantDestroyed && store.commits != commits {
+				t.Errorf("%s (FinalDestroy=%v): got %d commits: expected %d", name, finalDestroy, store.commits, commits)
+			}
+		}
+	}
+}
+
+func TestSessionForConn(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/conn", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connCtx := sessionManager.SessionForConn(r.Context())
+		sessionManager.Put(r.Context(), "baz", "request")
+
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		foo := sessionManager.GetString(connCtx, "foo")
+		fmt.Fprintf(bufrw, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(foo), foo)
+		bufrw.Flush()
+
+		sessionManager.Put(connCtx, "baz", "conn")
+		if _, _, err := sessionManager.CommitConn(connCtx); err != nil {
+			t.Error(err)
+		}
+		if token, _, err := sessionManager.CommitConn(connCtx); err != nil || token != "" {
+			t.Errorf("got %q, %v: expected no commit", token, err)
+		}
+	}))
+	mux.HandleFunc("/conn-early", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Changes made before the upgrade are committed by CommitConn.
+		sessionManager.Put(r.Context(), "baz", "early")
+		connCtx := sessionManager.SessionForConn(r.Context())
+
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(bufrw, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		bufrw.Flush()
+
+		if token, _, err := sessionManager.CommitConn(connCtx); err != nil || token == "" {
+			t.Errorf("got %q, %v: expected a commit", token, err)
+		}
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "baz")))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	ts.execute(t, "/put")
+
+	ts.execute(t, "/conn-early")
+	if _, body := ts.execute(t, "/get"); body != "early" {
+		t.Errorf("want %q; got %q", "early", body)
+	}
+
+	header, body := ts.execute(t, "/conn")
+	if body != "bar" {
+		t.Errorf("want %q; got %q", "bar", body)
+	}
+	if header.Get("Set-Cookie") != "" {
+		t.Errorf("got %q: expected no cookie", header.Get("Set-Cookie"))
+	}
+
+	_, body = ts.execute(t, "/get")
+	if body != "conn" {
+		t.Errorf("want %q; got %q", "conn", body)
+	}
+
+	// A pending error is returned by CommitConn, as it would be by Commit.
+	sessionManager = New()
+	sessionManager.MaxKeys = 1
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionManager.Put(ctx, "foo", "bar")
+	sessionManager.Put(ctx, "baz", "qux")
+	connCtx := sessionManager.SessionForConn(ctx)
+	if _, _, err := sessionManager.CommitConn(connCtx); err != ErrTooManyKeys {
+		t.Errorf("got %v: expected %v", err, ErrTooManyKeys)
+	}
+}
+
+func TestFlashRedirect(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "flash", "Welcome back")
+		http.Redirect(w, r, "/dashboard", http.StatusFound)
+	}))
+	mux.HandleFunc("/logout", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "flash", "Goodbye")
+		w.Header().Set("Location", "/dashboard")
+		w.WriteHeader(http.StatusSeeOther)
+	}))
+	mux.HandleFunc("/dashboard", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.PopString(r.Context(), "flash")))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	// The session cookie must be set on the redirect response itself.
+	header, _ := ts.execute(t, "/login")
+	if header.Get("Location") != "/dashboard" {
+		t.Errorf("got %q: expected %q", header.Get("Location"), "/dashboard")
+	}
+	if header.Get("Set-Cookie") == "" {
+		t.Fatal("expected session cookie on redirect response")
+	}
+
+	// Follow redirects from now on.
+	ts.Client().CheckRedirect = nil
+
+	for path, flash := range map[string]string{"/login": "Welcome back", "/logout": "Goodbye"} {
+		_, body := ts.execute(t, path)
+		if body != flash {
+			t.Errorf("%s: want %q; got %q", path, flash, body)
+		}
+
+		_, body = ts.execute(t, "/dashboard")
+		if body != "" {
+			t.Errorf("%s: want %q; got %q", path, "", body)
+		}
+	}
+}
+
 func TestRenewToken(t *testing.T) {
 	t.Parallel()
 
@@ -300,3 +837,2056 @@ func TestRememberMe(t *testing.T) {
 		t.Errorf("want no Max-Age or Expires attributes; got %q", header.Get("Set-Cookie"))
 	}
 }
+
+func TestMaxLifetime(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.Cookie.Persist = false
+	sessionManager.MaxLifetime = time.Hour
+
+	h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/renew" {
+			if err := sessionManager.RenewToken(r.Context()); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+		sessionManager.RememberMe(r.Context(), true)
+	}))
+
+	deadlines := make([]time.Time, 0, 2)
+	var cookie *http.Cookie
+	for _, path := range []string{"/", "/renew"} {
+		req := httptest.NewRequest("GET", path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		cookies := (&http.Response{Header: rr.Header()}).Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("%s: got %d cookies: expected %d", path, len(cookies), 1)
+		}
+		cookie = cookies[0]
+		if cookie.MaxAge < 3590 || cookie.MaxAge > 3601 {
+			t.Errorf("%s: got Max-Age %d: expected about %d", path, cookie.MaxAge, 3600)
+		}
+
+		ctx, err := sessionManager.Load(context.Background(), cookie.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadlines = append(deadlines, sessionManager.Deadline(ctx))
+	}
+
+	// Renewing the token resets the deadline to the Lifetime, but it's still
+	// capped at the maximum lifetime from when the session was created.
+	if !deadlines[1].Equal(deadlines[0]) {
+		t.Errorf("got %v: expected %v", deadlines[1], deadlines[0])
+	}
+	if d := time.Until(deadlines[0]); d > time.Hour {
+		t.Errorf("got deadline in %v: expected no more than %v", d, time.Hour)
+	}
+
+	// The cap is reported before the session data is committed, both for a
+	// new session and after RenewToken.
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionManager.Put(ctx, "foo", "bar")
+	for _, renew := range []bool{false, true} {
+		if renew {
+			if err := sessionManager.RenewToken(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		deadline, expiry := sessionManager.Deadline(ctx), sessionManager.Expiry(ctx)
+		if d := sessionManager.AbsoluteRemaining(ctx); d > time.Hour {
+			t.Errorf("got %v remaining: expected no more than %v", d, time.Hour)
+		}
+		_, committed, err := sessionManager.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !deadline.Equal(committed) || !expiry.Equal(committed) {
+			t.Errorf("got deadline %v and expiry %v: expected %v", deadline, expiry, committed)
+		}
+	}
+}
+
+func TestCookiePersistence(t *testing.T) {
+	t.Parallel()
+
+	for _, persist := range []bool{false, true} {
+		for _, rememberMe := range []bool{false, true} {
+			sessionManager := New()
+			sessionManager.Cookie.Persist = persist
+
+			h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sessionManager.RememberMe(r.Context(), rememberMe)
+			}))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+			cookie := rr.Header().Get("Set-Cookie")
+			hasMaxAge := strings.Contains(cookie, "Max-Age=")
+			hasExpires := strings.Contains(cookie, "Expires=")
+			want := persist || rememberMe
+			if hasMaxAge != want || hasExpires != want {
+				t.Errorf("Persist=%v, rememberMe=%v: got %q: expected Max-Age and Expires present %v", persist, rememberMe, cookie, want)
+			}
+		}
+	}
+}
+
+func TestCookieDomain(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		host            string
+		skipDomainCheck bool
+		wantErr         error
+	}{
+		{"example.com", false, nil},
+		{"app.example.com", false, nil},
+		{"API.Example.com:8443", false, nil},
+		{"notexample.com", false, ErrCookieDomainMismatch},
+		{"example.org", false, ErrCookieDomainMismatch},
+		{"example.org", true, nil},
+	}
+
+	for _, tt := range tests {
+		sessionManager := New()
+		sessionManager.Cookie.Domain = ".example.com"
+		sessionManager.Cookie.SkipDomainCheck = tt.skipDomainCheck
+
+		var gotErr error
+		sessionManager.ErrorFunc = func(w http.ResponseWriter, r *http.Request, err error) {
+			gotErr = err
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sessionManager.Put(r.Context(), "foo", "bar")
+		}))
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = tt.host
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if gotErr != tt.wantErr {
+			t.Errorf("%s: got %v: expected %v", tt.host, gotErr, tt.wantErr)
+		}
+		cookie := rr.Header().Get("Set-Cookie")
+		if tt.wantErr == nil && !strings.Contains(cookie, "Domain=example.com") {
+			t.Errorf("%s: got %q: expected to contain %q", tt.host, cookie, "Domain=example.com")
+		}
+		if tt.wantErr != nil && cookie != "" {
+			t.Errorf("%s: got %q: expected no session cookie", tt.host, cookie)
+		}
+	}
+}
+
+func TestOnce(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	var calls int
+	var mu sync.Mutex
+	initSecret := func() interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return fmt.Sprintf("secret-%d", calls)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.Once(r.Context(), "csrf", initSecret).(string)))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	for i := 0; i < 3; i++ {
+		_, body := ts.execute(t, "/")
+		if body != "secret-1" {
+			t.Errorf("want %q; got %q", "secret-1", body)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls: expected %d", calls, 1)
+	}
+
+	// A request with an existing value doesn't modify the session.
+	header, _ := ts.execute(t, "/")
+	if header.Get("Set-Cookie") != "" {
+		t.Errorf("got %q: expected no session cookie", header.Get("Set-Cookie"))
+	}
+}
+
+func TestTrackActivity(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.TrackActivity = true
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "userID", 1)
+	}))
+	mux.HandleFunc("/activity", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := sessionManager.Activity(r.Context())
+		fmt.Fprintf(w, "%d %s %s", a.Count, a.LastMethod, a.LastPath)
+	}))
+	mux.HandleFunc("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	// Activity isn't recorded until there is a session.
+	header, _ := ts.execute(t, "/anonymous")
+	if header.Get("Set-Cookie") != "" {
+		t.Errorf("got %q: expected no session cookie", header.Get("Set-Cookie"))
+	}
+
+	ts.execute(t, "/login")
+	ts.execute(t, "/dashboard")
+
+	// The activity is recorded after the handler has run, so this shows the
+	// previous request.
+	_, body := ts.execute(t, "/activity")
+	if body != "2 GET /dashboard" {
+		t.Errorf("want %q; got %q", "2 GET /dashboard", body)
+	}
+	_, body = ts.execute(t, "/activity")
+	if body != "3 GET /activity" {
+		t.Errorf("want %q; got %q", "3 GET /activity", body)
+	}
+}
+
+type fixedExpiryStrategy struct {
+	ttl     time.Duration
+	created time.Time
+}
+
+func (s *fixedExpiryStrategy) Expiry(now, created, lastActive, deadline time.Time) time.Time {
+	s.created = created
+	return lastActive.Add(s.ttl)
+}
+
+func TestExpiryStrategy(t *testing.T) {
+	t.Parallel()
+
+	strategy := &fixedExpiryStrategy{ttl: 90 * time.Second}
+	sessionManager := New()
+	sessionManager.ExpiryStrategy = strategy
+
+	h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	cookies := (&http.Response{Header: rr.Header()}).Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies: expected %d", len(cookies), 1)
+	}
+	if cookies[0].MaxAge != 90 && cookies[0].MaxAge != 91 {
+		t.Errorf("got %d: expected %d", cookies[0].MaxAge, 90)
+	}
+
+	expiry, found, err := sessionManager.StoreExpiry(cookies[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if d := time.Until(expiry); d < 89*time.Second || d > 90*time.Second {
+		t.Errorf("got %v: expected store expiry in %v", d, 90*time.Second)
+	}
+
+	if d := strategy.created.Sub(start); d < -time.Second || d > time.Second {
+		t.Errorf("got %v: expected created time close to %v", strategy.created, start)
+	}
+}
+
+func TestRequestCounts(t *testing.T) {
+	t.Parallel()
+
+	var redundant []int
+	sessionManager := New()
+	sessionManager.OnRedundantCommit = func(ctx context.Context, commits int) {
+		redundant = append(redundant, commits)
+	}
+
+	var ctx context.Context
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+		sessionManager.Put(r.Context(), "foo", "bar")
+	})
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(h))
+	defer ts.Close()
+	ts.execute(t, "/")
+
+	got := sessionManager.RequestCounts(ctx)
+	if want := (RequestCounts{Loads: 1, Commits: 1}); got != want {
+		t.Errorf("got %+v: expected %+v", got, want)
+	}
+	if len(redundant) != 0 {
+		t.Errorf("got %v: expected no redundant commits", redundant)
+	}
+
+	nested := newTestServer(t, sessionManager.LoadAndSave(sessionManager.LoadAndSave(h)))
+	defer nested.Close()
+	nested.execute(t, "/")
+
+	got = sessionManager.RequestCounts(ctx)
+	if want := (RequestCounts{Loads: 2, Commits: 2}); got != want {
+		t.Errorf("got %+v: expected %+v", got, want)
+	}
+	if len(redundant) != 1 || redundant[0] != 2 {
+		t.Errorf("got %v: expected %v", redundant, []int{2})
+	}
+}
+
+func TestLoadAndSaveFunc(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	}))
+
+	handlers := map[string]http.Handler{
+		"LoadAndSave": sessionManager.LoadAndSave(mux),
+		"LoadAndSaveFunc": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sessionManager.LoadAndSaveFunc(w, r, mux.ServeHTTP)
+		}),
+	}
+
+	cookies := make(map[string]string)
+	for name, h := range handlers {
+		ts := newTestServer(t, h)
+		defer ts.Close()
+
+		header, _ := ts.execute(t, "/put")
+		cookie := header.Get("Set-Cookie")
+		token := extractTokenFromCookie(cookie)
+		cookies[name] = strings.Replace(cookie, token, "TOKEN", 1)
+
+		_, body := ts.execute(t, "/get")
+		if body != "bar" {
+			t.Errorf("%s: want %q; got %q", name, "bar", body)
+		}
+	}
+
+	if cookies["LoadAndSave"] != cookies["LoadAndSaveFunc"] {
+		t.Errorf("got %q: expected %q", cookies["LoadAndSaveFunc"], cookies["LoadAndSave"])
+	}
+}
+
+type slowStore struct {
+	Store
+	delay time.Duration
+}
+
+func (s *slowStore) Commit(token string, b []byte, expiry time.Time) error {
+	time.Sleep(s.delay)
+	return s.Store.Commit(token, b, expiry)
+}
+
+func TestAsyncCommit(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.Store = &slowStore{Store: sessionManager.Store, delay: 500 * time.Millisecond}
+	sessionManager.AsyncCommit = true
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+		w.Write([]byte("OK"))
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := sessionManager.Get(r.Context(), "foo")
+		if v == nil {
+			http.Error(w, "foo does not exist in session", 500)
+			return
+		}
+		w.Write([]byte(v.(string)))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	start := time.Now()
+	header, body := ts.execute(t, "/put")
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("response blocked by store commit: took %v", elapsed)
+	}
+	if body != "OK" {
+		t.Errorf("want %q; got %q", "OK", body)
+	}
+	if header.Get("Set-Cookie") == "" {
+		t.Fatal("want Set-Cookie header; got none")
+	}
+
+	time.Sleep(time.Second)
+
+	_, body = ts.execute(t, "/get")
+	if body != "bar" {
+		t.Errorf("want %q; got %q", "bar", body)
+	}
+}
+
+func TestAsyncCommitContext(t *testing.T) {
+	t.Parallel()
+
+	errs := make(chan error, 1)
+	sessionManager := New()
+	sessionManager.AsyncCommit = true
+	sessionManager.IdentityKey = "userID"
+	sessionManager.GenerationFunc = func(ctx context.Context, identity interface{}) (int64, error) {
+		// Give the request context time to be canceled.
+		time.Sleep(50 * time.Millisecond)
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	sessionManager.AsyncCommitErrorFunc = func(r *http.Request, err error) {
+		errs <- err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "userID", 1)
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sessionManager.GetInt(r.Context(), "userID"))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	ts.execute(t, "/login")
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected background commit error: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, body := ts.execute(t, "/get"); body != "1" {
+		t.Errorf("got %q: expected %q", body, "1")
+	}
+}
+
+func TestSkipFunc(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.Store = &mockstore.MockStore{}
+	sessionManager.SkipFunc = func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, "/static/")
+	}
+
+	h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+
+	r := httptest.NewRequest("GET", "/static/app.css", nil)
+	r.AddCookie(&http.Cookie{Name: sessionManager.Cookie.Name, Value: "token"})
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	if rr.Body.String() != "OK" {
+		t.Errorf("want %q; got %q", "OK", rr.Body.String())
+	}
+	if rr.Header().Get("Set-Cookie") != "" {
+		t.Errorf("want %q; got %q", "", rr.Header().Get("Set-Cookie"))
+	}
+	if rr.Header().Get("Vary") != "" {
+		t.Errorf("want %q; got %q", "", rr.Header().Get("Vary"))
+	}
+}
+
+func TestNotModifiedResponse(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+		w.Header().Set("ETag", `"abc"`)
+		w.WriteHeader(http.StatusNotModified)
+		w.Write([]byte("should not be sent"))
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", `"abc"`)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("want %d; got %d", http.StatusNotModified, rr.Code)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("want empty body; got %q", rr.Body.String())
+	}
+	if rr.Header().Get("ETag") != `"abc"` {
+		t.Errorf("want %q; got %q", `"abc"`, rr.Header().Get("ETag"))
+	}
+	if rr.Header().Get("Set-Cookie") == "" {
+		t.Error("want Set-Cookie header; got none")
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/exact", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	}))
+	mux.HandleFunc("/wrong", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("hello"))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	for _, path := range []string{"/exact", "/wrong"} {
+		rs, err := ts.Client().Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if string(body) != "hello" {
+			t.Errorf("%s: want %q; got %q", path, "hello", body)
+		}
+		if rs.ContentLength != 5 {
+			t.Errorf("%s: want %d; got %d", path, 5, rs.ContentLength)
+		}
+	}
+}
+
+func TestStreamThreshold(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.StreamThreshold = 64 * 1024
+
+	chunk := bytes.Repeat([]byte("a"), 32*1024)
+	var maxBuffered int
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+		bw := w.(*bufferedResponseWriter)
+		for i := 0; i < 320; i++ {
+			w.Write(chunk)
+			if bw.buf != nil && bw.buf.Cap() > maxBuffered {
+				maxBuffered = bw.buf.Cap()
+			}
+		}
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, body := ts.execute(t, "/download")
+	if len(body) != 320*len(chunk) {
+		t.Errorf("want body length %d; got %d", 320*len(chunk), len(body))
+	}
+	if maxBuffered > 4*sessionManager.StreamThreshold {
+		t.Errorf("want buffer to stay bounded; grew to %d bytes", maxBuffered)
+	}
+	if header.Get("Set-Cookie") == "" {
+		t.Error("want Set-Cookie header; got none")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flush", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+		w.Write([]byte("foo"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("bar"))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, body := ts.execute(t, "/flush")
+	if body != "foobar" {
+		t.Errorf("want %q; got %q", "foobar", body)
+	}
+	if header.Get("Set-Cookie") == "" {
+		t.Error("want Set-Cookie header; got none")
+	}
+}
+
+type failingStore struct {
+	Store
+	err error
+}
+
+func (s *failingStore) Commit(token string, b []byte, expiry time.Time) error {
+	return s.err
+}
+
+func TestCanceledRequest(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.Store = &failingStore{Store: sessionManager.Store, err: errors.New("commit called")}
+	sessionManager.ErrorFunc = func(w http.ResponseWriter, r *http.Request, err error) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var writeErr error
+	h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+		cancel()
+		_, writeErr = w.Write([]byte("OK"))
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	if writeErr != context.Canceled {
+		t.Errorf("got %v: expected %v", writeErr, context.Canceled)
+	}
+	if cookie := rr.Header().Get("Set-Cookie"); cookie != "" {
+		t.Errorf("got %q: expected no session cookie", cookie)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("got %q: expected empty body", rr.Body.String())
+	}
+}
+
+func TestErrorFuncSessionContext(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionManager.Put(ctx, "userID", "alice")
+	token, _, err := sessionManager.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commitErr := errors.New("commit failed")
+	sessionManager.Store = &failingStore{Store: sessionManager.Store, err: commitErr}
+
+	var gotErr error
+	var gotUserID string
+	sessionManager.ErrorFunc = func(w http.ResponseWriter, r *http.Request, err error) {
+		gotErr = err
+		gotUserID = sessionManager.GetString(r.Context(), "userID")
+		http.Error(w, "error", http.StatusInternalServerError)
+	}
+
+	h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionManager.Cookie.Name, Value: token})
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	if gotErr != commitErr {
+		t.Errorf("want %v; got %v", commitErr, gotErr)
+	}
+	if gotUserID != "alice" {
+		t.Errorf("want %q; got %q", "alice", gotUserID)
+	}
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("want %d; got %d", http.StatusInternalServerError, rr.Code)
+	}
+}
+
+func TestReauthenticateCookie(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sensitive", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Reauthenticate(r.Context(), 10*time.Minute)
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, _ := ts.execute(t, "/sensitive")
+	cookie := header.Get("Set-Cookie")
+	if !strings.Contains(cookie, "Max-Age=600") && !strings.Contains(cookie, "Max-Age=601") {
+		t.Errorf("got %q: expected to contain %q", cookie, "Max-Age=600")
+	}
+
+	token := extractTokenFromCookie(cookie)
+	_, found, _ := sessionManager.Store.Find(token)
+	if !found {
+		t.Error("want session to be committed to store")
+	}
+}
+
+type reversingCookieCodec struct{}
+
+func (reversingCookieCodec) Encode(token string) (string, error) {
+	return "v1." + reverse(token), nil
+}
+
+func (reversingCookieCodec) Decode(value string) (string, error) {
+	if !strings.HasPrefix(value, "v1.") {
+		return "", errors.New("unknown cookie value version")
+	}
+	return reverse(strings.TrimPrefix(value, "v1.")), nil
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func TestUseHostPrefix(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.Cookie.Path = ""
+	if err := sessionManager.UseHostPrefix(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := sessionManager.getCookie()
+	if c.Name != "__Host-session" || !c.Secure || c.Path != "/" || c.Domain != "" {
+		t.Errorf("got %+v: expected name %q, Secure, path %q and no domain", c, "__Host-session", "/")
+	}
+
+	// Calling it again doesn't add the prefix twice.
+	if err := sessionManager.UseHostPrefix(); err != nil {
+		t.Fatal(err)
+	}
+	if name := sessionManager.getCookie().Name; name != "__Host-session" {
+		t.Errorf("got %q: expected %q", name, "__Host-session")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	})
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, _ := ts.execute(t, "/put")
+	cookie := header.Get("Set-Cookie")
+	for _, want := range []string{"__Host-session=", "; Path=/;", "; Secure"} {
+		if !strings.Contains(cookie, want) {
+			t.Errorf("got %q: expected it to contain %q", cookie, want)
+		}
+	}
+	if strings.Contains(cookie, "Domain=") {
+		t.Errorf("got %q: expected no domain", cookie)
+	}
+
+	for _, cookie := range []SessionCookie{
+		{Name: "session", Domain: "example.com", Path: "/"},
+		{Name: "session", Path: "/admin"},
+		{Name: "__Secure-session", Path: "/"},
+	} {
+		sessionManager := New()
+		sessionManager.Cookie = cookie
+		if err := sessionManager.UseHostPrefix(); err != ErrCookiePrefixConflict {
+			t.Errorf("%+v: got %v: expected %v", cookie, err, ErrCookiePrefixConflict)
+		}
+		if got := sessionManager.getCookie(); got != cookie {
+			t.Errorf("got %+v: expected settings to be unchanged", got)
+		}
+	}
+}
+
+func TestUseSecurePrefix(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.Cookie.Domain = "example.com"
+	if err := sessionManager.UseSecurePrefix(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := sessionManager.getCookie()
+	if c.Name != "__Secure-session" || !c.Secure || c.Domain != "example.com" {
+		t.Errorf("got %+v: expected name %q, Secure and domain %q", c, "__Secure-session", "example.com")
+	}
+
+	sessionManager = New()
+	sessionManager.Cookie.Name = "__Host-session"
+	if err := sessionManager.UseSecurePrefix(); err != ErrCookiePrefixConflict {
+		t.Errorf("got %v: expected %v", err, ErrCookiePrefixConflict)
+	}
+}
+
+func TestCookiePathFunc(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.CookiePathFunc = ForwardedPrefixPath
+
+	handler := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", "Path=/"},
+		{"/app", "Path=/app"},
+		{"/app/", "Path=/app"},
+		{"/", "Path=/"},
+		{"app", "Path=/"},
+		{"/app;Domain=example.org", "Path=/"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.prefix != "" {
+			r.Header.Set("X-Forwarded-Prefix", tt.prefix)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+
+		cookie := rr.Header().Get("Set-Cookie")
+		if !strings.Contains(cookie, "; "+tt.want+";") {
+			t.Errorf("prefix %q: got %q: expected it to contain %q", tt.prefix, cookie, tt.want)
+		}
+	}
+
+	if err := sessionManager.UseHostPrefix(); err != ErrCookiePrefixConflict {
+		t.Errorf("got %v: expected %v", err, ErrCookiePrefixConflict)
+	}
+}
+
+func TestCommitAndCookie(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.Cookie.Domain = "example.com"
+	sessionManager.Cookie.SkipDomainCheck = true
+	sessionManager.Cookie.Secure = true
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	})
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, _ := ts.execute(t, "/put")
+	want := header.Get("Set-Cookie")
+	want = strings.Replace(want, extractTokenFromCookie(want), "TOKEN", 1)
+
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := sessionManager.CommitAndCookie(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie != nil {
+		t.Errorf("got %v: expected no cookie for an unmodified session", cookie)
+	}
+
+	sessionManager.Put(ctx, "foo", "bar")
+	cookie, err = sessionManager.CommitAndCookie(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Replace(cookie.String(), cookie.Value, "TOKEN", 1)
+	if got != want {
+		t.Errorf("got %q: expected %q", got, want)
+	}
+
+	ctx, err = sessionManager.Load(context.Background(), cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sessionManager.GetString(ctx, "foo"); got != "bar" {
+		t.Errorf("got %q: expected %q", got, "bar")
+	}
+
+	if err := sessionManager.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err = sessionManager.CommitAndCookie(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie.Value != "" || cookie.MaxAge != -1 {
+		t.Errorf("got %q: expected a cookie which deletes the session cookie", cookie.String())
+	}
+}
+
+func TestCookieValueCodec(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.CookieValueCodec = reversingCookieCodec{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, _ := ts.execute(t, "/put")
+	value := extractTokenFromCookie(header.Get("Set-Cookie"))
+	if !strings.HasPrefix(value, "v1.") {
+		t.Fatalf("got %q: expected cookie value to be encoded", value)
+	}
+
+	token := reverse(strings.TrimPrefix(value, "v1."))
+	if _, found, _ := sessionManager.Store.Find(token); !found {
+		t.Errorf("got %v: expected cookie value to resolve to a stored token", found)
+	}
+	if _, found, _ := sessionManager.Store.Find(value); found {
+		t.Errorf("got %v: expected cookie value not to be a stored token", found)
+	}
+
+	_, body := ts.execute(t, "/get")
+	if body != "bar" {
+		t.Errorf("want %q; got %q", "bar", body)
+	}
+
+	// A cookie value which can't be decoded is treated as no session.
+	req := httptest.NewRequest("GET", "/get", nil)
+	req.AddCookie(&http.Cookie{Name: sessionManager.Cookie.Name, Value: token})
+	rr := httptest.NewRecorder()
+	sessionManager.LoadAndSave(mux).ServeHTTP(rr, req)
+	if rr.Body.String() != "" {
+		t.Errorf("want %q; got %q", "", rr.Body.String())
+	}
+}
+
+func TestCookieValueEncoding(t *testing.T) {
+	t.Parallel()
+
+	codecs := map[string]CookieValueCodec{
+		"Percent": PercentCookieValueCodec{},
+		"Base64":  Base64CookieValueCodec{},
+	}
+	for name, codec := range codecs {
+		codec := codec
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			// The token contains characters which aren't allowed in a cookie
+			// value.
+			token := `a b;c,"d"\e=f/é`
+			sessionManager := New()
+			sessionManager.TokenGenerator = func() (string, error) { return token, nil }
+			sessionManager.CookieValueCodec = codec
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sessionManager.Put(r.Context(), "foo", "bar")
+			}))
+			mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+			}))
+
+			ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+			defer ts.Close()
+
+			header, _ := ts.execute(t, "/put")
+			value := extractTokenFromCookie(header.Get("Set-Cookie"))
+			if value == "" || sessionManager.checkTokenValue(value) != value {
+				t.Fatalf("got %q: expected a valid cookie value", value)
+			}
+			if decoded, err := codec.Decode(value); err != nil || decoded != token {
+				t.Errorf("got %q, %v: expected %q", decoded, err, token)
+			}
+			if _, found, _ := sessionManager.Store.Find(token); !found {
+				t.Errorf("got %v: expected the token to be the store key", found)
+			}
+
+			if _, body := ts.execute(t, "/get"); body != "bar" {
+				t.Errorf("got %q: expected %q", body, "bar")
+			}
+		})
+	}
+
+	// URL-safe tokens are unchanged by percent-encoding.
+	token := "AbC-123_xyz"
+	if value, _ := (PercentCookieValueCodec{}).Encode(token); value != token {
+		t.Errorf("got %q: expected %q", value, token)
+	}
+}
+
+func TestOnRevoked(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.TombstoneTTL = time.Minute
+	sessionManager.OnRevoked = func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "flash", "logged out")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+
+	newSession := func() string {
+		ctx, err := sessionManager.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionManager.Put(ctx, "userID", 1)
+		token, _, err := sessionManager.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	request := func(token string) *httptest.ResponseRecorder {
+		h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(sessionManager.GetString(r.Context(), "flash")))
+		}))
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: sessionManager.Cookie.Name, Value: token})
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	revoked := newSession()
+	if err := sessionManager.Revoke(context.Background(), revoked); err != nil {
+		t.Fatal(err)
+	}
+	rr := request(revoked)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("got %d: expected %d", rr.Code, http.StatusUnauthorized)
+	}
+	token := extractTokenFromCookie(rr.Header().Get("Set-Cookie"))
+	if token == "" || token == revoked {
+		t.Fatalf("got %q: expected a new session token", token)
+	}
+	if body := request(token).Body.String(); body != "logged out" {
+		t.Errorf("got %q: expected %q", body, "logged out")
+	}
+
+	// Unknown and destroyed tokens start a fresh session as usual.
+	destroyed := newSession()
+	ctx, err := sessionManager.Load(context.Background(), destroyed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionManager.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"unknown", destroyed} {
+		rr := request(token)
+		if rr.Code != http.StatusOK || rr.Header().Get("Set-Cookie") != "" {
+			t.Errorf("got %d %q: expected %d with no cookie", rr.Code, rr.Header().Get("Set-Cookie"), http.StatusOK)
+		}
+	}
+
+	// Load reports the revocation, and the session cookie is deleted.
+	ctx, err = sessionManager.Load(context.Background(), revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sessionManager.WasRevoked(ctx) || sessionManager.Status(ctx) != Destroyed {
+		t.Errorf("got %v %v: expected %v %v", sessionManager.WasRevoked(ctx), sessionManager.Status(ctx), true, Destroyed)
+	}
+}
+
+func TestTokenHeader(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.TokenHeader = "X-Session"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	}))
+	mux.HandleFunc("/destroy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := sessionManager.Destroy(r.Context()); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	execute := func(urlPath, token string) (http.Header, string) {
+		req, err := http.NewRequest("GET", ts.URL+urlPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("X-Session", token)
+		}
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+		body, err := ioutil.ReadAll(rs.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs.Header, string(body)
+	}
+
+	header, _ := execute("/put", "")
+	token := header.Get("X-Session")
+	if token == "" {
+		t.Fatal("want token in response header; got none")
+	}
+	if header.Get("Set-Cookie") != "" {
+		t.Errorf("want no Set-Cookie header; got %q", header.Get("Set-Cookie"))
+	}
+
+	header, body := execute("/get", token)
+	if body != "bar" {
+		t.Errorf("want %q; got %q", "bar", body)
+	}
+	if _, ok := header["X-Session"]; ok {
+		t.Errorf("want no token header for unmodified session; got %q", header.Get("X-Session"))
+	}
+
+	header, _ = execute("/destroy", token)
+	if v, ok := header["X-Session"]; !ok || v[0] != "" {
+		t.Errorf("want empty token header; got %q", v)
+	}
+	if header.Get("Set-Cookie") != "" {
+		t.Errorf("want no Set-Cookie header; got %q", header.Get("Set-Cookie"))
+	}
+
+	_, body = execute("/get", token)
+	if body != "" {
+		t.Errorf("want %q; got %q", "", body)
+	}
+}
+
+func TestTrustedTokenHeader(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.TrustedTokenHeader = "X-Internal-Session"
+	sessionManager.TrustTokenHeader = true
+
+	// The gateway has already resolved the session token.
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionManager.Put(ctx, "foo", "bar")
+	token, _, err := sessionManager.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "baz", "qux")
+	})
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	})
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	execute := func(urlPath string, header, cookie string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", ts.URL+urlPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set("X-Internal-Session", header)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: cookie})
+		}
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+		body, err := ioutil.ReadAll(rs.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs, string(body)
+	}
+
+	_, body := execute("/get", token, "")
+	if body != "bar" {
+		t.Errorf("want %q; got %q", "bar", body)
+	}
+
+	// The session cookie is ignored.
+	_, body = execute("/get", "", token)
+	if body != "" {
+		t.Errorf("want %q; got %q", "", body)
+	}
+
+	rs, _ := execute("/put", token, "")
+	if rs.Header.Get("Set-Cookie") != "" {
+		t.Errorf("want no Set-Cookie header; got %q", rs.Header.Get("Set-Cookie"))
+	}
+	values, _, err := sessionManager.GetSession(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["baz"] != "qux" {
+		t.Errorf("want %q; got %v", "qux", values["baz"])
+	}
+
+	// Without TrustTokenHeader the header is never used.
+	var gotErr error
+	sessionManager.TrustTokenHeader = false
+	sessionManager.ErrorFunc = func(w http.ResponseWriter, r *http.Request, err error) {
+		gotErr = err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	rs, body = execute("/get", token, "")
+	if rs.StatusCode != http.StatusInternalServerError || body == "bar" {
+		t.Errorf("want status %d; got %d with body %q", http.StatusInternalServerError, rs.StatusCode, body)
+	}
+	if gotErr != ErrUntrustedTokenHeader {
+		t.Errorf("want %v; got %v", ErrUntrustedTokenHeader, gotErr)
+	}
+}
+
+func TestMaxTokenLength(t *testing.T) {
+	t.Parallel()
+
+	store := &findCountingStore{MemStore: memstore.NewWithCleanupInterval(0)}
+	sessionManager := New()
+	sessionManager.Store = store
+	sessionManager.MaxTokenLength = 64
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	})
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	})
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	execute := func(urlPath, token string) (http.Header, string) {
+		req, err := http.NewRequest("GET", ts.URL+urlPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Cookie", "session="+token)
+		client := &http.Client{Transport: ts.Client().Transport}
+		rs, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+		body, err := ioutil.ReadAll(rs.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs.Header, string(body)
+	}
+
+	header, _ := ts.execute(t, "/put")
+	token := extractTokenFromCookie(header.Get("Set-Cookie"))
+	if _, body := execute("/get", token); body != "bar" {
+		t.Fatalf("want %q; got %q", "bar", body)
+	}
+
+	store.finds = 0
+	for _, token := range []string{strings.Repeat("a", 65), "tok,en"} {
+		header, body := execute("/get", token)
+		if body != "" {
+			t.Errorf("want %q; got %q", "", body)
+		}
+		if header.Get("Set-Cookie") != "" {
+			t.Errorf("want no Set-Cookie header; got %q", header.Get("Set-Cookie"))
+		}
+
+		header, _ = execute("/put", token)
+		if newToken := extractTokenFromCookie(header.Get("Set-Cookie")); newToken == token {
+			t.Errorf("want a new session token; got %q", newToken)
+		}
+	}
+	if store.finds != 0 {
+		t.Errorf("want no store lookups; got %d", store.finds)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	t.Parallel()
+
+	for _, idleTimeout := range []time.Duration{0, time.Hour} {
+		sessionManager := New()
+		sessionManager.IdleTimeout = idleTimeout
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sessionManager.Put(r.Context(), "foo", "bar")
+			fmt.Fprint(w, sessionManager.Expiry(r.Context()).Unix())
+		}))
+
+		ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+
+		rs, err := ts.Client().Get(ts.URL + "/put")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cookies := rs.Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("want 1 cookie; got %d", len(cookies))
+		}
+		// The cookie Expires attribute is rounded up to the nearest second, and
+		// with an idle timeout the commit may happen in a later second.
+		got, err := strconv.ParseInt(string(body), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := cookies[0].Expires.Unix() - 1
+		if got != want && got != want-1 {
+			t.Errorf("idle timeout %v: want %d; got %d", idleTimeout, want, got)
+		}
+	}
+}
+
+func TestUnmodifiedErrorResponse(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	b, err := sessionManager.Codec.Encode(time.Now().Add(time.Hour), map[string]interface{}{"foo": "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &mockstore.MockStore{}
+	store.ExpectFind("token", b, true, nil)
+	sessionManager.Store = store
+
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+	}
+	h := sessionManager.LoadAndSave(auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "baz")
+	})))
+
+	for _, token := range []string{"", "token"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if token != "" {
+			r.AddCookie(&http.Cookie{Name: sessionManager.Cookie.Name, Value: token})
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("want %d; got %d", http.StatusUnauthorized, rr.Code)
+		}
+		if rr.Header().Get("Set-Cookie") != "" {
+			t.Errorf("want %q; got %q", "", rr.Header().Get("Set-Cookie"))
+		}
+	}
+}
+
+func TestOmitCacheHeaders(t *testing.T) {
+	t.Parallel()
+
+	for _, omit := range []bool{false, true} {
+		sessionManager := New()
+		sessionManager.OmitCacheHeaders = omit
+
+		h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sessionManager.Put(r.Context(), "foo", "bar")
+		}))
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+		if rr.Header().Get("Set-Cookie") == "" {
+			t.Error("want Set-Cookie header; got none")
+		}
+		if got := rr.Header().Get("Vary") != ""; got == omit {
+			t.Errorf("omit %v: got Vary header %q", omit, rr.Header().Get("Vary"))
+		}
+		if got := rr.Header().Get("Cache-Control") != ""; got == omit {
+			t.Errorf("omit %v: got Cache-Control header %q", omit, rr.Header().Get("Cache-Control"))
+		}
+	}
+}
+
+func TestSetStore(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			sessionManager.SetStore(memstore.NewWithCleanupInterval(0))
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		header, _ := ts.execute(t, "/put")
+		if header.Get("Set-Cookie") == "" {
+			t.Fatal("want Set-Cookie header; got none")
+		}
+	}
+	<-done
+
+	store := memstore.NewWithCleanupInterval(0)
+	sessionManager.SetStore(store)
+	header, _ := ts.execute(t, "/put")
+	token := extractTokenFromCookie(header.Get("Set-Cookie"))
+	if _, found, _ := store.Find(token); !found {
+		t.Error("want session to be committed to the new store")
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.IdleTimeout = time.Hour
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			sessionManager.SetIdleTimeout(time.Duration(i+1) * time.Minute)
+			sessionManager.SetLifetime(time.Duration(i+1) * time.Hour)
+			cookie := sessionManager.Cookie
+			cookie.Name = fmt.Sprintf("session_%d", i)
+			sessionManager.SetCookie(cookie)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		ts.execute(t, "/put")
+	}
+	<-done
+
+	sessionManager.SetIdleTimeout(10 * time.Minute)
+	sessionManager.SetCookie(SessionCookie{Name: "custom", Path: "/", Persist: true})
+
+	header, _ := ts.execute(t, "/put")
+	cookie := header.Get("Set-Cookie")
+	if !strings.HasPrefix(cookie, "custom=") {
+		t.Errorf("got %q: expected prefix %q", cookie, "custom=")
+	}
+	if !strings.Contains(cookie, "Max-Age=600") && !strings.Contains(cookie, "Max-Age=601") {
+		t.Errorf("got %q: expected to contain %q", cookie, "Max-Age=600")
+	}
+}
+
+type stubConfigProvider struct {
+	mu     sync.Mutex
+	config SessionConfig
+}
+
+func (p *stubConfigProvider) SessionConfig() (SessionConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.config, nil
+}
+
+func (p *stubConfigProvider) setIdleTimeout(d time.Duration) {
+	p.mu.Lock()
+	p.config.IdleTimeout = d
+	p.mu.Unlock()
+}
+
+func TestWatchConfig(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.IdleTimeout = time.Hour
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	maxAge := func() string {
+		header, _ := ts.execute(t, "/put")
+		cookies := (&http.Response{Header: header}).Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("got %d cookies: expected %d", len(cookies), 1)
+		}
+		return strconv.Itoa(cookies[0].MaxAge)
+	}
+
+	provider := &stubConfigProvider{config: SessionConfig{IdleTimeout: 10 * time.Minute}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := sessionManager.WatchConfig(ctx, provider, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := maxAge(); got != "600" && got != "601" {
+		t.Errorf("got %s: expected %d", got, 600)
+	}
+
+	provider.setIdleTimeout(20 * time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	if got := maxAge(); got != "1200" && got != "1201" {
+		t.Errorf("got %s: expected %d", got, 1200)
+	}
+
+	// Without an override the static setting is used.
+	provider.setIdleTimeout(0)
+	time.Sleep(50 * time.Millisecond)
+	if got := maxAge(); got != "3600" && got != "3601" {
+		t.Errorf("got %s: expected %d", got, 3600)
+	}
+
+	// An interval which isn't positive is rejected rather than crashing the
+	// background goroutine.
+	if err := sessionManager.WatchConfig(ctx, provider, 0); err != ErrInvalidWatchInterval {
+		t.Errorf("got %v: expected %v", err, ErrInvalidWatchInterval)
+	}
+}
+
+func TestPassThroughUnmodified(t *testing.T) {
+	t.Parallel()
+
+	for _, passThrough := range []bool{false, true} {
+		sessionManager := New()
+		sessionManager.PassThroughUnmodified = passThrough
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sessionManager.Put(r.Context(), "foo", "bar")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("created"))
+		}))
+		mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Test", "get")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+		}))
+
+		ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+
+		rs, err := ts.Client().Get(ts.URL + "/put")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+		if rs.StatusCode != http.StatusCreated || string(body) != "created" {
+			t.Errorf("pass-through %v: got %d %q", passThrough, rs.StatusCode, body)
+		}
+		if rs.Header.Get("Set-Cookie") == "" {
+			t.Errorf("pass-through %v: want Set-Cookie header; got none", passThrough)
+		}
+
+		rs, err = ts.Client().Get(ts.URL + "/get")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+		if rs.StatusCode != http.StatusAccepted || string(body) != "bar" {
+			t.Errorf("pass-through %v: got %d %q", passThrough, rs.StatusCode, body)
+		}
+		if rs.Header.Get("X-Test") != "get" {
+			t.Errorf("pass-through %v: got X-Test %q", passThrough, rs.Header.Get("X-Test"))
+		}
+		if rs.Header.Get("Set-Cookie") != "" {
+			t.Errorf("pass-through %v: want no Set-Cookie header; got %q", passThrough, rs.Header.Get("Set-Cookie"))
+		}
+
+		ts.Close()
+	}
+}
+
+func benchmarkLoadAndSaveUnmodified(b *testing.B, passThrough bool) {
+	sessionManager := New()
+	sessionManager.PassThroughUnmodified = passThrough
+
+	body := bytes.Repeat([]byte("a"), 16*1024)
+	h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.GetString(r.Context(), "foo")
+		w.Write(body)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(discardResponseWriter{}, r)
+	}
+}
+
+type discardResponseWriter struct{}
+
+func (discardResponseWriter) Header() http.Header         { return http.Header{} }
+func (discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardResponseWriter) WriteHeader(int)             {}
+
+func BenchmarkLoadAndSaveUnmodified(b *testing.B) {
+	benchmarkLoadAndSaveUnmodified(b, false)
+}
+
+func BenchmarkLoadAndSaveUnmodifiedPassThrough(b *testing.B) {
+	benchmarkLoadAndSaveUnmodified(b, true)
+}
+
+func TestBufferReuse(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+		w.Write(bytes.Repeat([]byte(r.URL.Query().Get("c")), 1024))
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(c string) {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/?c="+c, nil))
+			if rr.Body.String() != strings.Repeat(c, 1024) {
+				t.Errorf("got corrupted body for %q", c)
+			}
+		}(string(rune('a' + i%26)))
+	}
+	wg.Wait()
+}
+
+func BenchmarkLoadAndSaveModified(b *testing.B) {
+	sessionManager := New()
+
+	body := bytes.Repeat([]byte("a"), 16*1024)
+	h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+		w.Write(body)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(discardResponseWriter{}, r)
+	}
+}
+
+func TestPersistentSameSite(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.Cookie.Persist = false
+	sessionManager.Cookie.SameSite = http.SameSiteStrictMode
+	sessionManager.Cookie.PersistentSameSite = http.SameSiteLaxMode
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put-normal", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/put-rememberMe-true", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.RememberMe(r.Context(), true)
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, _ := ts.execute(t, "/put-normal")
+	if !strings.Contains(header.Get("Set-Cookie"), "SameSite=Strict") {
+		t.Errorf("got %q: expected to contain %q", header.Get("Set-Cookie"), "SameSite=Strict")
+	}
+
+	header, _ = ts.execute(t, "/put-rememberMe-true")
+	if !strings.Contains(header.Get("Set-Cookie"), "SameSite=Lax") {
+		t.Errorf("got %q: expected to contain %q", header.Get("Set-Cookie"), "SameSite=Lax")
+	}
+}
+
+func TestUntouchedSessionNotSaved(t *testing.T) {
+	t.Parallel()
+
+	testTable := []struct {
+		name  string
+		setup func(s *SessionManager)
+	}{
+		{"default", func(s *SessionManager) {}},
+		{"idle timeout", func(s *SessionManager) { s.IdleTimeout = time.Hour }},
+		{"track activity", func(s *SessionManager) {
+			s.IdleTimeout = time.Hour
+			s.TrackActivity = true
+		}},
+	}
+
+	for _, test := range testTable {
+		sessionManager := New()
+		test.setup(sessionManager)
+		store := &countingStore{Store: sessionManager.Store}
+		sessionManager.Store = store
+
+		// Commit a valid session which holds no data.
+		ctx, err := sessionManager.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionManager.Put(ctx, "foo", "bar")
+		sessionManager.Remove(ctx, "foo")
+		emptyToken, _, err := sessionManager.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.mu.Lock()
+		store.commits = 0
+		store.mu.Unlock()
+
+		ts := newTestServer(t, sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sessionManager.GetString(r.Context(), "foo")
+			w.Write([]byte("OK"))
+		})))
+
+		for _, token := range []string{"", emptyToken} {
+			req, err := http.NewRequest("GET", ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != "" {
+				req.AddCookie(&http.Cookie{Name: sessionManager.Cookie.Name, Value: token})
+			}
+			rs, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs.Body.Close()
+
+			if cookie := rs.Header.Get("Set-Cookie"); cookie != "" {
+				t.Errorf("%s: token %q: got Set-Cookie %q: expected none", test.name, token, cookie)
+			}
+		}
+
+		store.mu.Lock()
+		if store.commits != 0 {
+			t.Errorf("%s: got %d commits: expected none", test.name, store.commits)
+		}
+		store.mu.Unlock()
+		ts.Close()
+	}
+}
+
+func TestGenerationFunc(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	generations := map[interface{}]int64{1: 1, 2: 5}
+
+	sessionManager := New()
+	sessionManager.IdentityKey = "userID"
+	sessionManager.GenerationFunc = func(ctx context.Context, identity interface{}) (int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return generations[identity], nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(r.URL.Query().Get("user"))
+		sessionManager.Put(r.Context(), "userID", userID)
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sessionManager.GetInt(r.Context(), "userID"))
+	}))
+
+	ts1 := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts1.Close()
+	ts2 := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts2.Close()
+	ts3 := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts3.Close()
+
+	ts1.execute(t, "/login?user=1")
+	ts2.execute(t, "/login?user=1")
+	ts3.execute(t, "/login?user=2")
+	for _, ts := range []*testServer{ts1, ts2} {
+		if _, body := ts.execute(t, "/get"); body != "1" {
+			t.Fatalf("got %q: expected %q", body, "1")
+		}
+	}
+
+	// Bumping the generation logs user 1 out of every session, but not user 2.
+	mu.Lock()
+	generations[1]++
+	mu.Unlock()
+	for _, ts := range []*testServer{ts1, ts2} {
+		if _, body := ts.execute(t, "/get"); body != "0" {
+			t.Errorf("got %q: expected the session to be invalidated", body)
+		}
+	}
+	if _, body := ts3.execute(t, "/get"); body != "2" {
+		t.Errorf("got %q: expected %q", body, "2")
+	}
+
+	// Logging in again records the new generation.
+	ts1.execute(t, "/login?user=1")
+	if _, body := ts1.execute(t, "/get"); body != "1" {
+		t.Errorf("got %q: expected %q", body, "1")
+	}
+
+	// GetField and LoadMany also ignore sessions from an old generation.
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionManager.Put(ctx, "userID", 2)
+	token, _, err := sessionManager.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := sessionManager.GetField(context.Background(), token, "userID"); err != nil || val != 2 {
+		t.Fatalf("got %v, %v: expected %v", val, err, 2)
+	}
+	mu.Lock()
+	generations[2]++
+	mu.Unlock()
+	if val, err := sessionManager.GetField(context.Background(), token, "userID"); err != nil || val != nil {
+		t.Errorf("got %v, %v: expected %v", val, err, nil)
+	}
+	ctxs, err := sessionManager.LoadMany(context.Background(), []string{token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ctxs) != 0 {
+		t.Errorf("got %d sessions: expected %d", len(ctxs), 0)
+	}
+}
+
+func TestLegacyCookieNames(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.LegacyCookieNames = []string{"old_session"}
+
+	newSession := func(val string) string {
+		ctx, err := sessionManager.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionManager.Put(ctx, "foo", val)
+		token, _, err := sessionManager.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	oldToken := newSession("old")
+	newToken := newSession("new")
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	})))
+	defer ts.Close()
+	client := &http.Client{Transport: ts.Client().Transport}
+
+	testTable := []struct {
+		name       string
+		cookies    map[string]string
+		wantBody   string
+		wantCookie string
+	}{
+		{"both", map[string]string{"session": newToken, "old_session": oldToken}, "new", ""},
+		{"legacy only", map[string]string{"old_session": oldToken}, "old", oldToken},
+		{"stale primary", map[string]string{"session": "missing", "old_session": oldToken}, "old", oldToken},
+	}
+	for _, test := range testTable {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range test.cookies {
+			req.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+		rs, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+
+		if string(body) != test.wantBody {
+			t.Errorf("%s: got %q: expected %q", test.name, body, test.wantBody)
+		}
+		var gotCookie string
+		legacyExpired := false
+		for _, c := range rs.Cookies() {
+			switch c.Name {
+			case "session":
+				gotCookie = c.Value
+			case "old_session":
+				legacyExpired = c.MaxAge < 0
+			}
+		}
+		if gotCookie != test.wantCookie {
+			t.Errorf("%s: got session cookie %q: expected %q", test.name, gotCookie, test.wantCookie)
+		}
+		if !legacyExpired {
+			t.Errorf("%s: expected the legacy cookie to be expired", test.name)
+		}
+	}
+
+	// Without a legacy cookie nothing extra is sent.
+	rs, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+	if cookie := rs.Header.Get("Set-Cookie"); cookie != "" {
+		t.Errorf("got Set-Cookie %q: expected none", cookie)
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "userID", 1)
+	}))
+	mux.Handle("/private", sessionManager.RequireSession("userID")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("private"))
+	})))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	rs, err := ts.Client().Get(ts.URL + "/private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+	if rs.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %d: expected %d", rs.StatusCode, http.StatusUnauthorized)
+	}
+
+	ts.execute(t, "/login")
+	if _, body := ts.execute(t, "/private"); body != "private" {
+		t.Errorf("got %q: expected %q", body, "private")
+	}
+
+	// A custom handler can redirect instead, and IdentityKey is used when no
+	// key is given.
+	sessionManager = New()
+	sessionManager.IdentityKey = "userID"
+	sessionManager.UnauthenticatedHandler = http.RedirectHandler("/login", http.StatusSeeOther)
+	h := sessionManager.LoadAndSave(sessionManager.RequireSession("")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("private"))
+	})))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/private", nil))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login" {
+		t.Errorf("got %d %q: expected a redirect to /login", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Requests without session data are rejected.
+	rr = httptest.NewRecorder()
+	sessionManager.RequireSession("userID")(http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest("GET", "/private", nil))
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("got %d: expected %d", rr.Code, http.StatusSeeOther)
+	}
+
+	// A default registered for the identity key doesn't count as being
+	// authenticated.
+	sessionManager = New()
+	sessionManager.IdentityKey = "userID"
+	sessionManager.SetDefault("userID", 0)
+	h = sessionManager.LoadAndSave(sessionManager.RequireSession("")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("private"))
+	})))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/private", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("got %d: expected %d", rr.Code, http.StatusUnauthorized)
+	}
+}
@@ -2,10 +2,22 @@ package sqlite3store
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// ErrUnsupportedTx is returned by CommitTx and DeleteTx if the transaction
+// isn't a *sql.Tx.
+var ErrUnsupportedTx = errors.New("sqlite3store: transaction must be a *sql.Tx")
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 // SQLite3Store represents the session store.
 type SQLite3Store struct {
 	db          *sql.DB
@@ -44,21 +56,173 @@ func (p *SQLite3Store) Find(token string) (b []byte, exists bool, err error) {
 	return b, true, nil
 }
 
+// FindMany returns the data for each of the given session tokens which is
+// found in the SQLite3Store instance, keyed by session token, using a single
+// query. Tokens which are not found or are expired are omitted.
+func (p *SQLite3Store) FindMany(tokens []string) (map[string][]byte, error) {
+	res := make(map[string][]byte, len(tokens))
+	if len(tokens) == 0 {
+		return res, nil
+	}
+
+	placeholders := make([]string, len(tokens))
+	args := make([]interface{}, len(tokens))
+	for i, token := range tokens {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+		args[i] = token
+	}
+
+	rows, err := p.db.Query("SELECT token, data FROM sessions WHERE token IN ("+strings.Join(placeholders, ", ")+") AND julianday('now') < expiry", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			token string
+			b     []byte
+		)
+		if err := rows.Scan(&token, &b); err != nil {
+			return nil, err
+		}
+		res[token] = b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// All returns the data for all of the unexpired session tokens in the
+// SQLite3Store instance, keyed by session token.
+func (p *SQLite3Store) All() (map[string][]byte, error) {
+	rows, err := p.db.Query("SELECT token, data FROM sessions WHERE julianday('now') < expiry")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string][]byte)
+	for rows.Next() {
+		var (
+			token string
+			b     []byte
+		)
+		if err := rows.Scan(&token, &b); err != nil {
+			return nil, err
+		}
+		res[token] = b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // Commit adds a session token and data to the SQLite3Store instance with the
 // given expiry time. If the session token already exists, then the data and expiry
 // time are updated.
 func (p *SQLite3Store) Commit(token string, b []byte, expiry time.Time) error {
-	_, err := p.db.Exec("REPLACE INTO sessions (token, data, expiry) VALUES ($1, $2, julianday($3))", token, b, expiry)
-	if err != nil {
-		return err
+	return commit(p.db, token, b, expiry)
+}
+
+// CommitTx adds a session token and data to the SQLite3Store instance in the same
+// way as Commit, but using the given transaction, which must be a *sql.Tx
+// opened on the same database. Otherwise ErrUnsupportedTx is returned.
+func (p *SQLite3Store) CommitTx(tx interface{}, token string, b []byte, expiry time.Time) error {
+	sqlTx, ok := tx.(*sql.Tx)
+	if !ok {
+		return ErrUnsupportedTx
 	}
-	return nil
+	return commit(sqlTx, token, b, expiry)
+}
+
+func commit(e execer, token string, b []byte, expiry time.Time) error {
+	_, err := e.Exec("REPLACE INTO sessions (token, data, expiry) VALUES ($1, $2, julianday($3))", token, b, expiry)
+	return err
 }
 
 // Delete removes a session token and corresponding data from the SQLite3Store
 // instance.
 func (p *SQLite3Store) Delete(token string) error {
-	_, err := p.db.Exec("DELETE FROM sessions WHERE token = $1", token)
+	return remove(p.db, token)
+}
+
+// DeleteTx removes a session token and corresponding data from the SQLite3Store
+// instance in the same way as Delete, but using the given transaction, which
+// must be a *sql.Tx opened on the same database. Otherwise ErrUnsupportedTx is
+// returned.
+func (p *SQLite3Store) DeleteTx(tx interface{}, token string) error {
+	sqlTx, ok := tx.(*sql.Tx)
+	if !ok {
+		return ErrUnsupportedTx
+	}
+	return remove(sqlTx, token)
+}
+
+func remove(e execer, token string) error {
+	_, err := e.Exec("DELETE FROM sessions WHERE token = $1", token)
+	return err
+}
+
+// AddToIndex adds a session token to the set of tokens held for the given
+// index key and value in the sessions_index table, until the expiry time.
+// Expired entries for the same key and value are removed at the same time.
+func (p *SQLite3Store) AddToIndex(key, value, token string, expiry time.Time) error {
+	_, err := p.db.Exec("DELETE FROM sessions_index WHERE name = $1 AND value = $2 AND expiry < julianday('now')", key, value)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec("REPLACE INTO sessions_index (name, value, token, expiry) VALUES ($1, $2, $3, julianday($4))", key, value, token, expiry)
+	return err
+}
+
+// RemoveFromIndex removes a session token from the set of tokens held for the
+// given index key and value in the sessions_index table.
+func (p *SQLite3Store) RemoveFromIndex(key, value, token string) error {
+	_, err := p.db.Exec("DELETE FROM sessions_index WHERE name = $1 AND value = $2 AND token = $3", key, value, token)
+	return err
+}
+
+// TokensForIndex returns the unexpired session tokens in the set held for the
+// given index key and value in the sessions_index table.
+func (p *SQLite3Store) TokensForIndex(key, value string) ([]string, error) {
+	rows, err := p.db.Query("SELECT token FROM sessions_index WHERE name = $1 AND value = $2 AND julianday('now') < expiry", key, value)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// Expiry returns the expiry time recorded for a given session token in the
+// SQLite3Store instance. If the session token is not found or is expired, the
+// returned exists flag will be set to false.
+func (p *SQLite3Store) Expiry(token string) (time.Time, bool, error) {
+	var seconds float64
+	row := p.db.QueryRow("SELECT (expiry - 2440587.5) * 86400.0 FROM sessions WHERE token = $1 AND julianday('now') < expiry", token)
+	err := row.Scan(&seconds)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true, nil
+}
+
+// Flush removes all session tokens and data from the SQLite3Store instance.
+func (p *SQLite3Store) Flush() error {
+	_, err := p.db.Exec("DELETE FROM sessions")
 	return err
 }
 
@@ -0,0 +1,87 @@
+package scs
+
+import (
+	"context"
+	"time"
+)
+
+// Session data keys used to record a step-up authentication requirement set
+// with RequireStepUp.
+const (
+	stepUpPurposeKey = "__stepUp:purpose"
+	stepUpExpiresKey = "__stepUp:expires"
+)
+
+// RequireStepUp marks the session as needing step-up authentication, where the
+// user must log in again before carrying out a sensitive action. The purpose
+// describes why, for example the action being attempted, and is returned by
+// NeedsStepUp. If StepUpTTL is set the requirement lapses once that long has
+// passed. Calling RequireStepUp again replaces any existing requirement. The
+// session data status will be set to Modified.
+//
+// A middleware guarding the sensitive routes can call NeedsStepUp and redirect
+// the user to log in again, and the login handler calls CompleteStepUp once
+// they have done so.
+func (s *SessionManager) RequireStepUp(ctx context.Context, purpose string) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	sd.values[stepUpPurposeKey] = purpose
+	if s.StepUpTTL > 0 {
+		sd.values[stepUpExpiresKey] = time.Now().Add(s.StepUpTTL).UnixNano()
+	} else {
+		delete(sd.values, stepUpExpiresKey)
+	}
+	sd.status = Modified
+	sd.written = true
+}
+
+// NeedsStepUp returns true and the purpose passed to RequireStepUp if the
+// session needs step-up authentication. It returns false once the requirement
+// has been cleared with CompleteStepUp or has lapsed.
+func (s *SessionManager) NeedsStepUp(ctx context.Context) (bool, string) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	purpose, ok := sd.values[stepUpPurposeKey].(string)
+	if !ok {
+		return false, ""
+	}
+	if expires, ok := sd.values[stepUpExpiresKey].(int64); ok && time.Now().UnixNano() >= expires {
+		sd.clearStepUp()
+		return false, ""
+	}
+	return true, purpose
+}
+
+// CompleteStepUp clears the step-up authentication requirement set with
+// RequireStepUp, once the user has logged in again. As with any login, you
+// should usually renew the session token with RenewToken too. If no
+// requirement is set this is a no-op; otherwise the session data status will
+// be set to Modified.
+func (s *SessionManager) CompleteStepUp(ctx context.Context) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	sd.clearStepUp()
+}
+
+// clearStepUp removes the step-up authentication requirement from the session
+// data. The caller must hold sd.mu.
+func (sd *sessionData) clearStepUp() {
+	_, required := sd.values[stepUpPurposeKey]
+	_, expires := sd.values[stepUpExpiresKey]
+	if !required && !expires {
+		return
+	}
+	delete(sd.values, stepUpPurposeKey)
+	delete(sd.values, stepUpExpiresKey)
+	sd.status = Modified
+	sd.written = true
+}
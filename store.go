@@ -1,10 +1,32 @@
 package scs
 
 import (
+	"errors"
+	"sync"
 	"time"
 )
 
+// ErrStoreUnavailable can be returned (or wrapped) by session stores when the
+// underlying storage can't be reached, for example because a database
+// connection failed. It allows callers to distinguish transient failures from
+// other errors.
+var ErrStoreUnavailable = errors.New("scs: session store unavailable")
+
+// ErrStoreBusy is returned when an operation on the session store can't start
+// within the SessionManager.StoreQueueTimeout, because
+// SessionManager.MaxConcurrentStoreOps operations are already running.
+var ErrStoreBusy = errors.New("scs: timed out waiting to use the session store")
+
+// ErrTxNotSupported is returned when a transaction has been added to the
+// context with WithTx, but the session store doesn't implement TxStore.
+var ErrTxNotSupported = errors.New("scs: session store does not support transactions")
+
 // Store is the interface for session stores.
+//
+// Errors returned by a Store should only be used to signal failures of the
+// store itself; the absence of a session is never an error. The storetest
+// package provides a conformance test which store implementations can use to
+// check that they meet this contract.
 type Store interface {
 	// Delete should remove the session token and corresponding data from the
 	// session store. If the token does not exist then Delete should be a no-op
@@ -12,10 +34,11 @@ type Store interface {
 	Delete(token string) (err error)
 
 	// Find should return the data for a session token from the store. If the
-	// session token is not found or is expired, the found return value should
-	// be false (and the err return value should be nil). Similarly, tampered
+	// session token is not found or is expired, Find should return a nil byte
+	// slice, a found value of false and a nil err value. Similarly, tampered
 	// or malformed tokens should result in a found return value of false and a
-	// nil err value. The err return value should be used for system errors only.
+	// nil err value. The err return value should be used for system errors only,
+	// never to signal that a session doesn't exist.
 	Find(token string) (b []byte, found bool, err error)
 
 	// Commit should add the session token and data to the store, with the given
@@ -23,3 +46,191 @@ type Store interface {
 	// expiry time should be overwritten.
 	Commit(token string, b []byte, expiry time.Time) (err error)
 }
+
+// FlushableStore is the interface for session stores which support removing
+// all session tokens and data in one operation.
+type FlushableStore interface {
+	Store
+
+	// Flush should remove all session tokens and corresponding data from the
+	// session store.
+	Flush() (err error)
+}
+
+// StatelessStore is the interface for session stores which hold the session
+// data in the session token itself (for example, in an encrypted cookie)
+// rather than persisting it on the server. When the session store implements
+// this interface, CommitToken is used instead of Commit and the session token
+// is replaced each time the session data is committed.
+type StatelessStore interface {
+	Store
+
+	// CommitToken should encode the session data and expiry time and return
+	// it as a new session token. Find should then return the data for this
+	// token until the expiry time.
+	CommitToken(b []byte, expiry time.Time) (token string, err error)
+}
+
+// ExpiryReportingStore is the interface for session stores which can report
+// the expiry time that they have recorded for a session token.
+type ExpiryReportingStore interface {
+	Store
+
+	// Expiry should return the expiry time recorded by the store for a session
+	// token. If the session token is not found or is expired, the found return
+	// value should be false (and the err return value should be nil).
+	Expiry(token string) (expiry time.Time, found bool, err error)
+}
+
+// RefreshingStore is the interface for session stores which can read the
+// data for a session token and extend its expiry time in a single operation.
+// When an IdleTimeout is set (and no ExpiryStrategy), Load uses FindAndRefresh
+// instead of Find, and if the session data isn't changed during the request it
+// isn't committed again, so refreshing an active session only costs one round
+// trip to the store.
+type RefreshingStore interface {
+	Store
+
+	// FindAndRefresh should return the data for a session token from the store,
+	// in the same way as Find, and if the session token is found, set its
+	// expiry time to newExpiry. The expiry time should only be changed if the
+	// token is found.
+	FindAndRefresh(token string, newExpiry time.Time) (b []byte, found bool, err error)
+}
+
+// TouchStore is the interface for session stores which can extend the expiry
+// time of a session token without rewriting its data. It is used to refresh
+// unmodified sessions when RefreshCookieEachRequest is set.
+type TouchStore interface {
+	Store
+
+	// Touch should set the expiry time of the session token to newExpiry. If
+	// the session token is not found, Touch should do nothing and return nil.
+	Touch(token string, newExpiry time.Time) (err error)
+}
+
+// LockingStore is the interface for session stores which support an advisory
+// lock on a session token. When SessionManager.LockTokens is enabled, the
+// LoadAndSave middleware holds the lock from before the session data is loaded
+// until after it has been committed, so that overlapping requests with the
+// same session token are handled one at a time and don't overwrite each
+// other's changes.
+type LockingStore interface {
+	Store
+
+	// Lock should block until the lock for the session token has been
+	// acquired, and return an error if it can't be. The lock should not depend
+	// on the session token existing in the store.
+	Lock(token string) (err error)
+
+	// Unlock should release the lock for the session token.
+	Unlock(token string) (err error)
+}
+
+// BatchFindStore is the interface for session stores which can read the data
+// for several session tokens in one operation. It is used by LoadMany.
+type BatchFindStore interface {
+	Store
+
+	// FindMany should return the data for each of the given session tokens
+	// which is found in the store, keyed by session token. Tokens which are
+	// not found or are expired should be omitted from the returned map, and
+	// the err return value should be used for system errors only.
+	FindMany(tokens []string) (b map[string][]byte, err error)
+}
+
+// IterableStore is the interface for session stores which support reading
+// the data for all of the session tokens in the store.
+type IterableStore interface {
+	Store
+
+	// All should return the data for all of the unexpired session tokens in
+	// the store, keyed by session token.
+	All() (b map[string][]byte, err error)
+}
+
+// IndexedStore is the interface for session stores which can keep a secondary
+// index from the value held under SessionManager.IndexKey (such as a user ID)
+// to the session tokens which hold it. It is used by DestroyAllForUser to find
+// a user's sessions without reading every session in the store.
+type IndexedStore interface {
+	Store
+
+	// AddToIndex should add the session token to the set of tokens held for
+	// the given index key and value, until the expiry time. If the token is
+	// already in the set, its expiry time should be updated.
+	AddToIndex(key, value, token string, expiry time.Time) (err error)
+
+	// RemoveFromIndex should remove the session token from the set of tokens
+	// held for the given index key and value. If the token isn't in the set
+	// then RemoveFromIndex should be a no-op and return nil (not an error).
+	RemoveFromIndex(key, value, token string) (err error)
+
+	// TokensForIndex should return the unexpired session tokens in the set
+	// held for the given index key and value. Tokens whose session data has
+	// since been deleted may be included.
+	TokensForIndex(key, value string) (tokens []string, err error)
+}
+
+// TxStore is the interface for session stores which can commit and delete
+// session data as part of a transaction held by the application, such as a
+// *sql.Tx, so that changes to the session data and to the application's own
+// data are committed or rolled back together. When a transaction has been
+// added to the context with WithTx, Commit, Destroy and RenewToken use
+// CommitTx and DeleteTx instead of Commit and Delete.
+type TxStore interface {
+	Store
+
+	// CommitTx should add the session token and data to the store using the
+	// given transaction, in the same way as Commit. If the transaction isn't
+	// of a type that the store can use, an error should be returned.
+	CommitTx(tx interface{}, token string, b []byte, expiry time.Time) (err error)
+
+	// DeleteTx should remove the session token and corresponding data from
+	// the store using the given transaction, in the same way as Delete.
+	DeleteTx(tx interface{}, token string) (err error)
+}
+
+// acquireStore waits until the session store can be used without exceeding
+// MaxConcurrentStoreOps, and returns a function which must be called when the
+// store operation has finished.
+func (s *SessionManager) acquireStore() (func(), error) {
+	if s.MaxConcurrentStoreOps <= 0 {
+		return func() {}, nil
+	}
+	slots := s.getStoreSlots()
+
+	release := func() { <-slots }
+	if s.StoreQueueTimeout <= 0 {
+		slots <- struct{}{}
+		return release, nil
+	}
+
+	timer := time.NewTimer(s.StoreQueueTimeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrStoreBusy
+	}
+}
+
+var storeSlotsMutex = &sync.Mutex{}
+
+// getStoreSlots returns the semaphore channel used by acquireStore, creating
+// it if necessary.
+func (s *SessionManager) getStoreSlots() chan struct{} {
+	if slots, ok := s.storeSlots.Load().(chan struct{}); ok {
+		return slots
+	}
+
+	storeSlotsMutex.Lock()
+	defer storeSlotsMutex.Unlock()
+	if slots, ok := s.storeSlots.Load().(chan struct{}); ok {
+		return slots
+	}
+	slots := make(chan struct{}, s.MaxConcurrentStoreOps)
+	s.storeSlots.Store(slots)
+	return slots
+}
@@ -0,0 +1,176 @@
+// Package storetest provides a conformance test for implementations of the
+// scs.Store interface.
+package storetest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+)
+
+// VerifyStore checks that the given store meets the contract of the scs.Store
+// interface, and of the optional scs.FlushableStore and
+// scs.ExpiryReportingStore interfaces if it implements them. It should be
+// called from a test function in the store's package. The checks use random
+// session tokens, but if the store implements scs.FlushableStore its Flush
+// method is called, so the store must not hold any data that you want to keep.
+func VerifyStore(t *testing.T, store scs.Store) {
+	t.Helper()
+
+	RunStoreTests(t, func() scs.Store { return store })
+}
+
+// RunStoreTests is like VerifyStore, but calls newStore to create a separate
+// store for each check, so that the checks don't share any state.
+func RunStoreTests(t *testing.T, newStore func() scs.Store) {
+	t.Helper()
+
+	t.Run("FindMissing", func(t *testing.T) {
+		store := newStore()
+		b, found, err := store.Find(randomToken(t))
+		if err != nil {
+			t.Fatalf("got %v: expected %v", err, nil)
+		}
+		if found != false {
+			t.Fatalf("got %v: expected %v", found, false)
+		}
+		if b != nil {
+			t.Fatalf("got %v: expected %v", b, nil)
+		}
+	})
+
+	t.Run("CommitAndFind", func(t *testing.T) {
+		store := newStore()
+		token := randomToken(t)
+		commit(t, store, token, []byte("encoded_data"), time.Now().Add(time.Minute))
+		expectData(t, store, token, []byte("encoded_data"))
+	})
+
+	t.Run("CommitUpdated", func(t *testing.T) {
+		store := newStore()
+		token := randomToken(t)
+		commit(t, store, token, []byte("encoded_data"), time.Now().Add(time.Minute))
+		commit(t, store, token, []byte("new_encoded_data"), time.Now().Add(time.Minute))
+		expectData(t, store, token, []byte("new_encoded_data"))
+	})
+
+	t.Run("FindExpired", func(t *testing.T) {
+		store := newStore()
+		token := randomToken(t)
+		commit(t, store, token, []byte("encoded_data"), time.Now().Add(-time.Hour))
+		expectMissing(t, store, token)
+	})
+
+	t.Run("Expire", func(t *testing.T) {
+		store := newStore()
+		token := randomToken(t)
+		commit(t, store, token, []byte("encoded_data"), time.Now().Add(1500*time.Millisecond))
+		expectData(t, store, token, []byte("encoded_data"))
+		time.Sleep(2500 * time.Millisecond)
+		expectMissing(t, store, token)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore()
+		token := randomToken(t)
+		commit(t, store, token, []byte("encoded_data"), time.Now().Add(time.Minute))
+		if err := store.Delete(token); err != nil {
+			t.Fatalf("got %v: expected %v", err, nil)
+		}
+		expectMissing(t, store, token)
+	})
+
+	t.Run("DeleteMissing", func(t *testing.T) {
+		store := newStore()
+		if err := store.Delete(randomToken(t)); err != nil {
+			t.Fatalf("got %v: expected %v", err, nil)
+		}
+	})
+
+	if _, ok := newStore().(scs.ExpiryReportingStore); ok {
+		t.Run("Expiry", func(t *testing.T) {
+			es := newStore().(scs.ExpiryReportingStore)
+			token := randomToken(t)
+			expiry := time.Now().Add(time.Hour)
+			commit(t, es, token, []byte("encoded_data"), expiry)
+
+			got, found, err := es.Expiry(token)
+			if err != nil {
+				t.Fatalf("got %v: expected %v", err, nil)
+			}
+			if found != true {
+				t.Fatalf("got %v: expected %v", found, true)
+			}
+			if d := got.Sub(expiry); d < -time.Second || d > time.Second {
+				t.Fatalf("got %v: expected %v", got, expiry)
+			}
+
+			_, found, err = es.Expiry(randomToken(t))
+			if err != nil {
+				t.Fatalf("got %v: expected %v", err, nil)
+			}
+			if found != false {
+				t.Fatalf("got %v: expected %v", found, false)
+			}
+		})
+	}
+
+	if _, ok := newStore().(scs.FlushableStore); ok {
+		t.Run("Flush", func(t *testing.T) {
+			fs := newStore().(scs.FlushableStore)
+			token := randomToken(t)
+			commit(t, fs, token, []byte("encoded_data"), time.Now().Add(time.Minute))
+			if err := fs.Flush(); err != nil {
+				t.Fatalf("got %v: expected %v", err, nil)
+			}
+			expectMissing(t, fs, token)
+		})
+	}
+}
+
+func randomToken(t *testing.T) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func commit(t *testing.T, store scs.Store, token string, b []byte, expiry time.Time) {
+	t.Helper()
+	if err := store.Commit(token, b, expiry); err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+}
+
+func expectData(t *testing.T, store scs.Store, token string, want []byte) {
+	t.Helper()
+	b, found, err := store.Find(token)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, want) == false {
+		t.Fatalf("got %v: expected %v", b, want)
+	}
+}
+
+func expectMissing(t *testing.T, store scs.Store, token string) {
+	t.Helper()
+	b, found, err := store.Find(token)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+	if b != nil {
+		t.Fatalf("got %v: expected %v", b, nil)
+	}
+}
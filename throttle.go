@@ -0,0 +1,97 @@
+package scs
+
+import (
+	"context"
+	"time"
+)
+
+// Session data keys used to record failed attempts for RecordFailure.
+const (
+	failureCountKey = "__failures:count"
+	lockedUntilKey  = "__failures:lockedUntil"
+)
+
+// RecordFailure records a failed attempt, such as a failed login, for the
+// session and returns true if the session is now locked out. The session is
+// locked out for LockoutWindow once LockoutThreshold failed attempts have been
+// recorded; failed attempts recorded while it is locked out don't extend the
+// lockout. The session data status will be set to Modified.
+//
+// Because the counter is held in the session data, a client can get a fresh
+// counter by discarding its session cookie, so this should be combined with
+// other throttling (for example per IP address or per account) rather than
+// relied upon alone.
+func (s *SessionManager) RecordFailure(ctx context.Context) (locked bool) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.lockedOut() {
+		return true
+	}
+
+	count, _ := sd.values[failureCountKey].(int64)
+	count++
+	sd.values[failureCountKey] = count
+	if s.LockoutThreshold > 0 && count >= int64(s.LockoutThreshold) {
+		sd.values[lockedUntilKey] = time.Now().Add(s.LockoutWindow).UnixNano()
+		locked = true
+	}
+	sd.status = Modified
+	sd.written = true
+	return locked
+}
+
+// ClearFailures resets the failed attempt counter for the session and ends any
+// lockout, for example after a successful login. If no failed attempts have
+// been recorded this is a no-op; otherwise the session data status will be set
+// to Modified.
+func (s *SessionManager) ClearFailures(ctx context.Context) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	sd.clearFailures()
+}
+
+// IsLockedOut returns true if the session has been locked out by RecordFailure
+// and LockoutWindow hasn't yet passed.
+func (s *SessionManager) IsLockedOut(ctx context.Context) bool {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return sd.lockedOut()
+}
+
+// lockedOut reports whether the session is currently locked out. If a lockout
+// has ended, the failed attempt counter is cleared. The caller must hold
+// sd.mu.
+func (sd *sessionData) lockedOut() bool {
+	until, ok := sd.values[lockedUntilKey].(int64)
+	if !ok {
+		return false
+	}
+	if time.Now().UnixNano() < until {
+		return true
+	}
+	sd.clearFailures()
+	return false
+}
+
+// clearFailures removes the failed attempt counter and lockout from the
+// session data. The caller must hold sd.mu.
+func (sd *sessionData) clearFailures() {
+	_, counted := sd.values[failureCountKey]
+	_, locked := sd.values[lockedUntilKey]
+	if !counted && !locked {
+		return
+	}
+	delete(sd.values, failureCountKey)
+	delete(sd.values, lockedUntilKey)
+	sd.status = Modified
+	sd.written = true
+}
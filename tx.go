@@ -0,0 +1,64 @@
+package scs
+
+import (
+	"context"
+	"time"
+)
+
+type txContextKey struct{}
+
+// WithTx returns a copy of ctx which holds the given transaction, such as a
+// *sql.Tx. When ctx also holds the session data, Commit, Destroy and RenewToken
+// write to the session store using the transaction, so the changes are only
+// persisted if the transaction is committed. The session store must implement
+// TxStore, otherwise they return ErrTxNotSupported.
+//
+// For example, to create a user and log them in atomically:
+//
+//	tx, err := db.Begin()
+//	// ...insert the user using tx...
+//	ctx := scs.WithTx(r.Context(), tx)
+//	sessionManager.Put(ctx, "userID", userID)
+//	if _, _, err := sessionManager.Commit(ctx); err != nil {
+//		tx.Rollback()
+//		// ...
+//	}
+//	err = tx.Commit()
+//
+// Once the session data has been committed using a transaction, later commits
+// in the same request cycle (such as the one made by the LoadAndSave
+// middleware) don't write it again unless it has been changed since, so a
+// rolled back transaction leaves no session data persisted.
+func WithTx(ctx context.Context, tx interface{}) context.Context {
+	return context.WithValue(ctx, txContextKey{}, tx)
+}
+
+// txStore adapts a TxStore so that commits and deletes use a transaction.
+type txStore struct {
+	TxStore
+	tx interface{}
+}
+
+func (t txStore) Commit(token string, b []byte, expiry time.Time) error {
+	return t.CommitTx(t.tx, token, b, expiry)
+}
+
+func (t txStore) Delete(token string) error {
+	return t.DeleteTx(t.tx, token)
+}
+
+// storeForContext returns the session store to use for writes in the given
+// context. If the context holds a transaction added with WithTx, the store is
+// wrapped so that commits and deletes use it, and inTx is true.
+func (s *SessionManager) storeForContext(ctx context.Context) (store Store, inTx bool, err error) {
+	store = s.getStore()
+	tx := ctx.Value(txContextKey{})
+	if tx == nil {
+		return store, false, nil
+	}
+	ts, ok := store.(TxStore)
+	if !ok {
+		return nil, false, ErrTxNotSupported
+	}
+	return txStore{TxStore: ts, tx: tx}, true, nil
+}
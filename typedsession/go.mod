@@ -0,0 +1,7 @@
+module github.com/gaconkzk/scs/typedsession
+
+go 1.21
+
+require github.com/gaconkzk/scs/v2 v2.0.0
+
+replace github.com/gaconkzk/scs/v2 => ../
@@ -0,0 +1,81 @@
+// Package typedsession provides a strongly-typed facade for applications which
+// keep all of their session state in a single struct, so that it can be read
+// and written without type assertions.
+//
+//	type UserSession struct {
+//		UserID int
+//		Cart   []string
+//	}
+//
+//	var userSession = typedsession.New[UserSession](sessionManager)
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		us, _ := userSession.Load(r.Context())
+//		us.Cart = append(us.Cart, r.FormValue("item"))
+//		userSession.Save(r.Context(), us)
+//	}
+package typedsession
+
+import (
+	"context"
+	"encoding/gob"
+	"reflect"
+
+	"github.com/gaconkzk/scs/v2"
+)
+
+// DefaultKey is the session data key used by New. It begins with "__", the
+// prefix reserved for keys used by scs itself, so that it doesn't clash with
+// the application's own keys.
+const DefaultKey = "__typed"
+
+// Typed stores a value of type T under a single session data key.
+type Typed[T any] struct {
+	manager *scs.SessionManager
+	key     string
+}
+
+// New returns a new Typed instance which stores its value under DefaultKey,
+// using the given session manager.
+func New[T any](s *scs.SessionManager) *Typed[T] {
+	return NewWithKey[T](s, DefaultKey)
+}
+
+// NewWithKey returns a new Typed instance which stores its value under the
+// given session data key, using the given session manager. Use a different key
+// for each Typed instance sharing a session manager.
+//
+// T is registered with the encoding/gob package, so that it can be encoded by
+// the default GobCodec. If T is an interface type it can't be registered, so
+// the concrete types stored in it must be registered by the application
+// instead.
+func NewWithKey[T any](s *scs.SessionManager, key string) *Typed[T] {
+	if reflect.TypeOf((*T)(nil)).Elem().Kind() != reflect.Interface {
+		var zero T
+		gob.Register(zero)
+	}
+
+	return &Typed[T]{
+		manager: s,
+		key:     key,
+	}
+}
+
+// Load returns the value from the session data. If there is no value, or the
+// value is not of type T, Load returns the zero value of T and false.
+func (t *Typed[T]) Load(ctx context.Context) (T, bool) {
+	val, ok := t.manager.Get(ctx, t.key).(T)
+	return val, ok
+}
+
+// Save adds the value to the session data, replacing any existing value. The
+// session data status will be set to Modified.
+func (t *Typed[T]) Save(ctx context.Context, val T) {
+	t.manager.Put(ctx, t.key, val)
+}
+
+// Clear removes the value from the session data. If there is no value then
+// this is a no-op.
+func (t *Typed[T]) Clear(ctx context.Context) {
+	t.manager.Remove(ctx, t.key)
+}
@@ -0,0 +1,133 @@
+package typedsession
+
+import (
+	"context"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gaconkzk/scs/v2"
+)
+
+type Address struct {
+	City     string
+	Postcode string
+}
+
+type UserSession struct {
+	UserID    int
+	Roles     []string
+	Address   *Address
+	Prefs     map[string]bool
+	LastLogin time.Time
+}
+
+func TestTyped(t *testing.T) {
+	sessionManager := scs.New()
+	userSession := New[UserSession](sessionManager)
+
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := userSession.Load(ctx); ok {
+		t.Fatal("expected no value")
+	}
+
+	want := UserSession{
+		UserID:    42,
+		Roles:     []string{"admin", "editor"},
+		Address:   &Address{City: "London", Postcode: "N1"},
+		Prefs:     map[string]bool{"darkMode": true},
+		LastLogin: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	userSession.Save(ctx, want)
+
+	token, _, err := sessionManager.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err = sessionManager.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := userSession.Load(ctx)
+	if !ok {
+		t.Fatal("expected a value")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v: expected %+v", got, want)
+	}
+
+	userSession.Clear(ctx)
+	if _, ok := userSession.Load(ctx); ok {
+		t.Error("expected no value")
+	}
+	if sessionManager.Status(ctx) != scs.Modified {
+		t.Errorf("got %v: expected %v", sessionManager.Status(ctx), scs.Modified)
+	}
+}
+
+func TestTypedWrongType(t *testing.T) {
+	sessionManager := scs.New()
+	userSession := NewWithKey[UserSession](sessionManager, "user")
+
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionManager.Put(ctx, "user", "not a struct")
+
+	got, ok := userSession.Load(ctx)
+	if ok {
+		t.Error("expected no value")
+	}
+	if !reflect.DeepEqual(got, UserSession{}) {
+		t.Errorf("got %+v: expected zero value", got)
+	}
+}
+
+type Shape interface {
+	Area() int
+}
+
+type Square struct {
+	Side int
+}
+
+func (s Square) Area() int { return s.Side * s.Side }
+
+func TestTypedInterface(t *testing.T) {
+	gob.Register(Square{})
+
+	sessionManager := scs.New()
+	shape := NewWithKey[Shape](sessionManager, "__shape")
+
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shape.Save(ctx, Square{Side: 3})
+
+	token, _, err := sessionManager.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err = sessionManager.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := shape.Load(ctx)
+	if !ok {
+		t.Fatal("expected a value")
+	}
+	if got.Area() != 9 {
+		t.Errorf("got %d: expected %d", got.Area(), 9)
+	}
+}